@@ -0,0 +1,181 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mar-cial/items/auth"
+	"github.com/mar-cial/items/db"
+	"github.com/mar-cial/items/model"
+	"github.com/mar-cial/items/problem"
+	"github.com/mar-cial/items/tenant"
+)
+
+const keyNameMaxLen = 100
+
+// createKeyRequest is the body of POST /admin/keys.
+type createKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	Tenant    string     `json:"tenant,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func (req createKeyRequest) validate(now time.Time) error {
+	var errs model.ValidationError
+	if strings.TrimSpace(req.Name) == "" {
+		errs = append(errs, model.FieldError{Field: "name", Message: "is required"})
+	} else if len([]rune(req.Name)) > keyNameMaxLen {
+		errs = append(errs, model.FieldError{Field: "name", Message: "is too long"})
+	}
+	if len(req.Scopes) == 0 {
+		errs = append(errs, model.FieldError{Field: "scopes", Message: "needs at least one scope"})
+	}
+	for _, s := range req.Scopes {
+		if !slices.Contains(auth.Scopes(), s) {
+			errs = append(errs, model.FieldError{Field: "scopes", Message: "isn't a scope: " + s})
+		}
+	}
+	if req.Tenant != "" && tenant.Valid(req.Tenant) != nil {
+		errs = append(errs, model.FieldError{Field: "tenant", Message: "has to be lowercase letters, digits and dashes"})
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(now) {
+		errs = append(errs, model.FieldError{Field: "expires_at", Message: "has to be in the future"})
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// createdKey is a new key with the key itself, the one time anyone gets
+// to see it.
+type createdKey struct {
+	model.APIKey
+	Key string `json:"key"`
+}
+
+// adminTenant is the tenant the caller's credentials tie them to. Admins
+// like that only get to see and make keys for their own tenant, anything
+// else would be a way out of it. "" is an admin for everybody.
+func adminTenant(r *http.Request) string {
+	if p, ok := auth.From(r.Context()); ok {
+		return p.Tenant
+	}
+	return ""
+}
+
+// keyErr is serveErr with a detail that says key, not item.
+func keyErr(w http.ResponseWriter, r *http.Request, id string, err error) {
+	if errors.Is(err, db.ErrNotFound) {
+		problem.Write(w, r, problem.TypeNotFound, "no api key "+id)
+		return
+	}
+	serveErr(w, r, err)
+}
+
+func (app *app) createKeyHandler(w http.ResponseWriter, r *http.Request) {
+	bodyBytes, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	var req createKeyRequest
+	if err := model.UnmarshalStrict(bodyBytes, &req); err != nil {
+		problem.Write(w, r, problem.TypeMalformedBody, err.Error())
+		return
+	}
+	if err := req.validate(time.Now()); err != nil {
+		serveErr(w, r, err)
+		return
+	}
+	if t := adminTenant(r); t != "" {
+		if req.Tenant == "" {
+			req.Tenant = t
+		} else if req.Tenant != t {
+			problem.Write(w, r, problem.TypeForbidden, "the credentials are for tenant "+t+", so are the keys they make")
+			return
+		}
+	}
+
+	plain, key, err := app.keys.Create(r.Context(), model.APIKey{
+		Name:      strings.TrimSpace(req.Name),
+		Scopes:    req.Scopes,
+		Tenant:    req.Tenant,
+		ExpiresAt: req.ExpiresAt,
+	})
+	if err != nil {
+		serveErr(w, r, err)
+		return
+	}
+
+	w.Header().Set("Location", strings.TrimSuffix(r.URL.Path, "/")+"/"+key.ID.Hex())
+	// nobody should be keeping this around
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, r, createdKey{APIKey: key, Key: plain})
+}
+
+func (app *app) listKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := app.keys.Store().ListKeys(r.Context())
+	if err != nil {
+		serveErr(w, r, err)
+		return
+	}
+	if t := adminTenant(r); t != "" {
+		keys = slices.DeleteFunc(keys, func(k model.APIKey) bool { return k.Tenant != t })
+	}
+	writeJSON(w, r, keys)
+}
+
+func (app *app) getKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	key, err := app.tenantKey(r, id)
+	if err != nil {
+		keyErr(w, r, id, err)
+		return
+	}
+	writeJSON(w, r, key)
+}
+
+// tenantKey is GetKey, but another tenant's key isn't there for an admin
+// tied to a tenant.
+func (app *app) tenantKey(r *http.Request, id string) (model.APIKey, error) {
+	key, err := app.keys.Store().GetKey(r.Context(), id)
+	if err != nil {
+		return key, err
+	}
+	if t := adminTenant(r); t != "" && key.Tenant != t {
+		return model.APIKey{}, db.ErrNotFound
+	}
+	return key, nil
+}
+
+// revokeKeyHandler is DELETE /admin/keys/{id}. The key stays around,
+// revoked, so the list still shows it was there.
+func (app *app) revokeKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if _, err := app.tenantKey(r, id); err != nil {
+		keyErr(w, r, id, err)
+		return
+	}
+	if _, err := app.keys.Store().RevokeKey(r.Context(), id, time.Now().UTC()); err != nil {
+		keyErr(w, r, id, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminRoutes registers the key management routes on r, which is mounted
+// at /admin.
+func (app *app) adminRoutes(r *mux.Router) {
+	r.HandleFunc("/keys", app.createKeyHandler).Methods(http.MethodPost)
+	r.HandleFunc("/keys", app.listKeysHandler).Methods(http.MethodGet)
+	r.HandleFunc("/keys/{id}", app.getKeyHandler).Methods(http.MethodGet)
+	r.HandleFunc("/keys/{id}", app.revokeKeyHandler).Methods(http.MethodDelete)
+}
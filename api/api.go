@@ -1,191 +1,841 @@
 package api
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"mime"
 	"net/http"
-	"os"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/mar-cial/items/auth"
+	"github.com/mar-cial/items/config"
 	"github.com/mar-cial/items/db"
+	"github.com/mar-cial/items/health"
+	"github.com/mar-cial/items/lifecycle"
+	"github.com/mar-cial/items/logging"
+	"github.com/mar-cial/items/metrics"
+	"github.com/mar-cial/items/middleware"
 	"github.com/mar-cial/items/model"
-	"go.mongodb.org/mongo-driver/mongo"
+	"github.com/mar-cial/items/openapi"
+	"github.com/mar-cial/items/patch"
+	"github.com/mar-cial/items/problem"
+	"github.com/mar-cial/items/ratelimit"
+	"github.com/mar-cial/items/search"
+	"github.com/mar-cial/items/tenant"
+	"github.com/mar-cial/items/tracing"
 )
 
 type app struct {
-	mc *mongo.Client
+	store    db.ItemStore
+	opts     Options
+	health   *health.Checker
+	metrics  *metrics.Metrics
+	versions []Version
+	keys     *auth.APIKeys
+	// jwt is nil unless the config has keys for tokens
+	jwt    *auth.JWT
+	policy auth.Policy
+	// limiter keeps the buckets for Options.RateLimit
+	limiter ratelimit.Limiter
+	// spec is what CreateRouter made of the routes, requests are checked
+	// against it
+	spec *openapi.Document
 }
 
-func CreateApp() (*app, error) {
-	client, err := db.CreateClient()
+// healthTimeout is how long a single readiness check gets, a probe that
+// hangs is as good as a failed one.
+const healthTimeout = 2 * time.Second
+
+// Options are the knobs for the middleware CreateRouter sets up. Zero
+// values switch that piece off.
+type Options struct {
+	// RequestTimeout is the deadline every request gets.
+	RequestTimeout time.Duration
+	// MaxBodyBytes caps request bodies.
+	MaxBodyBytes int64
+	// Logger is the base every request logger is made from, nil means no
+	// logs at all.
+	Logger *slog.Logger
+	// AccessLog logs a line per request.
+	AccessLog bool
+	// Auth makes the item and admin routes want credentials. Without it
+	// credentials are still checked when they're sent, but nobody has to
+	// send any.
+	Auth bool
+	// Tenancy makes every item request name a tenant, which the store
+	// keeps its items apart by. TenantHeader and TenantDomain are where
+	// requests whose credentials aren't tied to a tenant can name one,
+	// empty switches that way off.
+	Tenancy      bool
+	TenantHeader string
+	TenantDomain string
+	// RateLimit is how many requests a client gets on the item and admin
+	// routes, the zero Limit is no limit. RateLimitBy is who counts as a
+	// client, see rateKey. TrustedProxies are the load balancers whose
+	// forwarding headers say who the client is, see clientIP.
+	RateLimit      ratelimit.Limit
+	RateLimitBy    string
+	TrustedProxies []netip.Prefix
+	// CheckResponses, when set, gets every item response that doesn't
+	// match the OpenAPI spec. It's for tests, responses are buffered to
+	// check them.
+	CheckResponses func(r *http.Request, err error)
+}
 
-	return &app{
-		mc: client,
-	}, err
+func DefaultOptions() Options {
+	return Options{
+		RequestTimeout: 10 * time.Second,
+		MaxBodyBytes:   1 << 20,
+		Logger:         slog.Default(),
+		AccessLog:      true,
+	}
 }
 
-type errResponse struct {
-	Message string `json:"message"`
-	Status  int    `json:"status"`
+// NewApp wires the handlers to whatever store you hand it. Tests use this
+// with db.NewMemoryStore() so they don't need a mongo container.
+func NewApp(store db.ItemStore) *app {
+	m := metrics.New()
+	app := &app{
+		store:    m.InstrumentStore(tracing.InstrumentStore(store)),
+		opts:     DefaultOptions(),
+		health:   health.New(healthTimeout),
+		metrics:  m,
+		versions: Versions(),
+		keys:     auth.NewAPIKeys(db.NewMemoryKeyStore(), ""),
+		policy:   auth.DefaultPolicy(),
+		limiter:  ratelimit.NewMemory(),
+	}
+	app.health.Add("store", app.store.Ping)
+	return app
 }
 
-func serveErrResponse(w http.ResponseWriter, msg string, status int) {
-	json.NewEncoder(w).Encode(&errResponse{
-		Message: msg,
-		Status:  status,
-	})
+// middleware is the chain CreateRouter installs, outermost first. The
+// request id comes first so everything after it can log it, and recover
+// sits inside the access log and metrics so a panic shows up as the 500 it
+// became.
+func (app *app) middleware() []mux.MiddlewareFunc {
+	mws := []mux.MiddlewareFunc{middleware.RequestID(), tracing.Middleware, middleware.Logger(app.logger())}
+
+	if app.opts.AccessLog {
+		mws = append(mws, middleware.AccessLog())
+	}
+
+	mws = append(mws, app.metrics.InFlight, middleware.Observe(app.metrics.ObserveRequest))
+	mws = append(mws, middleware.Recover())
+
+	if app.opts.RequestTimeout > 0 {
+		mws = append(mws, middleware.Timeout(app.opts.RequestTimeout))
+	}
+	if app.opts.MaxBodyBytes > 0 {
+		mws = append(mws, middleware.BodyLimit(app.opts.MaxBodyBytes))
+	}
+
+	return append(mws, app.authenticate, middleware.RequireJSON(), commonMiddleware)
 }
 
+// logger is opts.Logger, or one that drops everything if there isn't one.
+func (app *app) logger() *slog.Logger {
+	if app.opts.Logger == nil {
+		return logging.Discard()
+	}
+	return app.opts.Logger
+}
+
+// OptionsFrom turns the server part of the config into router options.
+func OptionsFrom(cfg config.ServerConfig) Options {
+	opts := DefaultOptions()
+	opts.RequestTimeout = cfg.RequestTimeout
+	opts.MaxBodyBytes = cfg.MaxBodyBytes
+	opts.AccessLog = cfg.AccessLog
+	return opts
+}
+
+func CreateApp(cfg config.Config) (*app, error) {
+	client, err := db.CreateClient(cfg.Mongo.ConnectionURI())
+	if err != nil {
+		return &app{}, err
+	}
+
+	database := client.Database(cfg.Mongo.Database)
+	store := db.NewTenantMongoStore(database.Collection(cfg.Mongo.Collection), db.TenantStrategy(cfg.Tenancy.Strategy))
+	// the counts can't be a tenant's collection, tenant ids have no _
+	counts := cfg.Mongo.Collection + "_item_counts"
+	store.Reserve(cfg.Auth.KeysCollection, counts)
+	app := NewApp(db.NewQuotaStore(store, cfg.Tenancy.Quota, db.NewMongoQuotaCounter(database.Collection(counts))))
+	app.keys = auth.NewAPIKeys(db.NewMongoKeyStore(database.Collection(cfg.Auth.KeysCollection)), cfg.Auth.BootstrapKey)
+	app.opts = OptionsFrom(cfg.Server)
+	app.opts.Auth = cfg.Auth.Enabled
+	app.opts.Tenancy = cfg.Tenancy.Enabled()
+	app.opts.TenantHeader = cfg.Tenancy.Header
+	app.opts.TenantDomain = cfg.Tenancy.Domain
+	app.opts.RateLimit = ratelimit.Limit{Rate: cfg.RateLimit.Rate, Burst: cfg.RateLimit.Burst}
+	app.opts.RateLimitBy = cfg.RateLimit.By
+	app.opts.TrustedProxies = cfg.RateLimit.Proxies()
+
+	app.jwt, err = jwtFrom(logging.With(context.Background(), app.logger()), cfg.Auth.JWT, cfg.Tenancy.Claim)
+	if err != nil {
+		return app, err
+	}
+	app.health.Add("config", func(context.Context) error { return cfg.Validate() })
+	return app, nil
+}
+
+// serveErr turns an error from validation or from the store into a problem
+// response. Anything that isn't one of the model/db errors is our fault,
+// so 500.
+func serveErr(w http.ResponseWriter, r *http.Request, err error) {
+	var verr *db.ValidationError
+	var mverr model.ValidationError
+
+	// field names in whatever version the client is talking
+	v, _ := versionFrom(r.Context())
+
+	switch {
+	case errors.As(err, &mverr):
+		var fields []problem.FieldError
+		for k := range mverr {
+			fields = append(fields, problem.FieldError{Field: v.field(mverr[k].Field), Message: mverr[k].Message})
+		}
+		problem.New(problem.TypeValidation, "").WithErrors(fields...).Write(w, r)
+	case errors.As(err, &verr):
+		var fields []problem.FieldError
+		for k := range verr.Fields {
+			fields = append(fields, problem.FieldError{Field: v.field(verr.Fields[k].Field), Message: verr.Fields[k].Message})
+		}
+		problem.New(problem.TypeValidation, "").WithErrors(fields...).Write(w, r)
+	case errors.Is(err, patch.ErrInvalid):
+		problem.Write(w, r, problem.TypeMalformedBody, err.Error())
+	case errors.Is(err, patch.ErrTestFailed):
+		problem.Write(w, r, problem.TypePatchTestFailed, err.Error())
+	case errors.Is(err, patch.ErrUnprocessable):
+		problem.Write(w, r, problem.TypeUnprocessable, err.Error())
+	case errors.Is(err, db.ErrNotFound):
+		problem.Write(w, r, problem.TypeNotFound, err.Error())
+	case errors.Is(err, db.ErrInvalidID):
+		problem.Write(w, r, problem.TypeInvalidID, err.Error())
+	case errors.Is(err, db.ErrInvalidQuery):
+		problem.Write(w, r, problem.TypeInvalidQuery, err.Error())
+	case errors.Is(err, db.ErrVersionMismatch):
+		problem.Write(w, r, problem.TypePrecondition, err.Error())
+	case middleware.IsTimeout(err):
+		logging.From(r.Context()).Warn("request timed out", slog.Any("err", err))
+		problem.Write(w, r, problem.TypeTimeout, "")
+	case errors.Is(err, db.ErrConflict):
+		problem.Write(w, r, problem.TypeConflict, "")
+	case errors.Is(err, db.ErrContended):
+		problem.Write(w, r, problem.TypeContended, err.Error()+", try again")
+	case errors.Is(err, tenant.ErrInvalid):
+		problem.Write(w, r, problem.TypeBadRequest, err.Error())
+	case errors.Is(err, db.ErrQuotaExceeded):
+		problem.Write(w, r, problem.TypeQuotaExceeded, err.Error())
+	default:
+		// the client only gets a generic 500, the details go to the log
+		logging.From(r.Context()).Error("request failed", slog.Any("err", err))
+		problem.Write(w, r, problem.TypeInternal, "")
+	}
+}
+
+// writeJSON encodes v as the response body. By the time encoding fails the
+// status is out already, so all that's left is to log it.
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logging.From(r.Context()).Warn("writing response", slog.Any("err", err))
+	}
+}
+
+// readBody reads the whole request body. If that fails the response is
+// already written and ok is false.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	b, err := io.ReadAll(r.Body)
+
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		problem.Write(w, r, problem.TypeBodyTooLarge, fmt.Sprintf("body is limited to %d bytes", tooLarge.Limit))
+		return nil, false
+	case err != nil:
+		problem.Write(w, r, problem.TypeBadRequest, "could not read request body")
+		return nil, false
+	}
+	return b, true
+}
+
+// commonMiddleware sets the default content type. Problem responses
+// overwrite it with their own.
 func commonMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("Accept", "application/json")
+		next.ServeHTTP(w, r)
 	})
 }
 
 func (app *app) createOneItemHandler(w http.ResponseWriter, r *http.Request) {
-	coll := app.mc.Database(os.Getenv("DBNAME")).Collection(os.Getenv("DBCOLL"))
-	bodyBytes, err := io.ReadAll(r.Body)
-	if err != nil {
-		serveErrResponse(w, "bad request", http.StatusBadRequest)
+	bodyBytes, ok := readBody(w, r)
+	if !ok {
 		return
 	}
 
-	item, err := model.UnmarshalItem(bodyBytes)
+	item, err := app.version(r).decode(bodyBytes)
 	if err != nil {
-		serveErrResponse(w, "err unmarshaling", http.StatusBadRequest)
+		problem.Write(w, r, problem.TypeMalformedBody, err.Error())
+		return
+	}
+
+	if err := item.Validate(); err != nil {
+		serveErr(w, r, err)
 		return
 	}
 
-	res, err := db.InsertOneItem(r.Context(), coll, &item)
+	res, err := app.store.InsertOneItem(r.Context(), &item)
 	if err != nil {
-		serveErrResponse(w, "err unmarshaling", http.StatusBadRequest)
+		serveErr(w, r, err)
 		return
 	}
 
-	json.NewEncoder(w).Encode(&res)
+	writeJSON(w, r, &res)
 }
 
 func (app *app) createManyItemsHandler(w http.ResponseWriter, r *http.Request) {
-	coll := app.mc.Database(os.Getenv("DBNAME")).Collection(os.Getenv("DBCOLL"))
+	bodyBytes, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	items, err := app.version(r).decodeMany(bodyBytes)
+	if err != nil {
+		problem.Write(w, r, problem.TypeMalformedBody, err.Error())
+		return
+	}
 
-	var items []model.Item
-	if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
-		serveErrResponse(w, "err unmarshaling", http.StatusBadRequest)
+	if err := model.ValidateItems(items); err != nil {
+		serveErr(w, r, err)
 		return
 	}
 
-	insertManyRes, err := db.InsertItems(r.Context(), coll, items)
+	insertManyRes, err := app.store.InsertItems(r.Context(), items)
 	if err != nil {
-		serveErrResponse(w, "err from inserting items", http.StatusBadRequest)
+		serveErr(w, r, err)
 		return
 	}
 
-	json.NewEncoder(w).Encode(&insertManyRes)
+	writeJSON(w, r, &insertManyRes)
 
 }
 
-func (app *app) listOneItemHandler(w http.ResponseWriter, r *http.Request) {
-	coll := app.mc.Database(os.Getenv("DBNAME")).Collection(os.Getenv("DBCOLL"))
+// createItemsHandler is POST /items. An object creates one item and answers
+// 201 with the item, its ETag and a Location. An array creates them all in
+// one go, there's no single Location for that so it's just the ids.
+func (app *app) createItemsHandler(w http.ResponseWriter, r *http.Request) {
+	bodyBytes, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	if trimmed := bytes.TrimSpace(bodyBytes); len(trimmed) > 0 && trimmed[0] == '[' {
+		items, err := app.version(r).decodeMany(bodyBytes)
+		if err != nil {
+			problem.Write(w, r, problem.TypeMalformedBody, err.Error())
+			return
+		}
+
+		if err := model.ValidateItems(items); err != nil {
+			serveErr(w, r, err)
+			return
+		}
+
+		res, err := app.store.InsertItems(r.Context(), items)
+		if err != nil {
+			serveErr(w, r, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, r, &res)
+		return
+	}
 
+	item, err := app.version(r).decode(bodyBytes)
+	if err != nil {
+		problem.Write(w, r, problem.TypeMalformedBody, err.Error())
+		return
+	}
+
+	if err := item.Validate(); err != nil {
+		serveErr(w, r, err)
+		return
+	}
+
+	res, err := app.store.InsertOneItem(r.Context(), &item)
+	if err != nil {
+		serveErr(w, r, err)
+		return
+	}
+
+	// read it back so the body is what the store has, version and all
+	created, err := app.store.ListOneItem(r.Context(), res.InsertedID)
+	if err != nil {
+		serveErr(w, r, err)
+		return
+	}
+
+	w.Header().Set("Location", strings.TrimSuffix(r.URL.Path, "/")+"/"+res.InsertedID)
+	w.Header().Set("ETag", etag(created, app.version(r)))
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, r, app.version(r).encode(created))
+}
+
+func (app *app) listOneItemHandler(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 	if id == "" {
-		serveErrResponse(w, "no id received", http.StatusInternalServerError)
+		problem.Write(w, r, problem.TypeBadRequest, "no id received")
 		return
 	}
 
-	item, err := db.ListOneItem(r.Context(), coll, id)
+	item, err := app.store.ListOneItem(r.Context(), id)
 	if err != nil {
-		serveErrResponse(w, "err listing an item", http.StatusInternalServerError)
+		serveErr(w, r, err)
 		return
 	}
 
-	json.NewEncoder(w).Encode(&item)
+	tag := etag(item, app.version(r))
+	w.Header().Set("ETag", tag)
+	if noneMatch(r, tag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	writeJSON(w, r, app.version(r).encode(item))
 }
 
 func (app *app) listItemsHandler(w http.ResponseWriter, r *http.Request) {
-	coll := app.mc.Database(os.Getenv("DBNAME")).Collection(os.Getenv("DBCOLL"))
+	opts, err := parseListOptions(r.URL.Query())
+	if err != nil {
+		problem.Write(w, r, problem.TypeInvalidQuery, err.Error())
+		return
+	}
 
-	items, err := db.ListItems(r.Context(), coll)
+	page, err := app.store.ListItems(r.Context(), opts)
 	if err != nil {
-		serveErrResponse(w, "could not list all items", http.StatusInternalServerError)
+		serveErr(w, r, err)
 		return
 	}
 
-	err = json.NewEncoder(w).Encode(&items)
+	w.Header().Set("X-Total-Count", strconv.FormatInt(page.Total, 10))
+	if links := pageLinks(r.URL, opts, page); links != "" {
+		w.Header().Add("Link", links)
+	}
+
+	// items never gives null, an empty page is still []
+	writeJSON(w, r, app.version(r).items(page.Items))
+}
+
+type searchResponse struct {
+	Total   int64       `json:"total"`
+	Results []searchHit `json:"results"`
+}
+
+// searchHit is db.SearchHit with the item in the request's version.
+type searchHit struct {
+	Item       interface{}   `json:"item"`
+	Score      float64       `json:"score"`
+	Highlights []search.Span `json:"highlights"`
+}
+
+func (app *app) searchItemsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	query := q.Get("q")
+	if strings.TrimSpace(query) == "" {
+		problem.Write(w, r, problem.TypeInvalidQuery, "q is required")
+		return
+	}
+
+	opts, err := parseSearchOptions(q)
 	if err != nil {
-		fmt.Println(err)
+		problem.Write(w, r, problem.TypeInvalidQuery, err.Error())
+		return
+	}
+
+	page, err := app.store.SearchItems(r.Context(), query, opts)
+	if err != nil {
+		serveErr(w, r, err)
+		return
+	}
+
+	w.Header().Set("X-Total-Count", strconv.FormatInt(page.Total, 10))
+	if links := offsetLinks(r.URL, opts.Offset, clampLimit(opts.Limit), page.Total); links != "" {
+		w.Header().Add("Link", links)
+	}
+
+	v := app.version(r)
+	res := searchResponse{Total: page.Total, Results: make([]searchHit, len(page.Hits))}
+	for k, hit := range page.Hits {
+		res.Results[k] = searchHit{Item: v.encode(hit.Item), Score: hit.Score, Highlights: hit.Highlights}
 	}
+
+	writeJSON(w, r, &res)
 }
 
 func (app *app) updateOneItemHandler(w http.ResponseWriter, r *http.Request) {
-	coll := app.mc.Database(os.Getenv("DBNAME")).Collection(os.Getenv("DBCOLL"))
 	id := mux.Vars(r)["id"]
 
 	if id == "" {
-		serveErrResponse(w, "no id received", http.StatusInternalServerError)
+		problem.Write(w, r, problem.TypeBadRequest, "no id received")
+		return
+	}
+
+	bodyBytes, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	item, err := app.version(r).decode(bodyBytes)
+	if err != nil {
+		problem.Write(w, r, problem.TypeMalformedBody, err.Error())
+		return
+	}
+
+	if err := item.Validate(); err != nil {
+		serveErr(w, r, err)
+		return
+	}
+
+	version, err := ifMatchVersion(r.Context(), app.store, r, id)
+	if err != nil {
+		serveErr(w, r, err)
+		return
+	}
+
+	updateRes, err := app.store.UpdateOneItem(r.Context(), id, &item, version)
+	if err != nil {
+		serveErr(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, updateRes)
+
+}
+
+// replaceOneItemHandler is PUT /items/{id}. It replaces the whole item and
+// answers with it as stored, so the client gets the new ETag without
+// another GET.
+func (app *app) replaceOneItemHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if id == "" {
+		problem.Write(w, r, problem.TypeBadRequest, "no id received")
+		return
+	}
+
+	bodyBytes, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	item, err := app.version(r).decode(bodyBytes)
+	if err != nil {
+		problem.Write(w, r, problem.TypeMalformedBody, err.Error())
+		return
+	}
+
+	if err := item.Validate(); err != nil {
+		serveErr(w, r, err)
+		return
+	}
+
+	version, err := ifMatchVersion(r.Context(), app.store, r, id)
+	if err != nil {
+		serveErr(w, r, err)
+		return
+	}
+
+	// ID and version can be left out, but if they're there they have to
+	// be the ones we already have
+	stored, err := app.store.PatchOneItem(r.Context(), id, version, func(current model.Item) (model.Item, error) {
+		if !item.ID.IsZero() && item.ID != current.ID {
+			return current, model.ValidationError{{Field: "ID", Message: "can't be changed"}}
+		}
+		if item.Version != 0 && item.Version != current.Version {
+			return current, model.ValidationError{{Field: "version", Message: "can't be changed, use If-Match"}}
+		}
+		return item, nil
+	})
+	if err != nil {
+		serveErr(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag(stored, app.version(r)))
+
+	writeJSON(w, r, app.version(r).encode(stored))
+}
+
+// patchOneItemHandler takes either a merge patch or a JSON patch, depending
+// on Content-Type. The patched item has to pass the same validation as a
+// full update, and the response is the item as it is after the patch.
+func (app *app) patchOneItemHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if id == "" {
+		problem.Write(w, r, problem.TypeBadRequest, "no id received")
+		return
+	}
+
+	var apply func(doc, patch []byte) ([]byte, error)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case patch.MergePatchType:
+		apply = patch.MergePatch
+	case patch.JSONPatchType:
+		apply = patch.JSONPatch
+	default:
+		w.Header().Set("Accept-Patch", patch.MergePatchType+", "+patch.JSONPatchType)
+		problem.Write(w, r, problem.TypeUnsupportedMedia, "use "+patch.MergePatchType+" or "+patch.JSONPatchType)
+		return
+	}
+
+	bodyBytes, ok := readBody(w, r)
+	if !ok {
 		return
 	}
 
-	var item *model.Item
-	if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
-		serveErrResponse(w, "err unmarshaling", http.StatusBadRequest)
+	version, err := ifMatchVersion(r.Context(), app.store, r, id)
+	if err != nil {
+		serveErr(w, r, err)
 		return
 	}
 
-	updateRes, err := db.UpdateOneItem(r.Context(), coll, id, item)
+	// the patch is written against the representation the client sees
+	v := app.version(r)
+
+	item, err := app.store.PatchOneItem(r.Context(), id, version, func(current model.Item) (model.Item, error) {
+		doc, err := v.marshal(current)
+		if err != nil {
+			return current, err
+		}
+
+		patched, err := apply(doc, bodyBytes)
+		if err != nil {
+			return current, err
+		}
+
+		next, err := v.decode(patched)
+		if err != nil {
+			return current, fmt.Errorf("%w: %v", patch.ErrUnprocessable, err)
+		}
+		if next.ID != current.ID {
+			return current, model.ValidationError{{Field: "ID", Message: "can't be changed"}}
+		}
+		if next.Version != current.Version {
+			return current, model.ValidationError{{Field: "version", Message: "can't be changed, use If-Match"}}
+		}
+
+		return next, next.Validate()
+	})
 	if err != nil {
-		serveErrResponse(w, "err updating item", http.StatusInternalServerError)
+		serveErr(w, r, err)
 		return
 	}
 
-	json.NewEncoder(w).Encode(updateRes)
+	w.Header().Set("ETag", etag(item, v))
 
+	writeJSON(w, r, v.encode(item))
 }
 
 func (app *app) deleteOneItemHandler(w http.ResponseWriter, r *http.Request) {
-	coll := app.mc.Database(os.Getenv("DBNAME")).Collection(os.Getenv("DBCOLL"))
 	id := mux.Vars(r)["id"]
 
 	if id == "" {
-		serveErrResponse(w, "no id received", http.StatusInternalServerError)
+		problem.Write(w, r, problem.TypeBadRequest, "no id received")
+		return
+	}
+
+	version, err := ifMatchVersion(r.Context(), app.store, r, id)
+	if err != nil {
+		serveErr(w, r, err)
+		return
+	}
+
+	delRes, err := app.store.DeleteOneItem(r.Context(), id, version)
+	if err != nil {
+		serveErr(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, delRes)
+}
+
+// removeOneItemHandler is DELETE /items/{id}: 204 and no body.
+func (app *app) removeOneItemHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if id == "" {
+		problem.Write(w, r, problem.TypeBadRequest, "no id received")
 		return
 	}
 
-	delRes, err := db.DeleteOneItem(r.Context(), coll, id)
+	version, err := ifMatchVersion(r.Context(), app.store, r, id)
 	if err != nil {
-		serveErrResponse(w, "err received from delete one item", http.StatusInternalServerError)
+		serveErr(w, r, err)
+		return
+	}
+
+	if _, err := app.store.DeleteOneItem(r.Context(), id, version); err != nil {
+		serveErr(w, r, err)
 		return
 	}
 
-	json.NewEncoder(w).Encode(delRes)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// permissions is the scope every route behind auth needs, keyed by method
+// and path the way the spec has them. The /v1 and /v2 routes use the
+// /items entries. A route that isn't in here lets nobody in, so add it
+// along with the route, TestPermissionsCoverRoutes fails otherwise.
+var permissions = map[string]string{
+	"POST /items":               auth.ScopeItemsWrite,
+	"GET /items":                auth.ScopeItemsRead,
+	"GET /items/search":         auth.ScopeItemsRead,
+	"GET /items/{id}":           auth.ScopeItemsRead,
+	"PUT /items/{id}":           auth.ScopeItemsWrite,
+	"PATCH /items/{id}":         auth.ScopeItemsWrite,
+	"DELETE /items/{id}":        auth.ScopeItemsDelete,
+	"POST /items/create/one":    auth.ScopeItemsWrite,
+	"POST /items/create/many":   auth.ScopeItemsWrite,
+	"GET /items/list/{id}":      auth.ScopeItemsRead,
+	"GET /items/list":           auth.ScopeItemsRead,
+	"PUT /items/update/{id}":    auth.ScopeItemsWrite,
+	"DELETE /items/delete/{id}": auth.ScopeItemsDelete,
+	"POST /admin/keys":          auth.ScopeAdmin,
+	"GET /admin/keys":           auth.ScopeAdmin,
+	"GET /admin/keys/{id}":      auth.ScopeAdmin,
+	"DELETE /admin/keys/{id}":   auth.ScopeAdmin,
 }
 
 func CreateRouter(app *app) *mux.Router {
 	r := mux.NewRouter()
 
-	r.Use(commonMiddleware)
+	r.Use(app.middleware()...)
+
+	// mux answers these with plain text by default
+	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		problem.Write(w, r, problem.TypeNotFound, "no route matches "+r.URL.Path)
+	})
+	r.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		problem.Write(w, r, problem.TypeMethodNotAllowed, r.Method+" is not allowed here")
+	})
+
+	r.HandleFunc("/healthz", app.health.Liveness).Methods(http.MethodGet, http.MethodHead)
+	r.HandleFunc("/readyz", app.health.Readiness).Methods(http.MethodGet, http.MethodHead)
+	r.HandleFunc("/health", app.health.Details).Methods(http.MethodGet)
+	r.Handle("/metrics", app.metrics.Handler()).Methods(http.MethodGet)
+
+	// the spec is built from the router once everything's registered,
+	// including this route
+	var spec []byte
+	r.HandleFunc("/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(spec)
+	}).Methods(http.MethodGet)
+	r.Handle("/docs", http.RedirectHandler("docs/", http.StatusMovedPermanently)).Methods(http.MethodGet)
+	r.Handle("/docs/{file:.*}", http.StripPrefix("/docs/", openapi.UI())).Methods(http.MethodGet)
+
+	// the verb routes go first, /items/{id} would swallow /items/list
+	// otherwise. They're from before versions, so always v1.
+	r.Handle("/items/create/one", app.legacy("/items", app.createOneItemHandler)).Methods(http.MethodPost)
+	r.Handle("/items/create/many", app.legacy("/items", app.createManyItemsHandler)).Methods(http.MethodPost)
+	r.Handle("/items/list/{id}", app.legacy("/items/{id}", app.listOneItemHandler)).Methods(http.MethodGet)
+	r.Handle("/items/list", app.legacy("/items", app.listItemsHandler)).Methods(http.MethodGet)
+	r.Handle("/items/update/{id}", app.legacy("/items/{id}", app.updateOneItemHandler)).Methods(http.MethodPut)
+	r.Handle("/items/delete/{id}", app.legacy("/items/{id}", app.deleteOneItemHandler)).Methods(http.MethodDelete)
 
-	// an httprouter kinda approach...
-	// I'm not familiar with httprouter so I'll just use gorilla mux
 	i := r.PathPrefix("/items").Subrouter()
-	i.HandleFunc("/create/one", app.createOneItemHandler).Methods(http.MethodPost)
-	i.HandleFunc("/create/many", app.createManyItemsHandler).Methods(http.MethodPost)
-	i.HandleFunc("/list/{id}", app.listOneItemHandler).Methods(http.MethodGet)
-	i.HandleFunc("/list", app.listItemsHandler).Methods(http.MethodGet)
-	i.HandleFunc("/update/{id}", app.updateOneItemHandler).Methods(http.MethodPut)
-	i.HandleFunc("/delete/{id}", app.deleteOneItemHandler).Methods(http.MethodDelete)
+	i.Use(app.negotiate, app.checkResponse, app.rateLimit, app.authorize, app.resolveTenant, app.validateRequest)
+	app.itemRoutes(i)
+
+	// the same handlers again, with the path deciding the version
+	for _, v := range app.versions {
+		vr := r.PathPrefix("/" + v.Name + "/items").Subrouter()
+		vr.Use(app.pinVersion(v), app.checkResponse, app.rateLimit, app.authorize, app.resolveTenant, app.validateRequest)
+		app.itemRoutes(vr)
+	}
+
+	// without auth there's no telling an admin from anyone else, and keys
+	// made then would still work once it's on, so there's no /admin at all
+	if app.opts.Auth {
+		admin := r.PathPrefix("/admin").Subrouter()
+		admin.Use(app.checkResponse, app.rateLimit, app.authorize, app.validateRequest)
+		app.adminRoutes(admin)
+	}
+
+	doc, err := app.openAPI(r)
+	if err != nil {
+		app.logger().Warn("openapi spec doesn't match the routes", slog.Any("err", err))
+	}
+	app.spec = doc
+	spec, err = json.Marshal(doc)
+	if err != nil {
+		app.logger().Error("encoding openapi spec", slog.Any("err", err))
+	}
 
 	return r
 }
 
-func CreateServer() (*http.Server, error) {
-	app, err := CreateApp()
+// itemRoutes registers the REST routes on r, which is mounted wherever
+// items live.
+func (app *app) itemRoutes(r *mux.Router) {
+	r.HandleFunc("", app.createItemsHandler).Methods(http.MethodPost)
+	r.HandleFunc("", app.listItemsHandler).Methods(http.MethodGet)
+	r.HandleFunc("/search", app.searchItemsHandler).Methods(http.MethodGet)
+	r.HandleFunc("/{id}", app.listOneItemHandler).Methods(http.MethodGet)
+	r.HandleFunc("/{id}", app.replaceOneItemHandler).Methods(http.MethodPut)
+	r.HandleFunc("/{id}", app.patchOneItemHandler).Methods(http.MethodPatch)
+	r.HandleFunc("/{id}", app.removeOneItemHandler).Methods(http.MethodDelete)
+}
+
+// Register hands the server for app and the store behind it to lc. The
+// store goes in first so it's closed last, once the server has drained.
+// Readiness goes in last so it's the first thing to flip on shutdown, and
+// the server keeps going for cfg.ShutdownDelay after that so whatever is
+// probing it sees the 503 before the listener closes.
+func Register(lc *lifecycle.App, app *app, cfg config.ServerConfig) *http.Server {
+	srv := &http.Server{
+		Addr:    cfg.Addr(),
+		Handler: CreateRouter(app),
+	}
+
+	lc.Append(lifecycle.Hook{Name: "store", Stop: app.store.Close})
+	lc.Append(lifecycle.ServerHook(lc, "http", srv))
+	lc.Append(lifecycle.Hook{Name: "readiness", Stop: func(ctx context.Context) error {
+		app.health.Drain()
+		if cfg.ShutdownDelay <= 0 {
+			return nil
+		}
+
+		t := time.NewTimer(cfg.ShutdownDelay)
+		defer t.Stop()
+		select {
+		case <-t.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}})
+	return srv
+}
+
+func CreateServer(cfg config.Config) (*http.Server, error) {
+	app, err := CreateApp(cfg)
 	router := CreateRouter(app)
 
 	return &http.Server{
-		Addr:    fmt.Sprintf(":%s", os.Getenv("SERVERPORT")),
+		Addr:    cfg.Server.Addr(),
 		Handler: router,
 	}, err
 }
@@ -4,53 +4,74 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"os"
+	"path"
+	"strings"
 	"testing"
+	"time"
 
+	jwtlib "github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
+	"github.com/mar-cial/items/auth"
+	"github.com/mar-cial/items/config"
+	"github.com/mar-cial/items/db"
+	"github.com/mar-cial/items/health"
+	"github.com/mar-cial/items/lifecycle"
+	"github.com/mar-cial/items/metrics"
+	"github.com/mar-cial/items/middleware"
 	"github.com/mar-cial/items/model"
+	"github.com/mar-cial/items/openapi"
+	"github.com/mar-cial/items/problem"
+	"github.com/mar-cial/items/ratelimit"
+	"github.com/mar-cial/items/tracing"
 	"github.com/stretchr/testify/assert"
-	"github.com/testcontainers/testcontainers-go"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
-var endpoint string
-var mc *mongo.Client
 var a *app
 var ids []string
 
 func TestCreateApp(t *testing.T) {
-	var err error
 	arrs := []string{"DBUSER", "DBPASS", "DBHOST", "DBPORT", "DBNAME"}
 	for k := range arrs {
 		s := os.Getenv(arrs[k])
 		assert.NotEmpty(t, s)
 	}
-	assert.NoError(t, err)
 
-	endpoint = endpoint[len(endpoint)-5:]
-	err = os.Setenv("DBPORT", endpoint)
+	cfg, err := config.Load(nil, os.Getenv)
 	assert.NoError(t, err)
 
-	app, err := CreateApp()
-	assert.NoError(t, err)
-
-	a = app
-	mc = app.mc
-
-	err = mc.Ping(context.Background(), nil)
+	// mongo.Connect is lazy so this works without a database, we just want
+	// to know it ends up with a mongo backed store.
+	app, err := CreateApp(cfg)
 	assert.NoError(t, err)
+	traced := app.store.(*metrics.Store).ItemStore.(*tracing.Store)
+	quota := traced.ItemStore.(*db.QuotaStore)
+	assert.IsType(t, &db.MongoStore{}, quota.ItemStore)
+	assert.Equal(t, cfg.Server.RequestTimeout, app.opts.RequestTimeout)
+	assert.Equal(t, cfg.Auth.Enabled, app.opts.Auth)
+	assert.Equal(t, cfg.Tenancy.Enabled(), app.opts.Tenancy)
+	assert.Equal(t, cfg.Tenancy.Header, app.opts.TenantHeader)
+
+	// everything else runs against the in-memory store
+	a = NewApp(db.NewMemoryStore())
+	assert.NotNil(t, a.store)
 }
 
 func TestCreateServer(t *testing.T) {
-	server, err := CreateServer()
+	cfg, err := config.Load([]string{"-port", "8080"}, os.Getenv)
 	assert.NoError(t, err)
-	assert.Equal(t, ":8000", server.Addr)
+
+	server, err := CreateServer(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, ":8080", server.Addr)
 }
 
 func TestCreateRouter(t *testing.T) {
@@ -276,8 +297,1373 @@ func TestCheckItemsAgain(t *testing.T) {
 	}
 }
 
+func TestErrorStatuses(t *testing.T) {
+	missing := primitive.NewObjectID().Hex()
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		body    string
+		status  int
+		problem problem.Type
+	}{
+		{"list missing", http.MethodGet, "/items/list/" + missing, "", http.StatusNotFound, problem.TypeNotFound},
+		{"list bad id", http.MethodGet, "/items/list/nope", "", http.StatusBadRequest, problem.TypeInvalidID},
+		{"update missing", http.MethodPut, "/items/update/" + missing, `{"title":"x","price":1}`, http.StatusNotFound, problem.TypeNotFound},
+		{"update bad id", http.MethodPut, "/items/update/nope", `{"title":"x","price":1}`, http.StatusBadRequest, problem.TypeInvalidID},
+		{"update null body", http.MethodPut, "/items/update/" + missing, `null`, http.StatusUnprocessableEntity, problem.TypeValidation},
+		{"delete missing", http.MethodDelete, "/items/delete/" + missing, "", http.StatusNotFound, problem.TypeNotFound},
+		{"delete bad id", http.MethodDelete, "/items/delete/nope", "", http.StatusBadRequest, problem.TypeInvalidID},
+		{"create many empty", http.MethodPost, "/items/create/many", `[]`, http.StatusUnprocessableEntity, problem.TypeValidation},
+		{"create one conflict", http.MethodPost, "/items/create/one", fmt.Sprintf(`{"ID":%q,"title":"x","price":1}`, ids[1]), http.StatusConflict, problem.TypeConflict},
+		{"create one invalid", http.MethodPost, "/items/create/one", `{"title":"","price":-1}`, http.StatusUnprocessableEntity, problem.TypeValidation},
+		{"create one unknown field", http.MethodPost, "/items/create/one", `{"title":"x","price":1,"colour":"red"}`, http.StatusBadRequest, problem.TypeMalformedBody},
+		{"create many invalid", http.MethodPost, "/items/create/many", `[{"title":"x","price":1},{"title":"","price":1}]`, http.StatusUnprocessableEntity, problem.TypeValidation},
+		{"update invalid", http.MethodPut, "/items/update/" + missing, `{"title":"x","price":1.001}`, http.StatusUnprocessableEntity, problem.TypeValidation},
+		{"create one garbage", http.MethodPost, "/items/create/one", `{`, http.StatusBadRequest, problem.TypeMalformedBody},
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/items/list/{id}", a.listOneItemHandler)
+	router.HandleFunc("/items/update/{id}", a.updateOneItemHandler)
+	router.HandleFunc("/items/delete/{id}", a.deleteOneItemHandler)
+	router.HandleFunc("/items/create/many", a.createManyItemsHandler)
+	router.HandleFunc("/items/create/one", a.createOneItemHandler)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, bytes.NewReader([]byte(tt.body)))
+			rec := httptest.NewRecorder()
+
+			router.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.status, rec.Code)
+			assert.Equal(t, problem.ContentType, rec.Header().Get("Content-Type"))
+
+			var body problem.Details
+			assert.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+			assert.Equal(t, tt.status, body.Status)
+			assert.Equal(t, tt.problem, body.Type)
+			assert.Equal(t, tt.path, body.Instance)
+		})
+	}
+}
+
+func TestBulkValidationReportsIndexes(t *testing.T) {
+	body := `[{"title":"ok","price":1},{"title":"","price":-1}]`
+	req := httptest.NewRequest(http.MethodPost, "/items/create/many", bytes.NewReader([]byte(body)))
+	rec := httptest.NewRecorder()
+
+	a.createManyItemsHandler(rec, req)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	var p problem.Details
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&p))
+	assert.Equal(t, []problem.FieldError{
+		{Field: "[1].title", Message: "is required"},
+		{Field: "[1].price", Message: "must not be negative"},
+	}, p.Errors)
+}
+
+func TestListItemsPaging(t *testing.T) {
+	app := NewApp(db.NewMemoryStore())
+	for i := 0; i < 5; i++ {
+		_, err := app.store.InsertOneItem(context.Background(), &model.Item{Title: fmt.Sprintf("paged %d", i), Price: float64(i + 1)})
+		assert.NoError(t, err)
+	}
+
+	get := func(path string) (*httptest.ResponseRecorder, []model.Item) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		rec := httptest.NewRecorder()
+		app.listItemsHandler(rec, req)
+
+		var items []model.Item
+		json.NewDecoder(rec.Body).Decode(&items)
+		return rec, items
+	}
+
+	rec, items := get("/items/list?limit=2&sort=price&order=desc")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "5", rec.Header().Get("X-Total-Count"))
+	assert.Len(t, items, 2)
+	assert.Equal(t, 5.0, items[0].Price)
+	assert.Contains(t, rec.Header().Get("Link"), `rel="next"`)
+	assert.NotContains(t, rec.Header().Get("Link"), `rel="prev"`)
+
+	// follow the next link
+	link := rec.Header().Get("Link")
+	next := link[1:strings.Index(link, ">")]
+	rec, items = get(next)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, 3.0, items[0].Price)
+	assert.Contains(t, rec.Header().Get("Link"), `rel="prev"`)
+
+	rec, items = get("/items/list?limit=2&offset=4&sort=price")
+	assert.Len(t, items, 1)
+	assert.Equal(t, `</items/list?limit=2&offset=2&sort=price>; rel="prev"`, rec.Header().Get("Link"))
+
+	// filters narrow down the total too, and stay in the links
+	rec, items = get("/items/list?limit=1&price[gte]=3&title[contains]=PAGED")
+	assert.Equal(t, "3", rec.Header().Get("X-Total-Count"))
+	assert.Len(t, items, 1)
+	assert.Contains(t, rec.Header().Get("Link"), "price%5Bgte%5D=3")
+
+	for _, bad := range []string{"price[regex]=x", "colour=red", "limit=0", "offset=-1", "sort=colour", "order=sideways", "cursor=abc&offset=1", "cursor=abc"} {
+		rec, _ = get("/items/list?" + bad)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, bad)
+	}
+}
+
+func TestSearchItemsHandler(t *testing.T) {
+	app := NewApp(db.NewMemoryStore())
+	_, err := app.store.InsertItems(context.Background(), []model.Item{
+		{Title: "HDMI cable", Price: 12},
+		{Title: "USB cable", Price: 45},
+		{Title: "Monitor", Price: 30},
+	})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/items/search?q=Cable&limit=1", nil)
+	rec := httptest.NewRecorder()
+	app.searchItemsHandler(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "2", rec.Header().Get("X-Total-Count"))
+	assert.Equal(t, `</items/search?limit=1&offset=1&q=Cable>; rel="next"`, rec.Header().Get("Link"))
+
+	var res struct {
+		Total   int64          `json:"total"`
+		Results []db.SearchHit `json:"results"`
+	}
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, int64(2), res.Total)
+	assert.Len(t, res.Results, 1)
+	assert.Contains(t, res.Results[0].Item.Title, "cable")
+	assert.Len(t, res.Results[0].Highlights, 1)
+
+	for _, bad := range []string{"", "q=", "q=%20", "q=--", "q=x&limit=nope"} {
+		req := httptest.NewRequest(http.MethodGet, "/items/search?"+bad, nil)
+		rec := httptest.NewRecorder()
+		app.searchItemsHandler(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, bad)
+	}
+}
+
+func TestPatchOneItemHandler(t *testing.T) {
+	app := NewApp(db.NewMemoryStore())
+	res, err := app.store.InsertOneItem(context.Background(), &model.Item{Title: "HDMI cable", Price: 12})
+	assert.NoError(t, err)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/items/{id}", app.patchOneItemHandler).Methods(http.MethodPatch)
+
+	do := func(id, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, "/items/"+id, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// only the price changes, the title stays put
+	rec := do(res.InsertedID, "application/merge-patch+json", `{"price":5}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var item model.Item
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&item))
+	assert.Equal(t, "HDMI cable", item.Title)
+	assert.Equal(t, 5.0, item.Price)
+
+	rec = do(res.InsertedID, "application/json-patch+json",
+		`[{"op":"test","path":"/price","value":5},{"op":"replace","path":"/title","value":"HDMI 2.1 cable"}]`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&item))
+	assert.Equal(t, "HDMI 2.1 cable", item.Title)
+
+	tests := []struct {
+		name        string
+		id          string
+		contentType string
+		body        string
+		status      int
+		problem     problem.Type
+	}{
+		{"test fails", res.InsertedID, "application/json-patch+json", `[{"op":"test","path":"/price","value":1},{"op":"replace","path":"/title","value":"nope"}]`, http.StatusConflict, problem.TypePatchTestFailed},
+		{"invalid result", res.InsertedID, "application/merge-patch+json", `{"title":""}`, http.StatusUnprocessableEntity, problem.TypeValidation},
+		{"unknown field", res.InsertedID, "application/merge-patch+json", `{"colour":"red"}`, http.StatusUnprocessableEntity, problem.TypeUnprocessable},
+		{"missing path", res.InsertedID, "application/json-patch+json", `[{"op":"remove","path":"/nope"}]`, http.StatusUnprocessableEntity, problem.TypeUnprocessable},
+		{"id change", res.InsertedID, "application/merge-patch+json", `{"ID":null}`, http.StatusUnprocessableEntity, problem.TypeValidation},
+		{"garbage", res.InsertedID, "application/merge-patch+json", `{`, http.StatusBadRequest, problem.TypeMalformedBody},
+		{"plain json", res.InsertedID, "application/json", `{"price":1}`, http.StatusUnsupportedMediaType, problem.TypeUnsupportedMedia},
+		{"missing item", primitive.NewObjectID().Hex(), "application/merge-patch+json", `{"price":1}`, http.StatusNotFound, problem.TypeNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := do(tt.id, tt.contentType, tt.body)
+			assert.Equal(t, tt.status, rec.Code)
+
+			var p problem.Details
+			assert.NoError(t, json.NewDecoder(rec.Body).Decode(&p))
+			assert.Equal(t, tt.problem, p.Type)
+		})
+	}
+
+	// none of the failed patches got through
+	got, err := app.store.ListOneItem(context.Background(), res.InsertedID)
+	assert.NoError(t, err)
+	assert.Equal(t, "HDMI 2.1 cable", got.Title)
+	assert.Equal(t, 5.0, got.Price)
+
+	// a patch that keeps losing races isn't an item that already exists
+	app.store = contendedStore{app.store}
+	rec = do(res.InsertedID, "application/merge-patch+json", `{"price":1}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	var p problem.Details
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&p))
+	assert.Equal(t, problem.TypeContended, p.Type)
+	assert.Equal(t, "Concurrent modification", p.Title)
+	assert.Contains(t, p.Detail, res.InsertedID)
+}
+
+// contendedStore never wins the race to write a patch
+type contendedStore struct {
+	db.ItemStore
+}
+
+func (s contendedStore) PatchOneItem(ctx context.Context, id string, version int64, fn db.PatchFunc) (model.Item, error) {
+	return model.Item{}, fmt.Errorf("%w: gave up on %s", db.ErrContended, id)
+}
+
+func TestConditionalRequests(t *testing.T) {
+	app := NewApp(db.NewMemoryStore())
+	res, err := app.store.InsertOneItem(context.Background(), &model.Item{Title: "HDMI cable", Price: 12})
+	assert.NoError(t, err)
+	id := res.InsertedID
+
+	router := mux.NewRouter()
+	router.HandleFunc("/items/list/{id}", app.listOneItemHandler).Methods(http.MethodGet)
+	router.HandleFunc("/items/update/{id}", app.updateOneItemHandler).Methods(http.MethodPut)
+	router.HandleFunc("/items/{id}", app.patchOneItemHandler).Methods(http.MethodPatch)
+	router.HandleFunc("/items/delete/{id}", app.deleteOneItemHandler).Methods(http.MethodDelete)
+
+	do := func(method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodGet, "/items/list/"+id, "", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `"v1-1"`, rec.Header().Get("ETag"))
+
+	rec = do(http.MethodGet, "/items/list/"+id, "", map[string]string{"If-None-Match": `"v1-1"`})
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	assert.Empty(t, rec.Body.String())
+
+	rec = do(http.MethodGet, "/items/list/"+id, "", map[string]string{"If-None-Match": `W/"v1-1"`})
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+
+	// first tool writes with the version it read
+	rec = do(http.MethodPut, "/items/update/"+id, `{"title":"HDMI cable","price":15}`, map[string]string{"If-Match": `"1"`})
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// second tool read the same version, too late now
+	rec = do(http.MethodPut, "/items/update/"+id, `{"title":"HDMI cable","price":20}`, map[string]string{"If-Match": `"1"`})
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+
+	var p problem.Details
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&p))
+	assert.Equal(t, problem.TypePrecondition, p.Type)
+
+	rec = do(http.MethodGet, "/items/list/"+id, "", map[string]string{"If-None-Match": `"v1-1"`})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `"v1-2"`, rec.Header().Get("ETag"))
+
+	rec = do(http.MethodPatch, "/items/"+id, `{"price":18}`, map[string]string{
+		"Content-Type": "application/merge-patch+json",
+		"If-Match":     `"1", "v1-2"`,
+	})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `"v1-3"`, rec.Header().Get("ETag"))
+
+	rec = do(http.MethodPatch, "/items/"+id, `{"version":10}`, map[string]string{"Content-Type": "application/merge-patch+json"})
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	for _, tag := range []string{`"2"`, `W/"3"`, `nonsense`} {
+		rec = do(http.MethodDelete, "/items/delete/"+id, "", map[string]string{"If-Match": tag})
+		assert.Equal(t, http.StatusPreconditionFailed, rec.Code, tag)
+	}
+
+	rec = do(http.MethodPut, "/items/update/"+id, `{"title":"HDMI cable","price":19}`, map[string]string{"If-Match": `*`})
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = do(http.MethodDelete, "/items/delete/"+id, "", map[string]string{"If-Match": `"4"`})
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// * is any version of something, with nothing there it's a 412 and
+	// not a 404
+	rec = do(http.MethodPut, "/items/update/"+id, `{"title":"HDMI cable","price":19}`, map[string]string{"If-Match": `*`})
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+	rec = do(http.MethodPatch, "/items/"+id, `{"price":18}`, map[string]string{"Content-Type": "application/merge-patch+json", "If-Match": `*`})
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+	rec = do(http.MethodDelete, "/items/delete/"+id, "", map[string]string{"If-Match": `*`})
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+	rec = do(http.MethodDelete, "/items/delete/"+id, "", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestRESTRoutes(t *testing.T) {
+	app := NewApp(db.NewMemoryStore())
+	app.opts.AccessLog = false
+	app.opts.CheckResponses = offSpec(t)
+	router := CreateRouter(app)
+
+	do := func(method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodPost, "/items", `{"title":"USB hub","price":20}`, nil)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, `"v1-1"`, rec.Header().Get("ETag"))
+	assert.Empty(t, rec.Header().Get("Deprecation"))
+
+	var created model.Item
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&created))
+	assert.Equal(t, "USB hub", created.Title)
+	assert.Equal(t, int64(1), created.Version)
+	location := rec.Header().Get("Location")
+	assert.Equal(t, "/items/"+created.ID.Hex(), location)
+
+	rec = do(http.MethodPost, "/items", `[{"title":"HDMI cable","price":12},{"title":"Mouse","price":25}]`, nil)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	var many db.InsertManyResult
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&many))
+	assert.Len(t, many.InsertedIDs, 2)
+
+	rec = do(http.MethodPost, "/items", `[{"title":"","price":1}]`, nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	rec = do(http.MethodGet, "/items", "", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "3", rec.Header().Get("X-Total-Count"))
+
+	rec = do(http.MethodGet, "/items/search?q=hub", "", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = do(http.MethodGet, location, "", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `"v1-1"`, rec.Header().Get("ETag"))
+
+	rec = do(http.MethodPut, location, `{"title":"USB hub","price":22}`, map[string]string{"If-Match": `"1"`})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `"v1-2"`, rec.Header().Get("ETag"))
+	var replaced model.Item
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&replaced))
+	assert.Equal(t, 22.0, replaced.Price)
+	assert.Equal(t, created.ID, replaced.ID)
+
+	rec = do(http.MethodPut, location, `{"title":"USB hub","price":23}`, map[string]string{"If-Match": `"1"`})
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+	rec = do(http.MethodPut, location, `{"ID":"64b7f0c2a1b2c3d4e5f60718","title":"USB hub","price":23}`, nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	rec = do(http.MethodPatch, location, `{"price":21}`, map[string]string{"Content-Type": "application/merge-patch+json"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = do(http.MethodDelete, location, "", nil)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Empty(t, rec.Body.String())
+
+	missing := primitive.NewObjectID().Hex()
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		rec = do(method, "/items/"+missing, "", nil)
+		assert.Equal(t, http.StatusNotFound, rec.Code, method)
+	}
+	rec = do(http.MethodPut, "/items/"+missing, `{"title":"x","price":1}`, nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = do(http.MethodGet, location, "", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestDeprecatedRoutes(t *testing.T) {
+	app := NewApp(db.NewMemoryStore())
+	app.opts.AccessLog = false
+	app.opts.CheckResponses = offSpec(t)
+	router := CreateRouter(app)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// old clients keep getting the old status codes and bodies
+	rec := do(http.MethodPost, "/items/create/one", `{"title":"USB hub","price":20}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "@1792368000", rec.Header().Get("Deprecation"))
+	assert.Equal(t, "Thu, 01 Apr 2027 00:00:00 GMT", rec.Header().Get("Sunset"))
+	assert.Equal(t, `</items>; rel="successor-version"`, rec.Header().Get("Link"))
+
+	var res db.InsertOneResult
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+
+	rec = do(http.MethodGet, "/items/list/"+res.InsertedID, "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `</items/`+res.InsertedID+`>; rel="successor-version"`, rec.Header().Get("Link"))
+
+	// paging links sit next to the successor one
+	rec = do(http.MethodGet, "/items/list?limit=1", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Values("Link"), `</items>; rel="successor-version"`)
+
+	rec = do(http.MethodDelete, "/items/delete/"+res.InsertedID, "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotEmpty(t, rec.Header().Get("Deprecation"))
+}
+
+func TestVersions(t *testing.T) {
+	app := NewApp(db.NewMemoryStore())
+	app.opts.AccessLog = false
+	app.opts.CheckResponses = offSpec(t)
+	router := CreateRouter(app)
+
+	do := func(method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodPost, "/v2/items", `{"title":"USB hub","price_cents":1999}`, nil)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	var v2 map[string]interface{}
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&v2))
+	id := v2["id"].(string)
+	assert.Equal(t, 1999.0, v2["price_cents"])
+	assert.Equal(t, "/v2/items/"+id, rec.Header().Get("Location"))
+
+	// same item, the way v1 and the unversioned routes have always had it
+	for _, path := range []string{"/v1/items/" + id, "/items/" + id} {
+		rec = do(http.MethodGet, path, "", nil)
+		assert.Equal(t, http.StatusOK, rec.Code, path)
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"), path)
+		assert.JSONEq(t, `{"ID":"`+id+`","title":"USB hub","price":19.99,"version":1}`, rec.Body.String(), path)
+	}
+
+	rec = do(http.MethodGet, "/items/"+id, "", map[string]string{"Accept": "application/vnd.items.v2+json"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/vnd.items.v2+json", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "Accept", rec.Header().Get("Vary"))
+	assert.JSONEq(t, `{"id":"`+id+`","title":"USB hub","price_cents":1999,"version":1}`, rec.Body.String())
+
+	assert.Equal(t, `"v2-1"`, rec.Header().Get("ETag"))
+
+	// a cached v1 body isn't the v2 one, even for the same version of the
+	// item
+	rec = do(http.MethodGet, "/items/"+id, "", map[string]string{"Accept": "application/vnd.items.v2+json", "If-None-Match": `"v1-1"`})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = do(http.MethodGet, "/items/"+id, "", map[string]string{"Accept": "application/vnd.items.v2+json", "If-None-Match": `"v2-1"`})
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	rec = do(http.MethodGet, "/v1/items/"+id, "", map[string]string{"If-None-Match": `"v2-1"`})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `"v1-1"`, rec.Header().Get("ETag"))
+
+	rec = do(http.MethodGet, "/items/"+id, "", map[string]string{"Accept": "application/vnd.items.v9+json"})
+	assert.Equal(t, http.StatusNotAcceptable, rec.Code)
+	rec = do(http.MethodGet, "/items/"+id, "", map[string]string{"Accept": "application/vnd.items.v9+json, application/json"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// lists, patches and validation errors all speak v2 too
+	rec = do(http.MethodGet, "/v2/items", "", nil)
+	assert.JSONEq(t, `[{"id":"`+id+`","title":"USB hub","price_cents":1999,"version":1}]`, rec.Body.String())
+
+	rec = do(http.MethodPatch, "/v2/items/"+id, `{"price_cents":2099}`, map[string]string{"Content-Type": "application/merge-patch+json"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"id":"`+id+`","title":"USB hub","price_cents":2099,"version":2}`, rec.Body.String())
+
+	rec = do(http.MethodPost, "/v2/items", `[{"title":"ok","price_cents":1},{"title":"x","price_cents":-1}]`, nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	var p problem.Details
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&p))
+	assert.Equal(t, []problem.FieldError{{Field: "[1].price_cents", Pointer: "/1/price_cents", Message: "must be at least 0"}}, p.Errors)
+
+	rec = do(http.MethodPost, "/v2/items", `{"title":"x","price":1}`, nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = do(http.MethodPost, "/v2/items", `{"id":"nope","title":"x","price_cents":1}`, nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	// for writing, a tag from either representation will do
+	rec = do(http.MethodPut, "/v1/items/"+id, `{"title":"USB hub","price":19.99}`, map[string]string{"If-Match": `"x-2"`})
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+	rec = do(http.MethodPut, "/v1/items/"+id, `{"title":"USB hub","price":19.99}`, map[string]string{"If-Match": `"v2-2"`})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `"v1-3"`, rec.Header().Get("ETag"))
+	rec = do(http.MethodPut, "/v2/items/"+id, `{"title":"USB hub","price_cents":1999}`, map[string]string{"If-Match": `"v1-3"`})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `"v2-4"`, rec.Header().Get("ETag"))
+}
+
+func TestAccepted(t *testing.T) {
+	app := NewApp(db.NewMemoryStore())
+
+	tests := []struct {
+		accept  string
+		version string
+		named   bool
+		err     bool
+	}{
+		{"", "v1", false, false},
+		{"application/json", "v1", false, false},
+		{"*/*", "v1", false, false},
+		{"application/vnd.items.v2+json", "v2", true, false},
+		{"application/json, application/vnd.items.v2+json", "v2", true, false},
+		{"application/vnd.items.v2+json;q=0, application/json", "v1", false, false},
+		{"application/vnd.items.v2+json; q=0.5, application/json", "v1", false, false},
+		{"application/vnd.items.v2+json;q=0.5, application/json;q=0.5", "v2", true, false},
+		{"application/vnd.items.v1+json;q=0.2, application/vnd.items.v2+json;q=0.8", "v2", true, false},
+		{"application/vnd.items.v2+json;q=0.8, application/vnd.items.v1+json", "v1", true, false},
+		{"application/vnd.items.v2+json;q=nope, application/json", "v1", false, false},
+		{"application/vnd.items.v9+json, application/json", "v1", false, false},
+		{"application/vnd.items.v9+json", "", false, true},
+		{"application/vnd.items.v2+json;q=0", "", false, true},
+		{"application/json;q=0", "", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			v, named, err := app.accepted(tt.accept)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.version, v.Name)
+			assert.Equal(t, tt.named, named)
+		})
+	}
+}
+
+func TestDeprecatedVersion(t *testing.T) {
+	app := NewApp(db.NewMemoryStore())
+	app.opts.AccessLog = false
+	app.versions[0].Deprecated = time.Date(2026, time.November, 1, 0, 0, 0, 0, time.UTC)
+	app.versions[0].Sunset = time.Date(2027, time.June, 1, 0, 0, 0, 0, time.UTC)
+	router := CreateRouter(app)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	rec := get("/v1/items")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "@1793491200", rec.Header().Get("Deprecation"))
+	assert.Equal(t, "Tue, 01 Jun 2027 00:00:00 GMT", rec.Header().Get("Sunset"))
+	assert.Equal(t, `</v2/items>; rel="successor-version"`, rec.Header().Get("Link"))
+
+	// the unversioned routes default to v1, so they're going too
+	assert.NotEmpty(t, get("/items").Header().Get("Deprecation"))
+	assert.Empty(t, get("/v2/items").Header().Get("Deprecation"))
+}
+
+// TestOpenAPICoversRoutes fails when a route has no operation in the spec,
+// or the spec documents a route that isn't there anymore.
+func TestOpenAPICoversRoutes(t *testing.T) {
+	app := NewApp(db.NewMemoryStore())
+	_, err := app.openAPI(CreateRouter(app))
+	assert.NoError(t, err)
+
+	// the auth responses are documented too
+	app.opts.Auth = true
+	doc, err := app.openAPI(CreateRouter(app))
+	assert.NoError(t, err)
+	assert.Contains(t, doc.Paths["/items/{id}"]["get"].Responses, "401")
+	assert.Contains(t, doc.Paths["/admin/keys"]["post"].Responses, "403")
+	assert.Empty(t, doc.Paths["/healthz"]["get"].Security)
+
+	// so is the tenant header, on the item routes only
+	app.opts.Tenancy = true
+	app.opts.TenantHeader = "X-Tenant"
+	doc, err = app.openAPI(CreateRouter(app))
+	assert.NoError(t, err)
+	var params []string
+	for _, p := range doc.Paths["/v2/items"]["post"].Parameters {
+		params = append(params, p.Name)
+	}
+	assert.Contains(t, params, "X-Tenant")
+	assert.Contains(t, doc.Paths["/v2/items"]["post"].Responses["403"].Description, "out of items")
+	assert.Empty(t, doc.Paths["/admin/keys"]["get"].Parameters)
+
+	// and the 429, with what a route costs
+	app.opts.RateLimit = ratelimit.Limit{Rate: 1, Burst: 20}
+	doc, err = app.openAPI(CreateRouter(app))
+	assert.NoError(t, err)
+	assert.Contains(t, doc.Paths["/v1/items/search"]["get"].Responses["429"].Headers, "Retry-After")
+	assert.Contains(t, doc.Paths["/items/create/many"]["post"].Description, "Costs 10 requests.")
+	assert.Contains(t, doc.Paths["/items"]["post"].Description, "or 10 for an array")
+	assert.NotContains(t, doc.Paths["/healthz"]["get"].Responses, "429")
+
+	// and it does notice
+	r := CreateRouter(app)
+	r.HandleFunc("/items/secret", func(http.ResponseWriter, *http.Request) {}).Methods(http.MethodPost)
+	_, err = app.openAPI(r)
+	assert.ErrorContains(t, err, "POST /items/secret")
+}
+
+func TestOpenAPIDocs(t *testing.T) {
+	app := NewApp(db.NewMemoryStore())
+	app.opts.AccessLog = false
+	router := CreateRouter(app)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	rec := get("/openapi.json")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var doc openapi.Document
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&doc))
+	assert.Equal(t, "3.1.0", doc.OpenAPI)
+	assert.Contains(t, doc.Paths, "/items/{id}")
+	assert.Contains(t, doc.Paths, "/v2/items/{id}")
+	assert.True(t, doc.Paths["/items/create/one"]["post"].Deprecated)
+	assert.Equal(t, []string{"title", "price_cents"}, doc.Components.Schemas["ItemV2"].Required)
+
+	// v2 is in the unversioned routes too, for whoever asks with Accept
+	get200 := doc.Paths["/items/{id}"]["get"].Responses["200"]
+	assert.Equal(t, "#/components/schemas/ItemV2", get200.Content["application/vnd.items.v2+json"].Schema.Ref)
+
+	rec = get("/docs")
+	assert.Equal(t, http.StatusMovedPermanently, rec.Code)
+	assert.Equal(t, "/docs/", rec.Header().Get("Location"))
+
+	rec = get("/docs/")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/html; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Body.String(), `url: "../openapi.json"`)
+
+	rec = get("/docs/swagger-ui-bundle.js")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "javascript")
+
+	assert.Equal(t, http.StatusNotFound, get("/docs/nope.js").Code)
+}
+
+// offSpec fails the test for every response that doesn't match the spec.
+func offSpec(t *testing.T) func(*http.Request, error) {
+	return func(r *http.Request, err error) {
+		t.Errorf("%s %s: %v", r.Method, r.URL, err)
+	}
+}
+
+func TestRequestValidation(t *testing.T) {
+	app := NewApp(db.NewMemoryStore())
+	app.opts.AccessLog = false
+	app.opts.CheckResponses = offSpec(t)
+	router := CreateRouter(app)
+
+	res, err := app.store.InsertOneItem(context.Background(), &model.Item{Title: "USB hub", Price: 20})
+	assert.NoError(t, err)
+	id := res.InsertedID
+
+	do := func(method, path, contentType, body string) (int, problem.Details) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		var p problem.Details
+		if rec.Header().Get("Content-Type") == problem.ContentType {
+			assert.NoError(t, json.NewDecoder(rec.Body).Decode(&p))
+		}
+		return rec.Code, p
+	}
+	pointers := func(p problem.Details) []string {
+		var out []string
+		for _, e := range p.Errors {
+			out = append(out, e.Pointer)
+		}
+		return out
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+		status      int
+		pointers    []string
+	}{
+		{"wrong types", http.MethodPost, "/items", "application/json", `{"title":7,"price":"cheap"}`, http.StatusUnprocessableEntity, []string{"/price", "/title"}},
+		{"missing field", http.MethodPost, "/items", "application/json", `{"title":"x"}`, http.StatusUnprocessableEntity, []string{"/price"}},
+		{"bulk", http.MethodPost, "/items", "application/json", `[{"title":"ok","price":1},{"price":1}]`, http.StatusUnprocessableEntity, []string{"/1/title"}},
+		{"empty bulk", http.MethodPost, "/v2/items", "application/json", `[]`, http.StatusUnprocessableEntity, []string{""}},
+		{"unknown field", http.MethodPost, "/items", "application/json", `{"title":"x","price":1,"colour":"red"}`, http.StatusBadRequest, []string{"/colour"}},
+		{"not json", http.MethodPost, "/items", "application/json", `{`, http.StatusBadRequest, nil},
+		{"no body", http.MethodPut, "/items/" + id, "application/json", ``, http.StatusBadRequest, nil},
+		{"merge patch", http.MethodPatch, "/items/" + id, "application/merge-patch+json", `{"price":"x"}`, http.StatusUnprocessableEntity, []string{"/price"}},
+		{"json patch", http.MethodPatch, "/items/" + id, "application/json-patch+json", `[{"op":"nope","path":"/price"}]`, http.StatusUnprocessableEntity, []string{"/0/op"}},
+		{"v2 field names", http.MethodPut, "/v2/items/" + id, "application/json", `{"title":"x","price":1}`, http.StatusBadRequest, []string{"/price_cents", "/price"}},
+		{"legacy", http.MethodPut, "/items/update/" + id, "application/json", `{"title":"  "}`, http.StatusUnprocessableEntity, []string{"/price", "/title"}},
+		{"valid", http.MethodPut, "/items/" + id, "application/json", `{"title":"USB hub","price":21}`, http.StatusOK, nil},
+	}
+
+	for _, tt := range tests {
+		status, p := do(tt.method, tt.path, tt.contentType, tt.body)
+		assert.Equal(t, tt.status, status, tt.name)
+		assert.Equal(t, tt.pointers, pointers(p), tt.name)
+	}
+
+	// unversioned routes take the body in the version Accept asks for
+	req := httptest.NewRequest(http.MethodPost, "/items", strings.NewReader(`{"title":"x","price_cents":100}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/vnd.items.v2+json")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+}
+
+// offSpecStore hands out items the spec says can't exist
+type offSpecStore struct {
+	*db.MemoryStore
+}
+
+func (s offSpecStore) ListOneItem(ctx context.Context, id string) (model.Item, error) {
+	return model.Item{Title: "", Price: -1}, nil
+}
+
+func TestCheckResponses(t *testing.T) {
+	app := NewApp(offSpecStore{db.NewMemoryStore()})
+	app.opts.AccessLog = false
+
+	var errs []error
+	app.opts.CheckResponses = func(r *http.Request, err error) { errs = append(errs, err) }
+	router := CreateRouter(app)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/items/64b7f0c2a1b2c3d4e5f60718", nil))
+
+	// the client still gets the response, the check only reports
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"price_cents":-100`)
+
+	if assert.Len(t, errs, 1) {
+		assert.ErrorContains(t, errs[0], "/price_cents")
+		assert.ErrorContains(t, errs[0], "/title")
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	const bootstrap = "bootstrap-key-that-is-long-enough-for-config"
+
+	app := NewApp(db.NewMemoryStore())
+	app.opts.AccessLog = false
+	app.opts.Auth = true
+	app.opts.CheckResponses = offSpec(t)
+	app.keys = auth.NewAPIKeys(db.NewMemoryKeyStore(), bootstrap)
+	router := CreateRouter(app)
+
+	do := func(method, path, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set(auth.KeyHeader, key)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// nothing gets in without a key, ops routes stay open
+	rec := do(http.MethodGet, "/items", "", "")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Header().Get("WWW-Authenticate"), auth.KeyHeader)
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/items/list", "", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/admin/keys", "", "").Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/healthz", "", "").Code)
+
+	// the bootstrap key makes the first real one
+	rec = do(http.MethodPost, "/admin/keys", bootstrap, `{"name":"shop frontend","scopes":["items:read"]}`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+
+	var created struct {
+		model.APIKey
+		Key string `json:"key"`
+	}
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&created))
+	assert.True(t, strings.HasPrefix(created.Key, "itk_"+created.Prefix+"_"))
+	assert.Equal(t, "/admin/keys/"+created.ID.Hex(), rec.Header().Get("Location"))
+
+	// it's stored hashed, and the hash never goes out
+	stored, err := app.keys.Store().GetKey(context.Background(), created.ID.Hex())
+	assert.NoError(t, err)
+	assert.Equal(t, auth.Hash(created.Key), stored.Hash)
+	assert.NotContains(t, stored.Hash, created.Key)
+
+	rec = do(http.MethodGet, "/admin/keys/"+created.ID.Hex(), bootstrap, "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), created.Key)
+	assert.NotContains(t, rec.Body.String(), stored.Hash)
+
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/items", created.Key, "").Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/v2/items", created.Key, "").Code)
+
+	// a key without admin can't manage keys, a wrong key gets nowhere
+	rec = do(http.MethodGet, "/admin/keys", created.Key, "")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Contains(t, rec.Body.String(), auth.ScopeAdmin)
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/items", created.Key[:len(created.Key)-1]+"x", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/healthz", "nope", "").Code)
+
+	rec = do(http.MethodGet, "/admin/keys", bootstrap, "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var keys []model.APIKey
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&keys))
+	if assert.Len(t, keys, 1) {
+		assert.Equal(t, "shop frontend", keys[0].Name)
+		assert.NotNil(t, keys[0].LastUsedAt)
+	}
+
+	for _, body := range []string{
+		`{"name":"","scopes":["items:read"]}`,
+		`{"name":"x","scopes":[]}`,
+		`{"name":"x","scopes":["Items Read"]}`,
+		`{"name":"x","scopes":["admin"],"expires_at":"2001-01-01T00:00:00Z"}`,
+	} {
+		assert.Equal(t, http.StatusUnprocessableEntity, do(http.MethodPost, "/admin/keys", bootstrap, body).Code, body)
+	}
+
+	// revoked keys stop working straight away
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/admin/keys/"+created.ID.Hex(), bootstrap, "").Code)
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/admin/keys/"+created.ID.Hex(), bootstrap, "").Code)
+	rec = do(http.MethodGet, "/items", created.Key, "")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Body.String(), "revoked")
+
+	assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/admin/keys/"+primitive.NewObjectID().Hex(), bootstrap, "").Code)
+
+	// with auth off there's nobody to keep out of /admin, so it isn't there
+	app.opts.Auth = false
+	router = CreateRouter(app)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodPost, "/admin/keys", "", `{"name":"x","scopes":["admin"]}`).Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/admin/keys", "", "").Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/items", "", "").Code)
+	_, err = app.openAPI(router)
+	assert.NoError(t, err)
+}
+
+func TestBearerTokens(t *testing.T) {
+	secret := "0123456789abcdef0123456789abcdef"
+
+	app := NewApp(db.NewMemoryStore())
+	app.opts.AccessLog = false
+	app.opts.Auth = true
+	app.opts.CheckResponses = offSpec(t)
+	jwt, err := jwtFrom(context.Background(), config.JWTConfig{
+		Issuer: "https://issuer.example.com", Audience: "items", HMACSecret: secret, ClockSkew: time.Second,
+	}, "tenant")
+	assert.NoError(t, err)
+	app.jwt = jwt
+	router := CreateRouter(app)
+
+	token := func(exp time.Time) string {
+		tok := jwtlib.NewWithClaims(jwtlib.SigningMethodHS256, jwtlib.MapClaims{
+			"iss": "https://issuer.example.com", "aud": "items", "sub": "svc-orders", "exp": exp.Unix(),
+			"scope": "items:read",
+		})
+		s, err := tok.SignedString([]byte(secret))
+		assert.NoError(t, err)
+		return s
+	}
+	get := func(authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/items", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusOK, get("Bearer "+token(time.Now().Add(time.Hour))).Code)
+
+	rec := get("Bearer " + token(time.Now().Add(-time.Hour)))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Body.String(), "expired")
+
+	rec = get("")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Header().Values("WWW-Authenticate"), `Bearer realm="items"`)
+
+	doc, err := app.openAPI(router)
+	assert.NoError(t, err)
+	assert.Contains(t, doc.Components.SecuritySchemes, "bearer")
+	assert.Len(t, doc.Paths["/items"]["get"].Security, 2)
+}
+
+func TestAuthorization(t *testing.T) {
+	app := NewApp(db.NewMemoryStore())
+	app.opts.AccessLog = false
+	app.opts.Auth = true
+	app.opts.CheckResponses = offSpec(t)
+	router := CreateRouter(app)
+
+	ctx := context.Background()
+	key := func(scopes ...string) string {
+		plain, _, err := app.keys.Create(ctx, model.APIKey{Name: "test", Scopes: scopes})
+		assert.NoError(t, err)
+		return plain
+	}
+	reader, writer, admin := key(auth.ScopeItemsRead), key(auth.ScopeItemsRead, auth.ScopeItemsWrite), key(auth.ScopeAdmin)
+
+	res, err := app.store.InsertOneItem(ctx, &model.Item{Title: "USB hub", Price: 20})
+	assert.NoError(t, err)
+	item := "/items/" + res.InsertedID
+
+	do := func(method, path, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(auth.KeyHeader, key)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		method, path, key, body string
+		status                  int
+	}{
+		{http.MethodGet, item, reader, "", http.StatusOK},
+		{http.MethodGet, "/v2/items/search?q=hub", reader, "", http.StatusOK},
+		{http.MethodGet, "/items/list", reader, "", http.StatusOK},
+		{http.MethodPost, "/items", reader, `{"title":"x","price":1}`, http.StatusForbidden},
+		{http.MethodPost, "/items/create/one", reader, `{"title":"x","price":1}`, http.StatusForbidden},
+		{http.MethodPost, "/items", writer, `{"title":"x","price":1}`, http.StatusCreated},
+		{http.MethodPatch, "/v1" + item, reader, `{"price":2}`, http.StatusForbidden},
+		{http.MethodDelete, item, writer, "", http.StatusForbidden},
+		{http.MethodGet, "/admin/keys", writer, "", http.StatusForbidden},
+		{http.MethodGet, "/admin/keys", admin, "", http.StatusOK},
+		// admin comes with everything else
+		{http.MethodDelete, item, admin, "", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		rec := do(tt.method, tt.path, tt.key, tt.body)
+		assert.Equal(t, tt.status, rec.Code, tt.method+" "+tt.path)
+	}
+
+	// the problem says what's missing
+	rec := do(http.MethodDelete, "/v2/items/"+primitive.NewObjectID().Hex(), writer, "")
+	var p problem.Details
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&p))
+	assert.Equal(t, problem.TypeForbidden, p.Type)
+	assert.Equal(t, []string{auth.ScopeItemsDelete}, p.MissingScopes)
+
+	// keys only get scopes that exist
+	assert.Equal(t, http.StatusUnprocessableEntity, do(http.MethodPost, "/admin/keys", admin, `{"name":"x","scopes":["items:everything"]}`).Code)
+}
+
+// TestPermissionsCoverRoutes fails when a route behind auth has nothing in
+// permissions, or permissions has a route that isn't there anymore.
+func TestPermissionsCoverRoutes(t *testing.T) {
+	app := NewApp(db.NewMemoryStore())
+	app.opts.Auth = true
+	r := CreateRouter(app)
+
+	used := map[string]bool{}
+	err := r.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil || route.GetHandler() == nil {
+			return nil
+		}
+		path := specPath(tpl)
+		methods, _ := route.GetMethods()
+
+		open := !strings.Contains(path, "/items") && !strings.HasPrefix(path, "/admin")
+		for _, m := range methods {
+			if open {
+				_, ok := app.permissionFor(m, path)
+				assert.False(t, ok, "%s %s is open but has a permission", m, path)
+				continue
+			}
+			_, ok := app.permissionFor(m, path)
+			assert.True(t, ok, "%s %s has no permission", m, path)
+			used[m+" "+path] = true
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	for key := range permissions {
+		assert.True(t, used[key], "%s has no route", key)
+	}
+}
+
+func TestTenancy(t *testing.T) {
+	app := NewApp(db.NewQuotaStore(db.NewMemoryStore(), func(id string) int64 {
+		if id == "acme" {
+			return 2
+		}
+		return 0
+	}, db.NewMemoryQuotaCounter()))
+	app.opts.AccessLog = false
+	app.opts.Tenancy = true
+	app.opts.TenantHeader = "X-Tenant"
+	app.opts.TenantDomain = "items.example.com"
+	app.opts.CheckResponses = offSpec(t)
+	router := CreateRouter(app)
+
+	do := func(method, path, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		for k := 0; k+1 < len(header); k += 2 {
+			if header[k] == "Host" {
+				req.Host = header[k+1]
+				continue
+			}
+			req.Header.Set(header[k], header[k+1])
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	problemType := func(rec *httptest.ResponseRecorder) problem.Type {
+		var p problem.Details
+		assert.NoError(t, json.NewDecoder(rec.Body).Decode(&p))
+		return p.Type
+	}
+
+	rec := do(http.MethodPost, "/items", `{"title":"Anvil","price":20}`, "X-Tenant", "acme")
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	anvil := rec.Header().Get("Location")
+	assert.Equal(t, http.StatusCreated, do(http.MethodPost, "/v2/items", `{"title":"Rocket","price_cents":100}`, "X-Tenant", "globex").Code)
+
+	// each tenant sees its own, the header and the subdomain are the same
+	// thing
+	assert.Equal(t, "1", do(http.MethodGet, "/items", "", "X-Tenant", "acme").Header().Get("X-Total-Count"))
+	assert.Equal(t, "1", do(http.MethodGet, "/items", "", "Host", "acme.items.example.com:8000").Header().Get("X-Total-Count"))
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, anvil, "", "X-Tenant", "acme").Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, anvil, "", "X-Tenant", "globex").Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, anvil, "", "Host", "globex.items.example.com").Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodPut, "/items/update/"+path.Base(anvil), `{"title":"Mine","price":1}`, "X-Tenant", "globex").Code)
+	rec = do(http.MethodGet, "/items/search?q=anvil", "", "X-Tenant", "globex")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "0", rec.Header().Get("X-Total-Count"))
+
+	// no tenant, or one that can't be
+	for _, header := range [][]string{nil, {"X-Tenant", "Acme Corp"}, {"Host", "items.example.com"}, {"Host", "a.b.items.example.com"}} {
+		rec := do(http.MethodGet, "/items", "", header...)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, header)
+	}
+	// the rest of the api doesn't care
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/healthz", "").Code)
+
+	// acme can have two items
+	rec = do(http.MethodPost, "/items", `[{"title":"Skates","price":5},{"title":"Glue","price":1}]`, "X-Tenant", "acme")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Equal(t, problem.TypeQuotaExceeded, problemType(rec))
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/items/create/one", `{"title":"Skates","price":5}`, "X-Tenant", "acme").Code)
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPost, "/items", `{"title":"Glue","price":1}`, "X-Tenant", "acme").Code)
+	assert.Equal(t, http.StatusCreated, do(http.MethodPost, "/items", `{"title":"Glue","price":1}`, "X-Tenant", "globex").Code)
+
+	// with auth, keys tied to a tenant only ever get that one
+	app.opts.Auth = true
+	router = CreateRouter(app)
+	ctx := context.Background()
+	tied, _, err := app.keys.Create(ctx, model.APIKey{Name: "acme", Scopes: []string{auth.ScopeItemsRead}, Tenant: "acme"})
+	assert.NoError(t, err)
+	loose, _, err := app.keys.Create(ctx, model.APIKey{Name: "loose", Scopes: []string{auth.ScopeItemsRead}})
+	assert.NoError(t, err)
+	admin, _, err := app.keys.Create(ctx, model.APIKey{Name: "admin", Scopes: []string{auth.ScopeAdmin}})
+	assert.NoError(t, err)
+
+	rec = do(http.MethodGet, "/items", "", auth.KeyHeader, tied)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "2", rec.Header().Get("X-Total-Count"))
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/items", "", auth.KeyHeader, tied, "X-Tenant", "acme").Code)
+	rec = do(http.MethodGet, "/items", "", auth.KeyHeader, tied, "X-Tenant", "globex")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Equal(t, problem.TypeForbidden, problemType(rec))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodGet, "/items", "", auth.KeyHeader, tied, "Host", "globex.items.example.com").Code)
+
+	assert.Equal(t, http.StatusForbidden, do(http.MethodGet, "/items", "", auth.KeyHeader, loose, "X-Tenant", "globex").Code)
+	rec = do(http.MethodGet, "/items", "", auth.KeyHeader, admin, "X-Tenant", "globex")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "2", rec.Header().Get("X-Total-Count"))
+
+	// keys get made for tenants that could exist
+	rec = do(http.MethodPost, "/admin/keys", `{"name":"x","scopes":["items:read"],"tenant":"Not A Tenant"}`, auth.KeyHeader, admin)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	rec = do(http.MethodPost, "/admin/keys", `{"name":"x","scopes":["items:read"],"tenant":"initech"}`, auth.KeyHeader, admin)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	var created createdKey
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&created))
+	assert.Equal(t, "initech", created.Tenant)
+}
+
+// brokenLimiter is a limiter whose backend is down.
+type brokenLimiter struct{}
+
+func (brokenLimiter) Take(context.Context, string, int, ratelimit.Limit) (ratelimit.Result, error) {
+	return ratelimit.Result{}, errors.New("connection refused")
+}
+
+func TestRateLimit(t *testing.T) {
+	app := NewApp(db.NewMemoryStore())
+	app.opts.AccessLog = false
+	app.opts.Logger = nil
+	// slow enough that nothing comes back while the test runs
+	app.opts.RateLimit = ratelimit.Limit{Rate: 0.01, Burst: 12}
+	app.opts.CheckResponses = offSpec(t)
+	router := CreateRouter(app)
+
+	do := func(method, path, body, addr string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = addr
+		for k := 0; k+1 < len(header); k += 2 {
+			req.Header.Set(header[k], header[k+1])
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodGet, "/items", "", "10.0.0.1:4000")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "12", rec.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "11", rec.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "100", rec.Header().Get("RateLimit-Reset"))
+	assert.Equal(t, "12;w=1200", rec.Header().Get("RateLimit-Policy"))
+
+	// an array costs more than one item, and the body still gets through
+	rec = do(http.MethodPost, "/items", `[{"title":"Skates","price":5},{"title":"Glue","price":1}]`, "10.0.0.1:4000")
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("RateLimit-Remaining"))
+	rec = do(http.MethodPost, "/items", `{"title":"Anvil","price":20}`, "10.0.0.1:4001")
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, "0", rec.Header().Get("RateLimit-Remaining"))
+
+	rec = do(http.MethodGet, "/v2/items", "", "10.0.0.1:4002")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "100", rec.Header().Get("Retry-After"))
+	assert.Equal(t, "0", rec.Header().Get("RateLimit-Remaining"))
+	var p problem.Details
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&p))
+	assert.Equal(t, problem.TypeRateLimited, p.Type)
+	assert.Equal(t, http.StatusTooManyRequests, p.Status)
+
+	// the rest of the api doesn't count, and the next ip has its own
+	rec = do(http.MethodGet, "/healthz", "", "10.0.0.1:4000")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get("RateLimit-Limit"))
+	rec = do(http.MethodPost, "/items/create/many", `[{"title":"Rocket","price":100}]`, "10.0.0.2:4000")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "2", rec.Header().Get("RateLimit-Remaining"))
+	rec = do(http.MethodGet, "/items/search?q=rocket", "", "10.0.0.2:4000")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "0", rec.Header().Get("RateLimit-Remaining"))
+
+	// with credentials it's per key, wherever they come from
+	ctx := context.Background()
+	app.opts.Auth = true
+	var keys []string
+	for _, name := range []string{"a", "b"} {
+		key, _, err := app.keys.Create(ctx, model.APIKey{Name: name, Scopes: []string{auth.ScopeItemsRead}})
+		assert.NoError(t, err)
+		keys = append(keys, key)
+	}
+	assert.Equal(t, "11", do(http.MethodGet, "/items", "", "10.0.0.1:4000", auth.KeyHeader, keys[0]).Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "10", do(http.MethodGet, "/items", "", "10.0.0.3:4000", auth.KeyHeader, keys[0]).Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "11", do(http.MethodGet, "/items", "", "10.0.0.1:4000", auth.KeyHeader, keys[1]).Header().Get("RateLimit-Remaining"))
+
+	// unless it's told to go by ip
+	app.opts.RateLimitBy = "ip"
+	assert.Equal(t, "11", do(http.MethodGet, "/items", "", "10.0.0.5:4000", auth.KeyHeader, keys[0]).Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "10", do(http.MethodGet, "/items", "", "10.0.0.5:4000", auth.KeyHeader, keys[1]).Header().Get("RateLimit-Remaining"))
+
+	// turning a request away for its credentials still costs its ip,
+	// missing ones and wrong ones alike. The spec has the 401s once
+	// there's a router with auth on.
+	app.opts.RateLimitBy = ""
+	router = CreateRouter(app)
+	for addr, header := range map[string][]string{"10.0.0.6:4000": nil, "10.0.0.7:4000": {auth.KeyHeader, "guess"}} {
+		for n := 0; n < 12; n++ {
+			rec = do(http.MethodGet, "/items", "", addr, header...)
+			assert.Equal(t, http.StatusUnauthorized, rec.Code, addr)
+		}
+		rec = do(http.MethodGet, "/items", "", addr, header...)
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code, addr)
+		assert.Equal(t, "100", rec.Header().Get("Retry-After"), addr)
+	}
+	// and a key that checks out still has its own bucket
+	assert.Equal(t, "10", do(http.MethodGet, "/items", "", "10.0.0.6:4000", auth.KeyHeader, keys[1]).Header().Get("RateLimit-Remaining"))
+
+	// a cost over the burst empties a full bucket rather than never
+	// getting through
+	app.opts.Auth = false
+	app.opts.RateLimit.Burst = 5
+	rec = do(http.MethodPost, "/items/create/many", `[{"title":"Rocket","price":100}]`, "10.0.0.4:4000")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "0", rec.Header().Get("RateLimit-Remaining"))
+
+	// behind a trusted proxy the client is the last hop it didn't add
+	// itself, and whatever the client put in front of that is ignored
+	app.opts.RateLimit.Burst = 12
+	app.opts.TrustedProxies = []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}
+	remaining := func(addr string, header ...string) string {
+		return do(http.MethodGet, "/items", "", addr, header...).Header().Get("RateLimit-Remaining")
+	}
+	assert.Equal(t, "11", remaining("10.1.0.1:4000", "X-Forwarded-For", "203.0.113.1"))
+	assert.Equal(t, "11", remaining("10.1.0.1:4000", "X-Forwarded-For", "203.0.113.2"))
+	assert.Equal(t, "10", remaining("10.1.0.2:4000", "X-Forwarded-For", "198.51.100.9, 203.0.113.1, 10.1.0.7"))
+	assert.Equal(t, "9", remaining("10.1.0.1:4000", "Forwarded", `for=198.51.100.9, for="203.0.113.1:5000";proto=https`))
+	assert.Equal(t, "11", remaining("10.1.0.1:4000", "Forwarded", `for="[2001:db8::1]:4711"`))
+	// a hop that isn't an address is the proxy that added it
+	assert.Equal(t, "11", remaining("10.1.0.1:4000", "Forwarded", "for=unknown"))
+	assert.Equal(t, "10", remaining("10.1.0.1:4000"))
+	// and anyone else saying who they're forwarding for is the client
+	assert.Equal(t, "11", remaining("10.0.0.9:4000", "X-Forwarded-For", "203.0.113.3"))
+	assert.Equal(t, "10", remaining("10.0.0.9:4000", "X-Forwarded-For", "203.0.113.4"))
+
+	// and a limiter that's down lets everything through
+	app.limiter = brokenLimiter{}
+	rec = do(http.MethodGet, "/items", "", "10.0.0.1:4000")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get("RateLimit-Limit"))
+}
+
+func TestTenantAdmins(t *testing.T) {
+	secret := "0123456789abcdef0123456789abcdef"
+
+	app := NewApp(db.NewMemoryStore())
+	app.opts.AccessLog = false
+	app.opts.Auth = true
+	app.opts.Tenancy = true
+	app.opts.TenantHeader = "X-Tenant"
+	app.opts.CheckResponses = offSpec(t)
+	jwt, err := jwtFrom(context.Background(), config.JWTConfig{
+		Issuer: "https://issuer.example.com", Audience: "items", HMACSecret: secret, ClockSkew: time.Second,
+	}, "tenant")
+	assert.NoError(t, err)
+	app.jwt = jwt
+	router := CreateRouter(app)
+
+	ctx := context.Background()
+	newKey := func(name, tenant string, scopes ...string) (string, string) {
+		plain, key, err := app.keys.Create(ctx, model.APIKey{Name: name, Scopes: scopes, Tenant: tenant})
+		assert.NoError(t, err)
+		return plain, key.ID.Hex()
+	}
+	admin, _ := newKey("admin", "", auth.ScopeAdmin)
+	acmeAdmin, _ := newKey("acme admin", "acme", auth.ScopeAdmin)
+	_, acmeID := newKey("acme ci", "acme", auth.ScopeItemsRead)
+	globex, globexID := newKey("globex ci", "globex", auth.ScopeItemsRead)
+
+	tok := jwtlib.NewWithClaims(jwtlib.SigningMethodHS256, jwtlib.MapClaims{
+		"iss": "https://issuer.example.com", "aud": "items", "sub": "acme-ops", "exp": time.Now().Add(time.Hour).Unix(),
+		"scope": auth.ScopeAdmin, "tenant": "acme",
+	})
+	bearer, err := tok.SignedString([]byte(secret))
+	assert.NoError(t, err)
+
+	do := func(method, path, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		for k := 0; k+1 < len(header); k += 2 {
+			req.Header.Set(header[k], header[k+1])
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	names := func(rec *httptest.ResponseRecorder) []string {
+		var keys []model.APIKey
+		assert.NoError(t, json.NewDecoder(rec.Body).Decode(&keys))
+		var names []string
+		for _, k := range keys {
+			names = append(names, k.Name)
+		}
+		return names
+	}
+
+	// an admin tied to a tenant, by key or by token, stays in it
+	for _, creds := range [][]string{{auth.KeyHeader, acmeAdmin}, {"Authorization", "Bearer " + bearer}} {
+		rec := do(http.MethodPost, "/admin/keys", `{"name":"x","scopes":["admin"],"tenant":"globex"}`, creds...)
+		assert.Equal(t, http.StatusForbidden, rec.Code, creds[0])
+
+		rec = do(http.MethodPost, "/admin/keys", `{"name":"x","scopes":["admin"]}`, creds...)
+		assert.Equal(t, http.StatusCreated, rec.Code, creds[0])
+		var created createdKey
+		assert.NoError(t, json.NewDecoder(rec.Body).Decode(&created))
+		assert.Equal(t, "acme", created.Tenant, creds[0])
+
+		rec = do(http.MethodPost, "/admin/keys", `{"name":"y","scopes":["items:read"],"tenant":"acme"}`, creds...)
+		assert.Equal(t, http.StatusCreated, rec.Code, creds[0])
+
+		rec = do(http.MethodGet, "/admin/keys", "", creds...)
+		assert.Equal(t, http.StatusOK, rec.Code, creds[0])
+		for _, name := range names(rec) {
+			assert.NotContains(t, []string{"admin", "globex ci"}, name, creds[0])
+		}
+
+		assert.Equal(t, http.StatusOK, do(http.MethodGet, "/admin/keys/"+acmeID, "", creds...).Code, creds[0])
+		assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/admin/keys/"+globexID, "", creds...).Code, creds[0])
+		assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/admin/keys/"+globexID, "", creds...).Code, creds[0])
+	}
+	// globex's key survived all that
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/items", "", auth.KeyHeader, globex).Code)
+
+	// an admin for everybody still sees and does everything
+	rec := do(http.MethodGet, "/admin/keys", "", auth.KeyHeader, admin)
+	assert.Contains(t, names(rec), "globex ci")
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/admin/keys/"+globexID, "", auth.KeyHeader, admin).Code)
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/items", "", auth.KeyHeader, globex).Code)
+}
+
+func TestSubdomain(t *testing.T) {
+	for host, want := range map[string]string{
+		"acme.items.example.com":      "acme",
+		"ACME.Items.Example.com:8000": "acme",
+		"acme.items.example.com.":     "acme",
+		"items.example.com":           "",
+		"a.b.items.example.com":       "",
+		"acme.items.example.com.evil": "",
+		"acmeitems.example.com":       "",
+		"[::1]:8000":                  "",
+	} {
+		assert.Equal(t, want, subdomain(host, "items.example.com"), host)
+	}
+}
+
 func TestMain(m *testing.M) {
-	var err error
 	envmap := map[string]string{
 		"DBUSER":     "root",
 		"DBPASS":     "testpass",
@@ -286,48 +1672,219 @@ func TestMain(m *testing.M) {
 		"DBNAME":     "testdb",
 		"DBCOLL":     "testcoll",
 		"SERVERPORT": "8000",
+		// auth is on by default and won't start without a way in
+		"AUTH_BOOTSTRAP_KEY": "0123456789abcdef0123456789abcdef",
 	}
 
 	for k := range envmap {
-		err = os.Setenv(k, envmap[k])
+		os.Setenv(k, envmap[k])
 	}
 
-	// to do this we need a mongo image, and a container running that image.
-	// aight the container is running now.
-	envs := map[string]string{
-		"MONGO_INITDB_ROOT_USERNAME": os.Getenv("DBUSER"),
-		"MONGO_INITDB_ROOT_PASSWORD": os.Getenv("DBPASS"),
-		"MONGO_INITDB_DATABASE":      os.Getenv("DBNAME"),
+	// handlers only talk to db.ItemStore now, so no mongo container needed
+	// here. The mongo side of things is covered in the db package.
+	code := m.Run()
+
+	os.Clearenv()
+	os.Exit(code)
+}
+
+// panicStore blows up or hangs on ListItems, everything else is a normal
+// memory store
+type panicStore struct {
+	*db.MemoryStore
+	hang bool
+}
+
+func (s panicStore) ListItems(ctx context.Context, opts db.ListOptions) (db.ItemPage, error) {
+	if s.hang {
+		<-ctx.Done()
+		return db.ItemPage{}, ctx.Err()
 	}
+	panic("store exploded")
+}
 
-	ctx := context.Background()
-	req := testcontainers.ContainerRequest{
-		Image:        "mongo",
-		Env:          envs,
-		ExposedPorts: []string{os.Getenv("DBPORT")},
-		Name:         "apiPkgMongoTestContainer",
-		Hostname:     os.Getenv("DBHOST"),
-		AutoRemove:   true,
-	}
-
-	mongoC, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
-		ContainerRequest: req,
-		Started:          true,
-	})
+func TestRouterMiddleware(t *testing.T) {
+	var logs bytes.Buffer
 
-	endpoint, err = mongoC.Endpoint(ctx, "")
-	if err != nil {
-		log.Fatalln(err)
+	base := NewApp(db.NewMemoryStore())
+	base.opts.Logger = slog.New(slog.NewJSONHandler(&logs, nil))
+	base.opts.MaxBodyBytes = 64
+
+	do := func(app *app, method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		CreateRouter(app).ServeHTTP(rec, req)
+		return rec
 	}
+	jsonBody := map[string]string{"Content-Type": "application/json"}
+
+	// routes actually get served through the chain now
+	rec := do(base, http.MethodPost, "/items/create/one", `{"title":"USB hub","price":20}`, jsonBody)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	assert.Len(t, rec.Header().Get(middleware.RequestIDHeader), 32)
+
+	rec = do(base, http.MethodGet, "/items/list", "", map[string]string{middleware.RequestIDHeader: "abc-123"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "abc-123", rec.Header().Get(middleware.RequestIDHeader))
+	assert.Contains(t, logs.String(), `"msg":"request","request_id":"abc-123","method":"GET","route":"/items/list","path":"/items/list","status":200`)
+
+	rec = do(base, http.MethodPost, "/items/create/one", `title=USB hub`, map[string]string{"Content-Type": "text/plain"})
+	assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code)
+
+	rec = do(base, http.MethodPost, "/items/create/one", `{"title":"`+strings.Repeat("a", 100)+`","price":1}`, jsonBody)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	var p problem.Details
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&p))
+	assert.Equal(t, problem.TypeBodyTooLarge, p.Type)
+
+	broken := NewApp(panicStore{MemoryStore: db.NewMemoryStore()})
+	broken.opts = base.opts
+	rec = do(broken, http.MethodGet, "/items/list", "", nil)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Equal(t, problem.ContentType, rec.Header().Get("Content-Type"))
+	assert.Contains(t, logs.String(), `"msg":"panic"`)
+	assert.Contains(t, logs.String(), "store exploded")
+	assert.Contains(t, logs.String(), `"status":500`)
+
+	slow := NewApp(panicStore{MemoryStore: db.NewMemoryStore(), hang: true})
+	slow.opts = base.opts
+	slow.opts.RequestTimeout = 20 * time.Millisecond
+	rec = do(slow, http.MethodGet, "/items/list", "", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	p = problem.Details{}
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&p))
+	assert.Equal(t, problem.TypeTimeout, p.Type)
+}
 
-	m.Run()
+type closeStore struct {
+	*db.MemoryStore
+	closed bool
+}
 
-	defer func() {
-		var err error
-		os.Clearenv()
-		err = mongoC.Terminate(ctx)
+func (s *closeStore) Close(ctx context.Context) error {
+	s.closed = true
+	return nil
+}
+
+func TestRegister(t *testing.T) {
+	store := &closeStore{MemoryStore: db.NewMemoryStore()}
+	app := NewApp(store)
+	app.opts.AccessLog = false
+
+	lc := lifecycle.New(nil)
+	srv := Register(lc, app, config.ServerConfig{Port: 0})
+	assert.NoError(t, lc.Start(context.Background()))
+
+	res, err := http.Get("http://" + srv.Addr + "/items/list")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.False(t, store.closed)
+
+	assert.NoError(t, lc.Stop(context.Background()))
+	assert.True(t, store.closed)
+}
+
+// pingStore is a memory store whose ping can be made to fail
+type pingStore struct {
+	*db.MemoryStore
+	err error
+}
+
+func (s *pingStore) Ping(ctx context.Context) error {
+	return s.err
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	store := &pingStore{MemoryStore: db.NewMemoryStore()}
+	app := NewApp(store)
+	app.opts.AccessLog = false
+	router := CreateRouter(app)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	assert.Equal(t, http.StatusOK, get("/healthz").Code)
+	assert.Equal(t, http.StatusOK, get("/readyz").Code)
+
+	store.err = fmt.Errorf("server selection timeout")
+	assert.Equal(t, http.StatusOK, get("/healthz").Code)
+	assert.Equal(t, http.StatusServiceUnavailable, get("/readyz").Code)
+
+	rec := get("/health")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	var report health.Report
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&report))
+	assert.Equal(t, "store", report.Checks[0].Name)
+	assert.Equal(t, "server selection timeout", report.Checks[0].Error)
+
+	// shutting down flips readiness, and the server still answers for the
+	// delay so probes see it
+	store.err = nil
+	lc := lifecycle.New(nil)
+	srv := Register(lc, app, config.ServerConfig{Port: 0, ShutdownDelay: 200 * time.Millisecond})
+	assert.NoError(t, lc.Start(context.Background()))
+	assert.Equal(t, http.StatusOK, get("/readyz").Code)
+
+	stopped := make(chan error)
+	go func() { stopped <- lc.Stop(context.Background()) }()
+	assert.Eventually(t, func() bool {
+		res, err := http.Get("http://" + srv.Addr + "/readyz")
 		if err != nil {
-			log.Fatalln(err)
+			return false
 		}
-	}()
+		res.Body.Close()
+		return res.StatusCode == http.StatusServiceUnavailable
+	}, 150*time.Millisecond, 10*time.Millisecond)
+
+	res, err := http.Get("http://" + srv.Addr + "/healthz")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	assert.NoError(t, <-stopped)
+	_, err = http.Get("http://" + srv.Addr + "/readyz")
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, get("/readyz").Code)
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	app := NewApp(db.NewMemoryStore())
+	app.opts.AccessLog = false
+	router := CreateRouter(app)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	var res db.InsertOneResult
+	rec := do(http.MethodPost, "/items/create/one", `{"title":"USB hub","price":20}`)
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+	do(http.MethodGet, "/items/list/"+res.InsertedID, "")
+	do(http.MethodGet, "/items/list/64b7f0c2a1b2c3d4e5f60718", "")
+
+	rec = do(http.MethodGet, "/metrics", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/plain")
+
+	out := rec.Body.String()
+	assert.Contains(t, out, `items_http_requests_total{method="POST",route="/items/create/one",status="200"} 1`)
+	assert.Contains(t, out, `items_http_requests_total{method="GET",route="/items/list/{id}",status="200"} 1`)
+	assert.Contains(t, out, `items_http_requests_total{method="GET",route="/items/list/{id}",status="404"} 1`)
+	assert.Contains(t, out, `items_store_operation_duration_seconds_count{op="list_one",result="not_found"} 1`)
+	assert.Contains(t, out, "items_stored 1\n")
 }
@@ -0,0 +1,180 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/mar-cial/items/auth"
+	"github.com/mar-cial/items/config"
+	"github.com/mar-cial/items/logging"
+	"github.com/mar-cial/items/middleware"
+	"github.com/mar-cial/items/problem"
+)
+
+// authenticators are tried in order, the first one that finds credentials
+// decides.
+func (app *app) authenticators() []auth.Authenticator {
+	authn := []auth.Authenticator{app.keys}
+	if app.jwt != nil {
+		authn = append(authn, app.jwt)
+	}
+	return authn
+}
+
+// jwtFrom is the token checker cfg asks for, nil when it doesn't ask for
+// one. tenantClaim is the claim that ties a token to a tenant.
+func jwtFrom(ctx context.Context, cfg config.JWTConfig, tenantClaim string) (*auth.JWT, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+
+	var keys auth.KeySource
+	switch {
+	case cfg.HMACSecret != "":
+		keys = auth.HMACKey([]byte(cfg.HMACSecret))
+	case cfg.KeyFile != "":
+		var err error
+		if keys, err = auth.LoadKeyFile(cfg.KeyFile); err != nil {
+			return nil, err
+		}
+	default:
+		jwks := auth.NewJWKS(cfg.JWKS, cfg.JWKSRefresh)
+		// not fatal, the issuer might just not be up yet. It gets tried
+		// again when tokens come in.
+		_ = jwks.Refresh(ctx)
+		keys = jwks
+	}
+
+	return auth.NewJWT(auth.JWTOptions{
+		Issuer:      cfg.Issuer,
+		Audience:    cfg.Audience,
+		ClockSkew:   cfg.ClockSkew,
+		Keys:        keys,
+		TenantClaim: tenantClaim,
+	}), nil
+}
+
+// authenticate runs on every request. Credentials that are there have to
+// check out, but no credentials is fine here, it's up to the routes
+// whether they need any.
+func (app *app) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, a := range app.authenticators() {
+			p, err := a.Authenticate(r)
+			switch {
+			case errors.Is(err, auth.ErrNoCredentials):
+				continue
+			case errors.Is(err, auth.ErrInvalidCredentials):
+				// guessing keys costs the ip, or it'd be free
+				if app.take(w, r, "ip:"+app.clientIP(r), 1) {
+					app.unauthorized(w, r, err.Error())
+				}
+				return
+			case err != nil:
+				serveErr(w, r, err)
+				return
+			}
+
+			ctx := auth.With(r.Context(), p)
+			ctx = logging.With(ctx, logging.From(ctx).With(slog.String("principal", p.Subject)))
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// unauthorized is the 401, with a challenge for every kind of credentials
+// we'd take.
+func (app *app) unauthorized(w http.ResponseWriter, r *http.Request, detail string) {
+	w.Header().Add("WWW-Authenticate", `APIKey header="`+auth.KeyHeader+`"`)
+	if app.jwt != nil {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="items"`)
+	}
+	problem.Write(w, r, problem.TypeUnauthorized, detail)
+}
+
+// authorize lets a request through to its route when the principal has
+// the scope permissions says the route needs. It's all off without
+// Options.Auth.
+func (app *app) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.opts.Auth {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		p, ok := auth.From(r.Context())
+		if !ok {
+			detail := "send an api key in " + auth.KeyHeader
+			if app.jwt != nil {
+				detail += " or a bearer token"
+			}
+			app.unauthorized(w, r, detail)
+			return
+		}
+
+		scope, ok := app.permission(r)
+		if !ok {
+			// a route someone forgot to put in permissions, better
+			// nobody gets in than everybody
+			logging.From(r.Context()).Error("route has no permission", slog.String("route", middleware.Route(r)))
+			problem.Write(w, r, problem.TypeForbidden, "this route isn't open to anyone")
+			return
+		}
+
+		if missing := app.policy.Missing(p, scope); len(missing) > 0 {
+			if p.Method == "jwt" {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="items", error="insufficient_scope", scope="`+strings.Join(missing, " ")+`"`)
+			}
+			problem.New(problem.TypeForbidden, "missing scope "+strings.Join(missing, ", ")).WithMissingScopes(missing...).Write(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// permission is the scope the route r matched needs.
+func (app *app) permission(r *http.Request) (string, bool) {
+	key, ok := app.routeKey(r)
+	if !ok {
+		return "", false
+	}
+	scope, ok := permissions[key]
+	return scope, ok
+}
+
+// permissionFor looks up method and path in permissions.
+func (app *app) permissionFor(method, path string) (string, bool) {
+	scope, ok := permissions[method+" "+app.unversioned(path)]
+	return scope, ok
+}
+
+// routeKey is the route r matched, keyed the way permissions and costs
+// are.
+func (app *app) routeKey(r *http.Request) (string, bool) {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return "", false
+	}
+	tpl, err := route.GetPathTemplate()
+	if err != nil {
+		return "", false
+	}
+	return r.Method + " " + app.unversioned(specPath(tpl)), true
+}
+
+// unversioned is path without the version in front, the versioned mounts
+// share the entries of the unversioned one.
+func (app *app) unversioned(path string) string {
+	for _, v := range app.versions {
+		if rest, ok := strings.CutPrefix(path, "/"+v.Name+"/"); ok {
+			return "/" + rest
+		}
+	}
+	return path
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// the verb routes (/items/create/one, /items/list/{id}, ...) were the whole
+// api before the REST ones. They still work, but only until sunset.
+var (
+	deprecatedAt = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+	sunsetAt     = time.Date(2027, time.April, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// legacy is a verb route: deprecated, and checked like the rest.
+func (app *app) legacy(successor string, h http.HandlerFunc) http.Handler {
+	return deprecated(successor, app.checkResponse(app.rateLimit(app.authorize(app.resolveTenant(app.validateRequest(h))))))
+}
+
+// deprecated marks every response from h as deprecated, with a Link to
+// the route that replaces it. {id} in successor is filled in from the
+// request.
+func deprecated(successor string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		link := successor
+		if id, ok := mux.Vars(r)["id"]; ok {
+			link = strings.ReplaceAll(link, "{id}", id)
+		}
+
+		markDeprecated(w.Header(), deprecatedAt, sunsetAt, link)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// markDeprecated sets Deprecation (RFC 9745), Sunset (RFC 8594) if there
+// is one, and a successor-version Link if there's somewhere to go.
+func markDeprecated(h http.Header, at, sunset time.Time, successor string) {
+	h.Set("Deprecation", "@"+strconv.FormatInt(at.Unix(), 10))
+	if !sunset.IsZero() {
+		h.Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+	}
+	if successor != "" {
+		h.Add("Link", "<"+successor+`>; rel="successor-version"`)
+	}
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mar-cial/items/db"
+	"github.com/mar-cial/items/model"
+)
+
+// etag is the strong ETag for an item served in v, "v2-3" for version 3
+// of the item as v2. An ETag only has to be unique per URL, but /items/{id}
+// answers in v1 or v2 depending on Accept, and a strong tag promises the
+// same bytes, so the representation is part of it.
+func etag(item model.Item, v Version) string {
+	return strconv.Quote(v.Name + "-" + strconv.FormatInt(item.Version, 10))
+}
+
+// tagVersion is the item version in one of our tags, without the quotes.
+// Any representation will do, and so will a bare version from before the
+// representation was in there. ok is false for anything that isn't ours.
+func tagVersion(tag string) (int64, bool) {
+	if name, n, found := strings.Cut(tag, "-"); found {
+		if len(name) < 2 || name[0] != 'v' || strings.Trim(name[1:], "0123456789") != "" {
+			return 0, false
+		}
+		tag = n
+	}
+	n, err := strconv.ParseInt(tag, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// splitTags splits an If-Match / If-None-Match header value into its
+// entity tags.
+func splitTags(header string) []string {
+	var tags []string
+	for _, t := range strings.Split(header, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+// noneMatch reports whether If-None-Match says the client already has
+// this representation. It uses weak comparison, like RFC 9110 asks for.
+func noneMatch(r *http.Request, tag string) bool {
+	for _, t := range splitTags(r.Header.Get("If-None-Match")) {
+		if t == "*" || strings.TrimPrefix(t, "W/") == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// ifMatchVersion turns If-Match into the version to hand the store. No
+// header means any version, * means any version of an item that's there,
+// which the store turns into the 412 RFC 9110 wants when it isn't. A
+// single tag is checked by the store itself, atomically. With a list we
+// look up the current version and only pass it on if it's in the list,
+// so the store still catches anything that changes after that.
+func ifMatchVersion(ctx context.Context, store db.ItemStore, r *http.Request, id string) (int64, error) {
+	tags := splitTags(r.Header.Get("If-Match"))
+	if len(tags) == 0 {
+		return db.AnyVersion, nil
+	}
+
+	var versions []int64
+	for _, t := range tags {
+		if t == "*" {
+			return db.ExistingVersion, nil
+		}
+
+		// weak tags never match with the strong comparison If-Match uses,
+		// and anything that isn't one of ours can't match either
+		v, err := strconv.Unquote(t)
+		if err != nil || strings.HasPrefix(t, "W/") {
+			continue
+		}
+		n, ok := tagVersion(v)
+		if !ok {
+			continue
+		}
+		versions = append(versions, n)
+	}
+
+	if len(versions) == 1 {
+		return versions[0], nil
+	}
+
+	mismatch := fmt.Errorf("%w: If-Match %s", db.ErrVersionMismatch, r.Header.Get("If-Match"))
+	if len(versions) == 0 {
+		return 0, mismatch
+	}
+
+	current, err := store.ListOneItem(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	for _, v := range versions {
+		if v == current.Version {
+			return v, nil
+		}
+	}
+	return 0, mismatch
+}
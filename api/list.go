@@ -0,0 +1,150 @@
+package api
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/mar-cial/items/db"
+	"github.com/mar-cial/items/filter"
+)
+
+// listParams are the query params that aren't filters.
+var listParams = []string{"limit", "offset", "cursor", "sort", "order"}
+
+// parseListOptions reads the paging query params for /items/list:
+//
+//	limit   page size, defaults to db.DefaultLimit and is capped at db.MaxLimit
+//	offset  how many items to skip, can't be used together with cursor
+//	cursor  opaque value from a previous page's Link header
+//	sort    created (default), title or price
+//	order   asc (default) or desc
+//
+// Everything else is a filter, see package filter for the syntax.
+func parseListOptions(q url.Values) (db.ListOptions, error) {
+	var opts db.ListOptions
+	var err error
+
+	opts.Limit, opts.Offset, err = parsePaging(q)
+	if err != nil {
+		return opts, err
+	}
+
+	opts.Cursor = q.Get("cursor")
+	if opts.Cursor != "" && q.Has("offset") {
+		return opts, fmt.Errorf("use either offset or cursor, not both")
+	}
+
+	opts.Sort, err = db.ParseSortField(q.Get("sort"))
+	if err != nil {
+		return opts, fmt.Errorf("sort must be one of created, title or price")
+	}
+
+	switch strings.ToLower(q.Get("order")) {
+	case "", "asc":
+	case "desc":
+		opts.Desc = true
+	default:
+		return opts, fmt.Errorf("order must be asc or desc")
+	}
+
+	opts.Filter, err = filter.Parse(q, db.ItemFilterSchema, listParams...)
+	if err != nil {
+		return opts, err
+	}
+
+	return opts, nil
+}
+
+// parseSearchOptions reads limit and offset for /items/search, same rules
+// as for listing.
+func parseSearchOptions(q url.Values) (db.SearchOptions, error) {
+	limit, offset, err := parsePaging(q)
+	return db.SearchOptions{Limit: limit, Offset: offset}, err
+}
+
+func parsePaging(q url.Values) (limit, offset int, err error) {
+	if v := q.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return 0, 0, fmt.Errorf("limit must be a positive integer")
+		}
+	}
+
+	if v := q.Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("offset must be a non-negative integer")
+		}
+	}
+	return limit, offset, nil
+}
+
+// clampLimit is the limit the store will actually use.
+func clampLimit(limit int) int {
+	if limit <= 0 {
+		return db.DefaultLimit
+	}
+	if limit > db.MaxLimit {
+		return db.MaxLimit
+	}
+	return limit
+}
+
+// pageLinks builds the Link header for a page. Offset requests get offset
+// links back, everything else gets cursor links.
+func pageLinks(u *url.URL, opts db.ListOptions, page db.ItemPage) string {
+	limit := clampLimit(opts.Limit)
+
+	if u.Query().Has("offset") {
+		return offsetLinks(u, opts.Offset, limit, page.Total)
+	}
+
+	var links []string
+	if page.Next != "" {
+		links = append(links, link(u, "next", limit, func(q url.Values) {
+			q.Set("cursor", page.Next)
+		}))
+	}
+	if page.Prev != "" {
+		links = append(links, link(u, "prev", limit, func(q url.Values) {
+			q.Set("cursor", page.Prev)
+		}))
+	}
+	return strings.Join(links, ", ")
+}
+
+// offsetLinks is the Link header for anything paged by offset.
+func offsetLinks(u *url.URL, offset, limit int, total int64) string {
+	var links []string
+
+	if int64(offset+limit) < total {
+		links = append(links, link(u, "next", limit, func(q url.Values) {
+			q.Set("offset", strconv.Itoa(offset+limit))
+		}))
+	}
+	if offset > 0 {
+		prev := offset - limit
+		if prev < 0 {
+			prev = 0
+		}
+		links = append(links, link(u, "prev", limit, func(q url.Values) {
+			q.Set("offset", strconv.Itoa(prev))
+		}))
+	}
+	return strings.Join(links, ", ")
+}
+
+// link is one Link header entry: the current url with paging params
+// swapped out by set.
+func link(u *url.URL, rel string, limit int, set func(q url.Values)) string {
+	q := u.Query()
+	q.Del("offset")
+	q.Del("cursor")
+	q.Set("limit", strconv.Itoa(limit))
+	set(q)
+
+	next := url.URL{Path: u.Path, RawQuery: q.Encode()}
+	return fmt.Sprintf(`<%s>; rel="%s"`, next.String(), rel)
+}
@@ -0,0 +1,694 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/mar-cial/items/auth"
+	"github.com/mar-cial/items/db"
+	"github.com/mar-cial/items/health"
+	"github.com/mar-cial/items/model"
+	"github.com/mar-cial/items/openapi"
+	"github.com/mar-cial/items/patch"
+	"github.com/mar-cial/items/problem"
+	"github.com/mar-cial/items/tenant"
+)
+
+const objectIDPattern = "^[0-9a-f]{24}$"
+
+// openAPI builds the spec for r out of its routes and app.operations. The
+// error lists routes nobody documented and operations whose route is
+// gone, the document is still usable either way.
+func (app *app) openAPI(r *mux.Router) (*openapi.Document, error) {
+	ops := app.operations()
+
+	doc := &openapi.Document{
+		OpenAPI: openapi.Version,
+		Info: openapi.Info{
+			Title:       "items",
+			Version:     app.versions[len(app.versions)-1].Name,
+			Description: "CRUD API for the items we sell.",
+		},
+		Paths: map[string]openapi.PathItem{},
+		Components: openapi.Components{
+			Schemas: app.schemas(),
+			SecuritySchemes: map[string]*openapi.SecurityScheme{
+				apiKeyScheme: {Type: "apiKey", In: "header", Name: auth.KeyHeader, Description: "Made with POST /admin/keys, or the bootstrap key from the config."},
+			},
+		},
+	}
+	if app.jwt != nil {
+		doc.Components.SecuritySchemes[bearerScheme] = &openapi.SecurityScheme{
+			Type: "http", Scheme: "bearer", BearerFormat: "JWT",
+			Description: "HS256, RS256 or ES256 tokens from the issuer in the config.",
+		}
+	}
+
+	var undocumented []string
+	seen := map[string]bool{}
+
+	err := r.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		// subrouters show up too, they don't handle anything themselves
+		if route.GetHandler() == nil {
+			return nil
+		}
+
+		tpl, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		path := specPath(tpl)
+
+		methods, err := route.GetMethods()
+		if err != nil {
+			undocumented = append(undocumented, "ANY "+path)
+			return nil
+		}
+
+		for _, m := range methods {
+			key := m + " " + path
+			op, ok := ops[key]
+			if !ok {
+				undocumented = append(undocumented, key)
+				continue
+			}
+
+			seen[key] = true
+			if doc.Paths[path] == nil {
+				doc.Paths[path] = openapi.PathItem{}
+			}
+			doc.Paths[path][strings.ToLower(m)] = op
+		}
+		return nil
+	})
+	if err != nil {
+		return doc, err
+	}
+
+	var stale []string
+	for key := range ops {
+		if !seen[key] {
+			stale = append(stale, key)
+		}
+	}
+
+	sort.Strings(undocumented)
+	sort.Strings(stale)
+
+	var errs []string
+	if len(undocumented) > 0 {
+		errs = append(errs, "routes without an operation: "+strings.Join(undocumented, ", "))
+	}
+	if len(stale) > 0 {
+		errs = append(errs, "operations without a route: "+strings.Join(stale, ", "))
+	}
+	if len(errs) > 0 {
+		return doc, fmt.Errorf("openapi: %s", strings.Join(errs, "; "))
+	}
+	return doc, nil
+}
+
+var muxPattern = regexp.MustCompile(`\{(\w+):[^}]*\}`)
+
+// specPath drops the regexps from a mux template, /docs/{file:.*} is
+// /docs/{file} as far as OpenAPI is concerned.
+func specPath(tpl string) string {
+	return muxPattern.ReplaceAllString(tpl, "{$1}")
+}
+
+// itemSchemaName is the component the item schema for v lives under.
+func itemSchemaName(v Version) string {
+	return "Item" + strings.ToUpper(v.Name)
+}
+
+func itemV1Schema() *openapi.Schema {
+	s := openapi.SchemaOf(model.Item{})
+	s.Properties["ID"].Pattern = objectIDPattern
+	s.Properties["ID"].Description = "Set by the store, leave it out when creating."
+	s.Properties["price"].Minimum = openapi.Float(0)
+	s.Properties["price"].Description = fmt.Sprintf("At most %d decimal places.", model.PriceMaxDecimals)
+	describeCommon(s)
+	s.Required = []string{"title", "price"}
+	return s
+}
+
+func itemV2Schema() *openapi.Schema {
+	s := openapi.SchemaOf(itemV2{})
+	s.Properties["id"].Pattern = objectIDPattern
+	s.Properties["id"].Description = "Set by the store, leave it out when creating."
+	s.Properties["price_cents"].Minimum = openapi.Float(0)
+	describeCommon(s)
+	s.Required = []string{"title", "price_cents"}
+	return s
+}
+
+// describeCommon adds the rules every version shares.
+func describeCommon(s *openapi.Schema) {
+	s.Properties["title"].MinLength = openapi.Int(1)
+	s.Properties["title"].MaxLength = openapi.Int(model.TitleMaxLen)
+	s.Properties["title"].Pattern = `\S`
+	s.Properties["version"].Minimum = openapi.Float(0)
+	s.Properties["version"].Description = "Set by the store, goes up by one on every write. The number in the ETag."
+}
+
+func createKeySchema() *openapi.Schema {
+	s := openapi.SchemaOf(createKeyRequest{})
+	s.Properties["name"].MinLength = openapi.Int(1)
+	s.Properties["name"].MaxLength = openapi.Int(keyNameMaxLen)
+	s.Properties["name"].Pattern = `\S`
+	s.Properties["scopes"].MinItems = openapi.Int(1)
+	s.Properties["scopes"].Items.Enum = nil
+	for _, scope := range auth.Scopes() {
+		s.Properties["scopes"].Items.Enum = append(s.Properties["scopes"].Items.Enum, scope)
+	}
+	s.Properties["tenant"].Pattern = tenant.Pattern
+	s.Properties["tenant"].Description = "The only tenant the key works for. Leave it out for a key that isn't tied to one."
+	s.Properties["expires_at"].Description = "Has to be in the future. Leave it out for a key that doesn't expire."
+	return s
+}
+
+func createdKeySchema() *openapi.Schema {
+	s := openapi.SchemaOf(createdKey{})
+	s.Properties["key"].Description = "The key itself. This is the only time you get to see it."
+	return s
+}
+
+// patchSchema is schema with nothing required, what a merge patch looks
+// like.
+func patchSchema(schema *openapi.Schema) *openapi.Schema {
+	s := *schema
+	s.Required = nil
+	return &s
+}
+
+func (app *app) schemas() map[string]*openapi.Schema {
+	s := map[string]*openapi.Schema{
+		"Problem":          openapi.SchemaOf(problem.Details{}),
+		"InsertOneResult":  openapi.SchemaOf(db.InsertOneResult{}),
+		"InsertManyResult": openapi.SchemaOf(db.InsertManyResult{}),
+		"UpdateResult":     openapi.SchemaOf(db.UpdateResult{}),
+		"DeleteResult":     openapi.SchemaOf(db.DeleteResult{}),
+		"HealthReport":     openapi.SchemaOf(health.Report{}),
+		"APIKey":           openapi.SchemaOf(model.APIKey{}),
+		"CreateKeyRequest": createKeySchema(),
+		"CreatedKey":       createdKeySchema(),
+		"JSONPatch": {
+			Type: "array",
+			Items: &openapi.Schema{
+				Type: "object",
+				Properties: map[string]*openapi.Schema{
+					"op":    {Type: "string", Enum: []interface{}{"add", "remove", "replace", "move", "copy", "test"}},
+					"path":  {Type: "string"},
+					"from":  {Type: "string"},
+					"value": {},
+				},
+				Required: []string{"op", "path"},
+			},
+		},
+	}
+
+	for _, v := range app.versions {
+		name := itemSchemaName(v)
+		s[name] = v.schema()
+		s[name+"Patch"] = patchSchema(s[name])
+
+		results := openapi.SchemaOf(searchResponse{})
+		results.Properties["results"].Items.Properties["item"] = openapi.Ref(name)
+		s["SearchResults"+strings.ToUpper(v.Name)] = results
+	}
+	return s
+}
+
+var (
+	idParam = openapi.Parameter{
+		Name: "id", In: "path", Required: true,
+		Schema: &openapi.Schema{Type: "string", Pattern: objectIDPattern},
+	}
+	ifMatchParam = openapi.Parameter{
+		Name: "If-Match", In: "header",
+		Description: "Only write if the item still has one of these ETags.",
+		Schema:      &openapi.Schema{Type: "string"},
+	}
+	ifNoneMatchParam = openapi.Parameter{
+		Name: "If-None-Match", In: "header",
+		Description: "304 if the item still has one of these ETags.",
+		Schema:      &openapi.Schema{Type: "string"},
+	}
+	pagingParams = []openapi.Parameter{
+		{Name: "limit", In: "query", Description: fmt.Sprintf("Page size, %d by default and at most %d.", db.DefaultLimit, db.MaxLimit),
+			Schema: &openapi.Schema{Type: "integer", Minimum: openapi.Float(1)}},
+		{Name: "offset", In: "query", Description: "How many to skip.",
+			Schema: &openapi.Schema{Type: "integer", Minimum: openapi.Float(0)}},
+	}
+	listParamsDoc = append(pagingParams[:2:2],
+		openapi.Parameter{Name: "cursor", In: "query", Description: "From a previous page's Link header, can't go with offset.",
+			Schema: &openapi.Schema{Type: "string"}},
+		openapi.Parameter{Name: "sort", In: "query",
+			Schema: &openapi.Schema{Type: "string", Enum: []interface{}{"created", "title", "price"}}},
+		openapi.Parameter{Name: "order", In: "query",
+			Schema: &openapi.Schema{Type: "string", Enum: []interface{}{"asc", "desc"}}},
+	)
+	searchParamsDoc = append([]openapi.Parameter{
+		{Name: "q", In: "query", Required: true, Description: "What to look for in titles.",
+			Schema: &openapi.Schema{Type: "string", MinLength: openapi.Int(1)}},
+	}, pagingParams...)
+
+	etagHeader       = openapi.Header{Description: "The item's version.", Schema: &openapi.Schema{Type: "string"}}
+	totalCountHeader = openapi.Header{Description: "How many there are in total.", Schema: &openapi.Schema{Type: "integer"}}
+	linkHeader       = openapi.Header{Description: "first/prev/next page links.", Schema: &openapi.Schema{Type: "string"}}
+)
+
+func jsonContent(s *openapi.Schema) map[string]openapi.MediaType {
+	return map[string]openapi.MediaType{"application/json": {Schema: s}}
+}
+
+func problemResponse(description string) *openapi.Response {
+	return &openapi.Response{
+		Description: description,
+		Content:     map[string]openapi.MediaType{problem.ContentType: {Schema: openapi.Ref("Problem")}},
+	}
+}
+
+// mount is one place the item routes are registered.
+type mount struct {
+	prefix string
+	// id goes in front of operation ids, so they stay unique
+	id  string
+	tag string
+	v   Version
+	// negotiated mounts pick the version from Accept
+	negotiated bool
+}
+
+// content is the response content for schema, in every version the mount
+// can answer with.
+func (app *app) content(m mount, schema func(Version) *openapi.Schema) map[string]openapi.MediaType {
+	c := jsonContent(schema(m.v))
+	if m.negotiated {
+		for _, v := range app.versions {
+			c[v.MediaType()] = openapi.MediaType{Schema: schema(v)}
+		}
+	}
+	return c
+}
+
+func opID(m mount, name string) string {
+	if m.id == "" {
+		return name
+	}
+	return m.id + strings.ToUpper(name[:1]) + name[1:]
+}
+
+// operations documents every route CreateRouter registers, keyed by
+// method and path. Add one here whenever you add a route,
+// TestOpenAPICoversRoutes fails otherwise.
+func (app *app) operations() map[string]*openapi.Operation {
+	health := func(summary string, res *openapi.Response) *openapi.Operation {
+		return &openapi.Operation{
+			Summary: summary, Tags: []string{"ops"},
+			Responses: map[string]*openapi.Response{"200": res, "503": {Description: "Not ready.", Content: jsonContent(openapi.Ref("HealthReport"))}},
+		}
+	}
+	up := &openapi.Response{Description: "Up.", Content: jsonContent(&openapi.Schema{Type: "object"})}
+	report := &openapi.Response{Description: "Every check.", Content: jsonContent(openapi.Ref("HealthReport"))}
+
+	ops := map[string]*openapi.Operation{
+		"GET /healthz":  health("Liveness", up),
+		"HEAD /healthz": health("Liveness", up),
+		"GET /readyz":   health("Readiness", report),
+		"HEAD /readyz":  health("Readiness", report),
+		"GET /health":   health("Every health check with its latency", report),
+		"GET /metrics": {
+			Summary: "Prometheus metrics", Tags: []string{"ops"},
+			Responses: map[string]*openapi.Response{"200": {Description: "Text exposition format."}},
+		},
+		"GET /openapi.json": {
+			Summary: "This document", Tags: []string{"docs"},
+			Responses: map[string]*openapi.Response{"200": {Description: "OpenAPI 3.1.", Content: jsonContent(&openapi.Schema{Type: "object"})}},
+		},
+		"GET /docs": {
+			Summary: "Redirects to /docs/", Tags: []string{"docs"},
+			Responses: map[string]*openapi.Response{"301": {Description: "To /docs/."}},
+		},
+		"GET /docs/{file}": {
+			Summary: "Docs UI", Tags: []string{"docs"},
+			Parameters: []openapi.Parameter{{Name: "file", In: "path", Required: true, Schema: &openapi.Schema{Type: "string"}}},
+			Responses:  map[string]*openapi.Response{"200": {Description: "Swagger UI and its assets."}, "404": {Description: "No such file."}},
+		},
+	}
+
+	mounts := []mount{{prefix: "/items", tag: "items", v: app.versions[0], negotiated: true}}
+	for _, v := range app.versions {
+		mounts = append(mounts, mount{prefix: "/" + v.Name + "/items", id: v.Name, tag: v.Name, v: v})
+	}
+	for _, m := range mounts {
+		for key, op := range app.itemOperations(m) {
+			ops[key] = app.limited(key, app.tenanted(key, app.secured(key, op)))
+		}
+	}
+
+	for key, op := range app.legacyOperations(mount{prefix: "/items", v: app.versions[0]}) {
+		ops[key] = app.limited(key, app.tenanted(key, app.secured(key, op)))
+	}
+	if !app.opts.Auth {
+		// no /admin without auth, see CreateRouter
+		return ops
+	}
+	for key, op := range app.adminOperations() {
+		op = app.secured(key, op)
+		if res, ok := op.Responses["403"]; ok && key == "POST /admin/keys" {
+			res.Description += " Or the caller is tied to a tenant and the key is for another one."
+		}
+		ops[key] = app.limited(key, op)
+	}
+	return ops
+}
+
+const (
+	apiKeyScheme = "apiKey"
+	bearerScheme = "bearer"
+)
+
+// secured adds what auth does to the operation at key, when it's switched
+// on. The docs shouldn't ask for keys the server doesn't.
+func (app *app) secured(key string, op *openapi.Operation) *openapi.Operation {
+	if !app.opts.Auth {
+		return op
+	}
+
+	method, path, _ := strings.Cut(key, " ")
+	scope, ok := app.permissionFor(method, path)
+	if !ok {
+		// TestPermissionsCoverRoutes catches these, nobody gets in
+		return op
+	}
+
+	op.Security = []openapi.SecurityRequirement{{apiKeyScheme: {scope}}}
+	if app.jwt != nil {
+		op.Security = append(op.Security, openapi.SecurityRequirement{bearerScheme: {scope}})
+	}
+	op.Description = strings.TrimSpace(op.Description + " Needs the " + scope + " scope.")
+	op.Responses["403"] = problemResponse("The caller doesn't have the " + scope + " scope.")
+	op.Responses["401"] = &openapi.Response{
+		Description: "No api key, or a bad one.",
+		Headers:     map[string]openapi.Header{"WWW-Authenticate": {Schema: &openapi.Schema{Type: "string"}}},
+		Content:     problemResponse("").Content,
+	}
+	return op
+}
+
+// tenanted adds what tenancy does to the item operation at key, when it's
+// switched on.
+func (app *app) tenanted(key string, op *openapi.Operation) *openapi.Operation {
+	if !app.opts.Tenancy {
+		return op
+	}
+
+	if app.opts.TenantHeader != "" {
+		op.Parameters = append(op.Parameters, openapi.Parameter{
+			Name: app.opts.TenantHeader, In: "header",
+			Description: "The tenant whose items these are. Credentials tied to a tenant don't need it, and can't name another one.",
+			Schema:      &openapi.Schema{Type: "string", Pattern: tenant.Pattern},
+		})
+	}
+	if _, ok := op.Responses["400"]; !ok {
+		op.Responses["400"] = problemResponse("No tenant, or not a valid one.")
+	}
+
+	forbidden := "The credentials are for another tenant."
+	if strings.HasPrefix(key, http.MethodPost+" ") {
+		forbidden += " Or the tenant is out of items."
+	}
+	if res, ok := op.Responses["403"]; ok {
+		res.Description += " " + forbidden
+	} else {
+		op.Responses["403"] = problemResponse(forbidden)
+	}
+	return op
+}
+
+// limited adds what rate limiting does to the operation at key, when it's
+// switched on: what it costs and the 429 for when that's too much.
+func (app *app) limited(key string, op *openapi.Operation) *openapi.Operation {
+	if !app.opts.RateLimit.Enabled() {
+		return op
+	}
+
+	method, path, _ := strings.Cut(key, " ")
+	key = method + " " + app.unversioned(path)
+	switch cost := routeCost(key); {
+	case key == "POST /items":
+		op.Description = strings.TrimSpace(op.Description + fmt.Sprintf(" Costs 1 request, or %d for an array.", bulkCost))
+	case cost != 1:
+		op.Description = strings.TrimSpace(op.Description + fmt.Sprintf(" Costs %d requests.", cost))
+	}
+
+	integer := &openapi.Schema{Type: "integer"}
+	op.Responses["429"] = &openapi.Response{
+		Description: fmt.Sprintf("Too many requests, the client gets %d at once and %g a second after that.", app.opts.RateLimit.Burst, app.opts.RateLimit.Rate),
+		Headers: map[string]openapi.Header{
+			"Retry-After":         {Description: "Seconds until this would go through.", Schema: integer},
+			"RateLimit-Limit":     {Description: "Requests the client gets at once.", Schema: integer},
+			"RateLimit-Remaining": {Description: "Requests the client has left.", Schema: integer},
+			"RateLimit-Reset":     {Description: "Seconds until the client has them all back.", Schema: integer},
+			"RateLimit-Policy":    {Description: "The burst and how many seconds it takes to come back, as burst;w=seconds.", Schema: &openapi.Schema{Type: "string"}},
+		},
+		Content: problemResponse("").Content,
+	}
+	return op
+}
+
+func (app *app) adminOperations() map[string]*openapi.Operation {
+	admin := func(id, summary string, op *openapi.Operation) *openapi.Operation {
+		op.OperationID = id
+		op.Summary = summary
+		op.Tags = []string{"admin"}
+		return op
+	}
+	keyID := openapi.Parameter{Name: "id", In: "path", Required: true, Schema: &openapi.Schema{Type: "string", Pattern: objectIDPattern}}
+
+	return map[string]*openapi.Operation{
+		"POST /admin/keys": admin("createKey", "Create an api key", &openapi.Operation{
+			Description: "Only the hash is stored, the key is in the response and nowhere else. A caller tied to a tenant only makes keys for that tenant, and without a tenant in the body the key is for theirs.",
+			RequestBody: &openapi.RequestBody{Required: true, Content: jsonContent(openapi.Ref("CreateKeyRequest"))},
+			Responses: map[string]*openapi.Response{
+				"201": {
+					Description: "Created.",
+					Headers:     map[string]openapi.Header{"Location": {Schema: &openapi.Schema{Type: "string"}}},
+					Content:     jsonContent(openapi.Ref("CreatedKey")),
+				},
+				"400": problemResponse("Malformed body."),
+				"413": problemResponse("Body too large."),
+				"415": problemResponse("Not json."),
+				"422": problemResponse("Didn't validate."),
+			},
+		}),
+		"GET /admin/keys": admin("listKeys", "List api keys", &openapi.Operation{
+			Description: "Revoked and expired keys too, oldest first. A caller tied to a tenant only sees that tenant's keys.",
+			Responses: map[string]*openapi.Response{
+				"200": {Description: "Every key.", Content: jsonContent(&openapi.Schema{Type: "array", Items: openapi.Ref("APIKey")})},
+			},
+		}),
+		"GET /admin/keys/{id}": admin("getKey", "Get an api key", &openapi.Operation{
+			Parameters: []openapi.Parameter{keyID},
+			Responses: map[string]*openapi.Response{
+				"200": {Description: "The key, without the key.", Content: jsonContent(openapi.Ref("APIKey"))},
+				"400": problemResponse("Not a key id."),
+				"404": problemResponse("No such key."),
+			},
+		}),
+		"DELETE /admin/keys/{id}": admin("revokeKey", "Revoke an api key", &openapi.Operation{
+			Description: "It stops working straight away but stays in the list.",
+			Parameters:  []openapi.Parameter{keyID},
+			Responses: map[string]*openapi.Response{
+				"204": {Description: "Revoked."},
+				"400": problemResponse("Not a key id."),
+				"404": problemResponse("No such key."),
+			},
+		}),
+	}
+}
+
+func (app *app) itemOperations(m mount) map[string]*openapi.Operation {
+	item := func(v Version) *openapi.Schema { return openapi.Ref(itemSchemaName(v)) }
+	items := func(v Version) *openapi.Schema { return &openapi.Schema{Type: "array", Items: item(v)} }
+	results := func(v Version) *openapi.Schema { return openapi.Ref("SearchResults" + strings.ToUpper(v.Name)) }
+
+	var body string
+	if m.negotiated {
+		body = "Send Accept: " + app.versions[len(app.versions)-1].MediaType() + " to talk in that version, both ways."
+	}
+
+	return map[string]*openapi.Operation{
+		"POST " + m.prefix: {
+			OperationID: opID(m, "createItems"), Tags: []string{m.tag},
+			Summary:     "Create one item, or several",
+			Description: "An object creates one item and answers with it. An array creates all of them at once and answers with their ids.",
+			RequestBody: &openapi.RequestBody{
+				Required: true, Description: body,
+				Content: jsonContent(&openapi.Schema{OneOf: []*openapi.Schema{
+					item(m.v), {Type: "array", Items: item(m.v), MinItems: openapi.Int(1)},
+				}}),
+			},
+			Responses: map[string]*openapi.Response{
+				"201": {
+					Description: "Created.",
+					Headers:     map[string]openapi.Header{"Location": {Schema: &openapi.Schema{Type: "string"}}, "ETag": etagHeader},
+					Content: app.content(m, func(v Version) *openapi.Schema {
+						return &openapi.Schema{OneOf: []*openapi.Schema{item(v), openapi.Ref("InsertManyResult")}}
+					}),
+				},
+				"400": problemResponse("Malformed body."),
+				"409": problemResponse("An item with that id exists already."),
+				"413": problemResponse("Body too large."),
+				"415": problemResponse("Not json."),
+				"422": problemResponse("Didn't validate."),
+			},
+		},
+		"GET " + m.prefix: {
+			OperationID: opID(m, "listItems"), Tags: []string{m.tag},
+			Summary:     "List items",
+			Description: "Any other query param is a filter on title or price.",
+			Parameters:  listParamsDoc,
+			Responses: map[string]*openapi.Response{
+				"200": {
+					Description: "A page of items.",
+					Headers:     map[string]openapi.Header{"X-Total-Count": totalCountHeader, "Link": linkHeader},
+					Content:     app.content(m, items),
+				},
+				"400": problemResponse("Bad query params."),
+			},
+		},
+		"GET " + m.prefix + "/search": {
+			OperationID: opID(m, "searchItems"), Tags: []string{m.tag},
+			Summary:    "Full text search on titles",
+			Parameters: searchParamsDoc,
+			Responses: map[string]*openapi.Response{
+				"200": {
+					Description: "Best matches first.",
+					Headers:     map[string]openapi.Header{"X-Total-Count": totalCountHeader, "Link": linkHeader},
+					Content:     app.content(m, results),
+				},
+				"400": problemResponse("Bad query params."),
+			},
+		},
+		"GET " + m.prefix + "/{id}": {
+			OperationID: opID(m, "getItem"), Tags: []string{m.tag},
+			Summary:    "Get one item",
+			Parameters: []openapi.Parameter{idParam, ifNoneMatchParam},
+			Responses: map[string]*openapi.Response{
+				"200": {Description: "The item.", Headers: map[string]openapi.Header{"ETag": etagHeader}, Content: app.content(m, item)},
+				"304": {Description: "You have it already."},
+				"400": problemResponse("Not an item id."),
+				"404": problemResponse("No such item."),
+			},
+		},
+		"PUT " + m.prefix + "/{id}": {
+			OperationID: opID(m, "replaceItem"), Tags: []string{m.tag},
+			Summary:     "Replace an item",
+			Parameters:  []openapi.Parameter{idParam, ifMatchParam},
+			RequestBody: &openapi.RequestBody{Required: true, Description: body, Content: jsonContent(item(m.v))},
+			Responses: map[string]*openapi.Response{
+				"200": {Description: "The item as stored.", Headers: map[string]openapi.Header{"ETag": etagHeader}, Content: app.content(m, item)},
+				"400": problemResponse("Malformed body or not an item id."),
+				"404": problemResponse("No such item."),
+				"412": problemResponse("If-Match didn't match."),
+				"413": problemResponse("Body too large."),
+				"422": problemResponse("Didn't validate."),
+			},
+		},
+		"PATCH " + m.prefix + "/{id}": {
+			OperationID: opID(m, "patchItem"), Tags: []string{m.tag},
+			Summary:    "Change part of an item",
+			Parameters: []openapi.Parameter{idParam, ifMatchParam},
+			RequestBody: &openapi.RequestBody{
+				Required: true, Description: body,
+				Content: map[string]openapi.MediaType{
+					patch.MergePatchType: {Schema: openapi.Ref(itemSchemaName(m.v) + "Patch")},
+					patch.JSONPatchType:  {Schema: openapi.Ref("JSONPatch")},
+				},
+			},
+			Responses: map[string]*openapi.Response{
+				"200": {Description: "The item after the patch.", Headers: map[string]openapi.Header{"ETag": etagHeader}, Content: app.content(m, item)},
+				"400": problemResponse("Malformed patch or not an item id."),
+				"404": problemResponse("No such item."),
+				"409": problemResponse("A test op failed, or the item kept changing under the patch."),
+				"412": problemResponse("If-Match didn't match."),
+				"413": problemResponse("Body too large."),
+				"415": problemResponse("Neither a merge patch nor a JSON patch."),
+				"422": problemResponse("The patched item didn't validate."),
+			},
+		},
+		"DELETE " + m.prefix + "/{id}": {
+			OperationID: opID(m, "deleteItem"), Tags: []string{m.tag},
+			Summary:    "Delete an item",
+			Parameters: []openapi.Parameter{idParam, ifMatchParam},
+			Responses: map[string]*openapi.Response{
+				"204": {Description: "Gone."},
+				"400": problemResponse("Not an item id."),
+				"404": problemResponse("No such item."),
+				"412": problemResponse("If-Match didn't match."),
+			},
+		},
+	}
+}
+
+// legacyOperations are the verb routes. They answer like they always did.
+func (app *app) legacyOperations(m mount) map[string]*openapi.Operation {
+	deprecation := map[string]openapi.Header{
+		"Deprecation": {Schema: &openapi.Schema{Type: "string"}},
+		"Sunset":      {Schema: &openapi.Schema{Type: "string"}},
+		"Link":        {Description: "The successor-version route.", Schema: &openapi.Schema{Type: "string"}},
+	}
+	ok := func(description string, content map[string]openapi.MediaType) map[string]*openapi.Response {
+		return map[string]*openapi.Response{
+			"200": {Description: description, Headers: deprecation, Content: content},
+			"400": problemResponse("Malformed body, query or id."),
+			"404": problemResponse("No such item."),
+			"412": problemResponse("If-Match didn't match."),
+			"422": problemResponse("Didn't validate."),
+		}
+	}
+	legacy := func(id, summary string, op *openapi.Operation) *openapi.Operation {
+		op.OperationID = id
+		op.Summary = summary
+		op.Tags = []string{"legacy"}
+		op.Deprecated = true
+		return op
+	}
+
+	item := openapi.Ref(itemSchemaName(m.v))
+	return map[string]*openapi.Operation{
+		"POST /items/create/one": legacy("legacyCreateOne", "Use POST /items", &openapi.Operation{
+			RequestBody: &openapi.RequestBody{Required: true, Content: jsonContent(item)},
+			Responses:   ok("The new id.", jsonContent(openapi.Ref("InsertOneResult"))),
+		}),
+		"POST /items/create/many": legacy("legacyCreateMany", "Use POST /items", &openapi.Operation{
+			RequestBody: &openapi.RequestBody{Required: true, Content: jsonContent(&openapi.Schema{Type: "array", Items: item, MinItems: openapi.Int(1)})},
+			Responses:   ok("The new ids.", jsonContent(openapi.Ref("InsertManyResult"))),
+		}),
+		"GET /items/list/{id}": legacy("legacyGetOne", "Use GET /items/{id}", &openapi.Operation{
+			Parameters: []openapi.Parameter{idParam, ifNoneMatchParam},
+			Responses:  ok("The item.", app.content(m, func(v Version) *openapi.Schema { return openapi.Ref(itemSchemaName(v)) })),
+		}),
+		"GET /items/list": legacy("legacyList", "Use GET /items", &openapi.Operation{
+			Parameters: listParamsDoc,
+			Responses: ok("A page of items.", app.content(m, func(v Version) *openapi.Schema {
+				return &openapi.Schema{Type: "array", Items: openapi.Ref(itemSchemaName(v))}
+			})),
+		}),
+		"PUT /items/update/{id}": legacy("legacyUpdate", "Use PUT /items/{id}", &openapi.Operation{
+			Parameters:  []openapi.Parameter{idParam, ifMatchParam},
+			RequestBody: &openapi.RequestBody{Required: true, Content: jsonContent(item)},
+			Responses:   ok("What changed.", jsonContent(openapi.Ref("UpdateResult"))),
+		}),
+		"DELETE /items/delete/{id}": legacy("legacyDelete", "Use DELETE /items/{id}", &openapi.Operation{
+			Parameters: []openapi.Parameter{idParam, ifMatchParam},
+			Responses:  ok("How many were deleted.", jsonContent(openapi.Ref("DeleteResult"))),
+		}),
+	}
+}
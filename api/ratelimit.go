@@ -0,0 +1,229 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mar-cial/items/auth"
+	"github.com/mar-cial/items/logging"
+	"github.com/mar-cial/items/problem"
+	"github.com/mar-cial/items/ratelimit"
+)
+
+// bulkCost is what a bulk create takes out of the bucket, whichever route
+// it comes in on. It's a flat price rather than one per item, the body
+// limit already caps how many items that is.
+const bulkCost = 10
+
+// costs is what a request to a route takes out of the client's bucket,
+// keyed like permissions. Anything not in here costs 1. POST /items costs
+// bulkCost when the body is an array.
+var costs = map[string]int{
+	"GET /items/search":       2,
+	"POST /items/create/many": bulkCost,
+}
+
+// rateLimit takes what a request costs out of its client's bucket and
+// turns it away with a 429 when there isn't enough left. Every response it
+// lets through gets the RateLimit headers too, so clients can slow down
+// before it comes to that. It runs ahead of authorize, so requests that
+// get turned away for their credentials are paid for too, out of their ip's
+// bucket. It's all off without Options.RateLimit.
+func (app *app) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.opts.RateLimit.Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cost, ok := app.cost(w, r)
+		if !ok {
+			return
+		}
+		if app.take(w, r, app.rateKey(r), cost) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// take takes cost out of the bucket at key, setting the RateLimit headers,
+// and writes the 429 when there isn't enough left. It's true when the
+// request can go on.
+func (app *app) take(w http.ResponseWriter, r *http.Request, key string, cost int) bool {
+	limit := app.opts.RateLimit
+	if !limit.Enabled() {
+		return true
+	}
+
+	res, err := app.limiter.Take(r.Context(), key, cost, limit)
+	if err != nil {
+		// a limiter that's down shouldn't take the api with it
+		logging.From(r.Context()).Warn("rate limiter failed, letting the request through", slog.Any("err", err))
+		return true
+	}
+
+	setRateLimit(w.Header(), res, limit)
+	if !res.Allowed {
+		wait := seconds(res.RetryAfter)
+		w.Header().Set("Retry-After", strconv.Itoa(wait))
+		problem.Write(w, r, problem.TypeRateLimited, fmt.Sprintf("this costs %d of a %d request burst, try again in %ds", cost, limit.Burst, wait))
+		return false
+	}
+	return true
+}
+
+// cost is what r takes out of the bucket. Telling a bulk POST /items from
+// a single one means reading the body, which is put back for the handler.
+// ok is false when reading it failed and the problem's been written.
+func (app *app) cost(w http.ResponseWriter, r *http.Request) (int, bool) {
+	key, _ := app.routeKey(r)
+	if key != "POST /items" {
+		return routeCost(key), true
+	}
+
+	b, ok := readBody(w, r)
+	if !ok {
+		return 0, false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(b))
+
+	if bytes.HasPrefix(bytes.TrimLeft(b, " \t\r\n"), []byte("[")) {
+		return bulkCost, true
+	}
+	return 1, true
+}
+
+// routeCost is what a request to the route at key costs, going by costs.
+func routeCost(key string) int {
+	if c, ok := costs[key]; ok {
+		return c
+	}
+	return 1
+}
+
+// rateKey is the bucket r comes out of. Options.RateLimitBy says how far
+// down to start: client goes by the credentials, then the tenant, then the
+// ip, tenant skips the credentials and ip goes straight to the ip. The
+// tenant is only the one resolveTenant would let through, so nobody can
+// spend another tenant's requests by naming it.
+func (app *app) rateKey(r *http.Request) string {
+	by := app.opts.RateLimitBy
+
+	if by == "" || by == "client" {
+		if p, ok := auth.From(r.Context()); ok {
+			return p.Method + ":" + p.Subject
+		}
+	}
+	if by != "ip" && app.opts.Tenancy {
+		if id, typ, _ := app.tenantOf(r); typ == "" {
+			return "tenant:" + id
+		}
+	}
+	return "ip:" + app.clientIP(r)
+}
+
+// clientIP is the address the request came from. When that's one of
+// Options.TrustedProxies it goes back through Forwarded, or
+// X-Forwarded-For without it, from the right: every hop that's a trusted
+// proxy too was only passing it on, the first one that isn't is the
+// client. Anything left of that is the client's to make up, so it isn't
+// looked at. A hop that isn't an address stops it at the proxy that added
+// it.
+func (app *app) clientIP(r *http.Request) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	if !app.trusted(ip) {
+		return ip
+	}
+
+	hops := forwardedFor(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := parseHop(hops[i])
+		if err != nil {
+			break
+		}
+		ip = addr.String()
+		if !app.trusted(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// trusted is whether ip is one of Options.TrustedProxies.
+func (app *app) trusted(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range app.opts.TrustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor is every for= in the Forwarded headers, or every address
+// in X-Forwarded-For when there's no Forwarded, in the order they were
+// added.
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	for _, v := range h.Values("Forwarded") {
+		for _, elem := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				k, v, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if strings.EqualFold(k, "for") {
+					hops = append(hops, strings.Trim(v, `"`))
+				}
+			}
+		}
+	}
+	if len(hops) > 0 {
+		return hops
+	}
+	for _, v := range h.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// parseHop is the address in a hop, which can come with a port and, for
+// ipv6 in Forwarded, brackets.
+func parseHop(hop string) (netip.Addr, error) {
+	if ap, err := netip.ParseAddrPort(hop); err == nil {
+		return ap.Addr().Unmap(), nil
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]"))
+	return addr.Unmap(), err
+}
+
+// setRateLimit sets the RateLimit headers from the IETF httpapi draft:
+// the burst, what's left of it, seconds until it's all back, and the
+// policy as burst and window.
+func setRateLimit(h http.Header, res ratelimit.Result, limit ratelimit.Limit) {
+	h.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(seconds(res.Reset)))
+	h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Burst, seconds(limit.Window())))
+}
+
+// seconds is d in whole seconds, rounded up so a client that waits that
+// long doesn't come back too early.
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/mar-cial/items/auth"
+	"github.com/mar-cial/items/logging"
+	"github.com/mar-cial/items/problem"
+	"github.com/mar-cial/items/tenant"
+)
+
+// resolveTenant works out whose items a request is about and puts the
+// tenant in the context, which is where the store takes it from. It's all
+// off without Options.Tenancy.
+func (app *app) resolveTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.opts.Tenancy {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		id, typ, detail := app.tenantOf(r)
+		if typ != "" {
+			problem.Write(w, r, typ, detail)
+			return
+		}
+
+		ctx := tenant.With(r.Context(), id)
+		ctx = logging.With(ctx, logging.From(ctx).With(slog.String("tenant", id)))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// tenantOf is the tenant for r, or the problem to answer with when there
+// isn't one it's allowed. Credentials tied to a tenant decide, and a
+// request that asks for another one gets turned down rather than quietly
+// pointed at the right one. Otherwise it's whatever the request asks for,
+// which with auth on only admins get to do.
+func (app *app) tenantOf(r *http.Request) (string, problem.Type, string) {
+	asked := app.askedTenant(r)
+	p, authed := auth.From(r.Context())
+
+	if authed && p.Tenant != "" {
+		if err := tenant.Valid(p.Tenant); err != nil {
+			return "", problem.TypeForbidden, "the credentials are for " + err.Error()
+		}
+		if asked != "" && asked != p.Tenant {
+			return "", problem.TypeForbidden, "the credentials are for tenant " + p.Tenant + ", not " + asked
+		}
+		return p.Tenant, "", ""
+	}
+
+	if asked == "" {
+		return "", problem.TypeBadRequest, "no tenant, " + app.tenantHint()
+	}
+	if err := tenant.Valid(asked); err != nil {
+		return "", problem.TypeBadRequest, err.Error()
+	}
+	if app.opts.Auth && !app.policy.Allowed(p, auth.ScopeAdmin) {
+		return "", problem.TypeForbidden, "the credentials aren't tied to a tenant, only admins get to pick one"
+	}
+	return asked, "", ""
+}
+
+// askedTenant is the tenant the request names, the header first and then
+// the subdomain.
+func (app *app) askedTenant(r *http.Request) string {
+	if app.opts.TenantHeader != "" {
+		if id := strings.TrimSpace(r.Header.Get(app.opts.TenantHeader)); id != "" {
+			return id
+		}
+	}
+	if app.opts.TenantDomain != "" {
+		return subdomain(r.Host, app.opts.TenantDomain)
+	}
+	return ""
+}
+
+// subdomain is the label in front of domain in host, acme for
+// acme.items.example.com. Anything deeper than one label isn't a tenant.
+func subdomain(host, domain string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	sub, ok := strings.CutSuffix(host, "."+strings.ToLower(domain))
+	if !ok || strings.Contains(sub, ".") {
+		return ""
+	}
+	return sub
+}
+
+// tenantHint says where the tenant could have come from.
+func (app *app) tenantHint() string {
+	var ways []string
+	if app.opts.TenantHeader != "" {
+		ways = append(ways, "send one in "+app.opts.TenantHeader)
+	}
+	if app.opts.TenantDomain != "" {
+		ways = append(ways, "use a subdomain of "+app.opts.TenantDomain)
+	}
+	if app.opts.Auth {
+		ways = append(ways, "use credentials tied to one")
+	}
+	if len(ways) == 0 {
+		return "use credentials tied to one"
+	}
+	return strings.Join(ways, " or ")
+}
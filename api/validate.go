@@ -0,0 +1,177 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/mar-cial/items/openapi"
+	"github.com/mar-cial/items/problem"
+)
+
+// operation finds the documented operation for the route r matched. The
+// unversioned routes talk whatever version was negotiated, so for those
+// it's the operation under that version's prefix.
+func (app *app) operation(r *http.Request) *openapi.Operation {
+	route := mux.CurrentRoute(r)
+	if route == nil || app.spec == nil {
+		return nil
+	}
+	tpl, err := route.GetPathTemplate()
+	if err != nil {
+		return nil
+	}
+
+	path := specPath(tpl)
+	method := strings.ToLower(r.Method)
+
+	if v, ok := versionFrom(r.Context()); ok && !strings.HasPrefix(path, "/"+v.Name+"/") {
+		if op := app.spec.Paths["/"+v.Name+path][method]; op != nil {
+			return op
+		}
+	}
+	return app.spec.Paths[path][method]
+}
+
+// mediaContent picks what content has for mediaType. Any json flavour we
+// don't list specifically is held to the plain json schema.
+func mediaContent(content map[string]openapi.MediaType, mediaType string) (openapi.MediaType, bool) {
+	if c, ok := content[mediaType]; ok {
+		return c, true
+	}
+	if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+		c, ok := content["application/json"]
+		return c, ok
+	}
+	return openapi.MediaType{}, false
+}
+
+// validateRequest holds request bodies up against the spec before the
+// handler sees them. Bodies in a media type the operation doesn't take
+// are left for the handler to turn down.
+func (app *app) validateRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op := app.operation(r)
+		if op == nil || op.RequestBody == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		content, ok := mediaContent(op.RequestBody.Content, mediaType)
+		if !ok || content.Schema == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, ok := readBody(w, r)
+		if !ok {
+			return
+		}
+		if len(bytes.TrimSpace(body)) == 0 {
+			problem.Write(w, r, problem.TypeMalformedBody, "request body is required")
+			return
+		}
+
+		errs, err := app.spec.Validate(content.Schema, body)
+		if err != nil {
+			problem.Write(w, r, problem.TypeMalformedBody, err.Error())
+			return
+		}
+		if len(errs) > 0 {
+			schemaProblem(errs).Write(w, r)
+			return
+		}
+
+		// the handler gets to read it all over again
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// schemaProblem turns schema violations into a problem. Fields we don't
+// know about make the body malformed, like they do in the handlers, the
+// rest is a validation failure.
+func schemaProblem(errs []openapi.ValidationError) *problem.Details {
+	typ := problem.TypeValidation
+	fields := make([]problem.FieldError, len(errs))
+	for k, e := range errs {
+		if e.Keyword == "additionalProperties" {
+			typ = problem.TypeMalformedBody
+		}
+		fields[k] = problem.FieldError{Field: e.Field(), Pointer: e.Pointer, Message: e.Message}
+	}
+	return problem.New(typ, "").WithErrors(fields...)
+}
+
+// checkResponse is the other direction, for tests: every response has to
+// be one the spec documents, in a content type it documents, with a body
+// that fits the schema. Anything else goes to Options.CheckResponses.
+func (app *app) checkResponse(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := app.opts.CheckResponses
+		if report == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &bufferedWriter{header: w.Header(), code: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		if op := app.operation(r); op != nil {
+			if err := app.conforms(op, rec); err != nil {
+				report(r, err)
+			}
+		}
+
+		w.WriteHeader(rec.code)
+		_, _ = w.Write(rec.body.Bytes())
+	})
+}
+
+func (app *app) conforms(op *openapi.Operation, rec *bufferedWriter) error {
+	res, ok := op.Responses[fmt.Sprint(rec.code)]
+	if !ok {
+		return fmt.Errorf("status %d isn't documented", rec.code)
+	}
+
+	if rec.body.Len() == 0 {
+		return nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(rec.header.Get("Content-Type"))
+	content, ok := mediaContent(res.Content, mediaType)
+	if !ok {
+		return fmt.Errorf("status %d: %s isn't documented", rec.code, mediaType)
+	}
+	if content.Schema == nil {
+		return nil
+	}
+
+	errs, err := app.spec.Validate(content.Schema, rec.body.Bytes())
+	if err != nil {
+		return fmt.Errorf("status %d: %w", rec.code, err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("status %d doesn't fit the schema: %v", rec.code, errs)
+	}
+	return nil
+}
+
+// bufferedWriter holds on to the response so checkResponse can look at it
+// before it goes out.
+type bufferedWriter struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (b *bufferedWriter) Header() http.Header { return b.header }
+
+func (b *bufferedWriter) WriteHeader(code int) { b.code = code }
+
+func (b *bufferedWriter) Write(p []byte) (int, error) { return b.body.Write(p) }
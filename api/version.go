@@ -0,0 +1,296 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mar-cial/items/model"
+	"github.com/mar-cial/items/openapi"
+	"github.com/mar-cial/items/problem"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Version is one representation of items on the wire. The handlers are
+// the same for every version, only the mapping to and from model.Item
+// changes.
+type Version struct {
+	// Name is both the path prefix (/v1) and the bit in the media type
+	// (application/vnd.items.v1+json).
+	Name string
+	// Deprecated and Sunset mark the version as on its way out. Set them
+	// in Versions and every response in that version says so. Zero means
+	// it isn't deprecated.
+	Deprecated time.Time
+	Sunset     time.Time
+
+	encode     func(model.Item) interface{}
+	decode     func([]byte) (model.Item, error)
+	decodeMany func([]byte) ([]model.Item, error)
+	// fields maps model field names to this version's, for validation
+	// errors
+	fields map[string]string
+	// schema is the item's OpenAPI schema
+	schema func() *openapi.Schema
+}
+
+// Versions are the versions the router mounts, oldest first. The first
+// one is what you get without asking.
+func Versions() []Version {
+	return []Version{
+		{
+			Name:       "v1",
+			encode:     func(item model.Item) interface{} { return item },
+			decode:     model.UnmarshalItem,
+			decodeMany: model.UnmarshalItems,
+			schema:     itemV1Schema,
+		},
+		{
+			Name:       "v2",
+			encode:     func(item model.Item) interface{} { return toV2(item) },
+			decode:     decodeV2,
+			decodeMany: decodeManyV2,
+			fields:     map[string]string{"ID": "id", "price": "price_cents"},
+			schema:     itemV2Schema,
+		},
+	}
+}
+
+// MediaType is what to put in Accept to ask for this version.
+func (v Version) MediaType() string {
+	return "application/vnd.items." + v.Name + "+json"
+}
+
+func (v Version) items(items []model.Item) []interface{} {
+	out := make([]interface{}, len(items))
+	for k := range items {
+		out[k] = v.encode(items[k])
+	}
+	return out
+}
+
+// field renames the last part of a validation error field, so "[2].price"
+// comes out as "[2].price_cents" in v2.
+func (v Version) field(name string) string {
+	prefix, last := "", name
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		prefix, last = name[:i+1], name[i+1:]
+	}
+	if renamed, ok := v.fields[last]; ok {
+		return prefix + renamed
+	}
+	return name
+}
+
+// itemV2 has whole cents instead of a float price, so nobody has to round
+// on a phone, and spells id like every other field.
+type itemV2 struct {
+	ID         string `json:"id,omitempty"`
+	Title      string `json:"title"`
+	PriceCents int64  `json:"price_cents"`
+	Version    int64  `json:"version"`
+}
+
+func toV2(item model.Item) itemV2 {
+	v := itemV2{
+		Title:      item.Title,
+		PriceCents: int64(math.Round(item.Price * 100)),
+		Version:    item.Version,
+	}
+	if !item.ID.IsZero() {
+		v.ID = item.ID.Hex()
+	}
+	return v
+}
+
+func (v itemV2) item() (model.Item, error) {
+	item := model.Item{
+		Title:   v.Title,
+		Price:   float64(v.PriceCents) / 100,
+		Version: v.Version,
+	}
+	if v.ID != "" {
+		id, err := primitive.ObjectIDFromHex(v.ID)
+		if err != nil {
+			return item, fmt.Errorf("id %q is not a valid object id", v.ID)
+		}
+		item.ID = id
+	}
+	return item, nil
+}
+
+func decodeV2(data []byte) (model.Item, error) {
+	var v itemV2
+	if err := model.UnmarshalStrict(data, &v); err != nil {
+		return model.Item{}, err
+	}
+	return v.item()
+}
+
+func decodeManyV2(data []byte) ([]model.Item, error) {
+	var vs []itemV2
+	if err := model.UnmarshalStrict(data, &vs); err != nil {
+		return nil, err
+	}
+
+	items := make([]model.Item, len(vs))
+	for k := range vs {
+		item, err := vs[k].item()
+		if err != nil {
+			return nil, fmt.Errorf("[%d]: %w", k, err)
+		}
+		items[k] = item
+	}
+	return items, nil
+}
+
+// marshal is encode, then json.
+func (v Version) marshal(item model.Item) ([]byte, error) {
+	return json.Marshal(v.encode(item))
+}
+
+type versionKey struct{}
+
+func withVersion(ctx context.Context, v Version) context.Context {
+	return context.WithValue(ctx, versionKey{}, v)
+}
+
+func versionFrom(ctx context.Context) (Version, bool) {
+	v, ok := ctx.Value(versionKey{}).(Version)
+	return v, ok
+}
+
+// version is the version the request is being served in.
+func (app *app) version(r *http.Request) Version {
+	if v, ok := versionFrom(r.Context()); ok {
+		return v
+	}
+	return app.versions[0]
+}
+
+// pinVersion is for the /v1, /v2 trees, where the path decides.
+func (app *app) pinVersion(v Version) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !v.Deprecated.IsZero() {
+				successor := ""
+				if latest, ok := app.latest(); ok && latest.Name != v.Name {
+					successor = "/" + latest.Name + strings.TrimPrefix(r.URL.Path, "/"+v.Name)
+				}
+				markDeprecated(w.Header(), v.Deprecated, v.Sunset, successor)
+			}
+			next.ServeHTTP(w, r.WithContext(withVersion(r.Context(), v)))
+		})
+	}
+}
+
+// negotiate picks the version for the unversioned routes from Accept. No
+// versioned media type in there means the first version, like before
+// there were versions.
+func (app *app) negotiate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+
+		v, named, err := app.accepted(r.Header.Get("Accept"))
+		if err != nil {
+			problem.Write(w, r, problem.TypeNotAcceptable, err.Error())
+			return
+		}
+
+		if named {
+			w.Header().Set("Content-Type", v.MediaType())
+		}
+		if !v.Deprecated.IsZero() {
+			markDeprecated(w.Header(), v.Deprecated, v.Sunset, "")
+		}
+		next.ServeHTTP(w, r.WithContext(withVersion(r.Context(), v)))
+	})
+}
+
+// accepted finds the version Accept asks for, going by q like RFC 9110
+// says: the highest q wins, a versioned media type beats a plain one on a
+// tie, and q=0 means not that one. Versions we don't have are skipped,
+// and only an error if there's nothing else in there we could answer with.
+func (app *app) accepted(accept string) (v Version, named bool, err error) {
+	if strings.TrimSpace(accept) == "" {
+		return app.versions[0], false, nil
+	}
+
+	var (
+		unknown   []string
+		best      Version
+		bestQ     float64
+		fallbackQ float64
+	)
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q, ok := quality(params)
+		if !ok || q == 0 {
+			continue
+		}
+
+		name, ok := strings.CutPrefix(mediaType, "application/vnd.items.")
+		if !ok {
+			fallbackQ = math.Max(fallbackQ, q)
+			continue
+		}
+		name = strings.TrimSuffix(name, "+json")
+
+		found := false
+		for _, v := range app.versions {
+			if v.Name == name {
+				found = true
+				if q > bestQ {
+					best, bestQ = v, q
+				}
+			}
+		}
+		if !found {
+			unknown = append(unknown, mediaType)
+		}
+	}
+
+	switch {
+	case bestQ > 0 && bestQ >= fallbackQ:
+		return best, true, nil
+	case fallbackQ > 0:
+		return app.versions[0], false, nil
+	case len(unknown) > 0:
+		return Version{}, false, fmt.Errorf("no such version: %s", strings.Join(unknown, ", "))
+	}
+	return Version{}, false, fmt.Errorf("nothing in %q is something we answer with", accept)
+}
+
+// quality is the q parameter of a media range, 1 when there isn't one.
+// ok is false when it's not a number between 0 and 1.
+func quality(params map[string]string) (float64, bool) {
+	s, ok := params["q"]
+	if !ok {
+		return 1, true
+	}
+	q, err := strconv.ParseFloat(s, 64)
+	if err != nil || q < 0 || q > 1 {
+		return 0, false
+	}
+	return q, true
+}
+
+// latest is the newest version that isn't deprecated.
+func (app *app) latest() (Version, bool) {
+	for k := len(app.versions) - 1; k >= 0; k-- {
+		if app.versions[k].Deprecated.IsZero() {
+			return app.versions[k], true
+		}
+	}
+	return Version{}, false
+}
@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mar-cial/items/db"
+	"github.com/mar-cial/items/logging"
+	"github.com/mar-cial/items/model"
+)
+
+// KeyHeader is where clients send their api key.
+const KeyHeader = "X-API-Key"
+
+const (
+	// keys look like itk_<prefix>_<secret>, so they're easy to spot in a
+	// leaked file and the prefix can be shown without giving the key away
+	keyTag       = "itk_"
+	prefixBytes  = 4
+	secretBytes  = 32
+	insertTries  = 3
+	touchEvery   = time.Minute
+	bootstrapSub = "bootstrap"
+)
+
+// dummyHash is what unknown prefixes get compared against, so they take as
+// long as known ones.
+var dummyHash = Hash(keyTag + "00000000_")
+
+// Hash is how keys are stored. Plain sha256 is enough, unlike passwords
+// the keys are long random strings nobody can guess at.
+func Hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// APIKeys issues keys and checks the ones requests bring.
+type APIKeys struct {
+	store db.KeyStore
+	// bootstrap is the hash of the key from the config, "" without one.
+	// It isn't in the store, so it works on an empty database.
+	bootstrap string
+	now       func() time.Time
+}
+
+func NewAPIKeys(store db.KeyStore, bootstrapKey string) *APIKeys {
+	k := &APIKeys{store: store, now: time.Now}
+	if bootstrapKey != "" {
+		k.bootstrap = Hash(bootstrapKey)
+	}
+	return k
+}
+
+// Store is where the keys live, for listing and revoking them.
+func (k *APIKeys) Store() db.KeyStore {
+	return k.store
+}
+
+// Create makes a new key out of the name, scopes, tenant and expiry in
+// tpl and stores its hash. The plain key is only ever in what this
+// returns, there's no getting it back later.
+func (k *APIKeys) Create(ctx context.Context, tpl model.APIKey) (string, model.APIKey, error) {
+	for try := 0; ; try++ {
+		prefix, err := randomHex(prefixBytes)
+		if err != nil {
+			return "", model.APIKey{}, err
+		}
+		secret, err := randomHex(secretBytes)
+		if err != nil {
+			return "", model.APIKey{}, err
+		}
+		plain := keyTag + prefix + "_" + secret
+
+		key := model.APIKey{
+			Name:      tpl.Name,
+			Prefix:    prefix,
+			Hash:      Hash(plain),
+			Scopes:    tpl.Scopes,
+			Tenant:    tpl.Tenant,
+			CreatedAt: k.now().UTC(),
+			ExpiresAt: tpl.ExpiresAt,
+		}
+		err = k.store.InsertKey(ctx, &key)
+		// a prefix is only 8 hex digits, so they can clash
+		if errors.Is(err, db.ErrConflict) && try < insertTries {
+			continue
+		}
+		if err != nil {
+			return "", model.APIKey{}, err
+		}
+		return plain, key, nil
+	}
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating key: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Authenticate checks the key in KeyHeader, if there is one.
+func (k *APIKeys) Authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get(KeyHeader)
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+	return k.Verify(r.Context(), key)
+}
+
+// Verify works out whose key this is. Hashes are compared in constant
+// time, and a key nobody has takes as long to turn down as one somebody
+// does.
+func (k *APIKeys) Verify(ctx context.Context, key string) (*Principal, error) {
+	hash := Hash(key)
+
+	if k.bootstrap != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(k.bootstrap)) == 1 {
+		return &Principal{Subject: bootstrapSub, Name: bootstrapSub, Method: "api_key", Scopes: []string{ScopeAdmin}}, nil
+	}
+
+	prefix, ok := keyPrefix(key)
+	if !ok {
+		return nil, fmt.Errorf("%w: not an api key", ErrInvalidCredentials)
+	}
+
+	stored, err := k.store.KeyByPrefix(ctx, prefix)
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		subtle.ConstantTimeCompare([]byte(hash), []byte(dummyHash))
+		return nil, fmt.Errorf("%w: unknown api key", ErrInvalidCredentials)
+	case err != nil:
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(stored.Hash)) != 1 {
+		return nil, fmt.Errorf("%w: unknown api key", ErrInvalidCredentials)
+	}
+
+	now := k.now()
+	switch {
+	case stored.RevokedAt != nil:
+		return nil, fmt.Errorf("%w: api key was revoked", ErrInvalidCredentials)
+	case !stored.Active(now):
+		return nil, fmt.Errorf("%w: api key expired", ErrInvalidCredentials)
+	}
+
+	k.touch(ctx, stored, now)
+
+	return &Principal{Subject: stored.ID.Hex(), Name: stored.Name, Method: "api_key", Scopes: stored.Scopes, Tenant: stored.Tenant}, nil
+}
+
+// touch keeps last used roughly right without a write on every request.
+// Failing to record it isn't worth failing the request over.
+func (k *APIKeys) touch(ctx context.Context, key model.APIKey, now time.Time) {
+	if key.LastUsedAt != nil && now.Sub(*key.LastUsedAt) < touchEvery {
+		return
+	}
+	if err := k.store.TouchKey(ctx, key.ID.Hex(), now.UTC()); err != nil {
+		logging.From(ctx).Warn("recording api key use", slog.String("key", key.Prefix), slog.Any("err", err))
+	}
+}
+
+// keyPrefix pulls the prefix out of itk_<prefix>_<secret>.
+func keyPrefix(key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, keyTag)
+	if !ok {
+		return "", false
+	}
+	prefix, secret, ok := strings.Cut(rest, "_")
+	if !ok || len(prefix) != 2*prefixBytes || len(secret) != 2*secretBytes {
+		return "", false
+	}
+	return prefix, true
+}
@@ -0,0 +1,80 @@
+// Package auth works out who a request is from. Every way of proving it
+// is an Authenticator, what they all come up with is a Principal that
+// the handlers find in the request context.
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// ScopeAdmin is what managing keys takes.
+const ScopeAdmin = "admin"
+
+var (
+	// ErrNoCredentials is a request that doesn't carry the credentials an
+	// Authenticator looks for. The next one might find some.
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrInvalidCredentials is credentials that are there but don't check
+	// out. That's the end of it, no other Authenticator gets a go.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Authenticator turns what a request carries into a Principal.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// Principal is who a request is from.
+type Principal struct {
+	// Subject is stable across requests, the key id for api keys.
+	Subject string
+	// Name is for humans and logs.
+	Name string
+	// Method is how they got in: "api_key" or "jwt".
+	Method string
+	Scopes []string
+	// Roles come from a token's roles claim, the Policy says what they
+	// grant.
+	Roles []string
+	// Claims is everything a verified token said, nil for api keys.
+	Claims map[string]interface{}
+	// Tenant is the one tenant the credentials are for, "" when they
+	// aren't tied to one.
+	Tenant string
+}
+
+func (p *Principal) HasScope(scope string) bool {
+	if p == nil {
+		return false
+	}
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// With returns ctx carrying p.
+func With(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// From is the principal in ctx, ok is false for anonymous requests.
+func From(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok && p != nil
+}
+
+// Claims are the verified token claims of the request in ctx, nil when it
+// didn't come with a token.
+func Claims(ctx context.Context) map[string]interface{} {
+	if p, ok := From(ctx); ok {
+		return p.Claims
+	}
+	return nil
+}
@@ -0,0 +1,412 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/mar-cial/items/db"
+	"github.com/mar-cial/items/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIKeys(t *testing.T) {
+	ctx := context.Background()
+	store := db.NewMemoryKeyStore()
+	keys := NewAPIKeys(store, "")
+
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	keys.now = func() time.Time { return now }
+
+	plain, key, err := keys.Create(ctx, model.APIKey{Name: "ci", Scopes: []string{"items:read"}})
+	assert.NoError(t, err)
+	assert.Len(t, plain, len(keyTag)+2*prefixBytes+1+2*secretBytes)
+	assert.Equal(t, Hash(plain), key.Hash)
+	assert.Equal(t, now, key.CreatedAt)
+
+	p, err := keys.Verify(ctx, plain)
+	assert.NoError(t, err)
+	assert.Equal(t, key.ID.Hex(), p.Subject)
+	assert.Equal(t, "ci", p.Name)
+	assert.True(t, p.HasScope("items:read"))
+	assert.False(t, p.HasScope(ScopeAdmin))
+	assert.Empty(t, p.Tenant)
+
+	tied, _, err := keys.Create(ctx, model.APIKey{Name: "acme ci", Scopes: []string{"items:read"}, Tenant: "acme"})
+	assert.NoError(t, err)
+	p, err = keys.Verify(ctx, tied)
+	assert.NoError(t, err)
+	assert.Equal(t, "acme", p.Tenant)
+
+	stored, _ := store.GetKey(ctx, key.ID.Hex())
+	assert.Equal(t, now, *stored.LastUsedAt)
+
+	// last used only gets written now and then
+	now = now.Add(10 * time.Second)
+	_, err = keys.Verify(ctx, plain)
+	assert.NoError(t, err)
+	stored, _ = store.GetKey(ctx, key.ID.Hex())
+	assert.Equal(t, now.Add(-10*time.Second), *stored.LastUsedAt)
+
+	// the right prefix with a secret that's one digit off
+	off := plain[:len(plain)-1] + "0"
+	if off == plain {
+		off = plain[:len(plain)-1] + "1"
+	}
+	for _, bad := range []string{
+		"",
+		"nope",
+		plain[:len(plain)-1],
+		off,
+		keyTag + "00000000_" + strings.Repeat("0", 2*secretBytes),
+	} {
+		_, err := keys.Verify(ctx, bad)
+		assert.ErrorIs(t, err, ErrInvalidCredentials, bad)
+	}
+
+	expires := now.Add(time.Hour)
+	short, _, err := keys.Create(ctx, model.APIKey{Name: "temp", Scopes: []string{"items:read"}, ExpiresAt: &expires})
+	assert.NoError(t, err)
+	_, err = keys.Verify(ctx, short)
+	assert.NoError(t, err)
+	now = expires
+	_, err = keys.Verify(ctx, short)
+	assert.ErrorContains(t, err, "expired")
+
+	_, err = store.RevokeKey(ctx, key.ID.Hex(), now)
+	assert.NoError(t, err)
+	_, err = keys.Verify(ctx, plain)
+	assert.ErrorContains(t, err, "revoked")
+}
+
+func TestBootstrapKey(t *testing.T) {
+	keys := NewAPIKeys(db.NewMemoryKeyStore(), "let-me-in-let-me-in-let-me-in-please")
+
+	p, err := keys.Verify(context.Background(), "let-me-in-let-me-in-let-me-in-please")
+	assert.NoError(t, err)
+	assert.True(t, p.HasScope(ScopeAdmin))
+
+	// no bootstrap key configured means none works, not that "" does
+	_, err = NewAPIKeys(db.NewMemoryKeyStore(), "").Verify(context.Background(), "")
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+}
+
+func TestAuthenticate(t *testing.T) {
+	keys := NewAPIKeys(db.NewMemoryKeyStore(), "")
+	plain, _, err := keys.Create(context.Background(), model.APIKey{Name: "ci", Scopes: []string{"admin"}})
+	assert.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/items", nil)
+	_, err = keys.Authenticate(r)
+	assert.ErrorIs(t, err, ErrNoCredentials)
+
+	r.Header.Set(KeyHeader, plain)
+	p, err := keys.Authenticate(r)
+	assert.NoError(t, err)
+
+	ctx := With(r.Context(), p)
+	got, ok := From(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, p, got)
+
+	_, ok = From(context.Background())
+	assert.False(t, ok)
+}
+
+// sign makes a token the way an issuer would.
+func sign(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+	tok := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		tok.Header["kid"] = kid
+	}
+	s, err := tok.SignedString(key)
+	assert.NoError(t, err)
+	return s
+}
+
+func pemFile(t *testing.T, pub interface{}) string {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "key.pem")
+	assert.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600))
+	return path
+}
+
+func TestJWT(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	claims := func(extra jwt.MapClaims) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"iss": "https://issuer.example.com", "aud": "items", "sub": "svc-orders",
+			"iat": now.Unix(), "exp": now.Add(time.Hour).Unix(), "scope": "items:read items:write",
+		}
+		for k, v := range extra {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	rsaKeys, err := LoadKeyFile(pemFile(t, &rsaKey.PublicKey))
+	assert.NoError(t, err)
+	ecKeys, err := LoadKeyFile(pemFile(t, &ecKey.PublicKey))
+	assert.NoError(t, err)
+
+	verifier := func(keys KeySource) *JWT {
+		j := NewJWT(JWTOptions{Issuer: "https://issuer.example.com", Audience: "items", ClockSkew: 30 * time.Second, Keys: keys})
+		j.now = func() time.Time { return now }
+		return j
+	}
+
+	for name, tt := range map[string]struct {
+		method jwt.SigningMethod
+		sign   interface{}
+		keys   KeySource
+	}{
+		"HS256": {jwt.SigningMethodHS256, secret, HMACKey(secret)},
+		"RS256": {jwt.SigningMethodRS256, rsaKey, rsaKeys},
+		"ES256": {jwt.SigningMethodES256, ecKey, ecKeys},
+	} {
+		p, err := verifier(tt.keys).Verify(ctx, sign(t, tt.method, tt.sign, "", claims(nil)))
+		if assert.NoError(t, err, name) {
+			assert.Equal(t, "svc-orders", p.Subject, name)
+			assert.Equal(t, "jwt", p.Method, name)
+			assert.Equal(t, []string{"items:read", "items:write"}, p.Scopes, name)
+			assert.Equal(t, "https://issuer.example.com", p.Claims["iss"], name)
+		}
+	}
+
+	j := verifier(HMACKey(secret))
+	for name, c := range map[string]jwt.MapClaims{
+		"expired":          {"exp": now.Add(-time.Minute).Unix()},
+		"no exp":           {"exp": nil},
+		"not yet":          {"nbf": now.Add(time.Minute).Unix()},
+		"issued in future": {"iat": now.Add(time.Minute).Unix()},
+		"wrong issuer":     {"iss": "https://evil.example.com"},
+		"wrong audience":   {"aud": "billing"},
+		"no subject":       {"sub": nil},
+	} {
+		_, err := j.Verify(ctx, sign(t, jwt.SigningMethodHS256, secret, "", claims(c)))
+		assert.ErrorIs(t, err, ErrInvalidCredentials, name)
+	}
+
+	// a few seconds off is what the skew is for
+	for name, c := range map[string]jwt.MapClaims{
+		"just expired": {"exp": now.Add(-10 * time.Second).Unix()},
+		"nearly valid": {"nbf": now.Add(10 * time.Second).Unix()},
+		"scp list":     {"scope": nil, "scp": []string{"items:read"}},
+		"aud list":     {"aud": []string{"billing", "items"}},
+	} {
+		_, err := j.Verify(ctx, sign(t, jwt.SigningMethodHS256, secret, "", claims(c)))
+		assert.NoError(t, err, name)
+	}
+
+	// the wrong key, alg none, and an HS256 token "signed" with the
+	// public key of an RS256 verifier all get turned down
+	_, err = j.Verify(ctx, sign(t, jwt.SigningMethodHS256, []byte("some other secret that is long!!"), "", claims(nil)))
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+	_, err = j.Verify(ctx, sign(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "", claims(nil)))
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+	pubPEM, _ := os.ReadFile(pemFile(t, &rsaKey.PublicKey))
+	_, err = verifier(rsaKeys).Verify(ctx, sign(t, jwt.SigningMethodHS256, pubPEM, "", claims(nil)))
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+
+	r := httptest.NewRequest("GET", "/items", nil)
+	_, err = j.Authenticate(r)
+	assert.ErrorIs(t, err, ErrNoCredentials)
+	r.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+	_, err = j.Authenticate(r)
+	assert.ErrorIs(t, err, ErrNoCredentials)
+	r.Header.Set("Authorization", "bearer "+sign(t, jwt.SigningMethodHS256, secret, "", claims(nil)))
+	p, err := j.Authenticate(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "svc-orders", Claims(With(ctx, p))["sub"])
+	assert.Empty(t, p.Tenant)
+
+	// the tenant claim is only read when there's one configured
+	j.opts.TenantClaim = "org"
+	p, err = j.Verify(ctx, sign(t, jwt.SigningMethodHS256, secret, "", claims(jwt.MapClaims{"org": "acme"})))
+	assert.NoError(t, err)
+	assert.Equal(t, "acme", p.Tenant)
+	p, err = j.Verify(ctx, sign(t, jwt.SigningMethodHS256, secret, "", claims(jwt.MapClaims{"org": 7})))
+	assert.NoError(t, err)
+	assert.Empty(t, p.Tenant)
+}
+
+func ecJWK(kid string, pub *ecdsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "EC", "crv": "P-256", "kid": kid, "use": "sig",
+		"x": base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, 32))),
+		"y": base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	ctx := context.Background()
+	old, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rotated, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	var mu sync.Mutex
+	var fetches int
+	var hold chan struct{}
+	set := []map[string]string{
+		ecJWK("old", &old.PublicKey),
+		{"kty": "RSA", "kid": "rsa", "alg": "RS256",
+			"n": base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "crv": "P-384", "kid": "unsupported"},
+		{"kty": "oct", "kid": "enc", "use": "enc", "k": "c2VjcmV0"},
+		{"kty": "oct", "kid": "hmac", "alg": "HS256", "k": "c2VjcmV0"},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		wait := hold
+		mu.Unlock()
+		if wait != nil {
+			<-wait
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		fetches++
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": set})
+	}))
+	defer srv.Close()
+
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	jwks := NewJWKS(srv.URL, 5*time.Minute)
+	jwks.now = func() time.Time { return now }
+
+	keys, err := jwks.Keys(ctx, "old", ES256)
+	assert.NoError(t, err)
+	assert.Len(t, keys, 1)
+	keys, err = jwks.Keys(ctx, "rsa", RS256)
+	assert.NoError(t, err)
+	assert.Len(t, keys, 1)
+	// a kid is only good for its own algorithm
+	_, err = jwks.Keys(ctx, "rsa", ES256)
+	assert.ErrorIs(t, err, ErrNoKey)
+	_, err = jwks.Keys(ctx, "enc", HS256)
+	assert.ErrorIs(t, err, ErrNoKey)
+	// a secret anyone can fetch would let anyone sign
+	_, err = jwks.Keys(ctx, "hmac", HS256)
+	assert.ErrorIs(t, err, ErrNoKey)
+
+	// the unknown kids above made it look once, that's all
+	assert.Equal(t, 2, fetches)
+
+	// the issuer rotates, tokens with the new kid make us look again
+	mu.Lock()
+	set = append(set, ecJWK("new", &rotated.PublicKey))
+	mu.Unlock()
+	now = now.Add(jwksMissEvery)
+	_, err = jwks.Keys(ctx, "new", ES256)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, fetches)
+
+	// but not for every made up kid
+	_, err = jwks.Keys(ctx, "made-up", ES256)
+	assert.ErrorIs(t, err, ErrNoKey)
+	assert.Equal(t, 3, fetches)
+
+	// a refresh goes on in the background, a slow issuer doesn't hold up
+	// the kids we have
+	mu.Lock()
+	hold = make(chan struct{})
+	mu.Unlock()
+	now = now.Add(5 * time.Minute)
+	got := make(chan error)
+	go func() {
+		_, err := jwks.Keys(ctx, "new", ES256)
+		got <- err
+	}()
+	select {
+	case err := <-got:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("a refresh held up a kid we have a key for")
+	}
+	close(hold)
+	assert.NoError(t, jwks.Refresh(ctx))
+
+	// the issuer going away keeps the keys we have
+	srv.Close()
+	now = now.Add(10 * time.Minute)
+	_, err = jwks.Keys(ctx, "new", ES256)
+	assert.NoError(t, err)
+
+	// and a file works the same
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	data, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{ecJWK("file", &old.PublicKey)}})
+	assert.NoError(t, os.WriteFile(path, data, 0o600))
+	keys, err = NewJWKS(path, time.Minute).Keys(ctx, "file", ES256)
+	assert.NoError(t, err)
+	assert.Len(t, keys, 1)
+
+	_, err = NewJWKS(filepath.Join(t.TempDir(), "nope.json"), time.Minute).Keys(ctx, "", ES256)
+	assert.Error(t, err)
+}
+
+func TestLoadKeyFile(t *testing.T) {
+	_, err := LoadKeyFile(filepath.Join(t.TempDir(), "nope.pem"))
+	assert.Error(t, err)
+
+	path := filepath.Join(t.TempDir(), "empty.pem")
+	assert.NoError(t, os.WriteFile(path, []byte("not pem"), 0o600))
+	_, err = LoadKeyFile(path)
+	assert.Error(t, err)
+
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	_, err = LoadKeyFile(pemFile(t, &p384.PublicKey))
+	assert.ErrorContains(t, err, "P-256")
+}
+
+func TestPolicy(t *testing.T) {
+	pol := DefaultPolicy()
+
+	reader := &Principal{Scopes: []string{ScopeItemsRead}}
+	assert.True(t, pol.Allowed(reader, ScopeItemsRead))
+	assert.False(t, pol.Allowed(reader, ScopeItemsWrite))
+	assert.Equal(t, []string{ScopeItemsWrite, ScopeItemsDelete}, pol.Missing(reader, ScopeItemsRead, ScopeItemsWrite, ScopeItemsDelete))
+
+	// admin implies the item scopes, roles grant theirs
+	admin := &Principal{Scopes: []string{ScopeAdmin}}
+	assert.Equal(t, []string{ScopeAdmin, ScopeItemsDelete, ScopeItemsRead, ScopeItemsWrite}, pol.Granted(admin))
+	editor := &Principal{Roles: []string{"editor", "no such role"}}
+	assert.Equal(t, []string{ScopeItemsRead, ScopeItemsWrite}, pol.Granted(editor))
+	assert.True(t, pol.Allowed(&Principal{Roles: []string{"admin"}}, ScopeItemsDelete))
+
+	// nobody gets anything, and nothing required is always fine
+	assert.Equal(t, []string{ScopeItemsRead}, pol.Missing(nil, ScopeItemsRead))
+	assert.True(t, pol.Allowed(reader))
+
+	// implications can go around in circles without looping forever
+	loop := Policy{Implies: map[string][]string{"a": {"b"}, "b": {"a"}}}
+	assert.Equal(t, []string{"a", "b"}, loop.Granted(&Principal{Scopes: []string{"b"}}))
+}
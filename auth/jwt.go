@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/mar-cial/items/logging"
+)
+
+// JWTOptions are what a token has to live up to. Issuer and Audience are
+// checked when they're set, ClockSkew is how far off exp, nbf and iat can
+// be and still count. TenantClaim is the claim that ties a token to a
+// tenant, if there's one.
+type JWTOptions struct {
+	Issuer      string
+	Audience    string
+	ClockSkew   time.Duration
+	Keys        KeySource
+	TenantClaim string
+}
+
+// JWT checks bearer tokens from the services we trust.
+type JWT struct {
+	opts JWTOptions
+	now  func() time.Time
+}
+
+func NewJWT(opts JWTOptions) *JWT {
+	return &JWT{opts: opts, now: time.Now}
+}
+
+// Authenticate checks the bearer token in Authorization, if there is one.
+func (j *JWT) Authenticate(r *http.Request) (*Principal, error) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return nil, ErrNoCredentials
+	}
+	return j.Verify(r.Context(), strings.TrimSpace(token))
+}
+
+// Verify checks token's signature and claims. Everything it finds in the
+// token ends up in Principal.Claims.
+func (j *JWT) Verify(ctx context.Context, token string) (*Principal, error) {
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{HS256, RS256, ES256}),
+		jwt.WithLeeway(j.opts.ClockSkew),
+		jwt.WithTimeFunc(j.now),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	}
+	if j.opts.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(j.opts.Issuer))
+	}
+	if j.opts.Audience != "" {
+		opts = append(opts, jwt.WithAudience(j.opts.Audience))
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.NewParser(opts...).ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		keys, err := j.opts.Keys.Keys(ctx, kid, t.Method.Alg())
+		if err != nil {
+			return nil, err
+		}
+		set := jwt.VerificationKeySet{}
+		for _, k := range keys {
+			set.Keys = append(set.Keys, k)
+		}
+		return set, nil
+	})
+	if err != nil {
+		if errors.Is(err, jwt.ErrTokenUnverifiable) && !errors.Is(err, ErrNoKey) {
+			// our side of it, like the jwks not loading
+			logging.From(ctx).Warn("can't verify token", slog.Any("err", err))
+		}
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+
+	sub, _ := claims.GetSubject()
+	if sub == "" {
+		return nil, fmt.Errorf("%w: token has no subject", ErrInvalidCredentials)
+	}
+
+	p := &Principal{
+		Subject: sub,
+		Name:    sub,
+		Method:  "jwt",
+		Scopes:  claimList(claims, "scope", "scp"),
+		Roles:   claimList(claims, "roles"),
+		Claims:  claims,
+	}
+	if j.opts.TenantClaim != "" {
+		p.Tenant, _ = claims[j.opts.TenantClaim].(string)
+	}
+	return p, nil
+}
+
+// claimList collects the claims in names. Each one is either a space
+// separated string, like the OAuth scope claim, or a list, like scp is
+// with some issuers.
+func claimList(claims jwt.MapClaims, names ...string) []string {
+	var out []string
+	for _, name := range names {
+		switch v := claims[name].(type) {
+		case string:
+			out = append(out, strings.Fields(v)...)
+		case []interface{}:
+			for _, s := range v {
+				if s, ok := s.(string); ok {
+					out = append(out, s)
+				}
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,410 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mar-cial/items/logging"
+)
+
+// The algorithms we take tokens in. Each one only ever gets checked with
+// its own kind of key, so an RS256 public key can't be passed off as an
+// HS256 secret.
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	ES256 = "ES256"
+)
+
+// ErrNoKey is a token nobody has a key for.
+var ErrNoKey = errors.New("no key for token")
+
+// KeySource finds the keys a token with key id kid and algorithm alg
+// could have been signed with.
+type KeySource interface {
+	Keys(ctx context.Context, kid, alg string) ([]interface{}, error)
+}
+
+// key is one verification key, with the algorithm it's for.
+type key struct {
+	id  string
+	alg string
+	key interface{}
+}
+
+// match picks the keys that fit kid and alg. A token without a kid could
+// be from any of them.
+func match(keys []key, kid, alg string) []interface{} {
+	var out []interface{}
+	for _, k := range keys {
+		if k.alg == alg && (kid == "" || k.id == kid) {
+			out = append(out, k.key)
+		}
+	}
+	return out
+}
+
+// algFor says which algorithm a key verifies, "" for keys we don't do.
+func algFor(k interface{}) string {
+	switch k := k.(type) {
+	case []byte:
+		return HS256
+	case *rsa.PublicKey:
+		return RS256
+	case *ecdsa.PublicKey:
+		if k.Curve == elliptic.P256() {
+			return ES256
+		}
+	}
+	return ""
+}
+
+// staticKeys never change.
+type staticKeys []key
+
+func (s staticKeys) Keys(_ context.Context, kid, alg string) ([]interface{}, error) {
+	// keys from a file don't have ids, so the token's one doesn't matter
+	if keys := match(s, "", alg); len(keys) > 0 {
+		return keys, nil
+	}
+	return nil, fmt.Errorf("%w: no %s key", ErrNoKey, alg)
+}
+
+// HMACKey is a shared secret for HS256.
+func HMACKey(secret []byte) KeySource {
+	return staticKeys{{alg: HS256, key: secret}}
+}
+
+// LoadKeyFile reads PEM public keys or certificates, as many as the file
+// has.
+func LoadKeyFile(path string) (KeySource, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("key file: %w", err)
+	}
+
+	var keys staticKeys
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		var pub interface{}
+		switch block.Type {
+		case "PUBLIC KEY":
+			pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			pub, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			cert, err = x509.ParseCertificate(block.Bytes)
+			if err == nil {
+				pub = cert.PublicKey
+			}
+		default:
+			return nil, fmt.Errorf("key file %s: %s blocks aren't public keys", path, block.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key file %s: %w", path, err)
+		}
+
+		alg := algFor(pub)
+		if alg == "" {
+			return nil, fmt.Errorf("key file %s: only RSA and P-256 keys are supported", path)
+		}
+		keys = append(keys, key{alg: alg, key: pub})
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("key file %s: no PEM public keys in it", path)
+	}
+	return keys, nil
+}
+
+const (
+	// jwksMaxBytes is plenty for any key set anyone actually publishes
+	jwksMaxBytes = 1 << 20
+	// jwksMissEvery is how often an unknown kid can make us go and look
+	// again, so a stream of made up kids can't have us hammer the issuer
+	jwksMissEvery = time.Minute
+)
+
+// JWKS is a JSON Web Key Set from a file or an http(s) url. It's kept
+// around for Refresh and looked at again after that, or sooner when a
+// token shows up with a kid we don't have, which is what rotating keys
+// looks like from here. Loading never holds the lock, and only one load
+// runs at a time, so a slow issuer only holds up the tokens we have no
+// key for.
+type JWKS struct {
+	source  string
+	refresh time.Duration
+	client  *http.Client
+	now     func() time.Time
+
+	mu   sync.Mutex
+	keys []key
+	// triedAt is the last load, whether it worked or not, so a broken
+	// source gets tried now and then and not on every request
+	triedAt  time.Time
+	missedAt time.Time
+	// loading is the load in flight, nil when there isn't one
+	loading *jwksLoad
+}
+
+// jwksLoad is one trip to the source. done is closed once it's back, err
+// is only safe to look at after that.
+type jwksLoad struct {
+	done chan struct{}
+	err  error
+}
+
+func (l *jwksLoad) wait(ctx context.Context) error {
+	select {
+	case <-l.done:
+		return l.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func NewJWKS(source string, refresh time.Duration) *JWKS {
+	return &JWKS{
+		source:  source,
+		refresh: refresh,
+		client:  &http.Client{Timeout: 5 * time.Second},
+		now:     time.Now,
+	}
+}
+
+func (j *JWKS) Keys(ctx context.Context, kid, alg string) ([]interface{}, error) {
+	j.mu.Lock()
+	now := j.now()
+	since := now.Sub(j.triedAt)
+	due := j.triedAt.IsZero() || since >= j.refresh || (j.keys == nil && since >= jwksMissEvery)
+	have := j.keys != nil
+	j.mu.Unlock()
+
+	if due {
+		l := j.load(ctx)
+		// with keys to go on the old ones do until the new ones are in,
+		// without there's nothing to do but wait
+		if !have {
+			if err := l.wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	j.mu.Lock()
+	if j.keys == nil {
+		j.mu.Unlock()
+		return nil, fmt.Errorf("%w: jwks %s isn't loaded", ErrNoKey, j.source)
+	}
+	keys := match(j.keys, kid, alg)
+	missed := len(keys) == 0 && kid != "" && now.Sub(j.missedAt) >= jwksMissEvery
+	if missed {
+		j.missedAt = now
+	}
+	j.mu.Unlock()
+
+	if missed {
+		if err := j.load(ctx).wait(ctx); err == nil {
+			j.mu.Lock()
+			keys = match(j.keys, kid, alg)
+			j.mu.Unlock()
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: no %s key %q", ErrNoKey, alg, kid)
+	}
+	return keys, nil
+}
+
+// Refresh loads the key set now.
+func (j *JWKS) Refresh(ctx context.Context) error {
+	return j.load(ctx).wait(ctx)
+}
+
+// load starts loading the key set, or hands back the load that's already
+// going. It carries on if ctx is cancelled, somebody else might be waiting
+// for it. When it fails the keys we had stay, an issuer that's down for a
+// bit shouldn't lock everyone out.
+func (j *JWKS) load(ctx context.Context) *jwksLoad {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.loading != nil {
+		return j.loading
+	}
+
+	l := &jwksLoad{done: make(chan struct{})}
+	j.loading = l
+	j.triedAt = j.now()
+
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		defer close(l.done)
+
+		keys, err := j.fetch(ctx)
+		if err != nil {
+			l.err = fmt.Errorf("jwks %s: %w", j.source, err)
+			logging.From(ctx).Warn("loading jwks", slog.Any("err", l.err))
+		}
+
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		if err == nil {
+			j.keys = keys
+		}
+		j.loading = nil
+	}()
+	return l
+}
+
+func (j *JWKS) fetch(ctx context.Context) ([]key, error) {
+	data, err := j.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(data)
+}
+
+func (j *JWKS) read(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(j.source, "http://") && !strings.HasPrefix(j.source, "https://") {
+		return os.ReadFile(j.source)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.source, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := j.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got %s", res.Status)
+	}
+	return io.ReadAll(io.LimitReader(res.Body, jwksMaxBytes))
+}
+
+// jwk is the parts of RFC 7517 we look at.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// parseJWKS skips keys that aren't for signatures or that we can't use,
+// one odd key shouldn't take the others down with it.
+func parseJWKS(data []byte) ([]key, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	var keys []key
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.key()
+		if err != nil {
+			continue
+		}
+		alg := algFor(pub)
+		if alg == "" || (k.Alg != "" && k.Alg != alg) {
+			continue
+		}
+		keys = append(keys, key{id: k.Kid, alg: alg, key: pub})
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no usable keys")
+	}
+	return keys, nil
+}
+
+func (k jwk) key() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := b64Int(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64Int(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("bad rsa exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("bad P-256 point")
+		}
+		// ecdh checks the point is actually on the curve
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+
+	case "oct":
+		// a secret anyone who can get at the set can read is no secret,
+		// HS256 only goes with JWT_HMAC_SECRET
+		return nil, errors.New("oct keys aren't taken from a jwks")
+	}
+	return nil, fmt.Errorf("unsupported kty %s", k.Kty)
+}
+
+func b64Int(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("bad base64url number")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,98 @@
+package auth
+
+import "sort"
+
+// The scopes routes can ask for. ScopeAdmin is in auth.go, it came first.
+const (
+	ScopeItemsRead   = "items:read"
+	ScopeItemsWrite  = "items:write"
+	ScopeItemsDelete = "items:delete"
+)
+
+// Scopes is every scope there is, for checking keys and for the docs.
+func Scopes() []string {
+	return []string{ScopeItemsRead, ScopeItemsWrite, ScopeItemsDelete, ScopeAdmin}
+}
+
+// Policy is what a principal is allowed, worked out from its scopes and
+// roles. It knows nothing about http, the api package asks it about
+// routes.
+type Policy struct {
+	// Roles are what each role in a token's roles claim grants.
+	Roles map[string][]string
+	// Implies are scopes that come with other scopes.
+	Implies map[string][]string
+}
+
+// DefaultPolicy has admin able to do everything and roles for the usual
+// kinds of caller.
+func DefaultPolicy() Policy {
+	return Policy{
+		Roles: map[string][]string{
+			"viewer":     {ScopeItemsRead},
+			"editor":     {ScopeItemsRead, ScopeItemsWrite},
+			"maintainer": {ScopeItemsRead, ScopeItemsWrite, ScopeItemsDelete},
+			"admin":      {ScopeAdmin},
+		},
+		Implies: map[string][]string{
+			ScopeAdmin: {ScopeItemsRead, ScopeItemsWrite, ScopeItemsDelete},
+		},
+	}
+}
+
+// Granted is every scope p ends up with, sorted.
+func (pol Policy) Granted(p *Principal) []string {
+	if p == nil {
+		return nil
+	}
+
+	granted := map[string]bool{}
+	var add func(scope string)
+	add = func(scope string) {
+		if granted[scope] {
+			return
+		}
+		granted[scope] = true
+		for _, s := range pol.Implies[scope] {
+			add(s)
+		}
+	}
+
+	for _, s := range p.Scopes {
+		add(s)
+	}
+	for _, role := range p.Roles {
+		for _, s := range pol.Roles[role] {
+			add(s)
+		}
+	}
+
+	out := make([]string, 0, len(granted))
+	for s := range granted {
+		out = append(out, s)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Missing is the scopes out of required that p doesn't have, nil when it
+// has them all. Nobody has anything, so for nil it's all of them.
+func (pol Policy) Missing(p *Principal, required ...string) []string {
+	granted := map[string]bool{}
+	for _, s := range pol.Granted(p) {
+		granted[s] = true
+	}
+
+	var missing []string
+	for _, s := range required {
+		if !granted[s] {
+			missing = append(missing, s)
+		}
+	}
+	return missing
+}
+
+// Allowed is Missing for when all you want is yes or no.
+func (pol Policy) Allowed(p *Principal, required ...string) bool {
+	return len(pol.Missing(p, required...)) == 0
+}
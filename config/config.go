@@ -0,0 +1,480 @@
+// Package config builds the one Config the server runs with. Values come
+// from, lowest to highest precedence: defaults, a YAML or TOML file, env
+// vars (with _FILE variants for secrets) and command line flags.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	Server    ServerConfig    `yaml:"server" toml:"server"`
+	Mongo     MongoConfig     `yaml:"mongo" toml:"mongo"`
+	Tracing   TracingConfig   `yaml:"tracing" toml:"tracing"`
+	Log       LogConfig       `yaml:"log" toml:"log"`
+	Auth      AuthConfig      `yaml:"auth" toml:"auth"`
+	Tenancy   TenancyConfig   `yaml:"tenancy" toml:"tenancy"`
+	RateLimit RateLimitConfig `yaml:"rate_limit" toml:"rate_limit"`
+
+	// PrintConfig means dump the redacted config and exit instead of
+	// serving. Only ever set by the flag.
+	PrintConfig bool `yaml:"-" toml:"-"`
+}
+
+type ServerConfig struct {
+	Port           int           `yaml:"port" toml:"port"`
+	RequestTimeout time.Duration `yaml:"request_timeout" toml:"request_timeout"`
+	// ShutdownTimeout is how long in-flight requests get to finish once
+	// the server is told to stop.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	// ShutdownDelay is how long the server keeps taking requests after
+	// readiness flips, so load balancers and readiness probes notice
+	// before the listener closes. It comes out of ShutdownTimeout.
+	ShutdownDelay time.Duration `yaml:"shutdown_delay" toml:"shutdown_delay"`
+	MaxBodyBytes  int64         `yaml:"max_body_bytes" toml:"max_body_bytes"`
+	AccessLog     bool          `yaml:"access_log" toml:"access_log"`
+}
+
+// MongoConfig takes either a full URI or the separate pieces. If URI is
+// set the pieces are ignored.
+type MongoConfig struct {
+	URI        string `yaml:"uri" toml:"uri"`
+	User       string `yaml:"user" toml:"user"`
+	Password   string `yaml:"password" toml:"password"`
+	Host       string `yaml:"host" toml:"host"`
+	Port       int    `yaml:"port" toml:"port"`
+	Database   string `yaml:"database" toml:"database"`
+	Collection string `yaml:"collection" toml:"collection"`
+}
+
+// TracingConfig picks where spans go. Exporter is none, stdout or file,
+// file appends OTLP JSON to File, a line per batch.
+type TracingConfig struct {
+	Exporter    string  `yaml:"exporter" toml:"exporter"`
+	File        string  `yaml:"file" toml:"file"`
+	SampleRatio float64 `yaml:"sample_ratio" toml:"sample_ratio"`
+	ServiceName string  `yaml:"service_name" toml:"service_name"`
+}
+
+// LogConfig is the level (debug, info, warn, error) and the format (json,
+// text) of the logs.
+type LogConfig struct {
+	Level  string `yaml:"level" toml:"level"`
+	Format string `yaml:"format" toml:"format"`
+}
+
+// AuthConfig is who gets in. With Enabled the item and admin routes want
+// an api key. BootstrapKey is an admin key that lives only here and not in
+// the database, it's how the first real keys get made. Enabled needs it or
+// JWT, or nobody could make any.
+type AuthConfig struct {
+	Enabled        bool      `yaml:"enabled" toml:"enabled"`
+	BootstrapKey   string    `yaml:"bootstrap_key" toml:"bootstrap_key"`
+	KeysCollection string    `yaml:"keys_collection" toml:"keys_collection"`
+	JWT            JWTConfig `yaml:"jwt" toml:"jwt"`
+}
+
+// JWTConfig is for bearer tokens from our other services. Setting one of
+// HMACSecret, KeyFile or JWKS switches them on. KeyFile is PEM public keys
+// or certificates, JWKS a key set file or an http(s) url that's fetched
+// again every JWKSRefresh.
+type JWTConfig struct {
+	Issuer      string        `yaml:"issuer" toml:"issuer"`
+	Audience    string        `yaml:"audience" toml:"audience"`
+	HMACSecret  string        `yaml:"hmac_secret" toml:"hmac_secret"`
+	KeyFile     string        `yaml:"key_file" toml:"key_file"`
+	JWKS        string        `yaml:"jwks" toml:"jwks"`
+	JWKSRefresh time.Duration `yaml:"jwks_refresh" toml:"jwks_refresh"`
+	ClockSkew   time.Duration `yaml:"clock_skew" toml:"clock_skew"`
+}
+
+// Enabled is whether any keys are configured.
+func (c JWTConfig) Enabled() bool {
+	return c.HMACSecret != "" || c.KeyFile != "" || c.JWKS != ""
+}
+
+// TenancyConfig splits the items between teams. Strategy is none (all of
+// them share the collection, like before), field (a tenant field on every
+// item) or collection (a collection per tenant, named after the items
+// one). A request's tenant comes from its credentials, the Claim in a
+// token or the tenant a key was made for, and otherwise from Header or
+// the subdomain of Domain. MaxItems is every tenant's quota, Quotas
+// overrides it for some, 0 is no limit. The counts are kept in mongo, so
+// the quotas hold across servers.
+type TenancyConfig struct {
+	Strategy string           `yaml:"strategy" toml:"strategy"`
+	Header   string           `yaml:"header" toml:"header"`
+	Domain   string           `yaml:"domain" toml:"domain"`
+	Claim    string           `yaml:"claim" toml:"claim"`
+	MaxItems int64            `yaml:"max_items" toml:"max_items"`
+	Quotas   map[string]int64 `yaml:"quotas" toml:"quotas"`
+}
+
+// Enabled is whether items are split by tenant at all.
+func (c TenancyConfig) Enabled() bool {
+	return c.Strategy != "" && c.Strategy != "none"
+}
+
+// Quota is how many items tenant may have, 0 for no limit.
+func (c TenancyConfig) Quota(tenant string) int64 {
+	if n, ok := c.Quotas[tenant]; ok {
+		return n
+	}
+	return c.MaxItems
+}
+
+// RateLimitConfig is how many requests a client gets: Rate a second on
+// average and up to Burst at once, a Rate of 0 switches it off. By is who
+// counts as one client: client (their api key or token, else their
+// tenant, else their ip), tenant (else the ip) or ip. TrustedProxies are
+// the addresses or CIDRs of the load balancers in front, whose
+// X-Forwarded-For or Forwarded says what the client's ip is. Without any
+// the ip is whatever connected.
+type RateLimitConfig struct {
+	Rate           float64  `yaml:"rate" toml:"rate"`
+	Burst          int      `yaml:"burst" toml:"burst"`
+	By             string   `yaml:"by" toml:"by"`
+	TrustedProxies []string `yaml:"trusted_proxies" toml:"trusted_proxies"`
+}
+
+// Proxies is TrustedProxies parsed, a plain address is a prefix of one.
+// Anything that doesn't parse is left out, Validate has already said so.
+func (c RateLimitConfig) Proxies() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, p := range c.TrustedProxies {
+		if prefix, err := parsePrefix(p); err == nil {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	return prefix.Masked(), err
+}
+
+// tenantID is tenant.Pattern. It's copied rather than imported so config
+// doesn't depend on the rest of the app.
+var tenantID = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// bootstrapKeyMinLen keeps the bootstrap key from being something
+// guessable, it's admin on everything.
+const bootstrapKeyMinLen = 32
+
+func Default() Config {
+	return Config{
+		Server: ServerConfig{
+			Port:            8000,
+			RequestTimeout:  10 * time.Second,
+			ShutdownTimeout: 15 * time.Second,
+			ShutdownDelay:   5 * time.Second,
+			MaxBodyBytes:    1 << 20,
+			AccessLog:       true,
+		},
+		Mongo: MongoConfig{
+			Host: "localhost",
+			Port: 27017,
+		},
+		Tracing: TracingConfig{
+			Exporter:    "none",
+			SampleRatio: 1,
+			ServiceName: "items",
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "json",
+		},
+		Auth: AuthConfig{
+			Enabled:        true,
+			KeysCollection: "api_keys",
+			JWT: JWTConfig{
+				JWKSRefresh: 5 * time.Minute,
+				ClockSkew:   30 * time.Second,
+			},
+		},
+		Tenancy: TenancyConfig{
+			Strategy: "none",
+			Header:   "X-Tenant",
+			Claim:    "tenant",
+		},
+		RateLimit: RateLimitConfig{
+			Rate:  10,
+			Burst: 50,
+			By:    "client",
+		},
+	}
+}
+
+// Addr is what the http server listens on.
+func (c ServerConfig) Addr() string {
+	return fmt.Sprintf(":%d", c.Port)
+}
+
+// ConnectionURI is URI if there is one, otherwise it's put together from
+// the pieces with the user and password escaped.
+func (c MongoConfig) ConnectionURI() string {
+	if c.URI != "" {
+		return c.URI
+	}
+
+	u := url.URL{
+		Scheme: "mongodb",
+		Host:   net.JoinHostPort(c.Host, strconv.Itoa(c.Port)),
+	}
+	if c.User != "" {
+		u.User = url.UserPassword(c.User, c.Password)
+	}
+	return u.String()
+}
+
+// Validate reports everything that's wrong at once, not just the first
+// thing.
+func (c Config) Validate() error {
+	var errs []string
+	bad := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		bad("server port %d is out of range", c.Server.Port)
+	}
+	if c.Server.RequestTimeout < 0 {
+		bad("request timeout can't be negative")
+	}
+	if c.Server.ShutdownTimeout < 0 {
+		bad("shutdown timeout can't be negative")
+	}
+	if c.Server.ShutdownDelay < 0 {
+		bad("shutdown delay can't be negative")
+	}
+	if c.Server.ShutdownTimeout > 0 && c.Server.ShutdownDelay >= c.Server.ShutdownTimeout {
+		bad("shutdown delay has to be shorter than the shutdown timeout, or nothing gets to drain")
+	}
+	if c.Server.MaxBodyBytes < 0 {
+		bad("max body bytes can't be negative")
+	}
+
+	if c.Mongo.URI != "" {
+		u, err := url.Parse(c.Mongo.URI)
+		if err != nil || (u.Scheme != "mongodb" && u.Scheme != "mongodb+srv") {
+			bad("mongo uri has to be a mongodb:// or mongodb+srv:// url")
+		}
+	} else {
+		if c.Mongo.Host == "" {
+			bad("mongo host is required when there's no mongo uri")
+		}
+		if c.Mongo.Port < 1 || c.Mongo.Port > 65535 {
+			bad("mongo port %d is out of range", c.Mongo.Port)
+		}
+		if c.Mongo.Password != "" && c.Mongo.User == "" {
+			bad("mongo password is set without a user")
+		}
+	}
+	if c.Mongo.Database == "" {
+		bad("mongo database is required")
+	}
+	if c.Mongo.Collection == "" {
+		bad("mongo collection is required")
+	}
+
+	switch c.Tracing.Exporter {
+	case "none", "stdout":
+	case "file":
+		if c.Tracing.File == "" {
+			bad("tracing file is required with the file exporter")
+		}
+	default:
+		bad("tracing exporter has to be none, stdout or file")
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		bad("tracing sample ratio has to be between 0 and 1")
+	}
+
+	switch strings.ToLower(c.Log.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		bad("log level has to be debug, info, warn or error")
+	}
+	if c.Log.Format != "json" && c.Log.Format != "text" {
+		bad("log format has to be json or text")
+	}
+
+	if c.Auth.BootstrapKey != "" && len(c.Auth.BootstrapKey) < bootstrapKeyMinLen {
+		bad("auth bootstrap key has to be at least %d characters", bootstrapKeyMinLen)
+	}
+	// with auth on and neither, nobody ever gets in to make the first key
+	if c.Auth.Enabled && c.Auth.BootstrapKey == "" && !c.Auth.JWT.Enabled() {
+		bad("auth needs a bootstrap key or jwt, or turn it off")
+	}
+	if c.Auth.KeysCollection == "" {
+		bad("auth keys collection is required")
+	} else if c.Auth.KeysCollection == c.Mongo.Collection {
+		bad("auth keys collection can't be the items collection")
+	} else if strings.HasPrefix(c.Auth.KeysCollection, c.Mongo.Collection+"_") {
+		bad("auth keys collection can't start with %s_, that's what tenants' collections are called", c.Mongo.Collection)
+	}
+
+	if jwt := c.Auth.JWT; jwt.Enabled() {
+		sources := 0
+		for _, s := range []string{jwt.HMACSecret, jwt.KeyFile, jwt.JWKS} {
+			if s != "" {
+				sources++
+			}
+		}
+		if sources > 1 {
+			bad("jwt takes one of hmac secret, key file or jwks")
+		}
+		if jwt.HMACSecret != "" && len(jwt.HMACSecret) < bootstrapKeyMinLen {
+			bad("jwt hmac secret has to be at least %d characters", bootstrapKeyMinLen)
+		}
+		if u, err := url.Parse(jwt.JWKS); jwt.JWKS != "" && err == nil && u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https" {
+			bad("jwt jwks has to be a file or an http(s) url")
+		}
+		if jwt.Issuer == "" || jwt.Audience == "" {
+			bad("jwt issuer and audience are required")
+		}
+		if jwt.JWKSRefresh <= 0 {
+			bad("jwt jwks refresh has to be positive")
+		}
+		if jwt.ClockSkew < 0 {
+			bad("jwt clock skew can't be negative")
+		}
+	}
+
+	switch c.Tenancy.Strategy {
+	case "none", "field", "collection":
+	default:
+		bad("tenancy strategy has to be none, field or collection")
+	}
+	if c.Tenancy.Enabled() && c.Tenancy.Header == "" && c.Tenancy.Domain == "" && c.Tenancy.Claim == "" {
+		bad("tenancy needs a header, domain or claim to get the tenant from")
+	}
+	if strings.ContainsAny(c.Tenancy.Header, " \t\r\n:") {
+		bad("tenancy header %q isn't a header name", c.Tenancy.Header)
+	}
+	if c.Tenancy.Domain != "" && (strings.Contains(c.Tenancy.Domain, ":") || strings.HasPrefix(c.Tenancy.Domain, ".")) {
+		bad("tenancy domain has to be a plain host name like items.example.com")
+	}
+	if c.Tenancy.MaxItems < 0 {
+		bad("tenancy max items can't be negative")
+	}
+	for _, t := range sortedKeys(c.Tenancy.Quotas) {
+		if !tenantID.MatchString(t) {
+			bad("tenancy quota for %q: not a tenant id", t)
+		}
+		if c.Tenancy.Quotas[t] < 0 {
+			bad("tenancy quota for %q can't be negative", t)
+		}
+	}
+
+	if c.RateLimit.Rate < 0 {
+		bad("rate limit rate can't be negative")
+	}
+	if c.RateLimit.Rate > 0 && c.RateLimit.Burst < 1 {
+		bad("rate limit burst has to be at least 1")
+	}
+	switch c.RateLimit.By {
+	case "client", "tenant", "ip":
+	default:
+		bad("rate limit by has to be client, tenant or ip")
+	}
+	for _, p := range c.RateLimit.TrustedProxies {
+		if _, err := parsePrefix(p); err != nil {
+			bad("rate limit trusted proxy %q isn't an address or CIDR", p)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New("invalid config: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+const redacted = "REDACTED"
+
+// Redacted is a copy that's safe to print or log.
+func (c Config) Redacted() Config {
+	if c.Mongo.Password != "" {
+		c.Mongo.Password = redacted
+	}
+	if c.Mongo.URI != "" {
+		c.Mongo.URI = redactURI(c.Mongo.URI)
+	}
+	if c.Auth.BootstrapKey != "" {
+		c.Auth.BootstrapKey = redacted
+	}
+	if c.Auth.JWT.HMACSecret != "" {
+		c.Auth.JWT.HMACSecret = redacted
+	}
+	return c
+}
+
+// LogValue makes slog log the redacted config, so handing the whole thing
+// to a logger can't leak the password.
+func (c Config) LogValue() slog.Value {
+	r := c.Redacted()
+	return slog.GroupValue(
+		slog.Int("port", r.Server.Port),
+		slog.Any("mongo", r.Mongo),
+		slog.String("tracing", r.Tracing.Exporter),
+		slog.String("log_level", r.Log.Level),
+		slog.Bool("auth", r.Auth.Enabled),
+		slog.Bool("jwt", r.Auth.JWT.Enabled()),
+		slog.String("tenancy", r.Tenancy.Strategy),
+		slog.Float64("rate_limit", r.RateLimit.Rate),
+	)
+}
+
+// LogValue is the redacted connection details.
+func (c MongoConfig) LogValue() slog.Value {
+	r := Config{Mongo: c}.Redacted().Mongo
+	if r.URI != "" {
+		return slog.GroupValue(
+			slog.String("uri", r.URI),
+			slog.String("database", r.Database),
+			slog.String("collection", r.Collection),
+		)
+	}
+	return slog.GroupValue(
+		slog.String("user", r.User),
+		slog.String("host", r.Host),
+		slog.Int("port", r.Port),
+		slog.String("database", r.Database),
+		slog.String("collection", r.Collection),
+	)
+}
+
+func redactURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		// can't tell where the password is, so hide all of it
+		return redacted
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	return u.String()
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
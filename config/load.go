@@ -0,0 +1,337 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// envVars maps each env var to the field it sets. The DB* and SERVERPORT
+// names are the ones compose.yml has always passed in.
+var envVars = []struct {
+	name   string
+	secret bool
+	set    func(c *Config, v string) error
+}{
+	{"SERVERPORT", false, func(c *Config, v string) error { return setInt(&c.Server.Port, v) }},
+	{"REQUEST_TIMEOUT", false, func(c *Config, v string) error { return setDuration(&c.Server.RequestTimeout, v) }},
+	{"SHUTDOWN_TIMEOUT", false, func(c *Config, v string) error { return setDuration(&c.Server.ShutdownTimeout, v) }},
+	{"SHUTDOWN_DELAY", false, func(c *Config, v string) error { return setDuration(&c.Server.ShutdownDelay, v) }},
+	{"MAX_BODY_BYTES", false, func(c *Config, v string) error { return setInt64(&c.Server.MaxBodyBytes, v) }},
+	{"ACCESS_LOG", false, func(c *Config, v string) error { return setBool(&c.Server.AccessLog, v) }},
+	{"MONGODB_URI", true, func(c *Config, v string) error { c.Mongo.URI = v; return nil }},
+	{"DBUSER", true, func(c *Config, v string) error { c.Mongo.User = v; return nil }},
+	{"DBPASS", true, func(c *Config, v string) error { c.Mongo.Password = v; return nil }},
+	{"DBHOST", false, func(c *Config, v string) error { c.Mongo.Host = v; return nil }},
+	{"DBPORT", false, func(c *Config, v string) error { return setInt(&c.Mongo.Port, v) }},
+	{"DBNAME", false, func(c *Config, v string) error { c.Mongo.Database = v; return nil }},
+	{"DBCOLL", false, func(c *Config, v string) error { c.Mongo.Collection = v; return nil }},
+	{"TRACING_EXPORTER", false, func(c *Config, v string) error { c.Tracing.Exporter = v; return nil }},
+	{"TRACING_FILE", false, func(c *Config, v string) error { c.Tracing.File = v; return nil }},
+	{"TRACING_SAMPLE_RATIO", false, func(c *Config, v string) error { return setFloat(&c.Tracing.SampleRatio, v) }},
+	{"LOG_LEVEL", false, func(c *Config, v string) error { c.Log.Level = v; return nil }},
+	{"LOG_FORMAT", false, func(c *Config, v string) error { c.Log.Format = v; return nil }},
+	{"OTEL_SERVICE_NAME", false, func(c *Config, v string) error { c.Tracing.ServiceName = v; return nil }},
+	{"AUTH_ENABLED", false, func(c *Config, v string) error { return setBool(&c.Auth.Enabled, v) }},
+	{"AUTH_BOOTSTRAP_KEY", true, func(c *Config, v string) error { c.Auth.BootstrapKey = v; return nil }},
+	{"AUTH_KEYS_COLLECTION", false, func(c *Config, v string) error { c.Auth.KeysCollection = v; return nil }},
+	{"JWT_ISSUER", false, func(c *Config, v string) error { c.Auth.JWT.Issuer = v; return nil }},
+	{"JWT_AUDIENCE", false, func(c *Config, v string) error { c.Auth.JWT.Audience = v; return nil }},
+	{"JWT_HMAC_SECRET", true, func(c *Config, v string) error { c.Auth.JWT.HMACSecret = v; return nil }},
+	{"JWT_KEY_FILE", false, func(c *Config, v string) error { c.Auth.JWT.KeyFile = v; return nil }},
+	{"JWT_JWKS", false, func(c *Config, v string) error { c.Auth.JWT.JWKS = v; return nil }},
+	{"JWT_JWKS_REFRESH", false, func(c *Config, v string) error { return setDuration(&c.Auth.JWT.JWKSRefresh, v) }},
+	{"JWT_CLOCK_SKEW", false, func(c *Config, v string) error { return setDuration(&c.Auth.JWT.ClockSkew, v) }},
+	{"TENANCY_STRATEGY", false, func(c *Config, v string) error { c.Tenancy.Strategy = v; return nil }},
+	{"TENANCY_HEADER", false, func(c *Config, v string) error { c.Tenancy.Header = v; return nil }},
+	{"TENANCY_DOMAIN", false, func(c *Config, v string) error { c.Tenancy.Domain = v; return nil }},
+	{"TENANCY_CLAIM", false, func(c *Config, v string) error { c.Tenancy.Claim = v; return nil }},
+	{"TENANCY_MAX_ITEMS", false, func(c *Config, v string) error { return setInt64(&c.Tenancy.MaxItems, v) }},
+	{"TENANCY_QUOTAS", false, func(c *Config, v string) error { return setQuotas(&c.Tenancy.Quotas, v) }},
+	{"RATELIMIT_RATE", false, func(c *Config, v string) error { return setFloat(&c.RateLimit.Rate, v) }},
+	{"RATELIMIT_BURST", false, func(c *Config, v string) error { return setInt(&c.RateLimit.Burst, v) }},
+	{"RATELIMIT_BY", false, func(c *Config, v string) error { c.RateLimit.By = v; return nil }},
+	{"RATELIMIT_TRUSTED_PROXIES", false, func(c *Config, v string) error { return setList(&c.RateLimit.TrustedProxies, v) }},
+}
+
+// Load builds the config from args (without the program name) and env.
+// getenv is os.Getenv outside of tests. Empty env vars count as not set.
+// If args asked for help the error is flag.ErrHelp.
+func Load(args []string, getenv func(string) string) (Config, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet("items", flag.ContinueOnError)
+	file := fs.String("config", "", "path to a .yaml, .yml or .toml config file (env CONFIG_FILE)")
+	fs.BoolVar(&cfg.PrintConfig, "print-config", false, "print the resolved config with secrets redacted and exit")
+
+	// flags write into their own copy, and only the ones actually given
+	// get copied over once the file and env are in
+	var fl Config
+	fs.IntVar(&fl.Server.Port, "port", 0, "port to serve on (env SERVERPORT)")
+	fs.DurationVar(&fl.Server.RequestTimeout, "request-timeout", 0, "deadline for every request (env REQUEST_TIMEOUT)")
+	fs.DurationVar(&fl.Server.ShutdownTimeout, "shutdown-timeout", 0, "how long in-flight requests get on shutdown (env SHUTDOWN_TIMEOUT)")
+	fs.DurationVar(&fl.Server.ShutdownDelay, "shutdown-delay", 0, "how long to keep serving once readiness fails on shutdown (env SHUTDOWN_DELAY)")
+	fs.Int64Var(&fl.Server.MaxBodyBytes, "max-body-bytes", 0, "request body size limit (env MAX_BODY_BYTES)")
+	fs.BoolVar(&fl.Server.AccessLog, "access-log", false, "log a line per request (env ACCESS_LOG)")
+	fs.StringVar(&fl.Mongo.URI, "mongo-uri", "", "full mongodb connection uri (env MONGODB_URI)")
+	fs.StringVar(&fl.Mongo.User, "db-user", "", "mongo user (env DBUSER)")
+	fs.StringVar(&fl.Mongo.Host, "db-host", "", "mongo host (env DBHOST)")
+	fs.IntVar(&fl.Mongo.Port, "db-port", 0, "mongo port (env DBPORT)")
+	fs.StringVar(&fl.Mongo.Database, "db-name", "", "mongo database (env DBNAME)")
+	fs.StringVar(&fl.Mongo.Collection, "db-coll", "", "mongo collection (env DBCOLL)")
+	fs.StringVar(&fl.Tracing.Exporter, "tracing-exporter", "", "none, stdout or file (env TRACING_EXPORTER)")
+	fs.StringVar(&fl.Tracing.File, "tracing-file", "", "where the file exporter writes spans (env TRACING_FILE)")
+	fs.Float64Var(&fl.Tracing.SampleRatio, "tracing-sample-ratio", 0, "share of traces to keep, 0 to 1 (env TRACING_SAMPLE_RATIO)")
+	fs.StringVar(&fl.Log.Level, "log-level", "", "debug, info, warn or error (env LOG_LEVEL)")
+	fs.StringVar(&fl.Log.Format, "log-format", "", "json or text (env LOG_FORMAT)")
+	fs.BoolVar(&fl.Auth.Enabled, "auth", false, "require an api key on the item and admin routes (env AUTH_ENABLED)")
+	fs.StringVar(&fl.Auth.KeysCollection, "auth-keys-coll", "", "mongo collection for api keys (env AUTH_KEYS_COLLECTION)")
+	fs.StringVar(&fl.Auth.JWT.Issuer, "jwt-issuer", "", "iss tokens have to have (env JWT_ISSUER)")
+	fs.StringVar(&fl.Auth.JWT.Audience, "jwt-audience", "", "aud tokens have to have (env JWT_AUDIENCE)")
+	fs.StringVar(&fl.Auth.JWT.KeyFile, "jwt-key-file", "", "PEM public keys tokens are signed with (env JWT_KEY_FILE)")
+	fs.StringVar(&fl.Auth.JWT.JWKS, "jwt-jwks", "", "JWKS file or url tokens are signed with (env JWT_JWKS)")
+	fs.StringVar(&fl.Tenancy.Strategy, "tenancy", "", "none, field or collection (env TENANCY_STRATEGY)")
+	fs.StringVar(&fl.Tenancy.Domain, "tenancy-domain", "", "domain whose subdomains name tenants (env TENANCY_DOMAIN)")
+	fs.Int64Var(&fl.Tenancy.MaxItems, "tenancy-max-items", 0, "items a tenant may have, 0 for no limit (env TENANCY_MAX_ITEMS)")
+	fs.Float64Var(&fl.RateLimit.Rate, "ratelimit-rate", 0, "requests a second a client gets, 0 for no limit (env RATELIMIT_RATE)")
+	fs.IntVar(&fl.RateLimit.Burst, "ratelimit-burst", 0, "requests a client can send at once (env RATELIMIT_BURST)")
+	// no flag for the password, the bootstrap key or the hmac secret on
+	// purpose, anyone can read them off ps
+
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	if fs.NArg() > 0 {
+		return cfg, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	if *file == "" {
+		*file = getenv("CONFIG_FILE")
+	}
+	if *file != "" {
+		if err := loadFile(&cfg, *file); err != nil {
+			return cfg, err
+		}
+	}
+
+	if err := loadEnv(&cfg, getenv); err != nil {
+		return cfg, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			cfg.Server.Port = fl.Server.Port
+		case "request-timeout":
+			cfg.Server.RequestTimeout = fl.Server.RequestTimeout
+		case "shutdown-timeout":
+			cfg.Server.ShutdownTimeout = fl.Server.ShutdownTimeout
+		case "shutdown-delay":
+			cfg.Server.ShutdownDelay = fl.Server.ShutdownDelay
+		case "max-body-bytes":
+			cfg.Server.MaxBodyBytes = fl.Server.MaxBodyBytes
+		case "access-log":
+			cfg.Server.AccessLog = fl.Server.AccessLog
+		case "mongo-uri":
+			cfg.Mongo.URI = fl.Mongo.URI
+		case "db-user":
+			cfg.Mongo.User = fl.Mongo.User
+		case "db-host":
+			cfg.Mongo.Host = fl.Mongo.Host
+		case "db-port":
+			cfg.Mongo.Port = fl.Mongo.Port
+		case "db-name":
+			cfg.Mongo.Database = fl.Mongo.Database
+		case "db-coll":
+			cfg.Mongo.Collection = fl.Mongo.Collection
+		case "tracing-exporter":
+			cfg.Tracing.Exporter = fl.Tracing.Exporter
+		case "tracing-file":
+			cfg.Tracing.File = fl.Tracing.File
+		case "tracing-sample-ratio":
+			cfg.Tracing.SampleRatio = fl.Tracing.SampleRatio
+		case "log-level":
+			cfg.Log.Level = fl.Log.Level
+		case "log-format":
+			cfg.Log.Format = fl.Log.Format
+		case "auth":
+			cfg.Auth.Enabled = fl.Auth.Enabled
+		case "auth-keys-coll":
+			cfg.Auth.KeysCollection = fl.Auth.KeysCollection
+		case "jwt-issuer":
+			cfg.Auth.JWT.Issuer = fl.Auth.JWT.Issuer
+		case "jwt-audience":
+			cfg.Auth.JWT.Audience = fl.Auth.JWT.Audience
+		case "jwt-key-file":
+			cfg.Auth.JWT.KeyFile = fl.Auth.JWT.KeyFile
+		case "jwt-jwks":
+			cfg.Auth.JWT.JWKS = fl.Auth.JWT.JWKS
+		case "tenancy":
+			cfg.Tenancy.Strategy = fl.Tenancy.Strategy
+		case "tenancy-domain":
+			cfg.Tenancy.Domain = fl.Tenancy.Domain
+		case "tenancy-max-items":
+			cfg.Tenancy.MaxItems = fl.Tenancy.MaxItems
+		case "ratelimit-rate":
+			cfg.RateLimit.Rate = fl.RateLimit.Rate
+		case "ratelimit-burst":
+			cfg.RateLimit.Burst = fl.RateLimit.Burst
+		}
+	})
+
+	return cfg, cfg.Validate()
+}
+
+// loadFile picks the format off the extension. Unknown keys are an error,
+// a typo in a config file shouldn't just get ignored.
+func loadFile(cfg *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("config file %s: %w", path, err)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(data), cfg)
+		if err != nil {
+			return fmt.Errorf("config file %s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("config file %s: unknown key %q", path, undecoded[0].String())
+		}
+	default:
+		return fmt.Errorf("config file %s: has to end in .yaml, .yml or .toml", path)
+	}
+	return nil
+}
+
+// loadEnv applies the env vars. Secrets can also come from a file named by
+// NAME_FILE, which is how docker secrets get mounted.
+func loadEnv(cfg *Config, getenv func(string) string) error {
+	for _, e := range envVars {
+		v := getenv(e.name)
+
+		if e.secret {
+			if path := getenv(e.name + "_FILE"); path != "" {
+				if v != "" {
+					return fmt.Errorf("both %s and %s_FILE are set", e.name, e.name)
+				}
+				b, err := os.ReadFile(path)
+				if err != nil {
+					return fmt.Errorf("%s_FILE: %w", e.name, err)
+				}
+				v = strings.TrimRight(string(b), "\r\n")
+			}
+		}
+
+		if v == "" {
+			continue
+		}
+		if err := e.set(cfg, v); err != nil {
+			return fmt.Errorf("%s: %w", e.name, err)
+		}
+	}
+	return nil
+}
+
+// Print writes the config as yaml with the secrets redacted.
+func Print(w io.Writer, cfg Config) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(cfg.Redacted()); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func setInt(dst *int, v string) error {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("%q is not a number", v)
+	}
+	*dst = n
+	return nil
+}
+
+func setInt64(dst *int64, v string) error {
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%q is not a number", v)
+	}
+	*dst = n
+	return nil
+}
+
+func setBool(dst *bool, v string) error {
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("%q is not true or false", v)
+	}
+	*dst = b
+	return nil
+}
+
+func setFloat(dst *float64, v string) error {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fmt.Errorf("%q is not a number", v)
+	}
+	*dst = f
+	return nil
+}
+
+// setQuotas reads tenant=count pairs separated by commas, like
+// acme=1000,globex=50.
+func setQuotas(dst *map[string]int64, v string) error {
+	quotas := map[string]int64{}
+	for _, pair := range strings.Split(v, ",") {
+		t, n, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return fmt.Errorf("%q is not tenant=count", pair)
+		}
+		var quota int64
+		if err := setInt64(&quota, n); err != nil {
+			return fmt.Errorf("quota for %s: %w", t, err)
+		}
+		quotas[t] = quota
+	}
+	*dst = quotas
+	return nil
+}
+
+// setList reads a list separated by commas, like 10.0.0.0/8,192.168.1.10.
+func setList(dst *[]string, v string) error {
+	var list []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	*dst = list
+	return nil
+}
+
+func setDuration(dst *time.Duration, v string) error {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("%q is not a duration like 10s", v)
+	}
+	*dst = d
+	return nil
+}
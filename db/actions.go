@@ -2,77 +2,263 @@ package db
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"log/slog"
 
+	"github.com/mar-cial/items/logging"
 	"github.com/mar-cial/items/model"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // idk why I made this one receive a pointer to an item...
 // will check back on it later.
 func InsertOneItem(ctx context.Context, coll *mongo.Collection, item *model.Item) (*mongo.InsertOneResult, error) {
+	if item == nil {
+		return &mongo.InsertOneResult{}, NewValidationError(FieldError{Field: "item", Message: "is required"})
+	}
+
+	item.Version = 1
+	item.Tenant = scopeOf(ctx)
 	bsonDoc, err := bson.Marshal(item)
 	if err != nil {
 		return &mongo.InsertOneResult{}, err
 	}
 
-	return coll.InsertOne(ctx, bsonDoc)
+	res, err := coll.InsertOne(ctx, bsonDoc)
+	return res, mongoErr(err)
 }
 
 func InsertItems(ctx context.Context, coll *mongo.Collection, items []model.Item) (*mongo.InsertManyResult, error) {
 	var in []interface{}
 
 	for k := range items {
-		in = append(in, items[k])
+		item := items[k]
+		item.Version = 1
+		item.Tenant = scopeOf(ctx)
+		in = append(in, item)
 	}
-	return coll.InsertMany(ctx, in)
+
+	res, err := coll.InsertMany(ctx, in)
+	return res, mongoErr(err)
 }
 
 func ListOneItem(ctx context.Context, coll *mongo.Collection, id string) (model.Item, error) {
-	var err error
 	var result model.Item
 
 	mongoid, err := primitive.ObjectIDFromHex(id)
-	filter := bson.M{"_id": mongoid}
+	if err != nil {
+		return result, invalidID(id)
+	}
+	filter := scoped(ctx, bson.M{"_id": mongoid})
 
 	err = coll.FindOne(ctx, filter).Decode(&result)
-	return result, err
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return result, notFound(id)
+	}
+	return result, mongoErr(err)
 }
 
-func ListItems(ctx context.Context, coll *mongo.Collection) ([]model.Item, error) {
-	var err error
+// ListItems reads one page of items. The cursor is walked one document at
+// a time with a limit on the query, so we never pull in more than a page
+// (plus one, to know if there's more).
+func ListItems(ctx context.Context, coll *mongo.Collection, opts ListOptions) (ItemPage, error) {
+	opts, c, err := opts.normalize()
+	if err != nil {
+		return ItemPage{}, err
+	}
+
+	// with no filter this is still the empty bson.M{}, "find everything"
+	filter := filterBSON(opts.Filter)
+	if id := scopeOf(ctx); id != "" {
+		filter = bson.M{"$and": bson.A{bson.M{"tenant": id}, filter}}
+	}
+
+	total, err := coll.CountDocuments(ctx, filter)
+	if err != nil {
+		return ItemPage{}, mongoErr(err)
+	}
+
+	field := opts.Sort.bsonField()
+	dir := 1
+	if !c.ascending(opts.Desc) {
+		dir = -1
+	}
+
+	find := options.Find().
+		SetSort(bson.D{{Key: field, Value: dir}, {Key: "_id", Value: dir}}).
+		SetLimit(int64(opts.Limit + 1))
+
+	if c != nil {
+		filter = bson.M{"$and": bson.A{filter, keysetFilter(field, dir, c)}}
+	} else {
+		find.SetSkip(int64(opts.Offset))
+	}
+
+	cursor, err := coll.Find(ctx, filter, find)
+	if err != nil {
+		return ItemPage{}, mongoErr(err)
+	}
+	defer cursor.Close(ctx)
+
 	var results []model.Item
+	for cursor.Next(ctx) {
+		var item model.Item
+		if err := cursor.Decode(&item); err != nil {
+			return ItemPage{}, err
+		}
+		results = append(results, item)
+	}
+	if err := cursor.Err(); err != nil {
+		return ItemPage{}, mongoErr(err)
+	}
+
+	return finishPage(opts, c, results, total), nil
+}
 
-	// empty bson.M{} means "find everything, no filter". Just leaving it here in
-	// case it needs to change later.
-	filter := bson.M{}
+// keysetFilter matches everything after the cursor position in the
+// direction we're reading.
+func keysetFilter(field string, dir int, c *cursor) bson.M {
+	op := "$gt"
+	if dir < 0 {
+		op = "$lt"
+	}
 
-	cursor, err := coll.Find(ctx, filter)
+	if field == "_id" {
+		return bson.M{"_id": bson.M{op: c.objectID()}}
+	}
+
+	return bson.M{"$or": bson.A{
+		bson.M{field: bson.M{op: c.Value}},
+		bson.M{field: c.Value, "_id": bson.M{op: c.objectID()}},
+	}}
+}
 
-	err = cursor.All(ctx, &results)
+// versionFilter adds the version check to a filter. Items written before
+// versions existed have no version field, and count as version 0.
+func versionFilter(filter bson.M, version int64) bson.M {
+	switch {
+	case version == AnyVersion, version == ExistingVersion:
+	case version == 0:
+		filter["version"] = bson.M{"$in": bson.A{0, nil}}
+	default:
+		filter["version"] = version
+	}
+	return filter
+}
 
-	return results, err
+// missedWrite works out why a filtered write asking for version matched
+// nothing: either the item isn't there or it's at another version.
+func missedWrite(ctx context.Context, coll *mongo.Collection, mongoid primitive.ObjectID, id string, version int64) error {
+	n, err := coll.CountDocuments(ctx, scoped(ctx, bson.M{"_id": mongoid}))
+	if err != nil {
+		return mongoErr(err)
+	}
+	if n == 0 {
+		return missing(id, version)
+	}
+	return fmt.Errorf("%w: %s", ErrVersionMismatch, id)
 }
 
-func UpdateOneItem(ctx context.Context, coll *mongo.Collection, id string, item *model.Item) (*mongo.UpdateResult, error) {
-	var err error
+// UpdateOneItem replaces title and price. With a version other than
+// AnyVersion it only goes through if the item is still at that version,
+// and the check happens in the update filter so nothing can sneak in
+// between.
+func UpdateOneItem(ctx context.Context, coll *mongo.Collection, id string, item *model.Item, version int64) (*mongo.UpdateResult, error) {
+	if item == nil {
+		return &mongo.UpdateResult{}, NewValidationError(FieldError{Field: "item", Message: "is required"})
+	}
+
 	mongoid, err := primitive.ObjectIDFromHex(id)
-	filter := bson.M{"_id": mongoid}
-	update := bson.M{"$set": bson.M{"title": item.Title, "price": item.Price}}
+	if err != nil {
+		return &mongo.UpdateResult{}, invalidID(id)
+	}
+	filter := versionFilter(scoped(ctx, bson.M{"_id": mongoid}), version)
+	update := bson.M{
+		"$set": bson.M{"title": item.Title, "price": item.Price},
+		"$inc": bson.M{"version": 1},
+	}
 
 	res, err := coll.UpdateOne(ctx, filter, update)
-	return res, err
+	if err != nil {
+		return res, mongoErr(err)
+	}
+
+	if res.MatchedCount == 0 {
+		return res, missedWrite(ctx, coll, mongoid, id, version)
+	}
+	return res, nil
+}
+
+// patchRetries is how many times PatchOneItem goes around when somebody
+// else keeps changing the item under it.
+const patchRetries = 5
+
+// PatchOneItem reads the item, runs fn on it and writes the result back,
+// but only if the item is still at the version fn saw. If it changed in
+// the meantime it tries again with the new version, unless the caller
+// asked for a specific version, then it's a mismatch.
+func PatchOneItem(ctx context.Context, coll *mongo.Collection, id string, version int64, fn PatchFunc) (model.Item, error) {
+	mongoid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return model.Item{}, invalidID(id)
+	}
+
+	for i := 0; i < patchRetries; i++ {
+		var current model.Item
+		err := coll.FindOne(ctx, scoped(ctx, bson.M{"_id": mongoid})).Decode(&current)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return model.Item{}, missing(id, version)
+		}
+		if err != nil {
+			return model.Item{}, mongoErr(err)
+		}
+
+		if !versionMatches(current.Version, version) {
+			return model.Item{}, fmt.Errorf("%w: %s", ErrVersionMismatch, id)
+		}
+
+		next, err := fn(current)
+		if err != nil {
+			return model.Item{}, err
+		}
+		next.ID = current.ID
+		next.Version = current.Version + 1
+
+		filter := versionFilter(scoped(ctx, bson.M{"_id": mongoid}), current.Version)
+		update := bson.M{"$set": bson.M{"title": next.Title, "price": next.Price, "version": next.Version}}
+
+		res, err := coll.UpdateOne(ctx, filter, update)
+		if err != nil {
+			return model.Item{}, mongoErr(err)
+		}
+		if res.MatchedCount == 1 {
+			return next, nil
+		}
+		logging.From(ctx).Debug("patch lost a race, retrying",
+			slog.Int64("version", current.Version), slog.Int("attempt", i+1))
+	}
+
+	return model.Item{}, fmt.Errorf("%w: gave up on %s after %d tries", ErrContended, id, patchRetries)
 }
 
-func DeleteOneItem(ctx context.Context, coll *mongo.Collection, id string) (*mongo.DeleteResult, error) {
+func DeleteOneItem(ctx context.Context, coll *mongo.Collection, id string, version int64) (*mongo.DeleteResult, error) {
 	mongoid, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		return &mongo.DeleteResult{}, err
+		return &mongo.DeleteResult{}, invalidID(id)
 	}
 
-	filter := bson.M{"_id": mongoid}
+	filter := versionFilter(scoped(ctx, bson.M{"_id": mongoid}), version)
 	res, err := coll.DeleteOne(ctx, filter)
+	if err != nil {
+		return res, mongoErr(err)
+	}
 
-	return res, err
+	if res.DeletedCount == 0 {
+		return res, missedWrite(ctx, coll, mongoid, id, version)
+	}
+	return res, nil
 }
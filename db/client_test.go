@@ -2,14 +2,17 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"testing"
 
 	"github.com/mar-cial/items/model"
+	"github.com/mar-cial/items/tenant"
 	"github.com/stretchr/testify/assert"
 	"github.com/testcontainers/testcontainers-go"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
@@ -18,7 +21,19 @@ var endpoint string
 var mc *mongo.Client
 var ids []primitive.ObjectID
 
+// mongoUp is false when there's no docker to start the container with. The
+// mongo tests skip themselves in that case, the memory store ones still run.
+var mongoUp bool
+
+func requireMongo(t *testing.T) {
+	t.Helper()
+	if !mongoUp {
+		t.Skip("mongo container not available")
+	}
+}
+
 func TestCreateClient(t *testing.T) {
+	requireMongo(t)
 	var err error
 	arrs := []string{"DBUSER", "DBPASS", "DBHOST", "DBPORT", "DBNAME"}
 	for k := range arrs {
@@ -31,7 +46,9 @@ func TestCreateClient(t *testing.T) {
 	err = os.Setenv("DBPORT", endpoint)
 	assert.NoError(t, err)
 
-	client, err := CreateClient()
+	uri := fmt.Sprintf("mongodb://%s:%s@%s:%s",
+		os.Getenv("DBUSER"), os.Getenv("DBPASS"), os.Getenv("DBHOST"), os.Getenv("DBPORT"))
+	client, err := CreateClient(uri)
 	assert.NotEmpty(t, client)
 	assert.NoError(t, err)
 
@@ -42,6 +59,7 @@ func TestCreateClient(t *testing.T) {
 }
 
 func TestInsertItem(t *testing.T) {
+	requireMongo(t)
 	ctx := context.Background()
 
 	item := model.Item{
@@ -63,6 +81,7 @@ func TestInsertItem(t *testing.T) {
 }
 
 func TestInsertItems(t *testing.T) {
+	requireMongo(t)
 	ctx := context.Background()
 
 	// we are also going to append this slice to testItemsList
@@ -94,6 +113,7 @@ func TestInsertItems(t *testing.T) {
 }
 
 func TestListOneItem(t *testing.T) {
+	requireMongo(t)
 	ctx := context.Background()
 
 	dbname := os.Getenv("DBNAME")
@@ -110,6 +130,7 @@ func TestListOneItem(t *testing.T) {
 }
 
 func TestListItems(t *testing.T) {
+	requireMongo(t)
 	ctx := context.Background()
 
 	dbname := os.Getenv("DBNAME")
@@ -117,17 +138,54 @@ func TestListItems(t *testing.T) {
 
 	coll := mc.Database(dbname).Collection(dbcoll)
 
-	res, err := ListItems(ctx, coll)
+	res, err := ListItems(ctx, coll, ListOptions{})
 	assert.NoError(t, err)
+	assert.Equal(t, int64(3), res.Total)
 
-	for k := range res {
-		assert.True(t, primitive.IsValidObjectID(res[k].ID.Hex()))
-		assert.Greater(t, res[k].Price, 0.0)
-		assert.NotEmpty(t, res[k].Title)
+	for k := range res.Items {
+		assert.True(t, primitive.IsValidObjectID(res.Items[k].ID.Hex()))
+		assert.Greater(t, res.Items[k].Price, 0.0)
+		assert.NotEmpty(t, res.Items[k].Title)
 	}
+
+	// two at a time, cheapest first
+	first, err := ListItems(ctx, coll, ListOptions{Limit: 2, Sort: SortPrice})
+	assert.NoError(t, err)
+	assert.Len(t, first.Items, 2)
+	assert.NotEmpty(t, first.Next)
+	assert.Empty(t, first.Prev)
+	assert.Equal(t, 99.99, first.Items[0].Price)
+
+	second, err := ListItems(ctx, coll, ListOptions{Limit: 2, Sort: SortPrice, Cursor: first.Next})
+	assert.NoError(t, err)
+	assert.Len(t, second.Items, 1)
+	assert.Empty(t, second.Next)
+	assert.NotEmpty(t, second.Prev)
+	assert.Equal(t, 8008.55, second.Items[0].Price)
+}
+
+func TestSearchItems(t *testing.T) {
+	requireMongo(t)
+	ctx := context.Background()
+
+	dbname := os.Getenv("DBNAME")
+	dbcoll := os.Getenv("DBCOLL")
+
+	coll := mc.Database(dbname).Collection(dbcoll)
+
+	err := EnsureIndexes(ctx, coll)
+	assert.NoError(t, err)
+
+	res, err := SearchItems(ctx, coll, "product 2", SearchOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), res.Total)
+	// the one with both words comes first
+	assert.Equal(t, "Test Product 2", res.Hits[0].Item.Title)
+	assert.Len(t, res.Hits[0].Highlights, 2)
 }
 
 func TestUpdateOneItem(t *testing.T) {
+	requireMongo(t)
 	ctx := context.Background()
 
 	dbname := os.Getenv("DBNAME")
@@ -140,7 +198,7 @@ func TestUpdateOneItem(t *testing.T) {
 		Price: 80085.55,
 	}
 
-	res, err := UpdateOneItem(ctx, coll, ids[0].Hex(), updatedItem)
+	res, err := UpdateOneItem(ctx, coll, ids[0].Hex(), updatedItem, 1)
 	assert.NoError(t, err)
 
 	// needs to be converted to int64 to pass, for whatever reason
@@ -152,9 +210,15 @@ func TestUpdateOneItem(t *testing.T) {
 
 	assert.Equal(t, item.Title, updatedItem.Title)
 	assert.Equal(t, item.Price, updatedItem.Price)
+	assert.Equal(t, int64(2), item.Version)
+
+	// version 1 is gone now
+	_, err = UpdateOneItem(ctx, coll, ids[0].Hex(), updatedItem, 1)
+	assert.ErrorIs(t, err, ErrVersionMismatch)
 }
 
 func TestDeleteOneItem(t *testing.T) {
+	requireMongo(t)
 	ctx := context.Background()
 
 	dbname := os.Getenv("DBNAME")
@@ -162,12 +226,81 @@ func TestDeleteOneItem(t *testing.T) {
 
 	coll := mc.Database(dbname).Collection(dbcoll)
 
-	res, err := DeleteOneItem(ctx, coll, ids[0].Hex())
+	res, err := DeleteOneItem(ctx, coll, ids[0].Hex(), AnyVersion)
 	assert.NoError(t, err)
 
 	fmt.Println(res)
 }
 
+func TestMongoStoreTenants(t *testing.T) {
+	requireMongo(t)
+	database := mc.Database(os.Getenv("DBNAME"))
+
+	for _, strategy := range []TenantStrategy{TenantField, TenantCollection} {
+		t.Run(string(strategy), func(t *testing.T) {
+			s := NewTenantMongoStore(database.Collection("tenants_"+string(strategy)), strategy)
+			checkTenants(t, s)
+
+			// no tenant, no items
+			_, err := s.ListItems(context.Background(), ListOptions{})
+			assert.ErrorIs(t, err, ErrNoTenant)
+		})
+	}
+
+	// one collection each, named after the items one
+	names, err := database.ListCollectionNames(context.Background(), bson.M{"name": bson.M{"$regex": "^tenants_collection_"}})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"tenants_collection_acme", "tenants_collection_globex"}, names)
+
+	// a collection that only looks like a tenant's isn't one
+	s := NewTenantMongoStore(database.Collection("tenants_collection"), TenantCollection)
+	s.Reserve("tenants_collection_globex")
+	_, err = s.ListItems(tenant.With(context.Background(), "globex"), ListOptions{})
+	assert.ErrorIs(t, err, tenant.ErrInvalid)
+	counts, err := s.CountByTenant(context.Background())
+	assert.NoError(t, err)
+	assert.Contains(t, counts, "acme")
+	assert.NotContains(t, counts, "globex")
+}
+
+func TestMongoQuotaCounter(t *testing.T) {
+	requireMongo(t)
+	coll := mc.Database(os.Getenv("DBNAME")).Collection("quota_counts")
+	ctx := context.Background()
+	assert.NoError(t, coll.Drop(ctx))
+	seed := func() (int64, error) { return 3, nil }
+
+	var c QuotaCounter = NewMongoQuotaCounter(coll)
+	ok, err := c.Reserve(ctx, "acme", 1, 5, seed)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	// the seed is only for a count that isn't there
+	ok, err = c.Reserve(ctx, "acme", 2, 5, func() (int64, error) { return 0, errors.New("seeded twice") })
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = c.Reserve(ctx, "acme", 1, 5, seed)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	assert.NoError(t, c.Release(ctx, "acme", 2))
+	ok, err = c.Reserve(ctx, "acme", 2, 5, seed)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// no limit still counts
+	ok, err = c.Reserve(ctx, "acme", 10, 0, seed)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	var doc struct{ N int64 }
+	assert.NoError(t, coll.FindOne(ctx, bson.M{"_id": "acme"}).Decode(&doc))
+	assert.Equal(t, int64(15), doc.N)
+
+	assert.NoError(t, c.Forget(ctx, "acme"))
+	found, err := coll.CountDocuments(ctx, bson.M{"_id": "acme"})
+	assert.NoError(t, err)
+	assert.Zero(t, found)
+}
+
 func TestMain(m *testing.M) {
 	var err error
 	envmap := map[string]string{
@@ -205,19 +338,23 @@ func TestMain(m *testing.M) {
 		ContainerRequest: req,
 		Started:          true,
 	})
+	if err != nil {
+		log.Println("skipping mongo tests:", err)
+		os.Exit(m.Run())
+	}
 
 	endpoint, err = mongoC.Endpoint(ctx, "")
 	if err != nil {
 		log.Fatalln(err)
 	}
+	mongoUp = true
 
-	m.Run()
+	code := m.Run()
 
-	defer func() {
-		os.Clearenv()
-		err = mongoC.Terminate(ctx)
-		if err != nil {
-			log.Fatalln(err)
-		}
-	}()
+	os.Clearenv()
+	err = mongoC.Terminate(ctx)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	os.Exit(code)
 }
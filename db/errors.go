@@ -0,0 +1,119 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mar-cial/items/model"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Every ItemStore returns one of these (possibly wrapped) instead of driver
+// errors, so callers can check with errors.Is and not care about mongo.
+var (
+	ErrNotFound   = errors.New("item not found")
+	ErrInvalidID  = errors.New("invalid item id")
+	ErrConflict   = errors.New("item already exists")
+	ErrValidation = errors.New("validation failed")
+	// ErrVersionMismatch is a conditional write where the item isn't at
+	// the version the caller expected anymore.
+	ErrVersionMismatch = errors.New("item version doesn't match")
+	// ErrContended is a write that kept losing races with other writers
+	// and gave up.
+	ErrContended = errors.New("item kept changing")
+)
+
+// AnyVersion makes a write unconditional.
+const AnyVersion int64 = -1
+
+// ExistingVersion makes a write conditional on there being an item at
+// all, whatever its version. A missing item is a version mismatch rather
+// than not found, like If-Match: * wants.
+const ExistingVersion int64 = -2
+
+// versionMatches says whether an item at have is one a write asking for
+// want can go through on.
+func versionMatches(have, want int64) bool {
+	return want == AnyVersion || want == ExistingVersion || have == want
+}
+
+// FieldError is the same thing model validation reports, so both kinds of
+// validation failure look alike to callers.
+type FieldError = model.FieldError
+
+// ValidationError carries all the field problems found at once. It matches
+// ErrValidation with errors.Is.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func NewValidationError(fields ...FieldError) *ValidationError {
+	return &ValidationError{Fields: fields}
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Fields) == 0 {
+		return ErrValidation.Error()
+	}
+
+	var parts []string
+	for k := range e.Fields {
+		parts = append(parts, fmt.Sprintf("%s: %s", e.Fields[k].Field, e.Fields[k].Message))
+	}
+	return fmt.Sprintf("%s: %s", ErrValidation, strings.Join(parts, "; "))
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+// Outcome sorts a store error into a few buckets for metrics and traces.
+// A not found is the store doing its job and shouldn't look like mongo
+// falling over, only "error" is.
+func Outcome(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, ErrNotFound):
+		return "not_found"
+	case errors.Is(err, ErrConflict), errors.Is(err, ErrVersionMismatch), errors.Is(err, ErrContended), errors.Is(err, ErrQuotaExceeded):
+		return "conflict"
+	case errors.Is(err, ErrValidation), errors.Is(err, ErrInvalidID), errors.Is(err, ErrInvalidQuery):
+		return "invalid"
+	}
+	return "error"
+}
+
+func invalidID(id string) error {
+	return fmt.Errorf("%w: %q", ErrInvalidID, id)
+}
+
+func notFound(id string) error {
+	return fmt.Errorf("%w: %s", ErrNotFound, id)
+}
+
+// missing is why a write asking for version found no item id: not found,
+// unless it needed the item to be there.
+func missing(id string, version int64) error {
+	if version == ExistingVersion {
+		return fmt.Errorf("%w: there's no item %s", ErrVersionMismatch, id)
+	}
+	return notFound(id)
+}
+
+// mongoErr translates the driver errors we know about into ours and leaves
+// everything else alone.
+func mongoErr(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, mongo.ErrNoDocuments):
+		return ErrNotFound
+	case errors.Is(err, mongo.ErrEmptySlice):
+		return NewValidationError(FieldError{Field: "items", Message: "must not be empty"})
+	case mongo.IsDuplicateKeyError(err):
+		return fmt.Errorf("%w: %v", ErrConflict, err)
+	}
+	return err
+}
@@ -0,0 +1,72 @@
+package db
+
+import (
+	"regexp"
+
+	"github.com/mar-cial/items/filter"
+	"github.com/mar-cial/items/model"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ItemFilterSchema is every field /items/list can filter on. The names are
+// the json ones, which happen to be the bson ones too.
+var ItemFilterSchema = filter.Schema{
+	"title": filter.String,
+	"price": filter.Number,
+}
+
+var mongoOps = map[filter.Op]string{
+	filter.OpEq:  "$eq",
+	filter.OpNe:  "$ne",
+	filter.OpGt:  "$gt",
+	filter.OpGte: "$gte",
+	filter.OpLt:  "$lt",
+	filter.OpLte: "$lte",
+	filter.OpIn:  "$in",
+}
+
+// filterBSON translates a filter tree into a mongo query. Values only ever
+// end up on the value side of an operator, and contains is quoted before
+// it becomes a regex.
+func filterBSON(e filter.Expr) bson.M {
+	switch e := e.(type) {
+	case filter.And:
+		if len(e) == 0 {
+			return bson.M{}
+		}
+		if len(e) == 1 {
+			return filterBSON(e[0])
+		}
+
+		var parts bson.A
+		for k := range e {
+			parts = append(parts, filterBSON(e[k]))
+		}
+		return bson.M{"$and": parts}
+	case filter.Cond:
+		switch e.Op {
+		case filter.OpContains:
+			return bson.M{e.Field: bson.M{
+				"$regex":   regexp.QuoteMeta(e.Value.(string)),
+				"$options": "i",
+			}}
+		case filter.OpExists:
+			return bson.M{e.Field: bson.M{"$exists": e.Value}}
+		}
+		return bson.M{e.Field: bson.M{mongoOps[e.Op]: e.Value}}
+	}
+	return bson.M{}
+}
+
+// itemGetter lets filter.Eval look at an item without knowing about it.
+func itemGetter(item model.Item) filter.Getter {
+	return func(field string) (interface{}, bool) {
+		switch field {
+		case "title":
+			return item.Title, true
+		case "price":
+			return item.Price, true
+		}
+		return nil, false
+	}
+}
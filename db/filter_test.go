@@ -0,0 +1,55 @@
+package db
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/mar-cial/items/filter"
+	"github.com/mar-cial/items/model"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func parseFilter(t *testing.T, raw string) filter.Expr {
+	t.Helper()
+	q, err := url.ParseQuery(raw)
+	assert.NoError(t, err)
+	e, err := filter.Parse(q, ItemFilterSchema)
+	assert.NoError(t, err)
+	return e
+}
+
+func TestFilterBSON(t *testing.T) {
+	assert.Equal(t, bson.M{}, filterBSON(nil))
+	assert.Equal(t, bson.M{}, filterBSON(parseFilter(t, "")))
+
+	assert.Equal(t, bson.M{"price": bson.M{"$gte": 10.0}}, filterBSON(parseFilter(t, "price[gte]=10")))
+
+	assert.Equal(t, bson.M{"$and": bson.A{
+		bson.M{"price": bson.M{"$in": []interface{}{1.0, 2.0}}},
+		bson.M{"title": bson.M{"$regex": `a\.b\*`, "$options": "i"}},
+	}}, filterBSON(parseFilter(t, "price[in]=1,2&title[contains]=a.b*")))
+}
+
+func TestMemoryStoreFilter(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+
+	_, err := s.InsertItems(ctx, []model.Item{
+		{Title: "HDMI cable", Price: 12},
+		{Title: "USB cable", Price: 45},
+		{Title: "Cable tie", Price: 2},
+		{Title: "Monitor", Price: 30},
+	})
+	assert.NoError(t, err)
+
+	page, err := s.ListItems(ctx, ListOptions{
+		Filter: parseFilter(t, "price[gte]=10&price[lt]=50&title[contains]=cable"),
+		Sort:   SortPrice,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), page.Total)
+	assert.Equal(t, "HDMI cable", page.Items[0].Title)
+	assert.Equal(t, "USB cable", page.Items[1].Title)
+}
@@ -0,0 +1,290 @@
+package db
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/mar-cial/items/logging"
+	"github.com/mar-cial/items/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// KeyStore keeps api keys. It only ever sees hashes, making and checking
+// keys is the auth package's job.
+type KeyStore interface {
+	// InsertKey sets key.ID. A key with the same prefix already there is
+	// ErrConflict.
+	InsertKey(ctx context.Context, key *model.APIKey) error
+	// KeyByPrefix is ErrNotFound when there's no such key, revoked and
+	// expired keys are still found.
+	KeyByPrefix(ctx context.Context, prefix string) (model.APIKey, error)
+	GetKey(ctx context.Context, id string) (model.APIKey, error)
+	// ListKeys is every key, oldest first.
+	ListKeys(ctx context.Context) ([]model.APIKey, error)
+	// RevokeKey marks the key revoked at at and returns it. Revoking it
+	// again keeps the first time.
+	RevokeKey(ctx context.Context, id string, at time.Time) (model.APIKey, error)
+	// TouchKey records the key was used at at.
+	TouchKey(ctx context.Context, id string, at time.Time) error
+}
+
+var (
+	_ KeyStore = (*MongoKeyStore)(nil)
+	_ KeyStore = (*MemoryKeyStore)(nil)
+)
+
+// MongoKeyStore keeps the keys in their own collection, next to the items.
+type MongoKeyStore struct {
+	coll *mongo.Collection
+
+	// indexed works like it does for MongoStore, the unique prefix index
+	// gets made on the first insert
+	mu      sync.Mutex
+	indexed bool
+}
+
+func NewMongoKeyStore(coll *mongo.Collection) *MongoKeyStore {
+	return &MongoKeyStore{coll: coll}
+}
+
+func (s *MongoKeyStore) ensureIndexes(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.indexed {
+		return nil
+	}
+
+	_, err := s.coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "prefix", Value: 1}},
+		Options: options.Index().SetName("prefix").SetUnique(true),
+	})
+	if err != nil {
+		logging.From(ctx).Warn("creating key indexes", slog.Any("err", err))
+		return err
+	}
+	s.indexed = true
+	return nil
+}
+
+func (s *MongoKeyStore) InsertKey(ctx context.Context, key *model.APIKey) error {
+	if err := s.ensureIndexes(ctx); err != nil {
+		return err
+	}
+
+	if key.ID.IsZero() {
+		key.ID = primitive.NewObjectID()
+	}
+	_, err := s.coll.InsertOne(ctx, key)
+	return mongoErr(err)
+}
+
+func (s *MongoKeyStore) KeyByPrefix(ctx context.Context, prefix string) (model.APIKey, error) {
+	var key model.APIKey
+	err := s.coll.FindOne(ctx, bson.M{"prefix": prefix}).Decode(&key)
+	return key, mongoErr(err)
+}
+
+func (s *MongoKeyStore) GetKey(ctx context.Context, id string) (model.APIKey, error) {
+	var key model.APIKey
+	oid, err := parseID(id)
+	if err != nil {
+		return key, err
+	}
+
+	err = s.coll.FindOne(ctx, bson.M{"_id": oid}).Decode(&key)
+	return key, mongoErr(err)
+}
+
+func (s *MongoKeyStore) ListKeys(ctx context.Context) ([]model.APIKey, error) {
+	cursor, err := s.coll.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, mongoErr(err)
+	}
+
+	keys := []model.APIKey{}
+	if err := cursor.All(ctx, &keys); err != nil {
+		return nil, mongoErr(err)
+	}
+	return keys, nil
+}
+
+func (s *MongoKeyStore) RevokeKey(ctx context.Context, id string, at time.Time) (model.APIKey, error) {
+	oid, err := parseID(id)
+	if err != nil {
+		return model.APIKey{}, err
+	}
+
+	// only set it when it isn't already, the first revocation is the one
+	// that counts
+	_, err = s.coll.UpdateOne(ctx,
+		bson.M{"_id": oid, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": at}})
+	if err != nil {
+		return model.APIKey{}, mongoErr(err)
+	}
+	return s.GetKey(ctx, id)
+}
+
+func (s *MongoKeyStore) TouchKey(ctx context.Context, id string, at time.Time) error {
+	oid, err := parseID(id)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.coll.UpdateOne(ctx, bson.M{"_id": oid}, bson.M{"$set": bson.M{"last_used_at": at}})
+	if err != nil {
+		return mongoErr(err)
+	}
+	if res.MatchedCount == 0 {
+		return notFound(id)
+	}
+	return nil
+}
+
+// MemoryKeyStore is the KeyStore for tests and for running without mongo.
+type MemoryKeyStore struct {
+	mu   sync.RWMutex
+	keys []model.APIKey
+}
+
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{}
+}
+
+// find assumes at least the read lock is held.
+func (s *MemoryKeyStore) find(match func(model.APIKey) bool) int {
+	for k := range s.keys {
+		if match(s.keys[k]) {
+			return k
+		}
+	}
+	return -1
+}
+
+func (s *MemoryKeyStore) byID(id string) (int, error) {
+	oid, err := parseID(id)
+	if err != nil {
+		return -1, err
+	}
+	k := s.find(func(key model.APIKey) bool { return key.ID == oid })
+	if k < 0 {
+		return -1, notFound(id)
+	}
+	return k, nil
+}
+
+// copyKey is so callers can't reach into the store through the slices
+// and pointers.
+func copyKey(key model.APIKey) model.APIKey {
+	key.Scopes = append([]string(nil), key.Scopes...)
+	for _, t := range []**time.Time{&key.LastUsedAt, &key.ExpiresAt, &key.RevokedAt} {
+		if *t != nil {
+			at := **t
+			*t = &at
+		}
+	}
+	return key
+}
+
+func (s *MemoryKeyStore) InsertKey(ctx context.Context, key *model.APIKey) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.find(func(k model.APIKey) bool { return k.Prefix == key.Prefix }) >= 0 {
+		return ErrConflict
+	}
+	if key.ID.IsZero() {
+		key.ID = primitive.NewObjectID()
+	}
+	s.keys = append(s.keys, copyKey(*key))
+	return nil
+}
+
+func (s *MemoryKeyStore) KeyByPrefix(ctx context.Context, prefix string) (model.APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return model.APIKey{}, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	k := s.find(func(key model.APIKey) bool { return key.Prefix == prefix })
+	if k < 0 {
+		return model.APIKey{}, ErrNotFound
+	}
+	return copyKey(s.keys[k]), nil
+}
+
+func (s *MemoryKeyStore) GetKey(ctx context.Context, id string) (model.APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return model.APIKey{}, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	k, err := s.byID(id)
+	if err != nil {
+		return model.APIKey{}, err
+	}
+	return copyKey(s.keys[k]), nil
+}
+
+func (s *MemoryKeyStore) ListKeys(ctx context.Context) ([]model.APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]model.APIKey, len(s.keys))
+	for k := range s.keys {
+		keys[k] = copyKey(s.keys[k])
+	}
+	return keys, nil
+}
+
+func (s *MemoryKeyStore) RevokeKey(ctx context.Context, id string, at time.Time) (model.APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return model.APIKey{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, err := s.byID(id)
+	if err != nil {
+		return model.APIKey{}, err
+	}
+	if s.keys[k].RevokedAt == nil {
+		s.keys[k].RevokedAt = &at
+	}
+	return copyKey(s.keys[k]), nil
+}
+
+func (s *MemoryKeyStore) TouchKey(ctx context.Context, id string, at time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, err := s.byID(id)
+	if err != nil {
+		return err
+	}
+	s.keys[k].LastUsedAt = &at
+	return nil
+}
@@ -0,0 +1,245 @@
+package db
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mar-cial/items/filter"
+	"github.com/mar-cial/items/model"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	DefaultLimit = 50
+	MaxLimit     = 500
+)
+
+// ErrInvalidQuery is for list options that make no sense, like a cursor
+// that was made for a different sort.
+var ErrInvalidQuery = errors.New("invalid query")
+
+// SortField is what ListItems can order by. SortCreated sorts on _id, since
+// an ObjectID starts with its creation time.
+type SortField string
+
+const (
+	SortCreated SortField = "created"
+	SortTitle   SortField = "title"
+	SortPrice   SortField = "price"
+)
+
+// bsonField is the document field a SortField maps to.
+func (f SortField) bsonField() string {
+	switch f {
+	case SortTitle:
+		return "title"
+	case SortPrice:
+		return "price"
+	}
+	return "_id"
+}
+
+func ParseSortField(s string) (SortField, error) {
+	switch f := SortField(strings.ToLower(s)); f {
+	case "":
+		return SortCreated, nil
+	case SortCreated, SortTitle, SortPrice:
+		return f, nil
+	}
+	return "", fmt.Errorf("%w: can't sort by %q", ErrInvalidQuery, s)
+}
+
+// ListOptions says which page of items to return. Use either Offset or
+// Cursor, not both. Cursor comes from a previous ItemPage. Filter narrows
+// down the items before paging, and Total counts only the matching ones.
+type ListOptions struct {
+	Limit  int
+	Offset int
+	Cursor string
+	Sort   SortField
+	Desc   bool
+	Filter filter.Expr
+}
+
+// normalize fills in defaults and clamps the limit. It's called by every
+// store so they all agree on what an empty ListOptions means.
+func (o ListOptions) normalize() (ListOptions, *cursor, error) {
+	if o.Sort == "" {
+		o.Sort = SortCreated
+	}
+	if o.Limit <= 0 {
+		o.Limit = DefaultLimit
+	}
+	if o.Limit > MaxLimit {
+		o.Limit = MaxLimit
+	}
+	if o.Offset < 0 {
+		return o, nil, fmt.Errorf("%w: offset must not be negative", ErrInvalidQuery)
+	}
+	if o.Cursor == "" {
+		return o, nil, nil
+	}
+	if o.Offset > 0 {
+		return o, nil, fmt.Errorf("%w: use either offset or cursor", ErrInvalidQuery)
+	}
+
+	c, err := decodeCursor(o.Cursor)
+	if err != nil {
+		return o, nil, err
+	}
+	if c.Sort != o.Sort || c.Desc != o.Desc {
+		return o, nil, fmt.Errorf("%w: cursor was made for a different sort", ErrInvalidQuery)
+	}
+	return o, c, nil
+}
+
+// ItemPage is one page of ListItems. Next and Prev are cursors for the
+// neighbouring pages and are empty when there's nothing there.
+type ItemPage struct {
+	Items []model.Item
+	Total int64
+	Next  string
+	Prev  string
+}
+
+// cursor is the keyset position a page starts after. Back means walk
+// backwards from it, which is how the prev cursor works.
+type cursor struct {
+	Sort  SortField   `json:"s"`
+	Desc  bool        `json:"d,omitempty"`
+	Value interface{} `json:"v,omitempty"`
+	ID    string      `json:"id"`
+	Back  bool        `json:"b,omitempty"`
+}
+
+func (c *cursor) objectID() primitive.ObjectID {
+	id, _ := primitive.ObjectIDFromHex(c.ID)
+	return id
+}
+
+// ascending is the direction the store actually has to read in.
+func (c *cursor) ascending(desc bool) bool {
+	if c == nil {
+		return !desc
+	}
+	return desc == c.Back
+}
+
+// item is the cursor position as an item, so stores that sort in Go can
+// compare against it with compareItems.
+func (c *cursor) item() model.Item {
+	item := model.Item{ID: c.objectID()}
+	switch v := c.Value.(type) {
+	case string:
+		item.Title = v
+	case float64:
+		item.Price = v
+	}
+	return item
+}
+
+// compareItems orders two items by the sort field, falling back to _id so
+// the order is always total. Same rules mongo uses for these types.
+func compareItems(f SortField, a, b model.Item) int {
+	switch f {
+	case SortTitle:
+		if c := strings.Compare(a.Title, b.Title); c != 0 {
+			return c
+		}
+	case SortPrice:
+		if a.Price < b.Price {
+			return -1
+		}
+		if a.Price > b.Price {
+			return 1
+		}
+	}
+	return bytes.Compare(a.ID[:], b.ID[:])
+}
+
+func newCursor(opts ListOptions, item model.Item, back bool) string {
+	c := cursor{
+		Sort: opts.Sort,
+		Desc: opts.Desc,
+		ID:   item.ID.Hex(),
+		Back: back,
+	}
+
+	switch opts.Sort {
+	case SortTitle:
+		c.Value = item.Title
+	case SortPrice:
+		c.Value = item.Price
+	}
+
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (*cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	}
+
+	var c cursor
+	if err := json.Unmarshal(b, &c); err != nil || !primitive.IsValidObjectID(c.ID) {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	}
+
+	switch c.Sort {
+	case SortTitle:
+		if _, ok := c.Value.(string); !ok {
+			return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+		}
+	case SortPrice:
+		if _, ok := c.Value.(float64); !ok {
+			return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+		}
+	}
+	return &c, nil
+}
+
+// finishPage builds the page out of what a store read. items is in read
+// order and may hold one extra item, which only tells us there's more.
+func finishPage(opts ListOptions, c *cursor, items []model.Item, total int64) ItemPage {
+	page := ItemPage{Total: total}
+
+	more := len(items) > opts.Limit
+	if more {
+		items = items[:opts.Limit]
+	}
+
+	back := c != nil && c.Back
+	if back {
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+		}
+	}
+	page.Items = items
+
+	if len(items) == 0 {
+		return page
+	}
+
+	first, last := items[0], items[len(items)-1]
+
+	// going forward there's a next page if we read an extra item, and a
+	// previous one if we didn't start at the top. Backwards it flips.
+	hasNext, hasPrev := more, c != nil || opts.Offset > 0
+	if back {
+		hasNext, hasPrev = true, more
+	}
+
+	if hasNext {
+		page.Next = newCursor(opts, last, false)
+	}
+	if hasPrev {
+		page.Prev = newCursor(opts, first, true)
+	}
+	return page
+}
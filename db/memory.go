@@ -0,0 +1,387 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/mar-cial/items/filter"
+	"github.com/mar-cial/items/model"
+	"github.com/mar-cial/items/search"
+	"github.com/mar-cial/items/tenant"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryStore keeps items in a map guarded by a RWMutex. It tries to behave
+// like MongoStore does, down to the errors it returns, so handlers can't
+// tell the difference. Tenants are kept apart like with TenantField: items
+// belong to the tenant in the context they were inserted with, "" if
+// there wasn't one, and nobody else sees them.
+type MemoryStore struct {
+	mu    sync.RWMutex
+	items map[primitive.ObjectID]model.Item
+	// order keeps insertion order so ListItems comes back in the same
+	// order mongo would give us for a plain Find.
+	order []primitive.ObjectID
+	// index is the title search index, kept in step with items
+	index *search.Index
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		items: make(map[primitive.ObjectID]model.Item),
+		index: search.NewIndex(),
+	}
+}
+
+// Ping always works, the memory is right here.
+func (s *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Close is a no-op, there's nothing to let go of.
+func (s *MemoryStore) Close(ctx context.Context) error {
+	return nil
+}
+
+// memTenant is who the items of a call belong to.
+func memTenant(ctx context.Context) string {
+	id, _ := tenant.From(ctx)
+	return id
+}
+
+// CountByTenant counts every tenant's items, whatever tenant ctx has.
+func (s *MemoryStore) CountByTenant(ctx context.Context) (map[string]int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	counts := map[string]int64{}
+	for _, item := range s.items {
+		counts[item.Tenant]++
+	}
+	return counts, nil
+}
+
+// get is the item with id if it's the tenant's. It assumes the lock is
+// held.
+func (s *MemoryStore) get(ctx context.Context, id primitive.ObjectID) (model.Item, bool) {
+	item, ok := s.items[id]
+	if !ok || item.Tenant != memTenant(ctx) {
+		return model.Item{}, false
+	}
+	return item, true
+}
+
+// insert assumes the write lock is held and that conflicts were already
+// checked.
+func (s *MemoryStore) insert(item model.Item) primitive.ObjectID {
+	if item.ID.IsZero() {
+		item.ID = primitive.NewObjectID()
+	}
+	item.Version = 1
+
+	s.order = append(s.order, item.ID)
+	s.items[item.ID] = item
+	s.index.Add(item.ID.Hex(), item.Title)
+
+	return item.ID
+}
+
+// parseID is the memory equivalent of what actions.go does with
+// primitive.ObjectIDFromHex.
+func parseID(id string) (primitive.ObjectID, error) {
+	mongoid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return mongoid, invalidID(id)
+	}
+	return mongoid, nil
+}
+
+func (s *MemoryStore) InsertOneItem(ctx context.Context, item *model.Item) (*InsertOneResult, error) {
+	if err := ctx.Err(); err != nil {
+		return &InsertOneResult{}, err
+	}
+
+	if item == nil {
+		return &InsertOneResult{}, NewValidationError(FieldError{Field: "item", Message: "is required"})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.items[item.ID]; ok && !item.ID.IsZero() {
+		return &InsertOneResult{}, fmt.Errorf("%w: %s", ErrConflict, item.ID.Hex())
+	}
+
+	in := *item
+	in.Tenant = memTenant(ctx)
+	id := s.insert(in)
+	return &InsertOneResult{InsertedID: id.Hex()}, nil
+}
+
+func (s *MemoryStore) InsertItems(ctx context.Context, items []model.Item) (*InsertManyResult, error) {
+	if err := ctx.Err(); err != nil {
+		return &InsertManyResult{}, err
+	}
+
+	if len(items) == 0 {
+		return &InsertManyResult{}, NewValidationError(FieldError{Field: "items", Message: "must not be empty"})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// check everything first so a conflict doesn't leave half the batch in
+	seen := make(map[primitive.ObjectID]bool)
+	for k := range items {
+		id := items[k].ID
+		if id.IsZero() {
+			continue
+		}
+		if _, ok := s.items[id]; ok || seen[id] {
+			return &InsertManyResult{}, fmt.Errorf("%w: %s", ErrConflict, id.Hex())
+		}
+		seen[id] = true
+	}
+
+	res := &InsertManyResult{}
+	for k := range items {
+		in := items[k]
+		in.Tenant = memTenant(ctx)
+		id := s.insert(in)
+		res.InsertedIDs = append(res.InsertedIDs, id.Hex())
+	}
+	return res, nil
+}
+
+func (s *MemoryStore) ListOneItem(ctx context.Context, id string) (model.Item, error) {
+	if err := ctx.Err(); err != nil {
+		return model.Item{}, err
+	}
+
+	mongoid, err := parseID(id)
+	if err != nil {
+		return model.Item{}, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	item, ok := s.get(ctx, mongoid)
+	if !ok {
+		return model.Item{}, notFound(id)
+	}
+	return item, nil
+}
+
+func (s *MemoryStore) ListItems(ctx context.Context, opts ListOptions) (ItemPage, error) {
+	if err := ctx.Err(); err != nil {
+		return ItemPage{}, err
+	}
+
+	opts, c, err := opts.normalize()
+	if err != nil {
+		return ItemPage{}, err
+	}
+
+	s.mu.RLock()
+	items := make([]model.Item, 0, len(s.order))
+	for _, id := range s.order {
+		item, ok := s.get(ctx, id)
+		if ok && filter.Eval(opts.Filter, itemGetter(item)) {
+			items = append(items, item)
+		}
+	}
+	s.mu.RUnlock()
+
+	total := int64(len(items))
+	asc := c.ascending(opts.Desc)
+	less := func(a, b model.Item) bool {
+		if asc {
+			return compareItems(opts.Sort, a, b) < 0
+		}
+		return compareItems(opts.Sort, a, b) > 0
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return less(items[i], items[j])
+	})
+
+	if c != nil {
+		from := c.item()
+		start := sort.Search(len(items), func(i int) bool {
+			return less(from, items[i])
+		})
+		items = items[start:]
+	} else if opts.Offset < len(items) {
+		items = items[opts.Offset:]
+	} else {
+		items = nil
+	}
+
+	if len(items) > opts.Limit+1 {
+		items = items[:opts.Limit+1]
+	}
+
+	return finishPage(opts, c, items, total), nil
+}
+
+// SearchItems uses the built-in inverted index, so there's no text index to
+// set up like with mongo.
+func (s *MemoryStore) SearchItems(ctx context.Context, q string, opts SearchOptions) (SearchPage, error) {
+	if err := ctx.Err(); err != nil {
+		return SearchPage{}, err
+	}
+
+	opts, err := opts.normalize()
+	if err != nil {
+		return SearchPage{}, err
+	}
+	if err := checkQuery(q); err != nil {
+		return SearchPage{}, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// the index has everybody's titles, so other tenants' hits go before
+	// paging or the totals would be off
+	var items []model.Item
+	var scores []float64
+	for _, h := range s.index.Search(q) {
+		mongoid, _ := primitive.ObjectIDFromHex(h.ID)
+		if item, ok := s.get(ctx, mongoid); ok {
+			items = append(items, item)
+			scores = append(scores, h.Score)
+		}
+	}
+	page := SearchPage{Total: int64(len(items))}
+
+	if opts.Offset >= len(items) {
+		return page, nil
+	}
+	end := len(items)
+	if end > opts.Offset+opts.Limit {
+		end = opts.Offset + opts.Limit
+	}
+
+	for k := opts.Offset; k < end; k++ {
+		page.Hits = append(page.Hits, newHit(items[k], scores[k], q))
+	}
+	return page, nil
+}
+
+// checkVersion assumes the lock is held.
+func checkVersion(current model.Item, version int64) error {
+	if !versionMatches(current.Version, version) {
+		return fmt.Errorf("%w: %s", ErrVersionMismatch, current.ID.Hex())
+	}
+	return nil
+}
+
+func (s *MemoryStore) UpdateOneItem(ctx context.Context, id string, item *model.Item, version int64) (*UpdateResult, error) {
+	if err := ctx.Err(); err != nil {
+		return &UpdateResult{}, err
+	}
+
+	if item == nil {
+		return &UpdateResult{}, NewValidationError(FieldError{Field: "item", Message: "is required"})
+	}
+
+	mongoid, err := parseID(id)
+	if err != nil {
+		return &UpdateResult{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.get(ctx, mongoid)
+	if !ok {
+		return &UpdateResult{}, missing(id, version)
+	}
+
+	if err := checkVersion(current, version); err != nil {
+		return &UpdateResult{}, err
+	}
+
+	// every write bumps the version, so like mongo with its $inc this
+	// always counts as a modification
+	current.Title = item.Title
+	current.Price = item.Price
+	current.Version++
+	s.items[mongoid] = current
+	s.index.Add(mongoid.Hex(), current.Title)
+
+	return &UpdateResult{MatchedCount: 1, ModifiedCount: 1}, nil
+}
+
+func (s *MemoryStore) PatchOneItem(ctx context.Context, id string, version int64, fn PatchFunc) (model.Item, error) {
+	if err := ctx.Err(); err != nil {
+		return model.Item{}, err
+	}
+
+	mongoid, err := parseID(id)
+	if err != nil {
+		return model.Item{}, err
+	}
+
+	// holding the write lock the whole time is what makes this atomic
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.get(ctx, mongoid)
+	if !ok {
+		return model.Item{}, missing(id, version)
+	}
+
+	if err := checkVersion(current, version); err != nil {
+		return model.Item{}, err
+	}
+
+	next, err := fn(current)
+	if err != nil {
+		return model.Item{}, err
+	}
+	next.ID = current.ID
+	next.Version = current.Version + 1
+	next.Tenant = current.Tenant
+
+	s.items[mongoid] = next
+	s.index.Add(mongoid.Hex(), next.Title)
+	return next, nil
+}
+
+func (s *MemoryStore) DeleteOneItem(ctx context.Context, id string, version int64) (*DeleteResult, error) {
+	if err := ctx.Err(); err != nil {
+		return &DeleteResult{}, err
+	}
+
+	mongoid, err := parseID(id)
+	if err != nil {
+		return &DeleteResult{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.get(ctx, mongoid)
+	if !ok {
+		return &DeleteResult{}, missing(id, version)
+	}
+
+	if err := checkVersion(current, version); err != nil {
+		return &DeleteResult{}, err
+	}
+
+	delete(s.items, mongoid)
+	s.index.Remove(mongoid.Hex())
+	for k := range s.order {
+		if s.order[k] == mongoid {
+			s.order = append(s.order[:k], s.order[k+1:]...)
+			break
+		}
+	}
+	return &DeleteResult{DeletedCount: 1}, nil
+}
@@ -0,0 +1,545 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mar-cial/items/model"
+	"github.com/mar-cial/items/tenant"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMemoryStoreCRUD(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+
+	one, err := s.InsertOneItem(ctx, &model.Item{Title: "Test Product 1", Price: 8008.55})
+	assert.NoError(t, err)
+	assert.True(t, primitive.IsValidObjectID(one.InsertedID))
+
+	many, err := s.InsertItems(ctx, []model.Item{
+		{Title: "Test Product 2", Price: 420.69},
+		{Title: "Test Product 3", Price: 99.99},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, many.InsertedIDs, 2)
+
+	item, err := s.ListOneItem(ctx, one.InsertedID)
+	assert.NoError(t, err)
+	assert.Equal(t, "Test Product 1", item.Title)
+	assert.Equal(t, one.InsertedID, item.ID.Hex())
+
+	page, err := s.ListItems(ctx, ListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, page.Items, 3)
+	assert.Equal(t, int64(3), page.Total)
+	// default sort is creation order
+	assert.Equal(t, "Test Product 3", page.Items[2].Title)
+
+	upd, err := s.UpdateOneItem(ctx, one.InsertedID, &model.Item{Title: "Updated Item 1", Price: 1}, AnyVersion)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), upd.MatchedCount)
+	assert.Equal(t, int64(1), upd.ModifiedCount)
+
+	// same values again still bumps the version
+	upd, err = s.UpdateOneItem(ctx, one.InsertedID, &model.Item{Title: "Updated Item 1", Price: 1}, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), upd.ModifiedCount)
+
+	item, err = s.ListOneItem(ctx, one.InsertedID)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), item.Version)
+
+	del, err := s.DeleteOneItem(ctx, one.InsertedID, AnyVersion)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), del.DeletedCount)
+
+	_, err = s.ListOneItem(ctx, one.InsertedID)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	page, err = s.ListItems(ctx, ListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, page.Items, 2)
+}
+
+func TestMemoryStoreConcurrentInserts(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.InsertOneItem(ctx, &model.Item{Title: "concurrent", Price: 1})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	page, err := s.ListItems(ctx, ListOptions{Limit: MaxLimit})
+	assert.NoError(t, err)
+	assert.Len(t, page.Items, 50)
+}
+
+func TestMemoryStoreErrors(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	missing := primitive.NewObjectID().Hex()
+
+	_, err := s.ListOneItem(ctx, "not-hex")
+	assert.ErrorIs(t, err, ErrInvalidID)
+
+	_, err = s.ListOneItem(ctx, missing)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = s.UpdateOneItem(ctx, missing, &model.Item{Title: "x"}, AnyVersion)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = s.UpdateOneItem(ctx, "not-hex", &model.Item{Title: "x"}, AnyVersion)
+	assert.ErrorIs(t, err, ErrInvalidID)
+
+	_, err = s.DeleteOneItem(ctx, missing, AnyVersion)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = s.InsertItems(ctx, nil)
+	assert.ErrorIs(t, err, ErrValidation)
+
+	var verr *ValidationError
+	assert.ErrorAs(t, err, &verr)
+	assert.Equal(t, "items", verr.Fields[0].Field)
+
+	res, err := s.InsertOneItem(ctx, &model.Item{Title: "x", Price: 1})
+	assert.NoError(t, err)
+
+	id, _ := primitive.ObjectIDFromHex(res.InsertedID)
+	_, err = s.InsertOneItem(ctx, &model.Item{ID: id, Title: "y"})
+	assert.ErrorIs(t, err, ErrConflict)
+
+	// a conflict in a batch inserts nothing
+	_, err = s.InsertItems(ctx, []model.Item{{Title: "z"}, {ID: id, Title: "y"}})
+	assert.ErrorIs(t, err, ErrConflict)
+
+	page, _ := s.ListItems(ctx, ListOptions{})
+	assert.Len(t, page.Items, 1)
+}
+
+func TestMemoryStorePagination(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+
+	// two items share a price so the _id tiebreak gets exercised
+	prices := []float64{5, 1, 3, 3, 9, 7, 2}
+	for k := range prices {
+		_, err := s.InsertOneItem(ctx, &model.Item{Title: fmt.Sprintf("item %d", k), Price: prices[k]})
+		assert.NoError(t, err)
+	}
+
+	pricesOf := func(items []model.Item) []float64 {
+		var out []float64
+		for k := range items {
+			out = append(out, items[k].Price)
+		}
+		return out
+	}
+
+	opts := ListOptions{Limit: 3, Sort: SortPrice, Desc: true}
+
+	p1, err := s.ListItems(ctx, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{9, 7, 5}, pricesOf(p1.Items))
+	assert.Equal(t, int64(7), p1.Total)
+	assert.Empty(t, p1.Prev)
+
+	opts.Cursor = p1.Next
+	p2, err := s.ListItems(ctx, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{3, 3, 2}, pricesOf(p2.Items))
+
+	opts.Cursor = p2.Next
+	p3, err := s.ListItems(ctx, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{1}, pricesOf(p3.Items))
+	assert.Empty(t, p3.Next)
+
+	// and walk back again
+	opts.Cursor = p3.Prev
+	back, err := s.ListItems(ctx, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, pricesOf(p2.Items), pricesOf(back.Items))
+	assert.NotEmpty(t, back.Next)
+
+	opts.Cursor = back.Prev
+	back, err = s.ListItems(ctx, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, pricesOf(p1.Items), pricesOf(back.Items))
+	assert.Empty(t, back.Prev)
+
+	// offsets
+	page, err := s.ListItems(ctx, ListOptions{Limit: 2, Offset: 5, Sort: SortPrice})
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{7, 9}, pricesOf(page.Items))
+
+	// a cursor only works with the sort it was made for
+	_, err = s.ListItems(ctx, ListOptions{Limit: 3, Sort: SortTitle, Cursor: p1.Next})
+	assert.ErrorIs(t, err, ErrInvalidQuery)
+
+	_, err = s.ListItems(ctx, ListOptions{Cursor: "garbage"})
+	assert.ErrorIs(t, err, ErrInvalidQuery)
+}
+
+func TestMemoryStoreSearch(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+
+	res, err := s.InsertItems(ctx, []model.Item{
+		{Title: "HDMI Cable", Price: 12},
+		{Title: "Café table", Price: 45},
+		{Title: "Cable tie", Price: 2},
+	})
+	assert.NoError(t, err)
+
+	page, err := s.SearchItems(ctx, "CABLE", SearchOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), page.Total)
+	assert.Greater(t, page.Hits[0].Score, 0.0)
+	assert.NotEmpty(t, page.Hits[0].Highlights)
+
+	page, err = s.SearchItems(ctx, "cafe", SearchOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "Café table", page.Hits[0].Item.Title)
+
+	page, err = s.SearchItems(ctx, "cable", SearchOptions{Limit: 1, Offset: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), page.Total)
+	assert.Len(t, page.Hits, 1)
+
+	// the index follows updates and deletes
+	_, err = s.UpdateOneItem(ctx, res.InsertedIDs[0], &model.Item{Title: "HDMI adapter", Price: 12}, AnyVersion)
+	assert.NoError(t, err)
+	_, err = s.DeleteOneItem(ctx, res.InsertedIDs[2], AnyVersion)
+	assert.NoError(t, err)
+
+	page, err = s.SearchItems(ctx, "cable", SearchOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), page.Total)
+
+	_, err = s.SearchItems(ctx, " -- ", SearchOptions{})
+	assert.ErrorIs(t, err, ErrInvalidQuery)
+}
+
+func TestMemoryStorePatch(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+
+	res, err := s.InsertOneItem(ctx, &model.Item{Title: "HDMI cable", Price: 12})
+	assert.NoError(t, err)
+
+	item, err := s.PatchOneItem(ctx, res.InsertedID, AnyVersion, func(current model.Item) (model.Item, error) {
+		current.Price = 15
+		return current, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "HDMI cable", item.Title)
+	assert.Equal(t, 15.0, item.Price)
+
+	// an error leaves the item alone
+	_, err = s.PatchOneItem(ctx, res.InsertedID, AnyVersion, func(current model.Item) (model.Item, error) {
+		current.Price = 99
+		return current, ErrValidation
+	})
+	assert.ErrorIs(t, err, ErrValidation)
+
+	item, _ = s.ListOneItem(ctx, res.InsertedID)
+	assert.Equal(t, 15.0, item.Price)
+
+	// concurrent patches don't lose each other's writes
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.PatchOneItem(ctx, res.InsertedID, AnyVersion, func(current model.Item) (model.Item, error) {
+				current.Price++
+				return current, nil
+			})
+		}()
+	}
+	wg.Wait()
+
+	item, _ = s.ListOneItem(ctx, res.InsertedID)
+	assert.Equal(t, 35.0, item.Price)
+
+	_, err = s.PatchOneItem(ctx, primitive.NewObjectID().Hex(), AnyVersion, func(current model.Item) (model.Item, error) {
+		return current, nil
+	})
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestMemoryStoreVersions(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+
+	res, err := s.InsertOneItem(ctx, &model.Item{Title: "HDMI cable", Price: 12, Version: 40})
+	assert.NoError(t, err)
+
+	// whatever the client sent, it starts at 1
+	item, _ := s.ListOneItem(ctx, res.InsertedID)
+	assert.Equal(t, int64(1), item.Version)
+
+	_, err = s.UpdateOneItem(ctx, res.InsertedID, &model.Item{Title: "x", Price: 1}, 7)
+	assert.ErrorIs(t, err, ErrVersionMismatch)
+
+	_, err = s.UpdateOneItem(ctx, res.InsertedID, &model.Item{Title: "x", Price: 1}, 1)
+	assert.NoError(t, err)
+
+	item, err = s.PatchOneItem(ctx, res.InsertedID, 1, func(current model.Item) (model.Item, error) {
+		return current, nil
+	})
+	assert.ErrorIs(t, err, ErrVersionMismatch)
+
+	item, err = s.PatchOneItem(ctx, res.InsertedID, 2, func(current model.Item) (model.Item, error) {
+		current.Version = 100
+		return current, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), item.Version)
+
+	_, err = s.DeleteOneItem(ctx, res.InsertedID, 2)
+	assert.ErrorIs(t, err, ErrVersionMismatch)
+
+	// ExistingVersion takes any version, but not no item at all
+	_, err = s.UpdateOneItem(ctx, res.InsertedID, &model.Item{Title: "y", Price: 2}, ExistingVersion)
+	assert.NoError(t, err)
+
+	_, err = s.DeleteOneItem(ctx, res.InsertedID, 4)
+	assert.NoError(t, err)
+
+	_, err = s.UpdateOneItem(ctx, res.InsertedID, &model.Item{Title: "y", Price: 2}, ExistingVersion)
+	assert.ErrorIs(t, err, ErrVersionMismatch)
+	_, err = s.PatchOneItem(ctx, res.InsertedID, ExistingVersion, func(current model.Item) (model.Item, error) {
+		return current, nil
+	})
+	assert.ErrorIs(t, err, ErrVersionMismatch)
+	_, err = s.DeleteOneItem(ctx, res.InsertedID, ExistingVersion)
+	assert.ErrorIs(t, err, ErrVersionMismatch)
+	_, err = s.DeleteOneItem(ctx, res.InsertedID, AnyVersion)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestMemoryKeyStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryKeyStore()
+
+	key := model.APIKey{Name: "ci", Prefix: "abcd1234", Hash: "h", Scopes: []string{"items:read"}}
+	assert.NoError(t, s.InsertKey(ctx, &key))
+	assert.False(t, key.ID.IsZero())
+
+	dup := model.APIKey{Name: "other", Prefix: "abcd1234"}
+	assert.ErrorIs(t, s.InsertKey(ctx, &dup), ErrConflict)
+
+	got, err := s.KeyByPrefix(ctx, "abcd1234")
+	assert.NoError(t, err)
+	assert.Equal(t, "ci", got.Name)
+	_, err = s.KeyByPrefix(ctx, "nope")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// what comes back is a copy
+	got.Scopes[0] = "admin"
+	got, _ = s.GetKey(ctx, key.ID.Hex())
+	assert.Equal(t, []string{"items:read"}, got.Scopes)
+
+	first := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.NoError(t, s.TouchKey(ctx, key.ID.Hex(), first))
+	revoked, err := s.RevokeKey(ctx, key.ID.Hex(), first)
+	assert.NoError(t, err)
+	assert.Equal(t, first, *revoked.RevokedAt)
+	assert.Equal(t, first, *revoked.LastUsedAt)
+
+	// the first revocation sticks
+	revoked, err = s.RevokeKey(ctx, key.ID.Hex(), first.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, first, *revoked.RevokedAt)
+
+	keys, err := s.ListKeys(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, keys, 1)
+
+	_, err = s.GetKey(ctx, "nope")
+	assert.ErrorIs(t, err, ErrInvalidID)
+	assert.ErrorIs(t, s.TouchKey(ctx, primitive.NewObjectID().Hex(), first), ErrNotFound)
+}
+
+// checkTenants runs through every store operation as two tenants and makes
+// sure neither ever sees or touches the other's items.
+func checkTenants(t *testing.T, s ItemStore) {
+	t.Helper()
+	acme := tenant.With(context.Background(), "acme")
+	globex := tenant.With(context.Background(), "globex")
+
+	one, err := s.InsertOneItem(acme, &model.Item{Title: "Rocket skates", Price: 10})
+	assert.NoError(t, err)
+	_, err = s.InsertItems(acme, []model.Item{{Title: "Anvil", Price: 20}, {Title: "Rocket", Price: 30}})
+	assert.NoError(t, err)
+	theirs, err := s.InsertOneItem(globex, &model.Item{Title: "Rocket launcher", Price: 40})
+	assert.NoError(t, err)
+
+	page, err := s.ListItems(acme, ListOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), page.Total)
+	page, err = s.ListItems(globex, ListOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), page.Total)
+	assert.Equal(t, "Rocket launcher", page.Items[0].Title)
+
+	found, err := s.SearchItems(acme, "rocket", SearchOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), found.Total)
+	found, err = s.SearchItems(globex, "rocket", SearchOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), found.Total)
+
+	// the other tenant's ids don't exist as far as globex is concerned
+	_, err = s.ListOneItem(globex, one.InsertedID)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = s.UpdateOneItem(globex, one.InsertedID, &model.Item{Title: "Mine now", Price: 1}, AnyVersion)
+	assert.ErrorIs(t, err, ErrNotFound)
+	// not even a version mismatch, that would give away it's there
+	_, err = s.UpdateOneItem(globex, one.InsertedID, &model.Item{Title: "Mine now", Price: 1}, 7)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = s.PatchOneItem(globex, one.InsertedID, AnyVersion, func(current model.Item) (model.Item, error) {
+		current.Title = "Mine now"
+		return current, nil
+	})
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = s.DeleteOneItem(globex, one.InsertedID, AnyVersion)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	item, err := s.ListOneItem(acme, one.InsertedID)
+	assert.NoError(t, err)
+	assert.Equal(t, "Rocket skates", item.Title)
+	assert.Equal(t, int64(1), item.Version)
+
+	// patching keeps the item with its tenant
+	_, err = s.PatchOneItem(acme, one.InsertedID, AnyVersion, func(current model.Item) (model.Item, error) {
+		return model.Item{Title: "Rocket skates II", Price: current.Price}, nil
+	})
+	assert.NoError(t, err)
+	item, err = s.ListOneItem(acme, one.InsertedID)
+	assert.NoError(t, err)
+	assert.Equal(t, "Rocket skates II", item.Title)
+
+	_, err = s.DeleteOneItem(acme, theirs.InsertedID, AnyVersion)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = s.DeleteOneItem(globex, theirs.InsertedID, AnyVersion)
+	assert.NoError(t, err)
+
+	// counting every tenant needs no tenant, and sees through wrappers
+	counter, ok := CounterOf(NewQuotaStore(s, func(string) int64 { return 0 }, NewMemoryQuotaCounter()))
+	assert.True(t, ok)
+	counts, err := counter.CountByTenant(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), counts["acme"])
+	assert.Zero(t, counts["globex"])
+	assert.Zero(t, counts[""])
+}
+
+func TestMemoryStoreTenants(t *testing.T) {
+	s := NewMemoryStore()
+	checkTenants(t, s)
+
+	// no tenant is a tenant of its own
+	page, err := s.ListItems(context.Background(), ListOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), page.Total)
+}
+
+func TestQuotaStore(t *testing.T) {
+	quota := func(id string) int64 {
+		if id == "small" {
+			return 2
+		}
+		return 0
+	}
+	items, counter := NewMemoryStore(), NewMemoryQuotaCounter()
+	s := NewQuotaStore(items, quota, counter)
+	small := tenant.With(context.Background(), "small")
+	big := tenant.With(context.Background(), "big")
+
+	_, err := s.InsertOneItem(small, &model.Item{Title: "one", Price: 1})
+	assert.NoError(t, err)
+	// all of a batch has to fit, or none of it goes in
+	_, err = s.InsertItems(small, []model.Item{{Title: "two", Price: 2}, {Title: "three", Price: 3}})
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+	assert.Equal(t, "conflict", Outcome(err))
+	_, err = s.InsertItems(small, []model.Item{{Title: "two", Price: 2}})
+	assert.NoError(t, err)
+	_, err = s.InsertOneItem(small, &model.Item{Title: "three", Price: 3})
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+
+	page, err := s.ListItems(small, ListOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), page.Total)
+
+	// deleting makes room again
+	_, err = s.DeleteOneItem(small, page.Items[0].ID.Hex(), AnyVersion)
+	assert.NoError(t, err)
+	_, err = s.InsertOneItem(small, &model.Item{Title: "three", Price: 3})
+	assert.NoError(t, err)
+
+	// racing for the last spot, only one gets it
+	_, err = s.DeleteOneItem(small, page.Items[1].ID.Hex(), AnyVersion)
+	assert.NoError(t, err)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var won int
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.InsertOneItem(small, &model.Item{Title: "race", Price: 1}); err == nil {
+				mu.Lock()
+				won++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, won)
+
+	// two servers sharing the counts can't both take it either
+	page, err = s.ListItems(small, ListOptions{})
+	assert.NoError(t, err)
+	_, err = s.DeleteOneItem(small, page.Items[0].ID.Hex(), AnyVersion)
+	assert.NoError(t, err)
+	other := NewQuotaStore(items, quota, counter)
+	won = 0
+	for _, store := range []*QuotaStore{s, other, s, other} {
+		wg.Add(1)
+		go func(store *QuotaStore) {
+			defer wg.Done()
+			if _, err := store.InsertOneItem(small, &model.Item{Title: "race", Price: 1}); err == nil {
+				mu.Lock()
+				won++
+				mu.Unlock()
+			}
+		}(store)
+	}
+	wg.Wait()
+	assert.Equal(t, 1, won)
+
+	// a count that's gone is counted again
+	assert.NoError(t, counter.Forget(context.Background(), "small"))
+	_, err = other.InsertOneItem(small, &model.Item{Title: "three", Price: 3})
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+
+	// other tenants have their own count
+	for i := 0; i < 5; i++ {
+		_, err = s.InsertOneItem(big, &model.Item{Title: "big", Price: 1})
+		assert.NoError(t, err)
+	}
+}
@@ -0,0 +1,154 @@
+package db
+
+import (
+	"context"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// QuotaCounter keeps count of every tenant's items for QuotaStore, and
+// makes checking the quota and counting the new items one step so two
+// inserts can't both take the last free spot. Where the counts live is how
+// far that holds: MemoryQuotaCounter is one process, MongoQuotaCounter is
+// every server on the database.
+type QuotaCounter interface {
+	// Reserve adds n to tenant's count if that leaves it at limit or
+	// under, or whatever it comes to with a limit of 0 or less, and says
+	// whether it did. seed is how many items the tenant has, for when
+	// there's no count yet.
+	Reserve(ctx context.Context, tenant string, n, limit int64, seed func() (int64, error)) (bool, error)
+	// Release takes n off tenant's count, for items that are gone. A
+	// count that's less than n is off somehow and gets dropped.
+	Release(ctx context.Context, tenant string, n int64) error
+	// Forget drops tenant's count, so the next Reserve seeds it again.
+	// It's for when there's no telling what made it in.
+	Forget(ctx context.Context, tenant string) error
+}
+
+var (
+	_ QuotaCounter = (*MemoryQuotaCounter)(nil)
+	_ QuotaCounter = (*MongoQuotaCounter)(nil)
+)
+
+// MemoryQuotaCounter keeps the counts in the process, which is all it
+// takes with one server or the memory store.
+type MemoryQuotaCounter struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func NewMemoryQuotaCounter() *MemoryQuotaCounter {
+	return &MemoryQuotaCounter{counts: map[string]int64{}}
+}
+
+func (c *MemoryQuotaCounter) Reserve(ctx context.Context, tenant string, n, limit int64, seed func() (int64, error)) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	have, ok := c.counts[tenant]
+	if !ok {
+		var err error
+		if have, err = seed(); err != nil {
+			return false, err
+		}
+		c.counts[tenant] = have
+	}
+	if limit > 0 && have+n > limit {
+		return false, nil
+	}
+	c.counts[tenant] = have + n
+	return true, nil
+}
+
+func (c *MemoryQuotaCounter) Release(ctx context.Context, tenant string, n int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if have, ok := c.counts[tenant]; ok && have >= n {
+		c.counts[tenant] = have - n
+	} else {
+		delete(c.counts, tenant)
+	}
+	return nil
+}
+
+func (c *MemoryQuotaCounter) Forget(ctx context.Context, tenant string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.counts, tenant)
+	return nil
+}
+
+// MongoQuotaCounter keeps a document per tenant, {_id: tenant, n: count},
+// and only ever changes n with a conditional $inc, so however many
+// servers share coll a tenant can't go over.
+type MongoQuotaCounter struct {
+	coll *mongo.Collection
+}
+
+func NewMongoQuotaCounter(coll *mongo.Collection) *MongoQuotaCounter {
+	return &MongoQuotaCounter{coll: coll}
+}
+
+func (c *MongoQuotaCounter) Reserve(ctx context.Context, tenant string, n, limit int64, seed func() (int64, error)) (bool, error) {
+	if limit > 0 && n > limit {
+		return false, nil
+	}
+
+	filter := bson.M{"_id": tenant}
+	if limit > 0 {
+		filter["n"] = bson.M{"$lte": limit - n}
+	}
+
+	for try := 0; ; try++ {
+		res, err := c.coll.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"n": n}})
+		if err != nil {
+			return false, mongoErr(err)
+		}
+		if res.MatchedCount == 1 {
+			return true, nil
+		}
+
+		// either it doesn't fit or there's no count yet, and once it's
+		// been seeded it's the first
+		if try > 0 {
+			return false, nil
+		}
+		found, err := c.coll.CountDocuments(ctx, bson.M{"_id": tenant})
+		if err != nil {
+			return false, mongoErr(err)
+		}
+		if found > 0 {
+			return false, nil
+		}
+
+		have, err := seed()
+		if err != nil {
+			return false, err
+		}
+		// if another server seeded it in the meantime theirs stays
+		_, err = c.coll.UpdateOne(ctx, bson.M{"_id": tenant}, bson.M{"$setOnInsert": bson.M{"n": have}}, options.Update().SetUpsert(true))
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return false, mongoErr(err)
+		}
+	}
+}
+
+func (c *MongoQuotaCounter) Release(ctx context.Context, tenant string, n int64) error {
+	res, err := c.coll.UpdateOne(ctx, bson.M{"_id": tenant, "n": bson.M{"$gte": n}}, bson.M{"$inc": bson.M{"n": -n}})
+	if err != nil {
+		return mongoErr(err)
+	}
+	if res.MatchedCount == 0 {
+		return c.Forget(ctx, tenant)
+	}
+	return nil
+}
+
+func (c *MongoQuotaCounter) Forget(ctx context.Context, tenant string) error {
+	_, err := c.coll.DeleteOne(ctx, bson.M{"_id": tenant})
+	return mongoErr(err)
+}
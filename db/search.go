@@ -0,0 +1,155 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mar-cial/items/model"
+	"github.com/mar-cial/items/search"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// titleTextIndex is the name of the text index SearchItems needs. Default
+// language "none" turns off stemming and stop words, so mongo matches
+// whole words like the memory store does.
+const titleTextIndex = "title_text"
+
+// SearchOptions pages through search results. Limit gets the same default
+// and cap as ListOptions.
+type SearchOptions struct {
+	Limit  int
+	Offset int
+}
+
+func (o SearchOptions) normalize() (SearchOptions, error) {
+	lo, _, err := ListOptions{Limit: o.Limit, Offset: o.Offset}.normalize()
+	return SearchOptions{Limit: lo.Limit, Offset: lo.Offset}, err
+}
+
+type SearchHit struct {
+	Item       model.Item    `json:"item"`
+	Score      float64       `json:"score"`
+	Highlights []search.Span `json:"highlights"`
+}
+
+type SearchPage struct {
+	Hits  []SearchHit
+	Total int64
+}
+
+func checkQuery(q string) error {
+	if len(search.Terms(q)) == 0 {
+		return fmt.Errorf("%w: search query has no words in it", ErrInvalidQuery)
+	}
+	return nil
+}
+
+func newHit(item model.Item, score float64, q string) SearchHit {
+	spans := search.Highlight(item.Title, q)
+	if spans == nil {
+		spans = []search.Span{}
+	}
+	return SearchHit{Item: item, Score: score, Highlights: spans}
+}
+
+// EnsureIndexes creates the indexes the mongo store relies on. It's safe
+// to call every time the app starts, mongo does nothing if they exist.
+func EnsureIndexes(ctx context.Context, coll *mongo.Collection) error {
+	_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "title", Value: "text"}},
+		Options: options.Index().
+			SetName(titleTextIndex).
+			SetDefaultLanguage("none"),
+	})
+	return err
+}
+
+// tenantTextIndex replaces titleTextIndex with TenantField. It starts
+// with the tenant, so a search only ever looks at one tenant's titles.
+const tenantTextIndex = "tenant_title_text"
+
+// EnsureTenantIndexes is EnsureIndexes for a collection tenants share by
+// the tenant field. Every index starts with the tenant, so lists in any
+// sort order stay on one tenant's items. A collection only gets one text
+// index, so a title_text from before tenancy is dropped first.
+func EnsureTenantIndexes(ctx context.Context, coll *mongo.Collection) error {
+	if _, err := coll.Indexes().DropOne(ctx, titleTextIndex); err != nil && !isIndexNotFound(err) {
+		return err
+	}
+
+	_, err := coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "title", Value: "text"}},
+			Options: options.Index().
+				SetName(tenantTextIndex).
+				SetDefaultLanguage("none"),
+		},
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "title", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "price", Value: 1}, {Key: "_id", Value: 1}}},
+	})
+	return err
+}
+
+// isIndexNotFound is dropping an index, or from a collection, that isn't
+// there.
+func isIndexNotFound(err error) bool {
+	var cmd mongo.CommandError
+	// 26 is NamespaceNotFound, 27 IndexNotFound
+	return errors.As(err, &cmd) && (cmd.Code == 26 || cmd.Code == 27)
+}
+
+// SearchItems runs a $text search over titles, best matches first.
+func SearchItems(ctx context.Context, coll *mongo.Collection, q string, opts SearchOptions) (SearchPage, error) {
+	opts, err := opts.normalize()
+	if err != nil {
+		return SearchPage{}, err
+	}
+	if err := checkQuery(q); err != nil {
+		return SearchPage{}, err
+	}
+
+	// hand mongo the folded terms so it never sees quotes or -negations
+	// from the user
+	filter := scoped(ctx, bson.M{"$text": bson.M{
+		"$search":             strings.Join(search.Terms(q), " "),
+		"$caseSensitive":      false,
+		"$diacriticSensitive": false,
+	}})
+
+	total, err := coll.CountDocuments(ctx, filter)
+	if err != nil {
+		return SearchPage{}, mongoErr(err)
+	}
+
+	score := bson.M{"$meta": "textScore"}
+	find := options.Find().
+		SetProjection(bson.M{"score": score}).
+		SetSort(bson.D{{Key: "score", Value: score}, {Key: "_id", Value: 1}}).
+		SetSkip(int64(opts.Offset)).
+		SetLimit(int64(opts.Limit))
+
+	cursor, err := coll.Find(ctx, filter, find)
+	if err != nil {
+		return SearchPage{}, mongoErr(err)
+	}
+	defer cursor.Close(ctx)
+
+	page := SearchPage{Total: total}
+	for cursor.Next(ctx) {
+		var doc struct {
+			model.Item `bson:",inline"`
+			Score      float64 `bson:"score"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return SearchPage{}, err
+		}
+		page.Hits = append(page.Hits, newHit(doc.Item, doc.Score, q))
+	}
+
+	return page, mongoErr(cursor.Err())
+}
@@ -0,0 +1,304 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/mar-cial/items/logging"
+	"github.com/mar-cial/items/model"
+	"github.com/mar-cial/items/tenant"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// ItemStore is everything the api package needs from a storage backend.
+// The mongo one is the real thing, the memory one is for tests and for
+// running the server without a database around.
+type ItemStore interface {
+	InsertOneItem(ctx context.Context, item *model.Item) (*InsertOneResult, error)
+	InsertItems(ctx context.Context, items []model.Item) (*InsertManyResult, error)
+	ListOneItem(ctx context.Context, id string) (model.Item, error)
+	ListItems(ctx context.Context, opts ListOptions) (ItemPage, error)
+	SearchItems(ctx context.Context, q string, opts SearchOptions) (SearchPage, error)
+	// The version arguments make writes conditional, pass AnyVersion to
+	// skip the check and ExistingVersion to only check the item's there.
+	// A mismatch is ErrVersionMismatch.
+	UpdateOneItem(ctx context.Context, id string, item *model.Item, version int64) (*UpdateResult, error)
+	PatchOneItem(ctx context.Context, id string, version int64, fn PatchFunc) (model.Item, error)
+	DeleteOneItem(ctx context.Context, id string, version int64) (*DeleteResult, error)
+	// Ping checks the backend can be reached, for the readiness probe.
+	Ping(ctx context.Context) error
+	// Close lets go of whatever the store holds on to, like the mongo
+	// connections. The store can't be used after.
+	Close(ctx context.Context) error
+}
+
+var (
+	_ ItemStore = (*MongoStore)(nil)
+	_ ItemStore = (*MemoryStore)(nil)
+)
+
+// PatchFunc gets the current item and returns what it should become. Stores
+// run it so that nothing else can change the item in between, and if it
+// returns an error nothing is written.
+type PatchFunc func(current model.Item) (model.Item, error)
+
+// These mirror the mongo driver result types field by field, so the JSON
+// the handlers send back looks exactly like it did before.
+type InsertOneResult struct {
+	InsertedID string
+}
+
+type InsertManyResult struct {
+	InsertedIDs []string
+}
+
+type UpdateResult struct {
+	MatchedCount  int64
+	ModifiedCount int64
+	UpsertedCount int64
+	UpsertedID    interface{}
+}
+
+type DeleteResult struct {
+	DeletedCount int64
+}
+
+// MongoStore is the ItemStore backed by mongo. It works out which
+// collection and which tenant a call is for and forwards to the functions
+// in actions.go.
+type MongoStore struct {
+	coll    *mongo.Collection
+	tenancy TenantStrategy
+	// reserved are collections next to the tenants' that aren't any
+	// tenant's, whatever they're called
+	reserved map[string]bool
+
+	// indexed has the collections EnsureIndexes worked for, so search can
+	// create the text index the first time it's needed instead of at
+	// startup, when mongo might not be up yet.
+	mu      sync.Mutex
+	indexed map[string]bool
+}
+
+// NewMongoStore keeps everything in coll, whoever it's for.
+func NewMongoStore(coll *mongo.Collection) *MongoStore {
+	return NewTenantMongoStore(coll, TenantNone)
+}
+
+// NewTenantMongoStore keeps tenants apart the way strategy says. Every
+// call but Ping and Close needs a tenant in its context then, see
+// tenant.With.
+func NewTenantMongoStore(coll *mongo.Collection, strategy TenantStrategy) *MongoStore {
+	return &MongoStore{coll: coll, tenancy: strategy, reserved: map[string]bool{}, indexed: map[string]bool{}}
+}
+
+// Reserve tells the store the collections in names aren't a tenant's,
+// like the api keys. With TenantCollection a tenant that would end up in
+// one of them is turned away and CountByTenant leaves them out. It's for
+// setting up the store, before it's used.
+func (s *MongoStore) Reserve(names ...string) {
+	for _, name := range names {
+		s.reserved[name] = true
+	}
+}
+
+// scope is the collection a call works on, and the context to hand to
+// actions.go so it sticks to the tenant. With TenantField the indexes the
+// tenant queries need are made first.
+func (s *MongoStore) scope(ctx context.Context) (context.Context, *mongo.Collection, error) {
+	if s.tenancy == TenantNone || s.tenancy == "" {
+		return ctx, s.coll, nil
+	}
+
+	id, err := requireTenant(ctx)
+	if err != nil {
+		return ctx, nil, err
+	}
+
+	if s.tenancy == TenantCollection {
+		name := s.coll.Name() + "_" + id
+		if s.reserved[name] {
+			return ctx, nil, fmt.Errorf("%w: %q, %s isn't a tenant's collection", tenant.ErrInvalid, id, name)
+		}
+		return ctx, s.coll.Database().Collection(name), nil
+	}
+	if err := s.ensureIndexes(ctx, s.coll); err != nil {
+		return ctx, nil, err
+	}
+	return withScope(ctx, id), s.coll, nil
+}
+
+// CountByTenant counts straight from the collections, no tenant needed in
+// ctx. With TenantField that's a group by the tenant field, with
+// TenantCollection every collection named after coll that isn't reserved
+// is a tenant.
+func (s *MongoStore) CountByTenant(ctx context.Context) (map[string]int64, error) {
+	switch s.tenancy {
+	case TenantField:
+		return countByField(ctx, s.coll)
+	case TenantCollection:
+		return countCollections(ctx, s.coll, s.reserved)
+	}
+
+	n, err := s.coll.CountDocuments(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]int64{"": n}, nil
+}
+
+// Ping asks the primary, since that's where the writes have to go.
+func (s *MongoStore) Ping(ctx context.Context) error {
+	return s.coll.Database().Client().Ping(ctx, readpref.Primary())
+}
+
+// Close disconnects the mongo client the collection came from.
+func (s *MongoStore) Close(ctx context.Context) error {
+	return s.coll.Database().Client().Disconnect(ctx)
+}
+
+// EnsureIndexes creates the indexes the collection for the tenant in ctx
+// needs, see the package level EnsureIndexes. After the first success it
+// doesn't go to mongo again.
+func (s *MongoStore) EnsureIndexes(ctx context.Context) error {
+	_, coll, err := s.scope(ctx)
+	if err != nil {
+		return err
+	}
+	return s.ensureIndexes(ctx, coll)
+}
+
+func (s *MongoStore) ensureIndexes(ctx context.Context, coll *mongo.Collection) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.indexed[coll.Name()] {
+		return nil
+	}
+
+	ensure := EnsureIndexes
+	if s.tenancy == TenantField {
+		ensure = EnsureTenantIndexes
+	}
+	if err := ensure(ctx, coll); err != nil {
+		logging.From(ctx).Warn("creating indexes", slog.Any("err", err))
+		return err
+	}
+	logging.From(ctx).Info("indexes ready", slog.String("collection", coll.Name()))
+	s.indexed[coll.Name()] = true
+	return nil
+}
+
+func (s *MongoStore) InsertOneItem(ctx context.Context, item *model.Item) (*InsertOneResult, error) {
+	ctx, coll, err := s.scope(ctx)
+	if err != nil {
+		return &InsertOneResult{}, err
+	}
+
+	res, err := InsertOneItem(ctx, coll, item)
+	if err != nil {
+		return &InsertOneResult{}, err
+	}
+
+	return &InsertOneResult{InsertedID: hexID(res.InsertedID)}, nil
+}
+
+func (s *MongoStore) InsertItems(ctx context.Context, items []model.Item) (*InsertManyResult, error) {
+	ctx, coll, err := s.scope(ctx)
+	if err != nil {
+		return &InsertManyResult{}, err
+	}
+
+	res, err := InsertItems(ctx, coll, items)
+	if err != nil {
+		return &InsertManyResult{}, err
+	}
+
+	out := &InsertManyResult{}
+	for k := range res.InsertedIDs {
+		out.InsertedIDs = append(out.InsertedIDs, hexID(res.InsertedIDs[k]))
+	}
+	return out, nil
+}
+
+func (s *MongoStore) ListOneItem(ctx context.Context, id string) (model.Item, error) {
+	ctx, coll, err := s.scope(ctx)
+	if err != nil {
+		return model.Item{}, err
+	}
+	return ListOneItem(ctx, coll, id)
+}
+
+func (s *MongoStore) ListItems(ctx context.Context, opts ListOptions) (ItemPage, error) {
+	ctx, coll, err := s.scope(ctx)
+	if err != nil {
+		return ItemPage{}, err
+	}
+	return ListItems(ctx, coll, opts)
+}
+
+func (s *MongoStore) SearchItems(ctx context.Context, q string, opts SearchOptions) (SearchPage, error) {
+	ctx, coll, err := s.scope(ctx)
+	if err != nil {
+		return SearchPage{}, err
+	}
+	if err := s.ensureIndexes(ctx, coll); err != nil {
+		return SearchPage{}, err
+	}
+	return SearchItems(ctx, coll, q, opts)
+}
+
+func (s *MongoStore) UpdateOneItem(ctx context.Context, id string, item *model.Item, version int64) (*UpdateResult, error) {
+	ctx, coll, err := s.scope(ctx)
+	if err != nil {
+		return &UpdateResult{}, err
+	}
+
+	res, err := UpdateOneItem(ctx, coll, id, item, version)
+	if err != nil {
+		return &UpdateResult{}, err
+	}
+
+	return &UpdateResult{
+		MatchedCount:  res.MatchedCount,
+		ModifiedCount: res.ModifiedCount,
+		UpsertedCount: res.UpsertedCount,
+		UpsertedID:    res.UpsertedID,
+	}, nil
+}
+
+func (s *MongoStore) PatchOneItem(ctx context.Context, id string, version int64, fn PatchFunc) (model.Item, error) {
+	ctx, coll, err := s.scope(ctx)
+	if err != nil {
+		return model.Item{}, err
+	}
+	return PatchOneItem(ctx, coll, id, version, fn)
+}
+
+func (s *MongoStore) DeleteOneItem(ctx context.Context, id string, version int64) (*DeleteResult, error) {
+	ctx, coll, err := s.scope(ctx)
+	if err != nil {
+		return &DeleteResult{}, err
+	}
+
+	res, err := DeleteOneItem(ctx, coll, id, version)
+	if err != nil {
+		return &DeleteResult{}, err
+	}
+
+	return &DeleteResult{DeletedCount: res.DeletedCount}, nil
+}
+
+// hexID turns whatever mongo handed back as an _id into a string. Items
+// always get ObjectIDs so the fallback is just there to be safe.
+func hexID(id interface{}) string {
+	if oid, ok := id.(primitive.ObjectID); ok {
+		return oid.Hex()
+	}
+	return fmt.Sprint(id)
+}
@@ -0,0 +1,245 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"github.com/mar-cial/items/logging"
+	"github.com/mar-cial/items/model"
+	"github.com/mar-cial/items/tenant"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// TenantStrategy is how MongoStore keeps tenants apart.
+type TenantStrategy string
+
+const (
+	// TenantNone is one collection everybody shares, the way it's always
+	// been. The tenant in the context is ignored.
+	TenantNone TenantStrategy = "none"
+	// TenantField puts a tenant field on every item and in every query,
+	// with indexes that start with it.
+	TenantField TenantStrategy = "field"
+	// TenantCollection gives every tenant a collection of its own, named
+	// after the items collection: items_acme for tenant acme.
+	TenantCollection TenantStrategy = "collection"
+)
+
+var (
+	// ErrNoTenant is a store that keeps tenants apart being asked to do
+	// something without one in the context. Better to fail than to guess
+	// whose items they are.
+	ErrNoTenant = errors.New("no tenant in context")
+	// ErrQuotaExceeded is an insert that would take a tenant past the
+	// number of items it's allowed.
+	ErrQuotaExceeded = errors.New("item quota exceeded")
+)
+
+// requireTenant is the tenant in ctx, checked, for the stores that need
+// one.
+func requireTenant(ctx context.Context) (string, error) {
+	id, ok := tenant.From(ctx)
+	if !ok {
+		return "", ErrNoTenant
+	}
+	if err := tenant.Valid(id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// scopeKey carries the tenant the functions in actions.go have to stick
+// to. MongoStore only sets it with TenantField, so calling them directly
+// on a collection works like it always did.
+type scopeKey struct{}
+
+func withScope(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, scopeKey{}, id)
+}
+
+func scopeOf(ctx context.Context) string {
+	id, _ := ctx.Value(scopeKey{}).(string)
+	return id
+}
+
+// scoped adds the tenant, if there is one, to a filter.
+func scoped(ctx context.Context, filter bson.M) bson.M {
+	if id := scopeOf(ctx); id != "" {
+		filter["tenant"] = id
+	}
+	return filter
+}
+
+// TenantCounter is a store that can count every tenant's items in one go.
+// The ItemStore methods only ever see the tenant in the context, which is
+// no good for metrics. Items from before tenancy, and every item without
+// it, count for "".
+type TenantCounter interface {
+	CountByTenant(ctx context.Context) (map[string]int64, error)
+}
+
+var (
+	_ TenantCounter = (*MongoStore)(nil)
+	_ TenantCounter = (*MemoryStore)(nil)
+)
+
+// CounterOf is the TenantCounter in store, looking through the wrappers
+// in between, as long as they have an Unwrap like QuotaStore does.
+func CounterOf(store ItemStore) (TenantCounter, bool) {
+	for {
+		if c, ok := store.(TenantCounter); ok {
+			return c, true
+		}
+		u, ok := store.(interface{ Unwrap() ItemStore })
+		if !ok {
+			return nil, false
+		}
+		store = u.Unwrap()
+	}
+}
+
+// QuotaFunc is how many items a tenant may have, 0 or less for no limit.
+// Without tenancy the tenant is "".
+type QuotaFunc func(tenant string) int64
+
+// QuotaStore refuses inserts that would take a tenant past its quota. The
+// counter keeps every tenant's count, seeded from ListItems on the store
+// it wraps the first time, and checks and bumps it in one go. Deletes take
+// items off again. With a MongoQuotaCounter that holds across servers,
+// with a MemoryQuotaCounter only within the one process.
+type QuotaStore struct {
+	ItemStore
+	quota   QuotaFunc
+	counter QuotaCounter
+}
+
+var _ ItemStore = (*QuotaStore)(nil)
+
+func NewQuotaStore(store ItemStore, quota QuotaFunc, counter QuotaCounter) *QuotaStore {
+	return &QuotaStore{ItemStore: store, quota: quota, counter: counter}
+}
+
+// Unwrap is the store QuotaStore wraps.
+func (s *QuotaStore) Unwrap() ItemStore {
+	return s.ItemStore
+}
+
+// reserve counts n more items for the tenant in ctx, if they fit.
+func (s *QuotaStore) reserve(ctx context.Context, n int) error {
+	id, _ := tenant.From(ctx)
+	limit := s.quota(id)
+
+	ok, err := s.counter.Reserve(ctx, id, int64(n), limit, func() (int64, error) {
+		page, err := s.ItemStore.ListItems(ctx, ListOptions{Limit: 1})
+		return page.Total, err
+	})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: tenant %q can have %d items", ErrQuotaExceeded, id, limit)
+	}
+	return nil
+}
+
+// forget drops the tenant's count after an insert that failed, when
+// there's no telling how much of it made it in. The next insert counts
+// again.
+func (s *QuotaStore) forget(ctx context.Context) {
+	id, _ := tenant.From(ctx)
+	if err := s.counter.Forget(context.WithoutCancel(ctx), id); err != nil {
+		logging.From(ctx).Warn("dropping item count", slog.String("tenant", id), slog.Any("err", err))
+	}
+}
+
+func (s *QuotaStore) InsertOneItem(ctx context.Context, item *model.Item) (*InsertOneResult, error) {
+	if err := s.reserve(ctx, 1); err != nil {
+		return &InsertOneResult{}, err
+	}
+	res, err := s.ItemStore.InsertOneItem(ctx, item)
+	if err != nil {
+		s.forget(ctx)
+	}
+	return res, err
+}
+
+func (s *QuotaStore) InsertItems(ctx context.Context, items []model.Item) (*InsertManyResult, error) {
+	if err := s.reserve(ctx, len(items)); err != nil {
+		return &InsertManyResult{}, err
+	}
+	res, err := s.ItemStore.InsertItems(ctx, items)
+	if err != nil {
+		s.forget(ctx)
+	}
+	return res, err
+}
+
+func (s *QuotaStore) DeleteOneItem(ctx context.Context, id string, version int64) (*DeleteResult, error) {
+	res, err := s.ItemStore.DeleteOneItem(ctx, id, version)
+	if err == nil && res.DeletedCount > 0 {
+		t, _ := tenant.From(ctx)
+		if err := s.counter.Release(context.WithoutCancel(ctx), t, res.DeletedCount); err != nil {
+			logging.From(ctx).Warn("counting a delete", slog.String("tenant", t), slog.Any("err", err))
+		}
+	}
+	return res, err
+}
+
+// countByField is how many items every tenant has in a TenantField
+// collection.
+func countByField(ctx context.Context, coll *mongo.Collection) (map[string]int64, error) {
+	cur, err := coll.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{"_id": "$tenant", "n": bson.M{"$sum": 1}}}},
+	})
+	if err != nil {
+		return nil, mongoErr(err)
+	}
+
+	var groups []struct {
+		Tenant *string `bson:"_id"`
+		N      int64   `bson:"n"`
+	}
+	if err := cur.All(ctx, &groups); err != nil {
+		return nil, mongoErr(err)
+	}
+
+	counts := map[string]int64{}
+	for _, g := range groups {
+		id := ""
+		if g.Tenant != nil {
+			id = *g.Tenant
+		}
+		counts[id] += g.N
+	}
+	return counts, nil
+}
+
+// countCollections is how many items every tenant has with
+// TenantCollection, where tenant acme's are in coll_acme. The reserved
+// collections aren't anyone's.
+func countCollections(ctx context.Context, coll *mongo.Collection, reserved map[string]bool) (map[string]int64, error) {
+	prefix := coll.Name() + "_"
+	names, err := coll.Database().ListCollectionNames(ctx, bson.M{"name": bson.M{"$regex": "^" + regexp.QuoteMeta(prefix)}})
+	if err != nil {
+		return nil, mongoErr(err)
+	}
+
+	counts := map[string]int64{}
+	for _, name := range names {
+		id := strings.TrimPrefix(name, prefix)
+		if reserved[name] || tenant.Valid(id) != nil {
+			continue
+		}
+		n, err := coll.Database().Collection(name).CountDocuments(ctx, bson.M{})
+		if err != nil {
+			return nil, mongoErr(err)
+		}
+		counts[id] = n
+	}
+	return counts, nil
+}
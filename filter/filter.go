@@ -0,0 +1,154 @@
+// Package filter is the query language for listing items. A query string
+// like
+//
+//	price[gte]=10&price[lt]=50&title[contains]=cable
+//
+// is parsed into an Expr that doesn't know about any database. The mongo
+// store turns it into BSON, other stores just call Eval on each item.
+//
+// Each parameter is field[op]=value, or field=value which means eq. All
+// parameters have to match (they're ANDed). Operators:
+//
+//	eq, ne              equal / not equal
+//	gt, gte, lt, lte    comparisons, numbers only
+//	in                  comma separated list, matches any of them
+//	contains            case-insensitive substring, strings only
+//	exists              true or false
+//
+// Only fields listed in the Schema can be used, and values are always
+// treated as plain values, never as operators, so nothing in the query
+// string reaches the database as anything but data.
+package filter
+
+import (
+	"strings"
+)
+
+type Op string
+
+const (
+	OpEq       Op = "eq"
+	OpNe       Op = "ne"
+	OpGt       Op = "gt"
+	OpGte      Op = "gte"
+	OpLt       Op = "lt"
+	OpLte      Op = "lte"
+	OpIn       Op = "in"
+	OpContains Op = "contains"
+	OpExists   Op = "exists"
+)
+
+// Expr is a node in the filter tree. It's either an And or a Cond.
+type Expr interface {
+	isExpr()
+}
+
+// And matches when every child matches. An empty And matches everything.
+type And []Expr
+
+// Cond is one comparison. Value is a float64 or string for the field's
+// type, a []interface{} of those for OpIn, and a bool for OpExists.
+type Cond struct {
+	Field string
+	Op    Op
+	Value interface{}
+}
+
+func (And) isExpr()  {}
+func (Cond) isExpr() {}
+
+// Getter hands Eval the value of a field, and whether it's there at all.
+type Getter func(field string) (interface{}, bool)
+
+// Eval says whether whatever get describes matches e. A nil Expr matches
+// everything.
+func Eval(e Expr, get Getter) bool {
+	switch e := e.(type) {
+	case nil:
+		return true
+	case And:
+		for k := range e {
+			if !Eval(e[k], get) {
+				return false
+			}
+		}
+		return true
+	case Cond:
+		return evalCond(e, get)
+	}
+	return false
+}
+
+func evalCond(c Cond, get Getter) bool {
+	v, ok := get(c.Field)
+
+	if c.Op == OpExists {
+		return ok == c.Value.(bool)
+	}
+	if !ok {
+		// same as mongo, ne matches documents without the field
+		return c.Op == OpNe
+	}
+
+	if c.Op == OpIn {
+		for _, want := range c.Value.([]interface{}) {
+			if n, ok := compare(v, want); ok && n == 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	if c.Op == OpContains {
+		s, _ := v.(string)
+		sub, _ := c.Value.(string)
+		return strings.Contains(strings.ToLower(s), strings.ToLower(sub))
+	}
+
+	n, ok := compare(v, c.Value)
+	if !ok {
+		return c.Op == OpNe
+	}
+
+	switch c.Op {
+	case OpEq:
+		return n == 0
+	case OpNe:
+		return n != 0
+	case OpGt:
+		return n > 0
+	case OpGte:
+		return n >= 0
+	case OpLt:
+		return n < 0
+	case OpLte:
+		return n <= 0
+	}
+	return false
+}
+
+// compare only knows the two types a Schema allows. ok is false when the
+// types don't match, which the parser never produces but a Getter might.
+func compare(a, b interface{}) (int, bool) {
+	switch a := a.(type) {
+	case float64:
+		b, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case a < b:
+			return -1, true
+		case a > b:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		b, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(a, b), true
+	}
+	return 0, false
+}
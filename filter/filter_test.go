@@ -0,0 +1,90 @@
+package filter
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var schema = Schema{"title": String, "price": Number}
+
+func parse(t *testing.T, raw string) (Expr, error) {
+	t.Helper()
+	q, err := url.ParseQuery(raw)
+	assert.NoError(t, err)
+	return Parse(q, schema, "limit", "sort")
+}
+
+func TestParse(t *testing.T) {
+	e, err := parse(t, "price[gte]=10&price[lt]=50&title[contains]=cable&limit=5")
+	assert.NoError(t, err)
+	assert.Equal(t, And{
+		Cond{Field: "price", Op: OpGte, Value: 10.0},
+		Cond{Field: "price", Op: OpLt, Value: 50.0},
+		Cond{Field: "title", Op: OpContains, Value: "cable"},
+	}, e)
+
+	e, err = parse(t, "title=Cable&price[in]=1,2.5&title[exists]=true")
+	assert.NoError(t, err)
+	assert.Equal(t, And{
+		Cond{Field: "price", Op: OpIn, Value: []interface{}{1.0, 2.5}},
+		Cond{Field: "title", Op: OpEq, Value: "Cable"},
+		Cond{Field: "title", Op: OpExists, Value: true},
+	}, e)
+}
+
+func TestParseRejects(t *testing.T) {
+	bad := []string{
+		"colour=red",          // not in the schema
+		"title[gt]=a",         // not a string op
+		"price[contains]=1",   // not a number op
+		"price[regex]=.*",     // not an op at all
+		"price[gte]=cheap",    // not a number
+		"price[gte]=NaN",      // not a finite number
+		"title[exists]=maybe", // not a bool
+		"$where=1",            // operator injection
+		"title[$ne]=x",        // same, different spot
+		"price[gte][$gt]=1",   // nested brackets
+		"title.nested[eq]=x",  // dotted paths
+	}
+
+	for _, raw := range bad {
+		_, err := parse(t, raw)
+		assert.ErrorIs(t, err, ErrInvalid, raw)
+	}
+}
+
+func TestEval(t *testing.T) {
+	item := map[string]interface{}{"title": "USB-C Cable", "price": 19.99}
+	get := func(field string) (interface{}, bool) {
+		v, ok := item[field]
+		return v, ok
+	}
+
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"", true},
+		{"price[gte]=10&price[lt]=50&title[contains]=cable", true},
+		{"price[gte]=20", false},
+		{"price=19.99", true},
+		{"price[ne]=19.99", false},
+		{"price[in]=1,19.99", true},
+		{"price[in]=1,2", false},
+		{"title[in]=a,USB-C Cable", true},
+		{"title[contains]=CABLE", true},
+		{"title[exists]=true", true},
+		{"title[exists]=false", false},
+		{"title=usb-c cable", false},
+	}
+
+	for _, tt := range tests {
+		e, err := parse(t, tt.query)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.want, Eval(e, get), tt.query)
+	}
+
+	assert.True(t, Eval(nil, get))
+}
@@ -0,0 +1,130 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalid is wrapped by every error Parse returns.
+var ErrInvalid = errors.New("invalid filter")
+
+type FieldType int
+
+const (
+	String FieldType = iota
+	Number
+)
+
+// Schema is the whitelist of filterable fields and their types. Anything
+// not in here can't be filtered on.
+type Schema map[string]FieldType
+
+// ops says which operators make sense for each type.
+var ops = map[FieldType]map[Op]bool{
+	String: {OpEq: true, OpNe: true, OpIn: true, OpContains: true, OpExists: true},
+	Number: {OpEq: true, OpNe: true, OpGt: true, OpGte: true, OpLt: true, OpLte: true, OpIn: true, OpExists: true},
+}
+
+// MaxInValues keeps a single in[] from turning into a huge query.
+const MaxInValues = 100
+
+var keyRe = regexp.MustCompile(`^([a-z_]+)(?:\[([a-z]+)\])?$`)
+
+// Parse turns query params into an And of conditions. Params named in
+// skip (paging, sorting...) are left alone, anything else that isn't a
+// schema field is an error. Conditions come out sorted by field and op so
+// the same query always gives the same Expr.
+func Parse(q url.Values, schema Schema, skip ...string) (Expr, error) {
+	skipped := make(map[string]bool)
+	for _, s := range skip {
+		skipped[s] = true
+	}
+
+	var out And
+	for key, values := range q {
+		if skipped[key] {
+			continue
+		}
+
+		m := keyRe.FindStringSubmatch(key)
+		if m == nil {
+			return nil, fmt.Errorf("%w: can't parse %q", ErrInvalid, key)
+		}
+
+		field, op := m[1], Op(m[2])
+		if op == "" {
+			op = OpEq
+		}
+
+		typ, ok := schema[field]
+		if !ok {
+			return nil, fmt.Errorf("%w: can't filter on %q", ErrInvalid, field)
+		}
+		if !ops[typ][op] {
+			return nil, fmt.Errorf("%w: %q doesn't support %s", ErrInvalid, field, op)
+		}
+
+		for _, raw := range values {
+			v, err := parseValue(typ, op, raw)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s[%s]: %v", ErrInvalid, field, op, err)
+			}
+			out = append(out, Cond{Field: field, Op: op, Value: v})
+		}
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		a, b := out[i].(Cond), out[j].(Cond)
+		if a.Field != b.Field {
+			return a.Field < b.Field
+		}
+		return a.Op < b.Op
+	})
+
+	return out, nil
+}
+
+func parseValue(typ FieldType, op Op, raw string) (interface{}, error) {
+	switch op {
+	case OpExists:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, errors.New("must be true or false")
+		}
+		return b, nil
+	case OpIn:
+		parts := strings.Split(raw, ",")
+		if len(parts) > MaxInValues {
+			return nil, fmt.Errorf("at most %d values", MaxInValues)
+		}
+
+		var list []interface{}
+		for _, p := range parts {
+			v, err := scalar(typ, p)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	}
+	return scalar(typ, raw)
+}
+
+func scalar(typ FieldType, raw string) (interface{}, error) {
+	if typ == String {
+		return raw, nil
+	}
+
+	f, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("%q is not a number", raw)
+	}
+	return f, nil
+}
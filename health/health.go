@@ -0,0 +1,166 @@
+// Package health answers the liveness and readiness probes. Liveness only
+// says the process is up, readiness runs every registered check and fails
+// while the server is draining so load balancers stop sending traffic
+// before the listener goes away.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	StatusUp   = "up"
+	StatusDown = "down"
+)
+
+// Check returns nil if the dependency is fine. It gets a context with the
+// checker's timeout.
+type Check func(ctx context.Context) error
+
+type Checker struct {
+	timeout time.Duration
+
+	mu     sync.RWMutex
+	checks map[string]Check
+
+	draining atomic.Bool
+}
+
+func New(timeout time.Duration) *Checker {
+	return &Checker{
+		timeout: timeout,
+		checks:  make(map[string]Check),
+	}
+}
+
+// Add registers a check under name, replacing one with the same name.
+func (c *Checker) Add(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks[name] = check
+}
+
+// Drain makes readiness fail from now on.
+func (c *Checker) Drain() {
+	c.draining.Store(true)
+}
+
+func (c *Checker) Draining() bool {
+	return c.draining.Load()
+}
+
+// Result is how one check went.
+type Result struct {
+	Name    string  `json:"name"`
+	Status  string  `json:"status"`
+	Latency float64 `json:"latency_ms"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// Report is the whole picture, checks sorted by name.
+type Report struct {
+	Status   string   `json:"status"`
+	Draining bool     `json:"draining"`
+	Checks   []Result `json:"checks"`
+}
+
+// Run runs every check at the same time, each with the timeout, and waits
+// for all of them.
+func (c *Checker) Run(ctx context.Context) Report {
+	c.mu.RLock()
+	names := make([]string, 0, len(c.checks))
+	for name := range c.checks {
+		names = append(names, name)
+	}
+	checks := make([]Check, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		checks[i] = c.checks[name]
+	}
+	c.mu.RUnlock()
+
+	results := make([]Result, len(names))
+	var wg sync.WaitGroup
+	for i := range checks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = c.run(ctx, names[i], checks[i])
+		}(i)
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusUp, Draining: c.Draining(), Checks: results}
+	if report.Draining {
+		report.Status = StatusDown
+	}
+	for _, r := range results {
+		if r.Status != StatusUp {
+			report.Status = StatusDown
+		}
+	}
+	return report
+}
+
+func (c *Checker) run(ctx context.Context, name string, check Check) Result {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check(ctx)
+	res := Result{
+		Name:    name,
+		Status:  StatusUp,
+		Latency: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		res.Status = StatusDown
+		res.Error = err.Error()
+	}
+	return res
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func statusCode(up bool) int {
+	if up {
+		return http.StatusOK
+	}
+	return http.StatusServiceUnavailable
+}
+
+// Liveness is /healthz. If this can answer at all the process is alive, it
+// doesn't look at any dependencies, restarting won't fix mongo being down.
+func (c *Checker) Liveness(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": StatusUp})
+}
+
+// Readiness is /readyz, 503 while draining or when any check fails.
+func (c *Checker) Readiness(w http.ResponseWriter, r *http.Request) {
+	// no point bothering mongo if we're going away anyway
+	if c.Draining() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": StatusDown, "reason": "draining"})
+		return
+	}
+
+	report := c.Run(r.Context())
+	writeJSON(w, statusCode(report.Status == StatusUp), map[string]string{"status": report.Status})
+}
+
+// Details is /health, the full report with every check's latency and
+// error.
+func (c *Checker) Details(w http.ResponseWriter, r *http.Request) {
+	report := c.Run(r.Context())
+	writeJSON(w, statusCode(report.Status == StatusUp), report)
+}
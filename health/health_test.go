@@ -0,0 +1,84 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func get(h http.HandlerFunc) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	return rec
+}
+
+func TestLivenessIgnoresChecks(t *testing.T) {
+	c := New(time.Second)
+	c.Add("store", func(context.Context) error { return errors.New("down") })
+	c.Drain()
+
+	rec := get(c.Liveness)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"status":"up"}`, rec.Body.String())
+}
+
+func TestReadiness(t *testing.T) {
+	var storeErr error
+	c := New(time.Second)
+	c.Add("store", func(context.Context) error { return storeErr })
+
+	assert.Equal(t, http.StatusOK, get(c.Readiness).Code)
+
+	storeErr = errors.New("connection refused")
+	assert.Equal(t, http.StatusServiceUnavailable, get(c.Readiness).Code)
+
+	storeErr = nil
+	c.Drain()
+	rec := get(c.Readiness)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.JSONEq(t, `{"status":"down","reason":"draining"}`, rec.Body.String())
+}
+
+func TestCheckTimeout(t *testing.T) {
+	c := New(10 * time.Millisecond)
+	c.Add("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	start := time.Now()
+	report := c.Run(context.Background())
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, StatusDown, report.Status)
+	assert.Equal(t, context.DeadlineExceeded.Error(), report.Checks[0].Error)
+}
+
+func TestDetails(t *testing.T) {
+	c := New(time.Second)
+	c.Add("store", func(context.Context) error { return nil })
+	c.Add("config", func(context.Context) error { return errors.New("mongo database is required") })
+
+	rec := get(c.Details)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+
+	var report Report
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&report))
+	assert.Equal(t, StatusDown, report.Status)
+	assert.False(t, report.Draining)
+	assert.Len(t, report.Checks, 2)
+
+	// sorted by name
+	assert.Equal(t, "config", report.Checks[0].Name)
+	assert.Equal(t, StatusDown, report.Checks[0].Status)
+	assert.Equal(t, "mongo database is required", report.Checks[0].Error)
+	assert.Equal(t, "store", report.Checks[1].Name)
+	assert.Equal(t, StatusUp, report.Checks[1].Status)
+	assert.Empty(t, report.Checks[1].Error)
+}
@@ -0,0 +1,215 @@
+// Package lifecycle starts and stops the long lived pieces of the server
+// in a fixed order. Components register a Hook, hooks start in the order
+// they were added and stop in reverse, so whatever started last (the http
+// server, usually) is the first thing to stop.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mar-cial/items/logging"
+)
+
+// Hook is one component. Either func can be nil.
+type Hook struct {
+	Name  string
+	Start func(ctx context.Context) error
+	Stop  func(ctx context.Context) error
+}
+
+type App struct {
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	hooks   []Hook
+	started int
+
+	// failed gets the first error a running component reports, that's
+	// Run's cue to shut everything down
+	failed chan error
+}
+
+// New returns an empty App. logger gets a line per start and stop, nil
+// means quiet.
+func New(logger *slog.Logger) *App {
+	if logger == nil {
+		logger = logging.Discard()
+	}
+	return &App{
+		logger: logger,
+		failed: make(chan error, 1),
+	}
+}
+
+// Append registers a hook. Hooks added after Start are never started.
+func (a *App) Append(h Hook) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.hooks = append(a.hooks, h)
+}
+
+// Fail tells Run a component died on its own. Only the first call counts.
+func (a *App) Fail(err error) {
+	select {
+	case a.failed <- err:
+	default:
+	}
+}
+
+// Start runs every start hook in order. If one fails the ones that already
+// started are stopped again, so nothing is left half up.
+func (a *App) Start(ctx context.Context) error {
+	a.mu.Lock()
+	hooks := a.hooks
+	a.mu.Unlock()
+
+	for i, h := range hooks {
+		if h.Start != nil {
+			a.logger.Info("starting", slog.String("component", h.Name))
+			if err := h.Start(ctx); err != nil {
+				err = fmt.Errorf("start %s: %w", h.Name, err)
+				a.mu.Lock()
+				a.started = i
+				a.mu.Unlock()
+				return errors.Join(err, a.Stop(ctx))
+			}
+		}
+	}
+
+	a.mu.Lock()
+	a.started = len(hooks)
+	a.mu.Unlock()
+	return nil
+}
+
+// Stop runs the stop hooks of everything that started, last one first.
+// Every hook gets its turn even if an earlier one failed, all the errors
+// come back together. It's safe to call more than once.
+func (a *App) Stop(ctx context.Context) error {
+	a.mu.Lock()
+	hooks := a.hooks[:a.started]
+	a.started = 0
+	a.mu.Unlock()
+
+	var errs []error
+	for i := len(hooks) - 1; i >= 0; i-- {
+		h := hooks[i]
+		if h.Stop == nil {
+			continue
+		}
+		a.logger.Info("stopping", slog.String("component", h.Name))
+		if err := h.Stop(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("stop %s: %w", h.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Run starts everything, waits for SIGINT, SIGTERM, ctx being done or a
+// component calling Fail, then stops everything. Stopping gets
+// stopTimeout, after that hooks see their context expire.
+func (a *App) Run(ctx context.Context, stopTimeout time.Duration) error {
+	ctx, cancel := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	if err := a.Start(ctx); err != nil {
+		return err
+	}
+
+	var runErr error
+	select {
+	case <-ctx.Done():
+		a.logger.Info("shutting down")
+	case runErr = <-a.failed:
+		a.logger.Error("shutting down", slog.Any("err", runErr))
+	}
+
+	stopCtx, stop := context.WithTimeout(context.Background(), stopTimeout)
+	defer stop()
+	return errors.Join(runErr, a.Stop(stopCtx))
+}
+
+// Go registers a background worker. fn runs in its own goroutine from
+// Start on and should return once its context is done, Stop cancels it and
+// waits for it to finish whatever it was doing. Workers that should keep
+// going until the http server has drained need to be added before it.
+func (a *App) Go(name string, fn func(ctx context.Context) error) {
+	var (
+		cancel context.CancelFunc
+		done   chan struct{}
+		err    error
+	)
+
+	a.Append(Hook{
+		Name: name,
+		Start: func(context.Context) error {
+			var ctx context.Context
+			ctx, cancel = context.WithCancel(context.Background())
+			done = make(chan struct{})
+
+			go func() {
+				defer close(done)
+				err = fn(ctx)
+				if err != nil && !errors.Is(err, context.Canceled) {
+					a.Fail(fmt.Errorf("%s: %w", name, err))
+				}
+			}()
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			cancel()
+			select {
+			case <-done:
+				if errors.Is(err, context.Canceled) {
+					return nil
+				}
+				return err
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		},
+	})
+}
+
+// ServerHook serves srv on its Addr. Start only returns once the port is
+// bound, so a taken port fails Start instead of showing up later. Stop
+// stops accepting connections and waits for in-flight requests, and if
+// ctx runs out first whatever is left gets cut off. Once started srv.Addr
+// is the address actually bound, which matters for ":0".
+func ServerHook(a *App, name string, srv *http.Server) Hook {
+	return Hook{
+		Name: name,
+		Start: func(ctx context.Context) error {
+			var lc net.ListenConfig
+			ln, err := lc.Listen(ctx, "tcp", srv.Addr)
+			if err != nil {
+				return err
+			}
+
+			srv.Addr = ln.Addr().String()
+			a.logger.Info("listening", slog.String("component", name), slog.String("addr", srv.Addr))
+			go func() {
+				if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+					a.Fail(fmt.Errorf("%s: %w", name, err))
+				}
+			}()
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			if err := srv.Shutdown(ctx); err != nil {
+				srv.Close()
+				return err
+			}
+			return nil
+		},
+	}
+}
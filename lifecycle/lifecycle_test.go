@@ -0,0 +1,180 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recorder makes hooks that note down when they run
+type recorder struct {
+	calls []string
+}
+
+func (r *recorder) hook(name string, startErr, stopErr error) Hook {
+	return Hook{
+		Name: name,
+		Start: func(context.Context) error {
+			r.calls = append(r.calls, "start "+name)
+			return startErr
+		},
+		Stop: func(context.Context) error {
+			r.calls = append(r.calls, "stop "+name)
+			return stopErr
+		},
+	}
+}
+
+func TestStartStopOrder(t *testing.T) {
+	var rec recorder
+	a := New(nil)
+	a.Append(rec.hook("store", nil, nil))
+	a.Append(rec.hook("worker", nil, nil))
+	a.Append(rec.hook("http", nil, nil))
+
+	assert.NoError(t, a.Start(context.Background()))
+	assert.NoError(t, a.Stop(context.Background()))
+	assert.Equal(t, []string{
+		"start store", "start worker", "start http",
+		"stop http", "stop worker", "stop store",
+	}, rec.calls)
+
+	// second stop has nothing left to do
+	assert.NoError(t, a.Stop(context.Background()))
+	assert.Len(t, rec.calls, 6)
+}
+
+func TestStartFailureRollsBack(t *testing.T) {
+	var rec recorder
+	boom := errors.New("port taken")
+
+	a := New(nil)
+	a.Append(rec.hook("store", nil, nil))
+	a.Append(rec.hook("http", boom, nil))
+	a.Append(rec.hook("never", nil, nil))
+
+	err := a.Start(context.Background())
+	assert.ErrorIs(t, err, boom)
+	assert.Equal(t, []string{"start store", "start http", "stop store"}, rec.calls)
+}
+
+func TestStopRunsEveryHook(t *testing.T) {
+	var rec recorder
+	first, second := errors.New("first"), errors.New("second")
+
+	a := New(nil)
+	a.Append(rec.hook("a", nil, first))
+	a.Append(rec.hook("b", nil, nil))
+	a.Append(rec.hook("c", nil, second))
+	assert.NoError(t, a.Start(context.Background()))
+
+	err := a.Stop(context.Background())
+	assert.ErrorIs(t, err, first)
+	assert.ErrorIs(t, err, second)
+	assert.Equal(t, []string{"stop c", "stop b", "stop a"}, rec.calls[3:])
+}
+
+func TestRunStopsOnCancelAndFail(t *testing.T) {
+	var rec recorder
+	a := New(nil)
+	a.Append(rec.hook("x", nil, nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go cancel()
+	assert.NoError(t, a.Run(ctx, time.Second))
+	assert.Equal(t, []string{"start x", "stop x"}, rec.calls)
+
+	died := errors.New("worker died")
+	a = New(nil)
+	a.Go("worker", func(ctx context.Context) error { return died })
+	err := a.Run(context.Background(), time.Second)
+	assert.ErrorIs(t, err, died)
+}
+
+func TestGoWaitsForWorkers(t *testing.T) {
+	flushed := false
+
+	a := New(nil)
+	a.Go("flusher", func(ctx context.Context) error {
+		<-ctx.Done()
+		time.Sleep(20 * time.Millisecond)
+		flushed = true
+		return ctx.Err()
+	})
+
+	assert.NoError(t, a.Start(context.Background()))
+	assert.NoError(t, a.Stop(context.Background()))
+	assert.True(t, flushed)
+
+	// a worker that won't stop runs into the deadline
+	a = New(nil)
+	a.Go("stuck", func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	})
+	assert.NoError(t, a.Start(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, a.Stop(ctx), context.DeadlineExceeded)
+}
+
+func TestServerHookDrains(t *testing.T) {
+	inFlight := make(chan struct{})
+	srv := &http.Server{
+		Addr: "127.0.0.1:0",
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(inFlight)
+			time.Sleep(50 * time.Millisecond)
+			w.Write([]byte("done"))
+		}),
+	}
+
+	a := New(nil)
+	a.Append(ServerHook(a, "http", srv))
+	assert.NoError(t, a.Start(context.Background()))
+
+	type result struct {
+		body string
+		err  error
+	}
+	got := make(chan result)
+	go func() {
+		res, err := http.Get("http://" + srv.Addr)
+		if err != nil {
+			got <- result{err: err}
+			return
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		got <- result{string(b), err}
+	}()
+
+	<-inFlight
+	assert.NoError(t, a.Stop(context.Background()))
+
+	r := <-got
+	assert.NoError(t, r.err)
+	assert.Equal(t, "done", r.body)
+
+	// and it's not accepting anything new
+	_, err := http.Get("http://" + srv.Addr)
+	assert.Error(t, err)
+}
+
+func TestServerHookPortTaken(t *testing.T) {
+	first := &http.Server{Addr: "127.0.0.1:0", Handler: http.NotFoundHandler()}
+	a := New(nil)
+	a.Append(ServerHook(a, "first", first))
+	assert.NoError(t, a.Start(context.Background()))
+	defer a.Stop(context.Background())
+
+	b := New(nil)
+	b.Append(ServerHook(b, "second", &http.Server{Addr: first.Addr}))
+	assert.Error(t, b.Start(context.Background()))
+}
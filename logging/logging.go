@@ -0,0 +1,73 @@
+// Package logging sets up the slog logger and carries it around in
+// contexts, so the db layer logs with the same request id, route and item
+// id the handler would.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/mar-cial/items/config"
+)
+
+// New builds a logger writing to w in the format and at the level cfg
+// says. Anything that looks like a secret is redacted on the way out,
+// see Redact.
+func New(cfg config.LogConfig, w io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		return nil, fmt.Errorf("log level %q: has to be debug, info, warn or error", cfg.Level)
+	}
+
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: Redact}
+
+	switch cfg.Format {
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("log format %q: has to be json or text", cfg.Format)
+}
+
+// Discard drops everything, for tests and for when nobody asked.
+func Discard() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelError + 1}))
+}
+
+// sensitive are bits of attribute keys that mean the value is a secret.
+// Config values implement slog.LogValuer and redact themselves, this is
+// the net for everything else.
+var sensitive = []string{"password", "passwd", "dbpass", "secret", "token", "authorization", "api_key", "apikey"}
+
+const redacted = "REDACTED"
+
+// Redact is a slog ReplaceAttr that blanks out attributes whose key looks
+// like it holds a secret.
+func Redact(groups []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	for _, s := range sensitive {
+		if strings.Contains(key, s) {
+			return slog.String(a.Key, redacted)
+		}
+	}
+	return a
+}
+
+type ctxKey struct{}
+
+// With returns a copy of ctx carrying logger.
+func With(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, logger)
+}
+
+// From returns the logger in ctx, or slog.Default() if there isn't one.
+func From(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(ctxKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,67 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/mar-cial/items/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	var buf bytes.Buffer
+
+	logger, err := New(config.LogConfig{Level: "warn", Format: "json"}, &buf)
+	assert.NoError(t, err)
+	logger.Info("quiet")
+	logger.Warn("loud", slog.Int("n", 1))
+	assert.NotContains(t, buf.String(), "quiet")
+	assert.Contains(t, buf.String(), `"msg":"loud","n":1`)
+
+	buf.Reset()
+	logger, err = New(config.LogConfig{Level: "DEBUG", Format: "text"}, &buf)
+	assert.NoError(t, err)
+	logger.Debug("hello", slog.String("who", "world"))
+	assert.Contains(t, buf.String(), "level=DEBUG msg=hello who=world")
+
+	_, err = New(config.LogConfig{Level: "chatty", Format: "json"}, &buf)
+	assert.Error(t, err)
+	_, err = New(config.LogConfig{Level: "info", Format: "xml"}, &buf)
+	assert.Error(t, err)
+}
+
+func TestSecretsNeverLogged(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(config.LogConfig{Level: "info", Format: "json"}, &buf)
+	assert.NoError(t, err)
+
+	cfg := config.Default()
+	cfg.Mongo.User = "root"
+	cfg.Mongo.Password = "hunter2"
+	logger.Info("config loaded", slog.Any("config", cfg))
+	logger.Info("just the mongo bit", slog.Any("mongo", cfg.Mongo))
+
+	cfg.Mongo.URI = "mongodb://root:hunter2@db:27017"
+	logger.Info("with a uri", slog.Any("mongo", cfg.Mongo))
+
+	// and the catch-all for things that don't know how to redact themselves
+	logger.Info("oops", slog.String("DBPASS", "hunter2"), slog.String("db_password", "hunter2"),
+		slog.Group("headers", slog.String("Authorization", "Bearer hunter2")))
+
+	assert.NotContains(t, buf.String(), "hunter2")
+	assert.Contains(t, buf.String(), `"user":"root"`)
+	assert.Contains(t, buf.String(), "mongodb://root:REDACTED@db:27017")
+}
+
+func TestContext(t *testing.T) {
+	assert.Equal(t, slog.Default(), From(context.Background()))
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil)).With(slog.String("request_id", "abc"))
+	ctx := With(context.Background(), logger)
+
+	From(ctx).Info("in the store")
+	assert.Contains(t, buf.String(), "msg=\"in the store\" request_id=abc")
+}
@@ -1,19 +1,68 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
 	"os"
 
 	"github.com/mar-cial/items/api"
+	"github.com/mar-cial/items/config"
+	"github.com/mar-cial/items/lifecycle"
+	"github.com/mar-cial/items/logging"
+	"github.com/mar-cial/items/tracing"
 )
 
+func fatal(msg string, err error) {
+	slog.Error(msg, slog.Any("err", err))
+	os.Exit(1)
+}
+
 func main() {
-	srv, err := api.CreateServer()
+	cfg, err := config.Load(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+
+	// print even if it didn't validate, that's usually why you're looking
+	if cfg.PrintConfig {
+		if perr := config.Print(os.Stdout, cfg); perr != nil {
+			fatal("printing config", perr)
+		}
+		if err != nil {
+			fatal("invalid config", err)
+		}
+		return
+	}
+	if err != nil {
+		fatal("invalid config", err)
+	}
+
+	logger, err := logging.New(cfg.Log, os.Stderr)
 	if err != nil {
-		log.Fatalln(err)
+		fatal("setting up logging", err)
 	}
+	slog.SetDefault(logger)
+	logger.Info("config loaded", slog.Any("config", cfg))
 
-	fmt.Printf("Serving on port %s\n", os.Getenv("SERVERPORT"))
-	log.Fatalln(srv.ListenAndServe())
+	app, err := api.CreateApp(cfg)
+	if err != nil {
+		fatal("creating app", err)
+	}
+
+	shutdownTracing, err := tracing.Setup(cfg.Tracing)
+	if err != nil {
+		fatal("setting up tracing", err)
+	}
+
+	lc := lifecycle.New(logger)
+	// first in so it's the last to stop, after the final requests' spans
+	lc.Append(lifecycle.Hook{Name: "tracing", Stop: shutdownTracing})
+	api.Register(lc, app, cfg.Server)
+
+	// returns on SIGINT/SIGTERM once everything has stopped
+	if err := lc.Run(context.Background(), cfg.Server.ShutdownTimeout); err != nil {
+		fatal("stopped with errors", err)
+	}
 }
@@ -0,0 +1,100 @@
+// Package metrics keeps the prometheus metrics for the http routes and the
+// item store. Every Metrics has its own registry instead of using the
+// global one, so tests can make as many as they like.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mar-cial/items/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "items"
+
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	inFlight prometheus.Gauge
+
+	storeOps *prometheus.HistogramVec
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by method, route template and status.",
+		}, []string{"method", "route", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP request latency by method, route template and status.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "http_requests_in_flight",
+			Help:      "HTTP requests being served right now.",
+		}),
+		storeOps: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "store_operation_duration_seconds",
+			Help:      "Item store call latency by operation and result.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"op", "result"}),
+	}
+
+	m.registry.MustRegister(
+		m.requests, m.duration, m.inFlight, m.storeOps,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Handler serves the registry in the prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{
+		Registry:      m.registry,
+		ErrorHandling: promhttp.ContinueOnError,
+	})
+}
+
+// route labels by template, so /items/list/{id} is one series and not one
+// per id. Anything that didn't match goes under one label, otherwise
+// scanners would blow up the cardinality.
+func route(r *http.Request) string {
+	if tpl := middleware.Route(r); tpl != "" {
+		return tpl
+	}
+	return "unmatched"
+}
+
+// ObserveRequest has the middleware.Observer shape.
+func (m *Metrics) ObserveRequest(r *http.Request, status int, d time.Duration) {
+	labels := prometheus.Labels{
+		"method": r.Method,
+		"route":  route(r),
+		"status": strconv.Itoa(status),
+	}
+	m.requests.With(labels).Inc()
+	m.duration.With(labels).Observe(d.Seconds())
+}
+
+// InFlight counts requests while they're being served.
+func (m *Metrics) InFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.inFlight.Inc()
+		defer m.inFlight.Dec()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,126 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mar-cial/items/db"
+	"github.com/mar-cial/items/middleware"
+	"github.com/mar-cial/items/model"
+	"github.com/mar-cial/items/tenant"
+	"github.com/mar-cial/items/tracing"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func scrape(t *testing.T, m *Metrics) string {
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	b, err := io.ReadAll(rec.Body)
+	assert.NoError(t, err)
+	return string(b)
+}
+
+func TestRequestMetricsUseRouteTemplates(t *testing.T) {
+	m := New()
+
+	r := mux.NewRouter()
+	r.Use(m.InFlight, middleware.Observe(m.ObserveRequest))
+	r.HandleFunc("/items/list/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if mux.Vars(r)["id"] == "missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}).Methods(http.MethodGet)
+
+	for _, id := range []string{"a", "b", "c", "missing"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/items/list/"+id, nil))
+	}
+
+	assert.Equal(t, 3.0, testutil.ToFloat64(m.requests.WithLabelValues("GET", "/items/list/{id}", "200")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.requests.WithLabelValues("GET", "/items/list/{id}", "404")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.inFlight))
+
+	out := scrape(t, m)
+	assert.Contains(t, out, `items_http_request_duration_seconds_count{method="GET",route="/items/list/{id}",status="200"} 3`)
+	assert.NotContains(t, out, `/items/list/a`)
+}
+
+func TestStoreMetrics(t *testing.T) {
+	m := New()
+	store := m.InstrumentStore(db.NewMemoryStore())
+	ctx := context.Background()
+
+	res, err := store.InsertOneItem(ctx, &model.Item{Title: "USB hub", Price: 20})
+	assert.NoError(t, err)
+	_, err = store.ListOneItem(ctx, res.InsertedID)
+	assert.NoError(t, err)
+	_, err = store.ListOneItem(ctx, "64b7f0c2a1b2c3d4e5f60718")
+	assert.ErrorIs(t, err, db.ErrNotFound)
+	_, err = store.ListOneItem(ctx, "nope")
+	assert.ErrorIs(t, err, db.ErrInvalidID)
+
+	out := scrape(t, m)
+	assert.Contains(t, out, `items_store_operation_duration_seconds_count{op="insert_one",result="ok"} 1`)
+	assert.Contains(t, out, `items_store_operation_duration_seconds_count{op="list_one",result="ok"} 1`)
+	assert.Contains(t, out, `items_store_operation_duration_seconds_count{op="list_one",result="not_found"} 1`)
+	assert.Contains(t, out, `items_store_operation_duration_seconds_count{op="list_one",result="invalid"} 1`)
+	assert.Contains(t, out, "items_stored 1\n")
+
+	_, err = store.InsertItems(ctx, []model.Item{{Title: "a", Price: 1}, {Title: "b", Price: 2}})
+	assert.NoError(t, err)
+	assert.Contains(t, scrape(t, m), "items_stored 3\n")
+}
+
+// downStore fails every list, like mongo being unreachable
+type downStore struct {
+	*db.MemoryStore
+}
+
+func (downStore) ListItems(ctx context.Context, opts db.ListOptions) (db.ItemPage, error) {
+	return db.ItemPage{}, context.DeadlineExceeded
+}
+
+func (downStore) CountByTenant(ctx context.Context) (map[string]int64, error) {
+	return nil, context.DeadlineExceeded
+}
+
+func TestStoredWithTenancy(t *testing.T) {
+	// the way api.NewApp stacks them, with no tenant around at scrape time
+	m := New()
+	store := m.InstrumentStore(tracing.InstrumentStore(db.NewQuotaStore(db.NewMemoryStore(), func(string) int64 { return 0 }, db.NewMemoryQuotaCounter())))
+
+	for id, n := range map[string]int{"acme": 2, "globex": 1} {
+		ctx := tenant.With(context.Background(), id)
+		for k := 0; k < n; k++ {
+			_, err := store.InsertOneItem(ctx, &model.Item{Title: "anvil", Price: 1})
+			assert.NoError(t, err)
+		}
+	}
+
+	out := scrape(t, m)
+	assert.Contains(t, out, "items_stored 3\n")
+	assert.Contains(t, out, `items_tenant_stored{tenant="acme"} 2`)
+	assert.Contains(t, out, `items_tenant_stored{tenant="globex"} 1`)
+}
+
+func TestScrapeSurvivesStoreDown(t *testing.T) {
+	m := New()
+	m.InstrumentStore(downStore{db.NewMemoryStore()})
+
+	out := scrape(t, m)
+	assert.NotContains(t, out, "items_stored ")
+	assert.True(t, strings.Contains(out, "go_goroutines"))
+}
+
+func TestObserveUnmatched(t *testing.T) {
+	m := New()
+	m.ObserveRequest(httptest.NewRequest(http.MethodGet, "/wp-login.php", nil), http.StatusNotFound, time.Millisecond)
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.requests.WithLabelValues("GET", "unmatched", "404")))
+}
@@ -0,0 +1,139 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/mar-cial/items/db"
+	"github.com/mar-cial/items/model"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Store times every call to the store it wraps. It embeds the store so
+// anything added to db.ItemStore later still works, it just isn't timed
+// until it gets a method here.
+type Store struct {
+	db.ItemStore
+	m *Metrics
+}
+
+var _ db.ItemStore = (*Store)(nil)
+
+// InstrumentStore wraps store and registers an item count gauge for it.
+func (m *Metrics) InstrumentStore(store db.ItemStore) *Store {
+	m.registry.MustRegister(&itemCount{store: store})
+	return &Store{ItemStore: store, m: m}
+}
+
+// Unwrap is the store Store wraps, see db.CounterOf.
+func (s *Store) Unwrap() db.ItemStore {
+	return s.ItemStore
+}
+
+func (s *Store) observe(op string, start time.Time, err error) {
+	s.m.storeOps.WithLabelValues(op, db.Outcome(err)).Observe(time.Since(start).Seconds())
+}
+
+func (s *Store) InsertOneItem(ctx context.Context, item *model.Item) (res *db.InsertOneResult, err error) {
+	defer func(start time.Time) { s.observe("insert_one", start, err) }(time.Now())
+	return s.ItemStore.InsertOneItem(ctx, item)
+}
+
+func (s *Store) InsertItems(ctx context.Context, items []model.Item) (res *db.InsertManyResult, err error) {
+	defer func(start time.Time) { s.observe("insert_many", start, err) }(time.Now())
+	return s.ItemStore.InsertItems(ctx, items)
+}
+
+func (s *Store) ListOneItem(ctx context.Context, id string) (item model.Item, err error) {
+	defer func(start time.Time) { s.observe("list_one", start, err) }(time.Now())
+	return s.ItemStore.ListOneItem(ctx, id)
+}
+
+func (s *Store) ListItems(ctx context.Context, opts db.ListOptions) (page db.ItemPage, err error) {
+	defer func(start time.Time) { s.observe("list", start, err) }(time.Now())
+	return s.ItemStore.ListItems(ctx, opts)
+}
+
+func (s *Store) SearchItems(ctx context.Context, q string, opts db.SearchOptions) (page db.SearchPage, err error) {
+	defer func(start time.Time) { s.observe("search", start, err) }(time.Now())
+	return s.ItemStore.SearchItems(ctx, q, opts)
+}
+
+func (s *Store) UpdateOneItem(ctx context.Context, id string, item *model.Item, version int64) (res *db.UpdateResult, err error) {
+	defer func(start time.Time) { s.observe("update", start, err) }(time.Now())
+	return s.ItemStore.UpdateOneItem(ctx, id, item, version)
+}
+
+func (s *Store) PatchOneItem(ctx context.Context, id string, version int64, fn db.PatchFunc) (item model.Item, err error) {
+	defer func(start time.Time) { s.observe("patch", start, err) }(time.Now())
+	return s.ItemStore.PatchOneItem(ctx, id, version, fn)
+}
+
+func (s *Store) DeleteOneItem(ctx context.Context, id string, version int64) (res *db.DeleteResult, err error) {
+	defer func(start time.Time) { s.observe("delete", start, err) }(time.Now())
+	return s.ItemStore.DeleteOneItem(ctx, id, version)
+}
+
+func (s *Store) Ping(ctx context.Context) (err error) {
+	defer func(start time.Time) { s.observe("ping", start, err) }(time.Now())
+	return s.ItemStore.Ping(ctx)
+}
+
+// countTimeout keeps a slow count from holding up the whole scrape.
+const countTimeout = 2 * time.Second
+
+var (
+	itemsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "stored"),
+		"Items in the store, counted at scrape time.",
+		nil, nil,
+	)
+	tenantItemsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "tenant", "stored"),
+		"Items each tenant has, counted at scrape time. Only there with tenancy.",
+		[]string{"tenant"}, nil,
+	)
+)
+
+// itemCount asks the store for its total on every scrape rather than
+// keeping a counter in sync with every write path. A store that keeps
+// tenants apart only counts the tenant in the context, and there's none
+// here, so when it can count them all it's asked for that instead.
+type itemCount struct {
+	store db.ItemStore
+}
+
+func (c *itemCount) Describe(ch chan<- *prometheus.Desc) {
+	ch <- itemsDesc
+	ch <- tenantItemsDesc
+}
+
+func (c *itemCount) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), countTimeout)
+	defer cancel()
+
+	// with the store down the gauge is just missing, the store op
+	// histogram already shows the errors and the rest of the scrape
+	// shouldn't fail over it
+	if counter, ok := db.CounterOf(c.store); ok {
+		counts, err := counter.CountByTenant(ctx)
+		if err != nil {
+			return
+		}
+		var total int64
+		for id, n := range counts {
+			total += n
+			if id != "" {
+				ch <- prometheus.MustNewConstMetric(tenantItemsDesc, prometheus.GaugeValue, float64(n), id)
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(itemsDesc, prometheus.GaugeValue, float64(total))
+		return
+	}
+
+	page, err := c.store.ListItems(ctx, db.ListOptions{Limit: 1})
+	if err != nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(itemsDesc, prometheus.GaugeValue, float64(page.Total))
+}
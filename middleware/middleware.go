@@ -0,0 +1,287 @@
+// Package middleware has the http middleware the router runs every request
+// through. Each one is built on its own with its own settings, and they
+// all have the func(http.Handler) http.Handler shape, so they plug
+// straight into mux's Use.
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mar-cial/items/logging"
+	"github.com/mar-cial/items/problem"
+)
+
+type Middleware = func(http.Handler) http.Handler
+
+// Chain runs the middleware in the order given, the first one outermost.
+func Chain(mws ...Middleware) Middleware {
+	return func(next http.Handler) http.Handler {
+		for i := len(mws) - 1; i >= 0; i-- {
+			next = mws[i](next)
+		}
+		return next
+	}
+}
+
+// statusWriter remembers what was written so middleware further out can
+// see the status and size.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+func wrap(w http.ResponseWriter) *statusWriter {
+	if sw, ok := w.(*statusWriter); ok {
+		return sw
+	}
+	return &statusWriter{ResponseWriter: w}
+}
+
+type ctxKey int
+
+const requestIDKey ctxKey = iota
+
+const RequestIDHeader = "X-Request-ID"
+
+// incoming request ids are only trusted if they look sane, otherwise a
+// client could stuff anything into our logs
+var requestIDRe = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// RequestID keeps the X-Request-ID a client or proxy sent, or makes one
+// up. Either way it goes back out on the response and into the context.
+func RequestID() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(RequestIDHeader)
+			if !requestIDRe.MatchString(id) {
+				id = newRequestID()
+			}
+
+			w.Header().Set(RequestIDHeader, id)
+			ctx := context.WithValue(r.Context(), requestIDKey, id)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// RequestIDFrom returns the request id RequestID stored, or "".
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// Logger puts a logger in the request context that already has the
+// request id, method, route and item id (for routes with one) on it.
+// Handlers and the store get it with logging.From.
+func Logger(base *slog.Logger) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			logger := base.With(
+				slog.String("request_id", RequestIDFrom(r.Context())),
+				slog.String("method", r.Method),
+				slog.String("route", Route(r)),
+			)
+			if id := mux.Vars(r)["id"]; id != "" {
+				logger = logger.With(slog.String("item_id", id))
+			}
+
+			next.ServeHTTP(w, r.WithContext(logging.With(r.Context(), logger)))
+		})
+	}
+}
+
+// Recover turns a panic in a handler into a 500 problem response, as long
+// as nothing was written yet, and logs the stack.
+func Recover() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sw := wrap(w)
+
+			defer func() {
+				rec := recover()
+				if rec == nil {
+					return
+				}
+				// net/http uses this one to abort on purpose
+				if rec == http.ErrAbortHandler {
+					panic(rec)
+				}
+
+				logging.From(r.Context()).Error("panic",
+					slog.String("err", fmt.Sprint(rec)),
+					slog.String("stack", string(debug.Stack())))
+
+				if sw.status == 0 {
+					problem.Write(sw, r, problem.TypeInternal, "")
+				}
+			}()
+
+			next.ServeHTTP(sw, r)
+		})
+	}
+}
+
+// AccessLog writes one line per request once it's done, with whatever
+// logger Logger put in the context. Server errors go out at error level so
+// they stand out.
+func AccessLog() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			sw := wrap(w)
+
+			next.ServeHTTP(sw, r)
+
+			status := sw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			level := slog.LevelInfo
+			if status >= http.StatusInternalServerError {
+				level = slog.LevelError
+			}
+			logging.From(r.Context()).LogAttrs(r.Context(), level, "request",
+				slog.String("path", r.URL.Path),
+				slog.Int("status", status),
+				slog.Int("bytes", sw.bytes),
+				slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+				slog.String("remote", r.RemoteAddr),
+			)
+		})
+	}
+}
+
+// Observer gets every finished request with its status and how long it
+// took.
+type Observer func(r *http.Request, status int, d time.Duration)
+
+// Observe reports each request to observe once it's done, for metrics.
+func Observe(observe Observer) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			sw := wrap(w)
+
+			next.ServeHTTP(sw, r)
+
+			status := sw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			observe(r, status, time.Since(start))
+		})
+	}
+}
+
+// Route is the path template of the mux route r matched, like
+// /items/list/{id}, or "" if it didn't match one.
+func Route(r *http.Request) string {
+	if cur := mux.CurrentRoute(r); cur != nil {
+		if tpl, err := cur.GetPathTemplate(); err == nil {
+			return tpl
+		}
+	}
+	return ""
+}
+
+// Timeout gives every request a deadline. Handlers pass the context down
+// to the store, so a slow query gets cut off there.
+func Timeout(d time.Duration) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// IsTimeout tells handlers an error came from the Timeout deadline.
+func IsTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// BodyLimit caps request bodies at n bytes. A Content-Length that's already
+// too big is turned away right here, anything else fails when the handler
+// reads past the limit with an *http.MaxBytesError.
+func BodyLimit(n int64) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > n {
+				problem.Write(w, r, problem.TypeBodyTooLarge, fmt.Sprintf("body is limited to %d bytes", n))
+				return
+			}
+
+			r.Body = http.MaxBytesReader(w, r.Body, n)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireJSON answers 415 to requests that send a body with a content type
+// that isn't JSON. application/json and any +json type (like
+// application/merge-patch+json) are JSON.
+func RequireJSON() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodPost, http.MethodPut, http.MethodPatch:
+			default:
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || !isJSON(mediaType) {
+				problem.Write(w, r, problem.TypeUnsupportedMedia, "request body has to be json")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func isJSON(mediaType string) bool {
+	return mediaType == "application/json" ||
+		(strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+json"))
+}
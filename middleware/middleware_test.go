@@ -0,0 +1,174 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mar-cial/items/logging"
+	"github.com/mar-cial/items/problem"
+	"github.com/stretchr/testify/assert"
+)
+
+var ok = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	io.Copy(io.Discard, r.Body)
+	w.Write([]byte("ok"))
+})
+
+func serve(h http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestChainOrder(t *testing.T) {
+	var order []string
+	mw := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	serve(Chain(mw("a"), mw("b"), mw("c"))(ok), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, []string{"a", "b", "c"}, order)
+}
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	h := RequestID()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestIDFrom(r.Context())
+	}))
+
+	rec := serve(h, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Len(t, seen, 32)
+	assert.Equal(t, seen, rec.Header().Get(RequestIDHeader))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(RequestIDHeader, "from-the-proxy.1")
+	rec = serve(h, req)
+	assert.Equal(t, "from-the-proxy.1", seen)
+	assert.Equal(t, "from-the-proxy.1", rec.Header().Get(RequestIDHeader))
+
+	// junk gets replaced
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(RequestIDHeader, "bad id\nwith newline")
+	serve(h, req)
+	assert.Len(t, seen, 32)
+}
+
+// jsonLogger logs json lines into buf
+func jsonLogger(buf *bytes.Buffer) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+}
+
+func TestRecover(t *testing.T) {
+	var buf bytes.Buffer
+	h := Chain(Logger(jsonLogger(&buf)), Recover())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+
+	rec := serve(h, httptest.NewRequest(http.MethodGet, "/items/list", nil))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Equal(t, problem.ContentType, rec.Header().Get("Content-Type"))
+	assert.Contains(t, buf.String(), `"err":"boom"`)
+	assert.Contains(t, buf.String(), `"level":"ERROR"`)
+}
+
+func TestLoggerAndAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+
+	r := mux.NewRouter()
+	r.Use(RequestID(), Logger(jsonLogger(&buf)), AccessLog())
+	r.HandleFunc("/items/list/{id}", func(w http.ResponseWriter, r *http.Request) {
+		logging.From(r.Context()).Debug("from the handler")
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("short and stout"))
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/items/list/abc123", nil)
+	req.Header.Set(RequestIDHeader, "abc")
+	serve(r, req)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 2)
+
+	var handler, access map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &handler))
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &access))
+
+	// both lines carry the request's details
+	for _, line := range []map[string]interface{}{handler, access} {
+		assert.Equal(t, "abc", line["request_id"])
+		assert.Equal(t, "GET", line["method"])
+		assert.Equal(t, "/items/list/{id}", line["route"])
+		assert.Equal(t, "abc123", line["item_id"])
+	}
+
+	assert.Equal(t, "from the handler", handler["msg"])
+	assert.Equal(t, "request", access["msg"])
+	assert.Equal(t, 418.0, access["status"])
+	assert.Equal(t, 15.0, access["bytes"])
+	assert.Contains(t, access, "latency_ms")
+}
+
+func TestTimeout(t *testing.T) {
+	h := Timeout(10 * time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		assert.True(t, IsTimeout(r.Context().Err()))
+	}))
+
+	serve(h, httptest.NewRequest(http.MethodGet, "/", nil))
+}
+
+func TestBodyLimit(t *testing.T) {
+	h := BodyLimit(5)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.ReadAll(r.Body)
+		var tooLarge *http.MaxBytesError
+		assert.ErrorAs(t, err, &tooLarge)
+	}))
+
+	// known length, turned away up front
+	rec := serve(h, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("too long")))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	// unknown length, the handler finds out
+	req := httptest.NewRequest(http.MethodPost, "/", io.NopCloser(strings.NewReader("too long")))
+	req.ContentLength = -1
+	serve(h, req)
+}
+
+func TestRequireJSON(t *testing.T) {
+	h := RequireJSON()(ok)
+
+	tests := []struct {
+		method, contentType string
+		status              int
+	}{
+		{http.MethodPost, "application/json", http.StatusOK},
+		{http.MethodPost, "application/json; charset=utf-8", http.StatusOK},
+		{http.MethodPatch, "application/merge-patch+json", http.StatusOK},
+		{http.MethodPut, "text/plain", http.StatusUnsupportedMediaType},
+		{http.MethodPost, "", http.StatusUnsupportedMediaType},
+		{http.MethodGet, "", http.StatusOK},
+		{http.MethodDelete, "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/", strings.NewReader("{}"))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		rec := serve(h, req)
+		assert.Equal(t, tt.status, rec.Code, tt.method+" "+tt.contentType)
+	}
+}
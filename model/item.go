@@ -1,23 +1,55 @@
 package model
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// Item is what we sell. Version is owned by the store: it starts at 1 and
+// goes up by one on every write, whatever a client sends in it. So is
+// Tenant, which stores that keep tenants apart by a field fill in. It
+// never leaves the server.
 type Item struct {
-	ID    primitive.ObjectID `bson:"_id,omitempty"`
-	Title string             `json:"title" bson:"title"`
-	Price float64            `json:"price" bson:"price"`
+	ID      primitive.ObjectID `bson:"_id,omitempty"`
+	Title   string             `json:"title" bson:"title"`
+	Price   float64            `json:"price" bson:"price"`
+	Version int64              `json:"version" bson:"version"`
+	Tenant  string             `json:"-" bson:"tenant,omitempty"`
 }
 
+// UnmarshalItem is strict about what it accepts: unknown fields are an
+// error, not something to silently drop.
 func UnmarshalItem(data []byte) (Item, error) {
 	var r Item
-	err := json.Unmarshal(data, &r)
+	err := UnmarshalStrict(data, &r)
 	return r, err
 }
 
+func UnmarshalItems(data []byte) ([]Item, error) {
+	var r []Item
+	err := UnmarshalStrict(data, &r)
+	return r, err
+}
+
+// UnmarshalStrict decodes a single json value into v, refusing unknown
+// fields and anything after the value.
+func UnmarshalStrict(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+
+	// trailing garbage after the value is a malformed body too
+	if dec.More() {
+		return errors.New("unexpected data after json value")
+	}
+	return nil
+}
+
 func (r *Item) Marshal() ([]byte, error) {
 	return json.Marshal(r)
 }
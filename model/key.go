@@ -0,0 +1,33 @@
+package model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// APIKey is an api key the way it's stored: never the key itself, only a
+// hash of it. Prefix is the part of the key that's fine to show around
+// and it's what the key gets looked up by. A key with a Tenant only works
+// for that tenant's items.
+type APIKey struct {
+	ID     primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Name   string             `json:"name" bson:"name"`
+	Prefix string             `json:"prefix" bson:"prefix"`
+	Hash   string             `json:"-" bson:"hash"`
+	Scopes []string           `json:"scopes" bson:"scopes"`
+	Tenant string             `json:"tenant,omitempty" bson:"tenant,omitempty"`
+
+	CreatedAt  time.Time  `json:"created_at" bson:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty" bson:"last_used_at,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty" bson:"revoked_at,omitempty"`
+}
+
+// Active is whether the key still lets anyone in at now.
+func (k APIKey) Active(now time.Time) bool {
+	if k.RevokedAt != nil {
+		return false
+	}
+	return k.ExpiresAt == nil || now.Before(*k.ExpiresAt)
+}
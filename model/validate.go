@@ -0,0 +1,97 @@
+package model
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	TitleMaxLen      = 200
+	PriceMaxDecimals = 2
+)
+
+// FieldError is one rule broken by one field. Field is the json name, with
+// an index in front for bulk payloads, like "[2].price".
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError is every FieldError found in one go, so clients can fix
+// everything at once instead of playing whack-a-mole.
+type ValidationError []FieldError
+
+func (v ValidationError) Error() string {
+	var parts []string
+	for k := range v {
+		parts = append(parts, fmt.Sprintf("%s: %s", v[k].Field, v[k].Message))
+	}
+	return "invalid item: " + strings.Join(parts, "; ")
+}
+
+// Validate checks the item against all the rules and returns a
+// ValidationError listing every violation, or nil.
+func (r *Item) Validate() error {
+	var errs ValidationError
+
+	title := strings.TrimSpace(r.Title)
+	switch {
+	case title == "":
+		errs = append(errs, FieldError{"title", "is required"})
+	case utf8.RuneCountInString(r.Title) > TitleMaxLen:
+		errs = append(errs, FieldError{"title", fmt.Sprintf("must be at most %d characters", TitleMaxLen)})
+	}
+
+	switch {
+	case math.IsNaN(r.Price) || math.IsInf(r.Price, 0):
+		errs = append(errs, FieldError{"price", "must be a finite number"})
+	case r.Price < 0:
+		errs = append(errs, FieldError{"price", "must not be negative"})
+	case decimals(r.Price) > PriceMaxDecimals:
+		errs = append(errs, FieldError{"price", fmt.Sprintf("must have at most %d decimal places", PriceMaxDecimals)})
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ValidateItems validates a bulk payload, prefixing each field with the
+// index of the item it came from.
+func ValidateItems(items []Item) error {
+	var errs ValidationError
+
+	for k := range items {
+		err := items[k].Validate()
+		if err == nil {
+			continue
+		}
+
+		for _, fe := range err.(ValidationError) {
+			errs = append(errs, FieldError{
+				Field:   fmt.Sprintf("[%d].%s", k, fe.Field),
+				Message: fe.Message,
+			})
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// decimals counts digits after the point in the shortest representation
+// of f, so 69.69 is 2 even though it isn't exact in binary.
+func decimals(f float64) int {
+	s := strconv.FormatFloat(f, 'f', -1, 64)
+	i := strings.IndexByte(s, '.')
+	if i < 0 {
+		return 0
+	}
+	return len(s) - i - 1
+}
@@ -0,0 +1,72 @@
+package model
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		item   Item
+		fields []string
+	}{
+		{"ok", Item{Title: "Test Item", Price: 69.69}, nil},
+		{"free", Item{Title: "Test Item", Price: 0}, nil},
+		{"empty title", Item{Title: "", Price: 1}, []string{"title"}},
+		{"blank title", Item{Title: "   ", Price: 1}, []string{"title"}},
+		{"long title", Item{Title: strings.Repeat("a", TitleMaxLen+1), Price: 1}, []string{"title"}},
+		{"negative price", Item{Title: "x", Price: -1}, []string{"price"}},
+		{"nan price", Item{Title: "x", Price: math.NaN()}, []string{"price"}},
+		{"inf price", Item{Title: "x", Price: math.Inf(1)}, []string{"price"}},
+		{"too many decimals", Item{Title: "x", Price: 1.999}, []string{"price"}},
+		{"everything wrong", Item{Title: "", Price: -1}, []string{"title", "price"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.item.Validate()
+			if tt.fields == nil {
+				assert.NoError(t, err)
+				return
+			}
+
+			verr, ok := err.(ValidationError)
+			assert.True(t, ok)
+
+			var got []string
+			for k := range verr {
+				got = append(got, verr[k].Field)
+			}
+			assert.Equal(t, tt.fields, got)
+		})
+	}
+}
+
+func TestValidateItems(t *testing.T) {
+	err := ValidateItems([]Item{
+		{Title: "fine", Price: 1},
+		{Title: "", Price: 1},
+		{Title: "x", Price: -2},
+	})
+
+	verr, ok := err.(ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, "[1].title", verr[0].Field)
+	assert.Equal(t, "[2].price", verr[1].Field)
+}
+
+func TestUnmarshalItemUnknownFields(t *testing.T) {
+	_, err := UnmarshalItem([]byte(`{"title":"x","price":1,"colour":"red"}`))
+	assert.Error(t, err)
+
+	_, err = UnmarshalItems([]byte(`[{"title":"x","price":1,"colour":"red"}]`))
+	assert.Error(t, err)
+
+	item, err := UnmarshalItem([]byte(`{"title":"x","price":1}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "x", item.Title)
+}
@@ -0,0 +1,126 @@
+package openapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type base struct {
+	Created time.Time `json:"created"`
+}
+
+type thing struct {
+	base
+	ID      primitive.ObjectID `json:"id,omitempty"`
+	Name    string             `json:"name"`
+	Count   uint               `json:"count"`
+	Tags    []string           `json:"tags,omitempty"`
+	Labels  map[string]float64 `json:"labels,omitempty"`
+	Raw     []byte             `json:"raw,omitempty"`
+	Any     interface{}        `json:"any,omitempty"`
+	Skipped string             `json:"-"`
+	NoTag   bool
+	hidden  int
+}
+
+func TestSchemaOf(t *testing.T) {
+	s := SchemaOf(thing{})
+
+	assert.Equal(t, "object", s.Type)
+	assert.Equal(t, false, s.AdditionalProperties)
+	assert.Equal(t, []string{"created", "name", "count", "NoTag"}, s.Required)
+	assert.Len(t, s.Properties, 9)
+
+	assert.Equal(t, &Schema{Type: "string", Format: "date-time"}, s.Properties["created"])
+	assert.Equal(t, &Schema{Type: "string"}, s.Properties["id"])
+	assert.Equal(t, &Schema{Type: "integer", Minimum: Float(0)}, s.Properties["count"])
+	assert.Equal(t, &Schema{Type: "array", Items: &Schema{Type: "string"}}, s.Properties["tags"])
+	assert.Equal(t, &Schema{Type: "object", AdditionalProperties: &Schema{Type: "number"}}, s.Properties["labels"])
+	assert.Equal(t, &Schema{Type: "string", Format: "byte"}, s.Properties["raw"])
+	assert.Equal(t, &Schema{}, s.Properties["any"])
+	assert.Equal(t, &Schema{Type: "boolean"}, s.Properties["NoTag"])
+
+	assert.Equal(t, SchemaOf(thing{}), SchemaOf(&thing{}))
+	assert.Equal(t, "#/components/schemas/Thing", Ref("Thing").Ref)
+}
+
+func TestUI(t *testing.T) {
+	ui := UI()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		rec.Header().Set("Content-Type", "application/json")
+		ui.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+path, nil))
+		return rec
+	}
+
+	rec := get("")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/html; charset=utf-8", rec.Header().Get("Content-Type"))
+
+	rec = get("swagger-ui.css")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/css")
+}
+
+func TestValidate(t *testing.T) {
+	doc := &Document{Components: Components{Schemas: map[string]*Schema{
+		"Thing": {
+			Type: "object",
+			Properties: map[string]*Schema{
+				"name":  {Type: "string", MinLength: Int(1), MaxLength: Int(3), Pattern: `^[a-z]+$`},
+				"count": {Type: "integer", Minimum: Float(0)},
+				"kind":  {Type: "string", Enum: []interface{}{"a", "b"}},
+			},
+			Required:             []string{"name"},
+			AdditionalProperties: false,
+		},
+	}}}
+	body := &Schema{OneOf: []*Schema{Ref("Thing"), {Type: "array", Items: Ref("Thing"), MinItems: Int(1)}}}
+
+	tests := map[string][]ValidationError{
+		`{"name":"abc","count":2,"kind":"a"}`: nil,
+		`{"name":"abc","count":2.0}`:          nil,
+		`[{"name":"a"},{"name":"b"}]`:         nil,
+		`{"name":"abcd","count":1.5}`: {
+			{Pointer: "/count", Keyword: "type", Message: "must be an integer"},
+			{Pointer: "/name", Keyword: "maxLength", Message: "must be at most 3 characters"},
+		},
+		`{"name":"ABC","count":-1,"kind":"c","a/b~":1}`: {
+			{Pointer: "/a~1b~0", Keyword: "additionalProperties", Message: "is not allowed"},
+			{Pointer: "/count", Keyword: "minimum", Message: "must be at least 0"},
+			{Pointer: "/kind", Keyword: "enum", Message: "must be one of [a b]"},
+			{Pointer: "/name", Keyword: "pattern", Message: "must match ^[a-z]+$"},
+		},
+		`[{"name":"a"},{}]`: {{Pointer: "/1/name", Keyword: "required", Message: "is required"}},
+		`[]`:                {{Pointer: "", Keyword: "minItems", Message: "must have at least 1 items"}},
+		`"thing"`:           {{Pointer: "", Keyword: "oneOf", Message: "doesn't match any of the allowed shapes"}},
+	}
+
+	for data, want := range tests {
+		errs, err := doc.Validate(body, []byte(data))
+		assert.NoError(t, err, data)
+		assert.Equal(t, want, errs, data)
+	}
+
+	for _, bad := range []string{``, `{`, `{} {}`} {
+		_, err := doc.Validate(body, []byte(bad))
+		assert.Error(t, err, bad)
+	}
+
+	// a broken spec is our problem, not the client's, but it still fails
+	errs, err := doc.Validate(Ref("Nope"), []byte(`{}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []ValidationError{{Keyword: "$ref", Message: "unknown schema #/components/schemas/Nope"}}, errs)
+}
+
+func TestValidationErrorField(t *testing.T) {
+	assert.Equal(t, "[2].price", ValidationError{Pointer: "/2/price"}.Field())
+	assert.Equal(t, "a/b.c", ValidationError{Pointer: "/a~1b/c"}.Field())
+	assert.Equal(t, "", ValidationError{Pointer: ""}.Field())
+}
@@ -0,0 +1,34 @@
+package openapi
+
+import (
+	_ "embed"
+	"net/http"
+
+	swaggerFiles "github.com/swaggo/files/v2"
+)
+
+// index is our own page, the one that comes with the assets points at the
+// petstore.
+//
+//go:embed ui/index.html
+var index []byte
+
+// UI serves Swagger UI for the spec at ../openapi.json. Everything is
+// embedded, so it works without internet. Mount it with the prefix
+// stripped, on a path ending in a slash.
+func UI() http.Handler {
+	assets := http.FileServer(http.FS(swaggerFiles.FS))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the api middleware says json, but these are html, css and js
+		w.Header().Del("Content-Type")
+
+		switch r.URL.Path {
+		case "", "/", "index.html", "/index.html":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = w.Write(index)
+		default:
+			assets.ServeHTTP(w, r)
+		}
+	})
+}
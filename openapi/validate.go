@@ -0,0 +1,272 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// ValidationError is one thing wrong with a json value.
+type ValidationError struct {
+	// Pointer is where, as an RFC 6901 JSON pointer. "" is the whole
+	// value.
+	Pointer string
+	// Keyword is the schema keyword that failed: type, required,
+	// additionalProperties, ...
+	Keyword string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%q: %s", e.Pointer, e.Message)
+}
+
+// Field is the pointer the way model field errors spell it, /2/price is
+// [2].price.
+func (e ValidationError) Field() string {
+	var b strings.Builder
+	for _, part := range splitPointer(e.Pointer) {
+		if _, err := strconv.Atoi(part); err == nil {
+			b.WriteString("[" + part + "]")
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(part)
+	}
+	return b.String()
+}
+
+// Validate checks data against schema, resolving refs in d's components.
+// The error is only for data that isn't a single json value, everything
+// wrong with the value itself is in the list.
+func (d *Document) Validate(schema *Schema, data []byte) ([]ValidationError, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("unexpected data after json value")
+	}
+
+	var errs []ValidationError
+	d.validate(schema, v, "", &errs)
+	return errs, nil
+}
+
+func (d *Document) resolve(s *Schema) (*Schema, error) {
+	for s.Ref != "" {
+		name := strings.TrimPrefix(s.Ref, "#/components/schemas/")
+		next, ok := d.Components.Schemas[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown schema %s", s.Ref)
+		}
+		s = next
+	}
+	return s, nil
+}
+
+func (d *Document) validate(s *Schema, v interface{}, ptr string, errs *[]ValidationError) {
+	fail := func(ptr, keyword, format string, args ...interface{}) {
+		*errs = append(*errs, ValidationError{Pointer: ptr, Keyword: keyword, Message: fmt.Sprintf(format, args...)})
+	}
+
+	s, err := d.resolve(s)
+	if err != nil {
+		fail(ptr, "$ref", "%v", err)
+		return
+	}
+
+	if len(s.OneOf) > 0 {
+		d.oneOf(s.OneOf, v, ptr, errs)
+	}
+
+	if s.Type != "" && !isType(v, s.Type) {
+		fail(ptr, "type", "must be %s %s", article(s.Type), s.Type)
+		return
+	}
+
+	if len(s.Enum) > 0 && !inEnum(v, s.Enum) {
+		fail(ptr, "enum", "must be one of %v", s.Enum)
+	}
+
+	switch v := v.(type) {
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.MinLength != nil && n < *s.MinLength {
+			fail(ptr, "minLength", "must be at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			fail(ptr, "maxLength", "must be at most %d characters", *s.MaxLength)
+		}
+		if s.Pattern != "" {
+			re, err := compile(s.Pattern)
+			if err != nil {
+				fail(ptr, "pattern", "%v", err)
+			} else if !re.MatchString(v) {
+				fail(ptr, "pattern", "must match %s", s.Pattern)
+			}
+		}
+
+	case json.Number:
+		f, _ := v.Float64()
+		if s.Minimum != nil && f < *s.Minimum {
+			fail(ptr, "minimum", "must be at least %v", *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			fail(ptr, "maximum", "must be at most %v", *s.Maximum)
+		}
+
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			fail(ptr, "minItems", "must have at least %d items", *s.MinItems)
+		}
+		if s.Items != nil {
+			for k := range v {
+				d.validate(s.Items, v[k], ptr+"/"+strconv.Itoa(k), errs)
+			}
+		}
+
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				fail(ptr+"/"+escape(name), "required", "is required")
+			}
+		}
+
+		// sorted so the errors come out in the same order every time
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			child := ptr + "/" + escape(k)
+			if prop, ok := s.Properties[k]; ok {
+				d.validate(prop, v[k], child, errs)
+				continue
+			}
+
+			switch extra := s.AdditionalProperties.(type) {
+			case bool:
+				if !extra {
+					fail(child, "additionalProperties", "is not allowed")
+				}
+			case *Schema:
+				d.validate(extra, v[k], child, errs)
+			}
+		}
+	}
+}
+
+// oneOf wants exactly one branch to match. When none does, the errors from
+// the branch of the right type are the useful ones, an object that's
+// missing a field shouldn't be told it's also not an array.
+func (d *Document) oneOf(branches []*Schema, v interface{}, ptr string, errs *[]ValidationError) {
+	var matched int
+	var closest []ValidationError
+
+	for _, b := range branches {
+		var berrs []ValidationError
+		d.validate(b, v, ptr, &berrs)
+		if len(berrs) == 0 {
+			matched++
+			continue
+		}
+		if rb, err := d.resolve(b); err == nil && rb.Type != "" && isType(v, rb.Type) && closest == nil {
+			closest = berrs
+		}
+	}
+
+	switch {
+	case matched == 1:
+	case matched > 1:
+		*errs = append(*errs, ValidationError{Pointer: ptr, Keyword: "oneOf", Message: "matches more than one of the allowed shapes"})
+	case closest != nil:
+		*errs = append(*errs, closest...)
+	default:
+		*errs = append(*errs, ValidationError{Pointer: ptr, Keyword: "oneOf", Message: "doesn't match any of the allowed shapes"})
+	}
+}
+
+func isType(v interface{}, typ string) bool {
+	switch v := v.(type) {
+	case nil:
+		return typ == "null"
+	case bool:
+		return typ == "boolean"
+	case string:
+		return typ == "string"
+	case json.Number:
+		if typ == "number" {
+			return true
+		}
+		f, err := v.Float64()
+		return typ == "integer" && err == nil && f == math.Trunc(f)
+	case []interface{}:
+		return typ == "array"
+	case map[string]interface{}:
+		return typ == "object"
+	}
+	return false
+}
+
+func inEnum(v interface{}, enum []interface{}) bool {
+	for _, e := range enum {
+		if fmt.Sprint(e) == fmt.Sprint(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func article(typ string) string {
+	if strings.ContainsRune("aeiou", rune(typ[0])) {
+		return "an"
+	}
+	return "a"
+}
+
+// escape and splitPointer do the ~0 ~1 dance from RFC 6901.
+func escape(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
+
+func splitPointer(ptr string) []string {
+	if ptr == "" {
+		return nil
+	}
+	parts := strings.Split(strings.TrimPrefix(ptr, "/"), "/")
+	for k := range parts {
+		parts[k] = strings.NewReplacer("~1", "/", "~0", "~").Replace(parts[k])
+	}
+	return parts
+}
+
+var patterns sync.Map
+
+// compile caches the regexps, the same handful get used on every request.
+func compile(pattern string) (*regexp.Regexp, error) {
+	if re, ok := patterns.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	patterns.Store(pattern, re)
+	return re, nil
+}
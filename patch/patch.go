@@ -0,0 +1,413 @@
+// Package patch applies JSON Merge Patch (RFC 7396) and JSON Patch
+// (RFC 6902) documents to raw JSON. It doesn't know what an item is, the
+// caller decodes and validates whatever comes out.
+package patch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	MergePatchType = "application/merge-patch+json"
+	JSONPatchType  = "application/json-patch+json"
+)
+
+var (
+	// ErrInvalid means the patch document itself is broken.
+	ErrInvalid = errors.New("invalid patch document")
+	// ErrTestFailed is a JSON Patch test op that didn't match.
+	ErrTestFailed = errors.New("patch test failed")
+	// ErrUnprocessable is a well formed patch that can't be applied to
+	// this document, like removing a path that isn't there.
+	ErrUnprocessable = errors.New("patch can't be applied")
+)
+
+// decode keeps numbers as json.Number so nothing loses precision on the
+// way through.
+func decode(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("unexpected data after json value")
+	}
+	return v, nil
+}
+
+// MergePatch applies an RFC 7396 merge patch to doc.
+func MergePatch(doc, patch []byte) ([]byte, error) {
+	d, err := decode(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := decode(patch)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+
+	return json.Marshal(merge(d, p))
+}
+
+func merge(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = merge(t[k], v)
+	}
+	return t
+}
+
+// Operation is one step of a JSON Patch. Value is empty when the
+// operation has none, a null value is the bytes null.
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// JSONPatch applies an RFC 6902 patch to doc. Operations run in order and
+// if any of them fails nothing is returned, so it's all or nothing.
+func JSONPatch(doc, patch []byte) ([]byte, error) {
+	d, err := decode(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var ops []Operation
+	dec := json.NewDecoder(bytes.NewReader(patch))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&ops); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+
+	for i, op := range ops {
+		d, err = apply(d, op)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %w", i, op.Op, op.Path, err)
+		}
+	}
+	return json.Marshal(d)
+}
+
+func apply(doc interface{}, op Operation) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	value := func() (interface{}, error) {
+		if len(op.Value) == 0 {
+			return nil, fmt.Errorf("%w: missing value", ErrInvalid)
+		}
+		v, err := decode(op.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+		return v, nil
+	}
+
+	switch op.Op {
+	case "add":
+		v, err := value()
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, v)
+	case "remove":
+		doc, _, err := remove(doc, path)
+		return doc, err
+	case "replace":
+		v, err := value()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := get(doc, path); err != nil {
+			return nil, err
+		}
+		if len(path) == 0 {
+			return v, nil
+		}
+		doc, _, err = remove(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, v)
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "move" && isPrefix(from, path) && len(from) < len(path) {
+			return nil, fmt.Errorf("%w: can't move a value into itself", ErrUnprocessable)
+		}
+
+		v, err := get(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "move" {
+			doc, _, err = remove(doc, from)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			v = deepCopy(v)
+		}
+		return add(doc, path, v)
+	case "test":
+		v, err := value()
+		if err != nil {
+			return nil, err
+		}
+		got, err := get(doc, path)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrTestFailed, err)
+		}
+		if !equal(got, v) {
+			return nil, ErrTestFailed
+		}
+		return doc, nil
+	}
+
+	return nil, fmt.Errorf("%w: unknown op %q", ErrInvalid, op.Op)
+}
+
+// parsePointer splits an RFC 6901 JSON pointer into unescaped tokens.
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(p, "/") {
+		return nil, fmt.Errorf("%w: bad json pointer %q", ErrInvalid, p)
+	}
+
+	parts := strings.Split(p[1:], "/")
+	for k := range parts {
+		parts[k] = strings.ReplaceAll(strings.ReplaceAll(parts[k], "~1", "/"), "~0", "~")
+	}
+	return parts, nil
+}
+
+func isPrefix(prefix, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for k := range prefix {
+		if prefix[k] != path[k] {
+			return false
+		}
+	}
+	return true
+}
+
+func index(token string, n int, allowEnd bool) (int, error) {
+	if allowEnd && token == "-" {
+		return n, nil
+	}
+
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("%w: bad array index %q", ErrUnprocessable, token)
+	}
+
+	max := n - 1
+	if allowEnd {
+		max = n
+	}
+	if i > max {
+		return 0, fmt.Errorf("%w: array index %d out of range", ErrUnprocessable, i)
+	}
+	return i, nil
+}
+
+func get(doc interface{}, path []string) (interface{}, error) {
+	cur := doc
+	for _, tok := range path {
+		switch c := cur.(type) {
+		case map[string]interface{}:
+			v, ok := c[tok]
+			if !ok {
+				return nil, fmt.Errorf("%w: %q not found", ErrUnprocessable, tok)
+			}
+			cur = v
+		case []interface{}:
+			i, err := index(tok, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			cur = c[i]
+		default:
+			return nil, fmt.Errorf("%w: %q not found", ErrUnprocessable, tok)
+		}
+	}
+	return cur, nil
+}
+
+// add sets path to v, building the new document on the way back up so
+// arrays can grow.
+func add(doc interface{}, path []string, v interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return v, nil
+	}
+
+	tok, rest := path[0], path[1:]
+	switch c := doc.(type) {
+	case map[string]interface{}:
+		if len(rest) == 0 {
+			c[tok] = v
+			return c, nil
+		}
+		child, ok := c[tok]
+		if !ok {
+			return nil, fmt.Errorf("%w: %q not found", ErrUnprocessable, tok)
+		}
+		nc, err := add(child, rest, v)
+		if err != nil {
+			return nil, err
+		}
+		c[tok] = nc
+		return c, nil
+	case []interface{}:
+		if len(rest) == 0 {
+			i, err := index(tok, len(c), true)
+			if err != nil {
+				return nil, err
+			}
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = v
+			return c, nil
+		}
+		i, err := index(tok, len(c), false)
+		if err != nil {
+			return nil, err
+		}
+		nc, err := add(c[i], rest, v)
+		if err != nil {
+			return nil, err
+		}
+		c[i] = nc
+		return c, nil
+	}
+	return nil, fmt.Errorf("%w: can't add to %q", ErrUnprocessable, tok)
+}
+
+func remove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("%w: can't remove the whole document", ErrUnprocessable)
+	}
+
+	tok, rest := path[0], path[1:]
+	switch c := doc.(type) {
+	case map[string]interface{}:
+		child, ok := c[tok]
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: %q not found", ErrUnprocessable, tok)
+		}
+		if len(rest) == 0 {
+			delete(c, tok)
+			return c, child, nil
+		}
+		nc, old, err := remove(child, rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		c[tok] = nc
+		return c, old, nil
+	case []interface{}:
+		i, err := index(tok, len(c), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(rest) == 0 {
+			old := c[i]
+			return append(c[:i], c[i+1:]...), old, nil
+		}
+		nc, old, err := remove(c[i], rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		c[i] = nc
+		return c, old, nil
+	}
+	return nil, nil, fmt.Errorf("%w: %q not found", ErrUnprocessable, tok)
+}
+
+func deepCopy(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k := range v {
+			out[k] = deepCopy(v[k])
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for k := range v {
+			out[k] = deepCopy(v[k])
+		}
+		return out
+	}
+	return v
+}
+
+// equal is JSON equality: numbers compare by value, so 1 and 1.0 match.
+func equal(a, b interface{}) bool {
+	switch a := a.(type) {
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		fa, errA := a.Float64()
+		fb, errB := b.Float64()
+		return errA == nil && errB == nil && fa == fb
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k := range a {
+			bv, ok := b[k]
+			if !ok || !equal(a[k], bv) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k := range a {
+			if !equal(a[k], b[k]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
@@ -0,0 +1,82 @@
+package patch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergePatch(t *testing.T) {
+	// the examples from RFC 7396 appendix A, a few of them anyway
+	tests := []struct {
+		doc, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"title":"x","price":1.10}`, `{"price":2}`, `{"price":2,"title":"x"}`},
+	}
+
+	for _, tt := range tests {
+		got, err := MergePatch([]byte(tt.doc), []byte(tt.patch))
+		assert.NoError(t, err)
+		assert.JSONEq(t, tt.want, string(got), tt.patch)
+	}
+
+	_, err := MergePatch([]byte(`{}`), []byte(`{`))
+	assert.ErrorIs(t, err, ErrInvalid)
+}
+
+func TestJSONPatch(t *testing.T) {
+	tests := []struct {
+		doc, patch, want string
+	}{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"foo":"bar","baz":"qux"}`},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":"qux"}]`, `{"foo":["bar","qux"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{`{"a":{"b":1}}`, `[{"op":"copy","from":"/a","path":"/c"},{"op":"replace","path":"/c/b","value":2}]`, `{"a":{"b":1},"c":{"b":2}}`},
+		{`{"a/b":1,"m~n":2}`, `[{"op":"test","path":"/a~1b","value":1},{"op":"test","path":"/m~0n","value":2.0}]`, `{"a/b":1,"m~n":2}`},
+		{`{"price":1.5}`, `[{"op":"test","path":"/price","value":1.5},{"op":"replace","path":"/price","value":3}]`, `{"price":3}`},
+		// null is a value like any other
+		{`{"note":"x"}`, `[{"op":"replace","path":"/note","value":null},{"op":"test","path":"/note","value":null}]`, `{"note":null}`},
+		{`{}`, `[{"op":"add","path":"/note","value":null}]`, `{"note":null}`},
+	}
+
+	for _, tt := range tests {
+		got, err := JSONPatch([]byte(tt.doc), []byte(tt.patch))
+		assert.NoError(t, err, tt.patch)
+		assert.JSONEq(t, tt.want, string(got), tt.patch)
+	}
+}
+
+func TestJSONPatchErrors(t *testing.T) {
+	tests := []struct {
+		doc, patch string
+		err        error
+	}{
+		{`{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`, ErrTestFailed},
+		{`{"baz":"qux"}`, `[{"op":"test","path":"/nope","value":"bar"}]`, ErrTestFailed},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`, ErrUnprocessable},
+		{`{"foo":"bar"}`, `[{"op":"remove","path":"/nope"}]`, ErrUnprocessable},
+		{`{"foo":"bar"}`, `[{"op":"replace","path":"/nope","value":1}]`, ErrUnprocessable},
+		{`{"foo":[1]}`, `[{"op":"add","path":"/foo/5","value":1}]`, ErrUnprocessable},
+		{`{"foo":{}}`, `[{"op":"move","from":"/foo","path":"/foo/bar"}]`, ErrUnprocessable},
+		{`{}`, `[{"op":"frobnicate","path":"/a"}]`, ErrInvalid},
+		{`{}`, `[{"op":"add","path":"/a"}]`, ErrInvalid},
+		{`{}`, `[{"op":"add","path":"a","value":1}]`, ErrInvalid},
+		{`{}`, `{"op":"add"}`, ErrInvalid},
+	}
+
+	for _, tt := range tests {
+		_, err := JSONPatch([]byte(tt.doc), []byte(tt.patch))
+		assert.ErrorIs(t, err, tt.err, tt.patch)
+	}
+}
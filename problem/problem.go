@@ -0,0 +1,146 @@
+// Package problem writes RFC 7807 problem details (application/problem+json)
+// for every error the API sends back.
+//
+// The type URIs below are the stable part: clients should branch on Type,
+// not on Title or Detail, which are only meant for humans.
+package problem
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+const ContentType = "application/problem+json"
+
+// Type is a problem type URI. They're relative references, resolved
+// against wherever the API is served from.
+type Type string
+
+const (
+	TypeBadRequest       Type = "/problems/bad-request"
+	TypeMalformedBody    Type = "/problems/malformed-body"
+	TypeInvalidID        Type = "/problems/invalid-id"
+	TypeInvalidQuery     Type = "/problems/invalid-query"
+	TypeNotFound         Type = "/problems/not-found"
+	TypeConflict         Type = "/problems/conflict"
+	TypeContended        Type = "/problems/concurrent-modification"
+	TypeValidation       Type = "/problems/validation"
+	TypeInternal         Type = "/problems/internal"
+	TypeMethodNotAllowed Type = "/problems/method-not-allowed"
+	TypeUnsupportedMedia Type = "/problems/unsupported-media-type"
+	TypePatchTestFailed  Type = "/problems/patch-test-failed"
+	TypeUnprocessable    Type = "/problems/unprocessable-patch"
+	TypePrecondition     Type = "/problems/precondition-failed"
+	TypeBodyTooLarge     Type = "/problems/body-too-large"
+	TypeTimeout          Type = "/problems/timeout"
+	TypeNotAcceptable    Type = "/problems/not-acceptable"
+	TypeUnauthorized     Type = "/problems/unauthorized"
+	TypeForbidden        Type = "/problems/forbidden"
+	TypeQuotaExceeded    Type = "/problems/quota-exceeded"
+	TypeRateLimited      Type = "/problems/rate-limited"
+)
+
+type entry struct {
+	title  string
+	status int
+}
+
+// catalog is the single place that says which title and status go with
+// each type. Add new types here and nowhere else.
+var catalog = map[Type]entry{
+	TypeBadRequest:       {"Bad request", http.StatusBadRequest},
+	TypeMalformedBody:    {"Malformed request body", http.StatusBadRequest},
+	TypeInvalidID:        {"Invalid item id", http.StatusBadRequest},
+	TypeInvalidQuery:     {"Invalid query parameters", http.StatusBadRequest},
+	TypeNotFound:         {"Not found", http.StatusNotFound},
+	TypeConflict:         {"Already exists", http.StatusConflict},
+	TypeContended:        {"Concurrent modification", http.StatusConflict},
+	TypeValidation:       {"Validation failed", http.StatusUnprocessableEntity},
+	TypeInternal:         {"Internal server error", http.StatusInternalServerError},
+	TypeMethodNotAllowed: {"Method not allowed", http.StatusMethodNotAllowed},
+	TypeUnsupportedMedia: {"Unsupported media type", http.StatusUnsupportedMediaType},
+	TypePatchTestFailed:  {"Patch test operation failed", http.StatusConflict},
+	TypeUnprocessable:    {"Patch can't be applied", http.StatusUnprocessableEntity},
+	TypePrecondition:     {"Item was changed by someone else", http.StatusPreconditionFailed},
+	TypeBodyTooLarge:     {"Request body too large", http.StatusRequestEntityTooLarge},
+	TypeTimeout:          {"Request timed out", http.StatusServiceUnavailable},
+	TypeNotAcceptable:    {"Not acceptable", http.StatusNotAcceptable},
+	TypeUnauthorized:     {"Authentication required", http.StatusUnauthorized},
+	TypeForbidden:        {"Not allowed", http.StatusForbidden},
+	TypeQuotaExceeded:    {"Item quota exceeded", http.StatusForbidden},
+	TypeRateLimited:      {"Too many requests", http.StatusTooManyRequests},
+}
+
+// Types lists every known problem type, mostly so tests and docs can walk
+// the catalog.
+func Types() []Type {
+	var out []Type
+	for t := range catalog {
+		out = append(out, t)
+	}
+	return out
+}
+
+// FieldError points at one invalid field in the request. Pointer is the
+// same place as an RFC 6901 JSON pointer into the body, when we have it.
+type FieldError struct {
+	Field   string `json:"field"`
+	Pointer string `json:"pointer,omitempty"`
+	Message string `json:"message"`
+}
+
+// Details is the problem document itself.
+type Details struct {
+	Type     Type         `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Errors   []FieldError `json:"errors,omitempty"`
+	// MissingScopes goes with TypeForbidden, it's what the caller would
+	// need to be let in.
+	MissingScopes []string `json:"missing_scopes,omitempty"`
+}
+
+// New fills in title and status from the catalog. Unknown types end up as
+// internal errors so we never send out a problem with status 0.
+func New(t Type, detail string) *Details {
+	e, ok := catalog[t]
+	if !ok {
+		t = TypeInternal
+		e = catalog[TypeInternal]
+	}
+
+	return &Details{
+		Type:   t,
+		Title:  e.title,
+		Status: e.status,
+		Detail: detail,
+	}
+}
+
+func (d *Details) WithErrors(errs ...FieldError) *Details {
+	d.Errors = append(d.Errors, errs...)
+	return d
+}
+
+func (d *Details) WithMissingScopes(scopes ...string) *Details {
+	d.MissingScopes = append(d.MissingScopes, scopes...)
+	return d
+}
+
+// Write sends the problem. Instance defaults to the request path.
+func (d *Details) Write(w http.ResponseWriter, r *http.Request) {
+	if d.Instance == "" && r != nil {
+		d.Instance = r.URL.Path
+	}
+
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(d.Status)
+	json.NewEncoder(w).Encode(d)
+}
+
+// Write is the shortcut for New(t, detail).Write(w, r).
+func Write(w http.ResponseWriter, r *http.Request, t Type, detail string) {
+	New(t, detail).Write(w, r)
+}
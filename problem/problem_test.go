@@ -0,0 +1,57 @@
+package problem
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCatalog(t *testing.T) {
+	for _, typ := range Types() {
+		p := New(typ, "")
+		assert.Equal(t, typ, p.Type)
+		assert.NotEmpty(t, p.Title)
+		assert.GreaterOrEqual(t, p.Status, 400)
+	}
+}
+
+func TestUnknownTypeIsInternal(t *testing.T) {
+	p := New(Type("/problems/whatever"), "detail")
+	assert.Equal(t, TypeInternal, p.Type)
+	assert.Equal(t, http.StatusInternalServerError, p.Status)
+}
+
+func TestWrite(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/items/create/one", nil)
+	rec := httptest.NewRecorder()
+
+	New(TypeValidation, "bad item").WithErrors(FieldError{Field: "title", Message: "is required"}).Write(rec, req)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.Equal(t, ContentType, rec.Header().Get("Content-Type"))
+
+	var body map[string]interface{}
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+	assert.Equal(t, "/problems/validation", body["type"])
+	assert.Equal(t, "Validation failed", body["title"])
+	assert.Equal(t, float64(422), body["status"])
+	assert.Equal(t, "bad item", body["detail"])
+	assert.Equal(t, "/items/create/one", body["instance"])
+	assert.Len(t, body["errors"], 1)
+}
+
+func TestMissingScopes(t *testing.T) {
+	req := httptest.NewRequest(http.MethodDelete, "/items/1", nil)
+	rec := httptest.NewRecorder()
+
+	New(TypeForbidden, "missing scope items:delete").WithMissingScopes("items:delete").Write(rec, req)
+
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	var body map[string]interface{}
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+	assert.Equal(t, []interface{}{"items:delete"}, body["missing_scopes"])
+	assert.NotContains(t, body, "errors")
+}
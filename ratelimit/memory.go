@@ -0,0 +1,86 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepEvery is how often Memory drops buckets nobody's used in a while.
+const sweepEvery = time.Minute
+
+// bucket is how many tokens there were at last.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Memory is a Limiter that keeps the buckets in a map. Every server has
+// its own, so behind a load balancer each one lets a client through at
+// the full rate.
+type Memory struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+	now     func() time.Time
+}
+
+var _ Limiter = (*Memory)(nil)
+
+func NewMemory() *Memory {
+	return &Memory{buckets: map[string]*bucket{}, now: time.Now}
+}
+
+func (m *Memory) Take(ctx context.Context, key string, cost int, limit Limit) (Result, error) {
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+
+	burst := float64(limit.Burst)
+	want := math.Min(float64(cost), burst)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.sweep(now, limit)
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		m.buckets[key] = b
+	}
+
+	// whatever came in since last time, up to what fits
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+
+	res := Result{Limit: limit.Burst}
+	if b.tokens >= want {
+		b.tokens -= want
+		res.Allowed = true
+	} else {
+		res.RetryAfter = limit.fill(want - b.tokens)
+	}
+	res.Remaining = int(math.Floor(b.tokens))
+	res.Reset = limit.fill(burst - b.tokens)
+	return res, nil
+}
+
+// sweep drops the buckets that would be full by now anyway, a new one
+// starts out full so nobody can tell. It goes by limit for all of them,
+// which is fine as long as everybody gets the same one. It assumes the
+// lock is held.
+func (m *Memory) sweep(now time.Time, limit Limit) {
+	if now.Sub(m.swept) < sweepEvery {
+		return
+	}
+	m.swept = now
+
+	for key, b := range m.buckets {
+		if now.Sub(b.last) >= limit.fill(float64(limit.Burst)-b.tokens) {
+			delete(m.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimit(t *testing.T) {
+	assert.False(t, Limit{}.Enabled())
+	assert.False(t, Limit{Rate: 1}.Enabled())
+	assert.True(t, Limit{Rate: 0.5, Burst: 1}.Enabled())
+	assert.Equal(t, 20*time.Second, Limit{Rate: 0.5, Burst: 10}.Window())
+}
+
+func TestMemory(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { return now }
+	limit := Limit{Rate: 2, Burst: 10}
+
+	// a fresh bucket is full
+	res, err := m.Take(ctx, "a", 1, limit)
+	assert.NoError(t, err)
+	assert.Equal(t, Result{Allowed: true, Limit: 10, Remaining: 9, Reset: 500 * time.Millisecond}, res)
+
+	res, _ = m.Take(ctx, "a", 8, limit)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 1, res.Remaining)
+	assert.Equal(t, 4500*time.Millisecond, res.Reset)
+
+	// not enough left, and nothing gets taken for trying
+	res, _ = m.Take(ctx, "a", 3, limit)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 1, res.Remaining)
+	assert.Equal(t, time.Second, res.RetryAfter)
+
+	// other keys have their own
+	res, _ = m.Take(ctx, "b", 10, limit)
+	assert.True(t, res.Allowed)
+
+	// tokens come back at the rate, but never more than the burst
+	now = now.Add(time.Second)
+	res, _ = m.Take(ctx, "a", 3, limit)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+	now = now.Add(time.Hour)
+	res, _ = m.Take(ctx, "a", 0, limit)
+	assert.Equal(t, 10, res.Remaining)
+	assert.Equal(t, time.Duration(0), res.Reset)
+
+	// more than the burst empties the bucket, but does go through
+	res, _ = m.Take(ctx, "a", 50, limit)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+	res, _ = m.Take(ctx, "a", 50, limit)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 5*time.Second, res.RetryAfter)
+
+	// buckets that filled up are forgotten
+	now = now.Add(time.Hour)
+	_, _ = m.Take(ctx, "c", 1, limit)
+	assert.Len(t, m.buckets, 1)
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = m.Take(ctx, "a", 1, limit)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestMemoryConcurrent(t *testing.T) {
+	m := NewMemory()
+	limit := Limit{Rate: 0.001, Burst: 50}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := map[string]int{}
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprint(i % 2)
+			res, err := m.Take(context.Background(), key, 1, limit)
+			assert.NoError(t, err)
+			if res.Allowed {
+				mu.Lock()
+				allowed[key]++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, map[string]int{"0": 50, "1": 50}, allowed)
+}
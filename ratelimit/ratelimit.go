@@ -0,0 +1,57 @@
+// Package ratelimit hands out tokens from a bucket per client. Every
+// request takes what it costs, the buckets fill back up at a steady rate,
+// and when one's empty the client waits. Limiter is the part that keeps
+// the buckets, Memory keeps them in this process.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// Limit is how fast a bucket fills, in tokens a second, and how many it
+// holds. A zero Rate is no limit at all.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Enabled is whether there's a limit.
+func (l Limit) Enabled() bool {
+	return l.Rate > 0 && l.Burst > 0
+}
+
+// Window is how long an empty bucket takes to fill up.
+func (l Limit) Window() time.Duration {
+	return l.fill(float64(l.Burst))
+}
+
+// fill is how long it takes for tokens to come in.
+func (l Limit) fill(tokens float64) time.Duration {
+	if tokens <= 0 {
+		return 0
+	}
+	return time.Duration(math.Ceil(tokens / l.Rate * float64(time.Second)))
+}
+
+// Result is how taking tokens went. Remaining is what's left in the
+// bucket after, Reset how long until it's full again and RetryAfter, when
+// it didn't work out, how long until there'd be enough.
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// Limiter keeps a bucket for every key. Take takes cost tokens from key's
+// bucket if it has them, and nothing if it doesn't. A cost over the burst
+// takes the whole bucket, otherwise it could never go through.
+//
+// Memory is the only one so far. One that several servers share, in
+// redis or the like, only has to do the same thing atomically.
+type Limiter interface {
+	Take(ctx context.Context, key string, cost int, limit Limit) (Result, error)
+}
@@ -0,0 +1,181 @@
+// Package search has the tokenizer, inverted index and highlighter used for
+// item title search. The mongo store lets a text index do the matching but
+// still uses Tokenize and Highlight here, so both stores highlight the
+// same way.
+package search
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Token is one word of the input, folded to lowercase without accents.
+// Start and End are rune offsets into the original text, End exclusive.
+type Token struct {
+	Term  string
+	Start int
+	End   int
+}
+
+// Tokenize splits text on anything that isn't a letter or a digit, and
+// folds case and accents so "Café" and "cafe" are the same term.
+func Tokenize(text string) []Token {
+	var tokens []Token
+	var term strings.Builder
+	start := -1
+
+	pos := 0
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = pos
+			}
+			term.WriteString(fold(r))
+		} else if start >= 0 {
+			tokens = append(tokens, Token{Term: term.String(), Start: start, End: pos})
+			term.Reset()
+			start = -1
+		}
+		pos++
+	}
+
+	if start >= 0 {
+		tokens = append(tokens, Token{Term: term.String(), Start: start, End: pos})
+	}
+	return tokens
+}
+
+// Terms is Tokenize without the positions, deduplicated.
+func Terms(text string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, t := range Tokenize(text) {
+		if !seen[t.Term] {
+			seen[t.Term] = true
+			out = append(out, t.Term)
+		}
+	}
+	return out
+}
+
+// fold decomposes r and drops the combining marks, so é becomes e.
+func fold(r rune) string {
+	var b strings.Builder
+	for _, d := range norm.NFD.String(string(r)) {
+		if unicode.Is(unicode.Mn, d) {
+			continue
+		}
+		b.WriteRune(unicode.ToLower(d))
+	}
+	return b.String()
+}
+
+// Span is a highlighted range of runes in the original text.
+type Span struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// Highlight returns where the query terms show up in text.
+func Highlight(text, query string) []Span {
+	want := make(map[string]bool)
+	for _, t := range Terms(query) {
+		want[t] = true
+	}
+
+	var spans []Span
+	for _, t := range Tokenize(text) {
+		if want[t.Term] {
+			spans = append(spans, Span{Start: t.Start, End: t.End})
+		}
+	}
+	return spans
+}
+
+// Hit is one matching document and how well it matched.
+type Hit struct {
+	ID    string
+	Score float64
+}
+
+// Index is an inverted index from terms to the documents that have them.
+// It isn't safe for concurrent use, the owner is expected to lock around
+// it.
+type Index struct {
+	postings map[string]map[string]int
+	docs     map[string][]string
+}
+
+func NewIndex() *Index {
+	return &Index{
+		postings: make(map[string]map[string]int),
+		docs:     make(map[string][]string),
+	}
+}
+
+// Add indexes text under id, replacing whatever id had before.
+func (idx *Index) Add(id, text string) {
+	idx.Remove(id)
+
+	var terms []string
+	for _, t := range Tokenize(text) {
+		p, ok := idx.postings[t.Term]
+		if !ok {
+			p = make(map[string]int)
+			idx.postings[t.Term] = p
+		}
+		if p[id] == 0 {
+			terms = append(terms, t.Term)
+		}
+		p[id]++
+	}
+	idx.docs[id] = terms
+}
+
+func (idx *Index) Remove(id string) {
+	for _, term := range idx.docs[id] {
+		delete(idx.postings[term], id)
+		if len(idx.postings[term]) == 0 {
+			delete(idx.postings, term)
+		}
+	}
+	delete(idx.docs, id)
+}
+
+// Search finds every document with at least one of the query terms and
+// scores it with plain tf-idf. Best hits come first, ties go by id so the
+// order is stable between calls.
+func (idx *Index) Search(query string) []Hit {
+	n := float64(len(idx.docs))
+	scores := make(map[string]float64)
+
+	for _, term := range Terms(query) {
+		p := idx.postings[term]
+		if len(p) == 0 {
+			continue
+		}
+
+		idf := math.Log(1 + n/float64(len(p)))
+		for id, tf := range p {
+			// shorter titles with the same match are better matches
+			scores[id] += float64(tf) * idf / math.Sqrt(float64(len(idx.docs[id])))
+		}
+	}
+
+	hits := make([]Hit, 0, len(scores))
+	for id, score := range scores {
+		hits = append(hits, Hit{ID: id, Score: score})
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].ID < hits[j].ID
+	})
+	return hits
+}
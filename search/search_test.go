@@ -0,0 +1,50 @@
+package search
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenize(t *testing.T) {
+	tokens := Tokenize("Crème Brûlée, USB-C!")
+	assert.Equal(t, []Token{
+		{Term: "creme", Start: 0, End: 5},
+		{Term: "brulee", Start: 6, End: 12},
+		{Term: "usb", Start: 14, End: 17},
+		{Term: "c", Start: 18, End: 19},
+	}, tokens)
+
+	assert.Empty(t, Tokenize("  -- !! "))
+	assert.Equal(t, []string{"cable", "hdmi"}, Terms("Cable HDMI cable"))
+}
+
+func TestHighlight(t *testing.T) {
+	spans := Highlight("HDMI Cable, café cable", "CABLE cafe")
+	assert.Equal(t, []Span{{5, 10}, {12, 16}, {17, 22}}, spans)
+	assert.Empty(t, Highlight("HDMI Cable", "monitor"))
+}
+
+func TestIndex(t *testing.T) {
+	idx := NewIndex()
+	idx.Add("1", "HDMI cable")
+	idx.Add("2", "USB monitor cable")
+	idx.Add("3", "Monitor")
+
+	hits := idx.Search("cable")
+	assert.Len(t, hits, 2)
+	// same match, shorter title wins
+	assert.Equal(t, "1", hits[0].ID)
+
+	hits = idx.Search("monitor cable")
+	assert.Len(t, hits, 3)
+	// has both words
+	assert.Equal(t, "2", hits[0].ID)
+
+	idx.Add("1", "HDMI adapter")
+	assert.Len(t, idx.Search("cable"), 1)
+
+	idx.Remove("2")
+	assert.Empty(t, idx.Search("cable"))
+	assert.Empty(t, idx.Search("nothing"))
+}
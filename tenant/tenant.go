@@ -0,0 +1,42 @@
+// Package tenant is which team a request is working for. The api works it
+// out once per request and puts it in the context, the stores keep every
+// tenant's items to themselves with it.
+package tenant
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// ErrInvalid is a tenant id that doesn't look like one.
+var ErrInvalid = errors.New("invalid tenant")
+
+// Pattern is what a tenant id looks like. They end up in collection names
+// and hostnames, so they're kept to what's safe in both.
+const Pattern = `^[a-z0-9][a-z0-9-]{0,62}$`
+
+var idPattern = regexp.MustCompile(Pattern)
+
+// Valid checks id is lowercase letters, digits and dashes, starting with
+// a letter or digit and at most 63 long.
+func Valid(id string) error {
+	if !idPattern.MatchString(id) {
+		return fmt.Errorf("%w: %q", ErrInvalid, id)
+	}
+	return nil
+}
+
+type tenantKey struct{}
+
+// With returns ctx carrying the tenant id.
+func With(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, id)
+}
+
+// From is the tenant in ctx, ok is false when there isn't one.
+func From(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(tenantKey{}).(string)
+	return id, ok && id != ""
+}
@@ -0,0 +1,30 @@
+package tenant
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValid(t *testing.T) {
+	for _, id := range []string{"acme", "team-7", "0", strings.Repeat("a", 63)} {
+		assert.NoError(t, Valid(id), id)
+	}
+	for _, id := range []string{"", "Acme", "-acme", "acme_corp", "a.b", "a/b", "ünï", strings.Repeat("a", 64)} {
+		assert.ErrorIs(t, Valid(id), ErrInvalid, id)
+	}
+}
+
+func TestContext(t *testing.T) {
+	_, ok := From(context.Background())
+	assert.False(t, ok)
+
+	_, ok = From(With(context.Background(), ""))
+	assert.False(t, ok)
+
+	id, ok := From(With(context.Background(), "acme"))
+	assert.True(t, ok)
+	assert.Equal(t, "acme", id)
+}
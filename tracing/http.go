@@ -0,0 +1,53 @@
+package tracing
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/mar-cial/items/middleware"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Middleware starts a server span for every request, as a child of the
+// caller's span if it sent a traceparent. The response gets a traceparent
+// of its own so the caller can find our span. The span is named after the
+// route template, the raw path goes in an attribute.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prop := otel.GetTextMapPropagator()
+		ctx := prop.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		name := r.Method
+		tpl := middleware.Route(r)
+		if tpl != "" {
+			name += " " + tpl
+		}
+
+		ctx, span := tracer().Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPMethod(r.Method),
+				semconv.HTTPRoute(tpl),
+				semconv.URLPath(r.URL.Path),
+				attribute.String("http.request_id", middleware.RequestIDFrom(r.Context())),
+			),
+		)
+		defer span.End()
+
+		prop.Inject(ctx, propagation.HeaderCarrier(w.Header()))
+
+		observe := middleware.Observe(func(r *http.Request, status int, d time.Duration) {
+			span.SetAttributes(semconv.HTTPStatusCode(status))
+			// 4xx is the client's problem, not a failed span
+			if status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(status))
+			}
+		})
+		observe(next).ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,90 @@
+package tracing
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// otlpFile is an otlptrace client that, instead of sending batches
+// anywhere, writes each one to w as a line of OTLP JSON. That's what the
+// collector's otlpjsonfile receiver reads and its file exporter writes.
+type otlpFile struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+var _ otlptrace.Client = (*otlpFile)(nil)
+
+func (c *otlpFile) Start(context.Context) error { return nil }
+
+func (c *otlpFile) Stop(context.Context) error { return nil }
+
+func (c *otlpFile) UploadTraces(ctx context.Context, spans []*tracepb.ResourceSpans) error {
+	b, err := encodeOTLP(&coltracepb.ExportTraceServiceRequest{ResourceSpans: spans})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err = c.w.Write(append(b, '\n'))
+	return err
+}
+
+// otlpIDs are the fields OTLP JSON wants in hex. protojson does bytes as
+// base64, which is the one place the two disagree besides enums.
+var otlpIDs = map[string]bool{"traceId": true, "spanId": true, "parentSpanId": true}
+
+// encodeOTLP is req in OTLP JSON: the protobuf JSON mapping with enums as
+// numbers and ids in hex.
+func encodeOTLP(req *coltracepb.ExportTraceServiceRequest) ([]byte, error) {
+	b, err := protojson.MarshalOptions{UseEnumNumbers: true}.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	if err := hexIDs(doc); err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+// hexIDs rewrites the base64 ids anywhere in v to hex.
+func hexIDs(v interface{}) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if s, ok := e.(string); ok && otlpIDs[k] {
+				id, err := base64.StdEncoding.DecodeString(s)
+				if err != nil {
+					return err
+				}
+				v[k] = hex.EncodeToString(id)
+				continue
+			}
+			if err := hexIDs(e); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, e := range v {
+			if err := hexIDs(e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/mar-cial/items/db"
+	"github.com/mar-cial/items/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Store puts a span around every call to the store it wraps, with the
+// item ids and how many items came back. Like metrics.Store it embeds the
+// store, so methods it doesn't know about yet go straight through.
+type Store struct {
+	db.ItemStore
+}
+
+var _ db.ItemStore = (*Store)(nil)
+
+func InstrumentStore(store db.ItemStore) *Store {
+	return &Store{ItemStore: store}
+}
+
+// Unwrap is the store Store wraps, see db.CounterOf.
+func (s *Store) Unwrap() db.ItemStore {
+	return s.ItemStore
+}
+
+var (
+	itemIDKey    = attribute.Key("item.id")
+	itemCountKey = attribute.Key("item.count")
+	outcomeKey   = attribute.Key("db.outcome")
+)
+
+const maxIDs = 20
+
+func start(ctx context.Context, op string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs, semconv.DBOperation(op))
+	return tracer().Start(ctx, "ItemStore."+op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+// end records how it went. Only real failures mark the span as an error,
+// not found and friends are normal answers.
+func end(span trace.Span, err error) {
+	outcome := db.Outcome(err)
+	span.SetAttributes(outcomeKey.String(outcome))
+	if outcome == "error" {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (s *Store) InsertOneItem(ctx context.Context, item *model.Item) (*db.InsertOneResult, error) {
+	ctx, span := start(ctx, "InsertOneItem")
+	res, err := s.ItemStore.InsertOneItem(ctx, item)
+	if err == nil {
+		span.SetAttributes(itemIDKey.String(res.InsertedID))
+	}
+	end(span, err)
+	return res, err
+}
+
+func (s *Store) InsertItems(ctx context.Context, items []model.Item) (*db.InsertManyResult, error) {
+	ctx, span := start(ctx, "InsertItems")
+	res, err := s.ItemStore.InsertItems(ctx, items)
+	if err == nil {
+		ids := res.InsertedIDs
+		// a big bulk insert shouldn't make a huge span
+		if len(ids) > maxIDs {
+			ids = ids[:maxIDs]
+		}
+		span.SetAttributes(itemCountKey.Int(len(res.InsertedIDs)), itemIDKey.StringSlice(ids))
+	}
+	end(span, err)
+	return res, err
+}
+
+func (s *Store) ListOneItem(ctx context.Context, id string) (model.Item, error) {
+	ctx, span := start(ctx, "ListOneItem", itemIDKey.String(id))
+	item, err := s.ItemStore.ListOneItem(ctx, id)
+	end(span, err)
+	return item, err
+}
+
+func (s *Store) ListItems(ctx context.Context, opts db.ListOptions) (db.ItemPage, error) {
+	ctx, span := start(ctx, "ListItems",
+		attribute.Int("db.limit", opts.Limit),
+		attribute.Int("db.offset", opts.Offset),
+		attribute.Bool("db.cursor", opts.Cursor != ""),
+	)
+	page, err := s.ItemStore.ListItems(ctx, opts)
+	if err == nil {
+		span.SetAttributes(itemCountKey.Int(len(page.Items)), attribute.Int64("item.total", page.Total))
+	}
+	end(span, err)
+	return page, err
+}
+
+func (s *Store) SearchItems(ctx context.Context, q string, opts db.SearchOptions) (db.SearchPage, error) {
+	ctx, span := start(ctx, "SearchItems")
+	page, err := s.ItemStore.SearchItems(ctx, q, opts)
+	if err == nil {
+		span.SetAttributes(itemCountKey.Int(len(page.Hits)), attribute.Int64("item.total", page.Total))
+	}
+	end(span, err)
+	return page, err
+}
+
+func (s *Store) UpdateOneItem(ctx context.Context, id string, item *model.Item, version int64) (*db.UpdateResult, error) {
+	ctx, span := start(ctx, "UpdateOneItem", itemIDKey.String(id), attribute.Int64("item.version", version))
+	res, err := s.ItemStore.UpdateOneItem(ctx, id, item, version)
+	if err == nil {
+		span.SetAttributes(itemCountKey.Int64(res.ModifiedCount))
+	}
+	end(span, err)
+	return res, err
+}
+
+func (s *Store) PatchOneItem(ctx context.Context, id string, version int64, fn db.PatchFunc) (model.Item, error) {
+	ctx, span := start(ctx, "PatchOneItem", itemIDKey.String(id), attribute.Int64("item.version", version))
+	item, err := s.ItemStore.PatchOneItem(ctx, id, version, fn)
+	end(span, err)
+	return item, err
+}
+
+func (s *Store) DeleteOneItem(ctx context.Context, id string, version int64) (*db.DeleteResult, error) {
+	ctx, span := start(ctx, "DeleteOneItem", itemIDKey.String(id), attribute.Int64("item.version", version))
+	res, err := s.ItemStore.DeleteOneItem(ctx, id, version)
+	if err == nil {
+		span.SetAttributes(itemCountKey.Int64(res.DeletedCount))
+	}
+	end(span, err)
+	return res, err
+}
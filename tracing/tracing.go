@@ -0,0 +1,113 @@
+// Package tracing sets up OpenTelemetry and has the span producing bits:
+// a server span per http request and a child span per store call.
+//
+// Everything goes through the global tracer provider and propagator. Setup
+// installs them in main, until then the otel defaults make it all no-ops.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mar-cial/items/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentation = "github.com/mar-cial/items"
+
+func tracer() trace.Tracer {
+	return otel.Tracer(instrumentation)
+}
+
+// NewExporter builds the exporter cfg asks for, nil for none. stdout is
+// the sdk's own pretty printed json, for reading, file is OTLP JSON for
+// the collector and friends. Anything that implements
+// sdktrace.SpanExporter can go to Install instead.
+func NewExporter(cfg config.TracingConfig) (sdktrace.SpanExporter, io.Closer, error) {
+	switch cfg.Exporter {
+	case "", "none":
+		return nil, nil, nil
+	case "stdout":
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		return exp, nil, err
+	case "file":
+		f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("tracing file: %w", err)
+		}
+		exp, err := otlptrace.New(context.Background(), &otlpFile{w: f})
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return exp, f, nil
+	}
+	return nil, nil, fmt.Errorf("unknown tracing exporter %q", cfg.Exporter)
+}
+
+// Install makes a tracer provider batching spans to exp and sets it, and
+// the W3C trace context propagator, as the otel globals. The provider is
+// returned so its Shutdown can flush whatever is still buffered.
+func Install(exp sdktrace.SpanExporter, cfg config.TracingConfig) (*sdktrace.TracerProvider, error) {
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(cfg.ServiceName),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+		// follow the caller's decision when there is one, so a trace isn't
+		// cut in half at our door
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(Propagator())
+	return tp, nil
+}
+
+// Propagator reads and writes traceparent/tracestate and baggage.
+func Propagator() propagation.TextMapPropagator {
+	return propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+}
+
+// Setup is NewExporter plus Install. The returned func flushes and closes
+// everything, it's fine to call with tracing off.
+func Setup(cfg config.TracingConfig) (func(context.Context) error, error) {
+	// propagate even when we don't export, callers further down can still
+	// use the ids
+	otel.SetTextMapPropagator(Propagator())
+
+	exp, closer, err := NewExporter(cfg)
+	if err != nil || exp == nil {
+		return func(context.Context) error { return nil }, err
+	}
+
+	tp, err := Install(exp, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if closer != nil {
+			if cerr := closer.Close(); err == nil {
+				err = cerr
+			}
+		}
+		return err
+	}, nil
+}
@@ -0,0 +1,199 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/mar-cial/items/config"
+	"github.com/mar-cial/items/db"
+	"github.com/mar-cial/items/middleware"
+	"github.com/mar-cial/items/model"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// record installs a provider that keeps every finished span in memory
+func record(t *testing.T) *tracetest.SpanRecorder {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+
+	prevTP, prevProp := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(Propagator())
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevTP)
+		otel.SetTextMapPropagator(prevProp)
+	})
+	return rec
+}
+
+func attrs(s sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	out := make(map[attribute.Key]attribute.Value)
+	for _, kv := range s.Attributes() {
+		out[kv.Key] = kv.Value
+	}
+	return out
+}
+
+const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestRequestAndStoreSpans(t *testing.T) {
+	rec := record(t)
+	mem := db.NewMemoryStore()
+	store := InstrumentStore(mem)
+
+	res, err := mem.InsertOneItem(context.Background(), &model.Item{Title: "USB hub", Price: 20})
+	assert.NoError(t, err)
+
+	r := mux.NewRouter()
+	r.Use(middleware.RequestID(), Middleware)
+	r.HandleFunc("/items/list/{id}", func(w http.ResponseWriter, r *http.Request) {
+		_, err := store.ListOneItem(r.Context(), mux.Vars(r)["id"])
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/items/list/"+res.InsertedID, nil)
+	req.Header.Set("traceparent", traceparent)
+	req.Header.Set(middleware.RequestIDHeader, "req-1")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	spans := rec.Ended()
+	assert.Len(t, spans, 2)
+	storeSpan, httpSpan := spans[0], spans[1]
+
+	// the server span continues the caller's trace
+	assert.Equal(t, "GET /items/list/{id}", httpSpan.Name())
+	assert.Equal(t, trace.SpanKindServer, httpSpan.SpanKind())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", httpSpan.SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", httpSpan.Parent().SpanID().String())
+	a := attrs(httpSpan)
+	assert.Equal(t, "/items/list/{id}", a["http.route"].AsString())
+	assert.Equal(t, int64(200), a["http.status_code"].AsInt64())
+	assert.Equal(t, "req-1", a["http.request_id"].AsString())
+
+	// and the store span hangs off it
+	assert.Equal(t, "ItemStore.ListOneItem", storeSpan.Name())
+	assert.Equal(t, httpSpan.SpanContext().SpanID(), storeSpan.Parent().SpanID())
+	assert.Equal(t, res.InsertedID, attrs(storeSpan)["item.id"].AsString())
+	assert.Equal(t, "ok", attrs(storeSpan)["db.outcome"].AsString())
+
+	// the response points at our span
+	out := w.Header().Get("traceparent")
+	assert.True(t, strings.HasPrefix(out, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+httpSpan.SpanContext().SpanID().String()), out)
+}
+
+func TestStoreSpanOutcomes(t *testing.T) {
+	rec := record(t)
+	store := InstrumentStore(db.NewMemoryStore())
+	ctx := context.Background()
+
+	_, err := store.InsertItems(ctx, []model.Item{{Title: "a", Price: 1}, {Title: "b", Price: 2}})
+	assert.NoError(t, err)
+	_, err = store.ListItems(ctx, db.ListOptions{Limit: 1})
+	assert.NoError(t, err)
+	_, err = store.DeleteOneItem(ctx, "64b7f0c2a1b2c3d4e5f60718", db.AnyVersion)
+	assert.ErrorIs(t, err, db.ErrNotFound)
+
+	spans := rec.Ended()
+	assert.Len(t, spans, 3)
+
+	assert.Equal(t, int64(2), attrs(spans[0])["item.count"].AsInt64())
+	assert.Len(t, attrs(spans[0])["item.id"].AsStringSlice(), 2)
+
+	assert.Equal(t, int64(1), attrs(spans[1])["item.count"].AsInt64())
+	assert.Equal(t, int64(2), attrs(spans[1])["item.total"].AsInt64())
+
+	// not found is an answer, not a failure
+	assert.Equal(t, "not_found", attrs(spans[2])["db.outcome"].AsString())
+	assert.Equal(t, codes.Unset, spans[2].Status().Code)
+}
+
+func TestServerErrorMarksSpan(t *testing.T) {
+	rec := record(t)
+
+	h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/nowhere", nil))
+
+	spans := rec.Ended()
+	assert.Len(t, spans, 1)
+	assert.Equal(t, "GET", spans[0].Name())
+	assert.Equal(t, codes.Error, spans[0].Status().Code)
+	assert.False(t, spans[0].Parent().IsValid())
+}
+
+func TestFileExporter(t *testing.T) {
+	prevTP, prevProp := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	defer func() {
+		otel.SetTracerProvider(prevTP)
+		otel.SetTextMapPropagator(prevProp)
+	}()
+
+	path := filepath.Join(t.TempDir(), "spans.json")
+	shutdown, err := Setup(config.TracingConfig{Exporter: "file", File: path, SampleRatio: 1, ServiceName: "items-test"})
+	assert.NoError(t, err)
+
+	_, err = InstrumentStore(db.NewMemoryStore()).ListItems(context.Background(), db.ListOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+
+	b, err := os.ReadFile(path)
+	assert.NoError(t, err)
+
+	// one OTLP JSON export request per line
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	assert.Len(t, lines, 1)
+	var req struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []struct {
+					Key   string
+					Value struct{ StringValue string }
+				}
+			}
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID, SpanID, Name string
+					Kind                  int
+				}
+			}
+		}
+	}
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &req))
+	assert.Len(t, req.ResourceSpans, 1)
+	assert.Contains(t, req.ResourceSpans[0].Resource.Attributes, struct {
+		Key   string
+		Value struct{ StringValue string }
+	}{"service.name", struct{ StringValue string }{"items-test"}})
+
+	span := req.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	assert.Equal(t, "ItemStore.ListItems", span.Name)
+	assert.Regexp(t, `^[0-9a-f]{32}$`, span.TraceID)
+	assert.Regexp(t, `^[0-9a-f]{16}$`, span.SpanID)
+	assert.Equal(t, 3, span.Kind) // SPAN_KIND_CLIENT
+}
+
+func TestSetupNone(t *testing.T) {
+	shutdown, err := Setup(config.TracingConfig{Exporter: "none"})
+	assert.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+
+	_, err = Setup(config.TracingConfig{Exporter: "file", File: "/does/not/exist/spans.json"})
+	assert.Error(t, err)
+}